@@ -1,19 +1,48 @@
 package client
 
 import (
+	"fmt"
 	"log"
+	"net"
+	"net/http"
+	"runtime"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 
-	"merkle-file-uploader/internal/utils"
+	"merkle-file-uploader/internal/merkle"
 )
 
 const (
-	defaultServerURL          = "http://localhost:8080"
-	defaultMerkleRootFilename = ".merkleroot"
+	defaultServerURL             = "http://localhost:8080"
+	defaultMerkleRootFilename    = ".merkleroot"
+	defaultSparseRootFilename    = ".sparseroot"
+	defaultMerkleBatchesFilename = ".merklebatches"
+	defaultHashAlgorithm         = merkle.SHA256
 )
 
-var hashFn = utils.Sha256
+var (
+	treeParams = merkle.Params{
+		Mode:            merkle.ModeRFC6962,
+		OddNodes:        merkle.OddNodesPromote,
+		CommitLeafCount: true,
+		ChunkSize:       merkle.DefaultChunkSize,
+	}
+)
+
+// requestTimeout bounds the requests to the server, but for the transfer of file contents, see newTransferClient.
+const requestTimeout = 30 * time.Second
+
+// newTransferClient creates an HTTP client for requests streaming whole files, which take as long as their size
+// requires: only connecting to the server and waiting for its response headers time out.
+func newTransferClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: requestTimeout}).DialContext
+	transport.ResponseHeaderTimeout = requestTimeout
+
+	return &http.Client{Transport: transport}
+}
 
 var Cmd = &cobra.Command{
 	Use:   "client",
@@ -26,6 +55,47 @@ var Cmd = &cobra.Command{
 }
 
 func init() {
+	Cmd.PersistentFlags().IntVar(
+		&treeParams.Arity,
+		"arity",
+		2,
+		fmt.Sprintf("number of children of the nodes of the merkle tree, as set on the server (%v)", merkle.Arities),
+	)
+
+	uploadCmd.Flags().StringVar(
+		&uploadHashAlgorithm,
+		"hash",
+		defaultHashAlgorithm,
+		fmt.Sprintf("hash algorithm used to build the merkle tree (%s)", strings.Join(merkle.HashAlgorithms(), ", ")),
+	)
+
+	uploadCmd.Flags().BoolVar(
+		&uploadAppend,
+		"append",
+		false,
+		"append the files to the ones already uploaded, verifying the new merkle root against the stored one",
+	)
+
+	uploadCmd.Flags().IntVar(
+		&uploadHashWorkers,
+		"hash-workers",
+		runtime.NumCPU(),
+		"number of goroutines hashing the files and building the merkle tree at once",
+	)
+
+	downloadCmd.Flags().BoolVar(
+		&downloadRestore,
+		"restore",
+		false,
+		"save the file in the current directory under its original name, rather than writing it to stdout",
+	)
+
 	Cmd.AddCommand(uploadCmd)
 	Cmd.AddCommand(downloadCmd)
+	Cmd.AddCommand(updateCmd)
+	Cmd.AddCommand(deleteCmd)
+	Cmd.AddCommand(verifyAbsentCmd)
+	Cmd.AddCommand(diffCmd)
+	Cmd.AddCommand(proofCmd)
+	Cmd.AddCommand(verifyProofCmd)
 }
@@ -0,0 +1,59 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"merkle-file-uploader/internal/merkle"
+	"merkle-file-uploader/internal/protocol/download"
+	"merkle-file-uploader/internal/utils"
+)
+
+var diffCmd = &cobra.Command{
+	Use:   "diff",
+	Short: "List the files that differ between two uploads, by their merkle root hashes, without downloading them",
+	Long:  "E.g. args: <rootA> <rootB>",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 2 {
+			fmt.Println("Please enter the two merkle root hashes of the uploads to compare")
+
+			return
+		}
+
+		var roots [2]merkle.Digest
+		for i, arg := range args {
+			root, err := merkle.ParseDigest(strings.TrimSpace(arg))
+			if err != nil || len(root) == 0 {
+				fmt.Println("Merkle Root hash is not a valid hex digest:", arg)
+
+				return
+			}
+			roots[i] = root
+		}
+
+		downloader := download.NewHttpDownloader(
+			&http.Client{Timeout: requestTimeout},
+			utils.EnvStr("SERVER_URL", defaultServerURL),
+			roots[0],
+			treeParams,
+		)
+
+		indices, err := downloader.Diff(roots[0], roots[1])
+		if err != nil {
+			fmt.Println(err)
+
+			return
+		}
+
+		if len(indices) == 0 {
+			fmt.Println("No file differs")
+
+			return
+		}
+
+		fmt.Println("Files that differ, by index:", strings.Trim(fmt.Sprint(indices), "[]"))
+	},
+}
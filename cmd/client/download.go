@@ -2,23 +2,28 @@ package client
 
 import (
 	"fmt"
-	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
-	"time"
+	"strings"
 
 	"github.com/spf13/cobra"
 
+	"merkle-file-uploader/internal/merkle"
+	"merkle-file-uploader/internal/protocol"
 	"merkle-file-uploader/internal/protocol/download"
 	"merkle-file-uploader/internal/utils"
 )
 
 type Downloader interface {
 	DownloadFileAt(index int, destination *os.File) error
+	FileMetadata(index int) (protocol.FileMetadataResponse, error)
 }
 
 var _ Downloader = (*download.HttpDownloader)(nil)
 
+var downloadRestore bool
+
 var downloadCmd = &cobra.Command{
 	Use:   "download",
 	Short: "Download a file by index, from the server, and verify its integrity",
@@ -36,20 +41,42 @@ var downloadCmd = &cobra.Command{
 			return
 		}
 
-		rootHash, err := os.ReadFile(utils.EnvStr("MERKLE_ROOT_FILENAME", defaultMerkleRootFilename))
+		rootHashHex, err := os.ReadFile(utils.EnvStr("MERKLE_ROOT_FILENAME", defaultMerkleRootFilename))
 		if err != nil {
 			fmt.Println("Merkle Root hash is missing or unreadable:", err)
 
 			return
 		}
 
+		rootHash, err := merkle.ParseDigest(strings.TrimSpace(string(rootHashHex)))
+		if err != nil {
+			fmt.Println("Merkle Root hash is not a valid hex digest:", err)
+
+			return
+		}
+
+		serverURL, err := batchURL(rootHash)
+		if err != nil {
+			fmt.Println(err)
+
+			return
+		}
+
 		downloader := download.NewHttpDownloader(
-			&http.Client{Timeout: time.Second * 30},
-			utils.EnvStr("SERVER_URL", defaultServerURL),
-			string(rootHash),
-			hashFn,
+			newTransferClient(),
+			serverURL,
+			rootHash,
+			treeParams,
 		)
 
+		if downloadRestore {
+			if err := restoreFileAt(downloader, index); err != nil {
+				fmt.Println(err)
+			}
+
+			return
+		}
+
 		if err := downloader.DownloadFileAt(index, os.Stdout); err != nil {
 			fmt.Println(err)
 
@@ -57,3 +84,37 @@ var downloadCmd = &cobra.Command{
 		}
 	},
 }
+
+// restoreFileAt downloads the file at index into the current directory, under its original name.
+// An existing file is never overwritten, and a file that fails verification is removed.
+func restoreFileAt(downloader Downloader, index int) (err error) {
+	metadata, err := downloader.FileMetadata(index)
+	if err != nil {
+		return
+	}
+
+	// the name comes from the server, it mustn't lead out of the current directory
+	name := filepath.Base(filepath.FromSlash(metadata.Name))
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		return fmt.Errorf("the original name of the file at index %d can't be restored: %q", index, metadata.Name)
+	}
+
+	destination, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return
+	}
+
+	err = downloader.DownloadFileAt(index, destination)
+	if closeErr := destination.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(name)
+
+		return
+	}
+
+	fmt.Printf("File #%d restored as %s (%d bytes)\n", index, name, metadata.Size)
+
+	return
+}
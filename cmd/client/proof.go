@@ -0,0 +1,128 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/spf13/cobra"
+
+	"merkle-file-uploader/internal/merkle"
+	"merkle-file-uploader/internal/protocol/download"
+	"merkle-file-uploader/internal/utils"
+)
+
+var proofCmd = &cobra.Command{
+	Use:   "proof",
+	Short: "Download the proof of a file by index, from the server, and store it to verify the file offline later on",
+	Long:  "E.g. args: <index> <proof file>",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 2 {
+			fmt.Println("Please enter one index of an uploaded file, and the file to store its proof in")
+
+			return
+		}
+
+		index, err := strconv.Atoi(args[0])
+		if err != nil || index < 1 {
+			fmt.Println("The index must be a number starting from 1")
+
+			return
+		}
+
+		rootHash, err := readRoot(utils.EnvStr("MERKLE_ROOT_FILENAME", defaultMerkleRootFilename))
+		if err != nil {
+			fmt.Println("Merkle Root hash is missing or invalid:", err)
+
+			return
+		}
+
+		serverURL, err := batchURL(rootHash)
+		if err != nil {
+			fmt.Println(err)
+
+			return
+		}
+
+		downloader := download.NewHttpDownloader(
+			&http.Client{Timeout: requestTimeout},
+			serverURL,
+			rootHash,
+			treeParams,
+		)
+
+		proof, err := downloader.Proof(index)
+		if err != nil {
+			fmt.Println(err)
+
+			return
+		}
+
+		proofBytes, err := proof.MarshalBinary()
+		if err != nil {
+			fmt.Println(err)
+
+			return
+		}
+
+		if err = os.WriteFile(args[1], proofBytes, 0644); err != nil {
+			fmt.Println("Failed to store the proof:", err)
+
+			return
+		}
+
+		fmt.Printf("Stored the proof of file %d in %s\n", index, args[1])
+	},
+}
+
+var verifyProofCmd = &cobra.Command{
+	Use:   "verify-proof",
+	Short: "Verify a file against a stored proof and the merkle root, offline",
+	Long:  "E.g. args: <proof file> <file>",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 2 {
+			fmt.Println("Please enter one proof file, and the file to verify")
+
+			return
+		}
+
+		rootHash, err := readRoot(utils.EnvStr("MERKLE_ROOT_FILENAME", defaultMerkleRootFilename))
+		if err != nil {
+			fmt.Println("Merkle Root hash is missing or invalid:", err)
+
+			return
+		}
+
+		proofBytes, err := os.ReadFile(args[0])
+		if err != nil {
+			fmt.Println("Failed to read the proof:", err)
+
+			return
+		}
+
+		var proof merkle.Proof
+		if err = proof.UnmarshalBinary(proofBytes); err != nil {
+			fmt.Println(err)
+
+			return
+		}
+
+		file, err := os.Open(args[1])
+		if err != nil {
+			fmt.Println(err)
+
+			return
+		}
+		defer func() { _ = file.Close() }()
+
+		index, err := download.VerifyProofFile(file, &proof, rootHash, treeParams)
+		if err != nil {
+			fmt.Println(err)
+
+			return
+		}
+
+		fmt.Printf("Verified: %s is file %d of merkle root %s\n", args[1], index, rootHash)
+	},
+}
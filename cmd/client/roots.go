@@ -0,0 +1,120 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"merkle-file-uploader/internal/merkle"
+	"merkle-file-uploader/internal/protocol"
+	"merkle-file-uploader/internal/protocol/upload"
+	"merkle-file-uploader/internal/utils"
+)
+
+// readRoots reads the roots stored by the last upload, or change, of the files.
+func readRoots() (roots upload.Roots, err error) {
+	if roots.MerkleRoot, err = readRoot(utils.EnvStr("MERKLE_ROOT_FILENAME", defaultMerkleRootFilename)); err != nil {
+		err = fmt.Errorf("merkle root hash is missing or invalid: %s", err)
+
+		return
+	}
+
+	if roots.SparseRoot, err = readRoot(utils.EnvStr("SPARSE_ROOT_FILENAME", defaultSparseRootFilename)); err != nil {
+		err = fmt.Errorf("sparse merkle root hash is missing or invalid: %s", err)
+
+		return
+	}
+
+	batches, err := readBatches()
+	if err != nil {
+		return
+	}
+	roots.BatchID = batches[roots.MerkleRoot.String()]
+
+	return
+}
+
+// readBatches reads the batches the files of the stored merkle roots have been uploaded to, by root hash.
+// Files uploaded outside of batches, before they were introduced, have none.
+func readBatches() (batches map[string]string, err error) {
+	batches = make(map[string]string)
+
+	batchesJson, err := os.ReadFile(utils.EnvStr("MERKLE_BATCHES_FILENAME", defaultMerkleBatchesFilename))
+	if errors.Is(err, os.ErrNotExist) {
+		return batches, nil
+	}
+	if err != nil {
+		return
+	}
+
+	if err = json.Unmarshal(batchesJson, &batches); err != nil {
+		err = fmt.Errorf("merkle root batches are invalid: %s", err)
+	}
+
+	return
+}
+
+// batchURL is the URL the files of the merkle root rootHash are served at, on the server: the one of their batch,
+// or the server URL itself for the files uploaded outside of batches.
+func batchURL(rootHash merkle.Digest) (string, error) {
+	batches, err := readBatches()
+	if err != nil {
+		return "", err
+	}
+
+	return protocol.BatchURL(utils.EnvStr("SERVER_URL", defaultServerURL), batches[rootHash.String()]), nil
+}
+
+func readRoot(filename string) (root merkle.Digest, err error) {
+	rootHex, err := os.ReadFile(filename)
+	if err != nil {
+		return
+	}
+
+	return merkle.ParseDigest(strings.TrimSpace(string(rootHex)))
+}
+
+// storeRoots stores the roots of the uploaded files, hex-encoded, records the batch of the merkle root,
+// and shows them.
+func storeRoots(roots upload.Roots) (err error) {
+	merkleRootFilename := utils.EnvStr("MERKLE_ROOT_FILENAME", defaultMerkleRootFilename)
+	if err = os.WriteFile(merkleRootFilename, []byte(roots.MerkleRoot.String()), 0644); err != nil {
+		return fmt.Errorf("failed to store merkle root: %s", err)
+	}
+
+	sparseRootFilename := utils.EnvStr("SPARSE_ROOT_FILENAME", defaultSparseRootFilename)
+	if err = os.WriteFile(sparseRootFilename, []byte(roots.SparseRoot.String()), 0644); err != nil {
+		return fmt.Errorf("failed to store sparse merkle root: %s", err)
+	}
+
+	if roots.BatchID != "" {
+		if err = storeBatch(roots.MerkleRoot, roots.BatchID); err != nil {
+			return fmt.Errorf("failed to store the batch of merkle root: %s", err)
+		}
+
+		fmt.Println("Batch:", roots.BatchID)
+	}
+
+	fmt.Println("Merkle Root hash:", roots.MerkleRoot)
+	fmt.Println("Sparse Merkle Root hash:", roots.SparseRoot)
+
+	return
+}
+
+// storeBatch records the batch of a merkle root, along with the ones of the earlier roots.
+func storeBatch(rootHash merkle.Digest, batchID string) (err error) {
+	batches, err := readBatches()
+	if err != nil {
+		return
+	}
+	batches[rootHash.String()] = batchID
+
+	batchesJson, err := json.MarshalIndent(batches, "", "  ")
+	if err != nil {
+		return
+	}
+
+	return os.WriteFile(utils.EnvStr("MERKLE_BATCHES_FILENAME", defaultMerkleBatchesFilename), batchesJson, 0644)
+}
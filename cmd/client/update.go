@@ -0,0 +1,98 @@
+package client
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/spf13/cobra"
+
+	"merkle-file-uploader/internal/merkle"
+	"merkle-file-uploader/internal/protocol/upload"
+	"merkle-file-uploader/internal/utils"
+)
+
+type Updater interface {
+	UpdateFileAt(index int, filePath string, roots upload.Roots) (upload.Roots, error)
+	DeleteFileAt(index int, roots upload.Roots) (upload.Roots, error)
+}
+
+var _ Updater = (*upload.HttpUploader)(nil)
+
+var updateCmd = &cobra.Command{
+	Use:   "update",
+	Short: "Replace an uploaded file, by index, and verify that it's the only change to the merkle root",
+	Long:  "E.g. args: <index> <file>",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 2 {
+			fmt.Println("Please enter the index of an uploaded file, and the path of the file replacing it")
+
+			return
+		}
+
+		changeFileAt(args[0], func(updater Updater, index int, roots upload.Roots) (upload.Roots, error) {
+			return updater.UpdateFileAt(index, args[1], roots)
+		})
+	},
+}
+
+var deleteCmd = &cobra.Command{
+	Use:   "delete",
+	Short: "Delete an uploaded file, by index, and verify that it's the only change to the merkle root",
+	Long:  "E.g. args: <index>",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			fmt.Println("Please enter one index of an uploaded file to delete")
+
+			return
+		}
+
+		changeFileAt(args[0], func(updater Updater, index int, roots upload.Roots) (upload.Roots, error) {
+			return updater.DeleteFileAt(index, roots)
+		})
+	},
+}
+
+// changeFileAt runs a change to the file at indexArg, replacing the stored roots with the verified new ones.
+func changeFileAt(indexArg string, change func(updater Updater, index int, roots upload.Roots) (upload.Roots, error)) {
+	index, err := strconv.Atoi(indexArg)
+	if err != nil || index < 1 {
+		fmt.Println("The index must be a number starting from 1")
+
+		return
+	}
+
+	roots, err := readRoots()
+	if err != nil {
+		fmt.Println(err)
+
+		return
+	}
+
+	// the hash algorithm of the stored tree is used, whatever the one an uploader is created with
+	algorithm, err := merkle.HashAlgorithm(defaultHashAlgorithm)
+	if err != nil {
+		fmt.Println(err)
+
+		return
+	}
+
+	updater := upload.NewHttpUploader(
+		newTransferClient(),
+		utils.EnvStr("SERVER_URL", defaultServerURL),
+		algorithm,
+		treeParams,
+		1, // a single file is hashed
+	)
+
+	if roots, err = change(updater, index, roots); err != nil {
+		fmt.Println(err)
+
+		return
+	}
+
+	if err = storeRoots(roots); err != nil {
+		fmt.Println(err)
+
+		return
+	}
+}
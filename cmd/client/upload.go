@@ -3,23 +3,29 @@ package client
 import (
 	"errors"
 	"fmt"
-	"net/http"
 	"os"
-	"time"
 
 	"github.com/spf13/cobra"
 
+	"merkle-file-uploader/internal/merkle"
 	"merkle-file-uploader/internal/protocol"
 	"merkle-file-uploader/internal/protocol/upload"
 	"merkle-file-uploader/internal/utils"
 )
 
 type Uploader interface {
-	UploadFilesFrom(filePaths []string) ([]protocol.UploadedFile, string, error)
+	UploadFilesFrom(filePaths []string) ([]protocol.UploadedFile, upload.Roots, error)
+	AppendFilesFrom(filePaths []string, roots upload.Roots) ([]protocol.UploadedFile, upload.Roots, error)
 }
 
 var _ Uploader = (*upload.HttpUploader)(nil)
 
+var (
+	uploadHashAlgorithm string
+	uploadAppend        bool
+	uploadHashWorkers   int
+)
+
 var uploadCmd = &cobra.Command{
 	Use:   "upload",
 	Short: "Upload a set of files, or an entire folder, to the server",
@@ -38,9 +44,37 @@ var uploadCmd = &cobra.Command{
 			return
 		}
 
+		algorithm, err := merkle.HashAlgorithm(uploadHashAlgorithm)
+		if err != nil {
+			fmt.Println(err)
+
+			return
+		}
+
 		serverURL := utils.EnvStr("SERVER_URL", defaultServerURL)
-		uploader := upload.NewHttpUploader(&http.Client{Timeout: time.Second * 30}, serverURL, hashFn)
-		uploadedFiles, merkleRoot, err := uploader.UploadFilesFrom(filePaths)
+		uploader := upload.NewHttpUploader(
+			newTransferClient(),
+			serverURL,
+			algorithm,
+			treeParams,
+			uploadHashWorkers,
+		)
+
+		var (
+			uploadedFiles []protocol.UploadedFile
+			roots         upload.Roots
+		)
+		if uploadAppend {
+			if roots, err = readRoots(); err != nil {
+				fmt.Println(err)
+
+				return
+			}
+
+			uploadedFiles, roots, err = uploader.AppendFilesFrom(filePaths, roots)
+		} else {
+			uploadedFiles, roots, err = uploader.UploadFilesFrom(filePaths)
+		}
 		if err != nil {
 			fmt.Println(err)
 
@@ -51,14 +85,11 @@ var uploadCmd = &cobra.Command{
 			fmt.Printf("Uploaded file at index #%d: %s\n", f.Index, f.Name)
 		}
 
-		merkleRootFilename := utils.EnvStr("MERKLE_ROOT_FILENAME", defaultMerkleRootFilename)
-		if err = os.WriteFile(merkleRootFilename, []byte(merkleRoot), 0644); err != nil {
-			fmt.Printf("Failed to store merkle root: %s\n", err)
+		if err = storeRoots(roots); err != nil {
+			fmt.Println(err)
 
 			return
 		}
-
-		fmt.Println("Merkle Root hash:", merkleRoot)
 	},
 }
 
@@ -0,0 +1,47 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/spf13/cobra"
+
+	"merkle-file-uploader/internal/protocol"
+	"merkle-file-uploader/internal/protocol/download"
+	"merkle-file-uploader/internal/utils"
+)
+
+var verifyAbsentCmd = &cobra.Command{
+	Use:   "verify-absent",
+	Short: "Verify that no file with the given name has been uploaded to the server",
+	Long:  "E.g. args: <name>",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) != 1 {
+			fmt.Println("Please enter one file name to verify")
+
+			return
+		}
+
+		roots, err := readRoots()
+		if err != nil {
+			fmt.Println(err)
+
+			return
+		}
+
+		downloader := download.NewHttpDownloader(
+			&http.Client{Timeout: requestTimeout},
+			protocol.BatchURL(utils.EnvStr("SERVER_URL", defaultServerURL), roots.BatchID),
+			roots.MerkleRoot,
+			treeParams,
+		)
+
+		if err := downloader.VerifyAbsent(args[0], roots.SparseRoot); err != nil {
+			fmt.Println(err)
+
+			return
+		}
+
+		fmt.Printf("Verified: %s has not been uploaded\n", args[0])
+	},
+}
@@ -8,10 +8,11 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/spf13/cobra"
 
+	"merkle-file-uploader/internal/merkle"
+	"merkle-file-uploader/internal/protocol"
 	"merkle-file-uploader/internal/protocol/download"
 	"merkle-file-uploader/internal/protocol/upload"
 	"merkle-file-uploader/internal/storage"
-	"merkle-file-uploader/internal/utils"
 )
 
 const (
@@ -20,38 +21,139 @@ const (
 	defaultAwsSecretAccessKey = "test"
 	defaultAwsEndpoint        = "http://localhost:4566"
 	defaultS3BucketName       = "mfu-202312"
-	defaultMerkleTreeFilename = ".merkletree.gob"
+	// the tree isn't gob-encoded anymore, but the name is kept so that trees stored before are still found
+	defaultMerkleTreeFilename    = ".merkletree.gob"
+	defaultSparseTreeFilename    = ".sparsetree.gob"
+	defaultMountainRangeFilename = ".mountainrange"
+	defaultStorageDir            = "mfu-data"
+	defaultSQLitePath            = "mfu.db"
 )
 
-var hashFn = utils.Sha256
+// storages the server can keep files and trees in, picked by --storage, see config
+const (
+	storageMemory     = "memory"
+	storageS3         = "s3"
+	storageFileSystem = "fs"
+	storageSQLite     = "sqlite"
+)
+
+var (
+	defaultHashAlgorithm = merkle.SHA256
+	treeParams           = merkle.Params{
+		Mode:            merkle.ModeRFC6962,
+		OddNodes:        merkle.OddNodesPromote,
+		CommitLeafCount: true,
+		ChunkSize:       merkle.DefaultChunkSize,
+	}
+)
 
 var Cmd = &cobra.Command{
 	Use:   "server",
 	Short: "The mfu server exposes a HTTP API for verifiable files upload & download",
 	Run: func(cmd *cobra.Command, args []string) {
-		//repository := storage.NewInMemoryStorage()
-		repository, err := storage.NewS3Storage(
-			utils.EnvStr("AWS_ACCESS_KEY_ID", defaultAwsAccessKeyId),
-			utils.EnvStr("AWS_SECRET_ACCESS_KEY", defaultAwsSecretAccessKey),
-			utils.EnvStr("AWS_ENDPOINT", defaultAwsEndpoint),
-			utils.EnvStr("AWS_S3_BUCKET_NAME", defaultS3BucketName),
-			defaultMerkleTreeFilename,
-		)
+		cfg, err := loadConfig(cmd)
+		if err != nil {
+			log.Fatal(err)
+
+			return
+		}
+
+		backend, hashWorkers := protocol.TreeBackend(cfg.Tree.Backend), cfg.Tree.HashWorkers
+		treeParams.Arity = cfg.Tree.Arity
+
+		repository, err := newRepository(cfg.Storage)
 		if err != nil {
-			log.Fatal("error while connecting to S3:", err)
+			log.Fatal(err)
+
+			return
+		}
+
+		// used for uploads not specifying a hash algorithm, and trees stored before it was recorded
+		hashAlgorithm, err := merkle.HashAlgorithm(defaultHashAlgorithm)
+		if err != nil {
+			log.Fatal(err)
 
 			return
 		}
 
 		r := mux.NewRouter()
-		r.HandleFunc("/upload", upload.NewUploadHandler(repository, hashFn))
-		r.HandleFunc("/download/{index}", download.NewDownloadHandler(repository))
-		r.HandleFunc("/proof/{index}", download.NewProofHandler(repository, hashFn))
+		r.HandleFunc("/batches", upload.NewBatchUploadHandler(repository, hashAlgorithm, treeParams, hashWorkers, backend))
+		r.HandleFunc("/diff/{rootA}/{rootB}", download.NewDiffHandler(repository))
 
-		port := utils.EnvInt("PORT", defaultPort)
-		log.Println("mfu server started on port", port)
-		if err := http.ListenAndServe(fmt.Sprintf(":%d", port), r); err != nil {
+		// the routes of the files uploaded outside of batches, for older clients, are scoped to a batch under /batches/{id}
+		batches := r.PathPrefix(fmt.Sprintf("/batches/{%s}", protocol.BatchIDParam)).Subrouter()
+		for _, route := range []struct {
+			path       string
+			newHandler func(storage.Repository) func(http.ResponseWriter, *http.Request)
+		}{
+			{"/upload", func(repository storage.Repository) func(http.ResponseWriter, *http.Request) {
+				return upload.NewUploadHandler(repository, hashAlgorithm, treeParams, hashWorkers, backend)
+			}},
+			{"/download/{index}", download.NewDownloadHandler},
+			{"/metadata/{index}", download.NewMetadataHandler},
+			{"/proof/{index}", func(repository storage.Repository) func(http.ResponseWriter, *http.Request) {
+				return download.NewProofHandler(repository, hashAlgorithm, backend)
+			}},
+			{"/proof", func(repository storage.Repository) func(http.ResponseWriter, *http.Request) {
+				return download.NewMultiProofHandler(repository, hashAlgorithm, backend)
+			}},
+			{"/proof/by-name/{name}", download.NewSparseProofHandler},
+			{"/files/{index}", func(repository storage.Repository) func(http.ResponseWriter, *http.Request) {
+				return upload.NewFileHandler(repository, hashAlgorithm, backend)
+			}},
+		} {
+			r.HandleFunc(route.path, route.newHandler(repository))
+			batches.HandleFunc(route.path, protocol.NewBatchHandler(repository, route.newHandler))
+		}
+
+		log.Println("mfu server started on port", cfg.Port)
+		if err := http.ListenAndServe(fmt.Sprintf(":%d", cfg.Port), r); err != nil {
 			log.Fatal(err)
 		}
 	},
 }
+
+// newRepository creates the storage picked by the config.
+func newRepository(cfg storageConfig) (repository storage.Repository, err error) {
+	switch cfg.Kind {
+	case storageMemory:
+		repository = storage.NewInMemoryStorage()
+		log.Println("mfu server storing files in memory, they're lost when it stops")
+	case storageS3:
+		repository, err = storage.NewS3Storage(
+			cfg.S3.AccessKeyID,
+			cfg.S3.SecretAccessKey,
+			cfg.S3.Endpoint,
+			cfg.S3.Bucket,
+			defaultMerkleTreeFilename,
+			defaultSparseTreeFilename,
+			defaultMountainRangeFilename,
+		)
+		if err != nil {
+			err = fmt.Errorf("error while connecting to S3: %s", err)
+		}
+	case storageFileSystem:
+		repository, err = storage.NewFileSystemStorage(
+			cfg.FileSystem.Dir,
+			defaultMerkleTreeFilename,
+			defaultSparseTreeFilename,
+			defaultMountainRangeFilename,
+		)
+		if err == nil {
+			log.Println("mfu server storing files in", cfg.FileSystem.Dir)
+		}
+	case storageSQLite:
+		repository, err = storage.NewSQLiteStorage(cfg.SQLite.Path)
+		if err == nil {
+			log.Println("mfu server storing files in", cfg.SQLite.Path)
+		}
+	default:
+		err = fmt.Errorf("%w: unsupported storage %q", errInvalidConfig, cfg.Kind)
+	}
+
+	return
+}
+
+func init() {
+	addConfigFlags(Cmd)
+}
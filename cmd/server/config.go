@@ -0,0 +1,277 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+
+	"merkle-file-uploader/internal/merkle"
+	"merkle-file-uploader/internal/protocol"
+)
+
+var (
+	errInvalidConfig = errors.New("invalid server config")
+)
+
+// config is the configuration of the server: its defaults are overridden by the YAML file given with --config,
+// then by environment variables, then by the flags set on the command line. See validate.
+type config struct {
+	Port    int           `yaml:"port"`
+	Tree    treeConfig    `yaml:"tree"`
+	Storage storageConfig `yaml:"storage"`
+}
+
+// treeConfig configures the trees of the uploaded files: the structure they're kept in, see protocol.TreeBackend,
+// the arity of new trees, and the number of goroutines hashing the files and building the trees at once.
+type treeConfig struct {
+	Backend     string `yaml:"backend"`
+	Arity       int    `yaml:"arity"`
+	HashWorkers int    `yaml:"hashWorkers"`
+}
+
+// storageConfig picks the storage files and trees are kept in, with Kind, and configures each of them.
+type storageConfig struct {
+	Kind       string           `yaml:"kind"`
+	FileSystem fileSystemConfig `yaml:"fs"`
+	SQLite     sqliteConfig     `yaml:"sqlite"`
+	S3         s3Config         `yaml:"s3"`
+}
+
+type fileSystemConfig struct {
+	Dir string `yaml:"dir"`
+}
+
+type sqliteConfig struct {
+	Path string `yaml:"path"`
+}
+
+type s3Config struct {
+	AccessKeyID     string `yaml:"accessKeyId"`
+	SecretAccessKey string `yaml:"secretAccessKey"`
+	Endpoint        string `yaml:"endpoint"`
+	Bucket          string `yaml:"bucket"`
+}
+
+// setting is a string setting of the config, overridden by an environment variable, and a flag if any.
+// Credentials have no flag, as flags are shown to anyone listing the processes.
+type setting struct {
+	env   string
+	flag  string
+	usage string
+	value *string
+}
+
+// intSetting is a setting of the config as setting is, but holding a number.
+type intSetting struct {
+	env   string
+	flag  string
+	usage string
+	value *int
+}
+
+func defaultConfig() config {
+	return config{
+		Port: defaultPort,
+		Tree: treeConfig{
+			Backend:     string(protocol.TreeBackendTree),
+			Arity:       2,
+			HashWorkers: runtime.NumCPU(),
+		},
+		Storage: storageConfig{
+			Kind:       storageS3,
+			FileSystem: fileSystemConfig{Dir: defaultStorageDir},
+			SQLite:     sqliteConfig{Path: defaultSQLitePath},
+			S3: s3Config{
+				AccessKeyID:     defaultAwsAccessKeyId,
+				SecretAccessKey: defaultAwsSecretAccessKey,
+				Endpoint:        defaultAwsEndpoint,
+				Bucket:          defaultS3BucketName,
+			},
+		},
+	}
+}
+
+func (c *config) settings() []setting {
+	return []setting{
+		{
+			env:  "TREE",
+			flag: "tree",
+			usage: fmt.Sprintf(
+				"structure the files are kept in: %q, rebuilt by every upload, or %q, an append-only Merkle Mountain Range",
+				protocol.TreeBackendTree,
+				protocol.TreeBackendMountainRange,
+			),
+			value: &c.Tree.Backend,
+		},
+		{
+			env:   "STORAGE",
+			flag:  "storage",
+			usage: fmt.Sprintf("storage the files and trees are kept in: %q, %q, %q or %q", storageMemory, storageFileSystem, storageSQLite, storageS3),
+			value: &c.Storage.Kind,
+		},
+		{env: "STORAGE_DIR", flag: "storage-dir", usage: "directory of the fs storage", value: &c.Storage.FileSystem.Dir},
+		{env: "SQLITE_PATH", flag: "sqlite-path", usage: "database file of the sqlite storage", value: &c.Storage.SQLite.Path},
+		{env: "AWS_ENDPOINT", flag: "s3-endpoint", usage: "endpoint of the s3 storage", value: &c.Storage.S3.Endpoint},
+		{env: "AWS_S3_BUCKET_NAME", flag: "s3-bucket", usage: "bucket of the s3 storage", value: &c.Storage.S3.Bucket},
+		{env: "AWS_ACCESS_KEY_ID", value: &c.Storage.S3.AccessKeyID},
+		{env: "AWS_SECRET_ACCESS_KEY", value: &c.Storage.S3.SecretAccessKey},
+	}
+}
+
+func (c *config) intSettings() []intSetting {
+	return []intSetting{
+		{env: "PORT", flag: "port", usage: "port the server listens on", value: &c.Port},
+		{
+			env:   "TREE_ARITY",
+			flag:  "arity",
+			usage: fmt.Sprintf("number of children of the nodes of the merkle trees of new uploads (%v)", merkle.Arities),
+			value: &c.Tree.Arity,
+		},
+		{
+			env:   "HASH_WORKERS",
+			flag:  "hash-workers",
+			usage: "number of goroutines hashing the uploaded files and building the merkle tree at once",
+			value: &c.Tree.HashWorkers,
+		},
+	}
+}
+
+// addConfigFlags adds the flags of the config, see loadConfig.
+func addConfigFlags(cmd *cobra.Command) {
+	defaults := defaultConfig()
+
+	cmd.Flags().String("config", "", "YAML config file, overridden by environment variables and flags")
+	for _, s := range defaults.intSettings() {
+		cmd.Flags().Int(s.flag, *s.value, fmt.Sprintf("%s (env %s)", s.usage, s.env))
+	}
+	for _, s := range defaults.settings() {
+		if s.flag != "" {
+			cmd.Flags().String(s.flag, *s.value, fmt.Sprintf("%s (env %s)", s.usage, s.env))
+		}
+	}
+}
+
+// loadConfig loads the config of the server, from its defaults, the config file, environment variables and flags,
+// then validates it.
+func loadConfig(cmd *cobra.Command) (c config, err error) {
+	c = defaultConfig()
+
+	path, err := cmd.Flags().GetString("config")
+	if err != nil {
+		return
+	}
+	if path != "" {
+		if err = c.readFile(path); err != nil {
+			return
+		}
+	}
+
+	for _, s := range c.intSettings() {
+		if value := os.Getenv(s.env); value != "" {
+			if *s.value, err = strconv.Atoi(value); err != nil {
+				return c, fmt.Errorf("%w: %s: %s", errInvalidConfig, s.env, err)
+			}
+		}
+		if cmd.Flags().Changed(s.flag) {
+			if *s.value, err = cmd.Flags().GetInt(s.flag); err != nil {
+				return
+			}
+		}
+	}
+
+	for _, s := range c.settings() {
+		if value := os.Getenv(s.env); value != "" {
+			*s.value = value
+		}
+		if s.flag != "" && cmd.Flags().Changed(s.flag) {
+			if *s.value, err = cmd.Flags().GetString(s.flag); err != nil {
+				return
+			}
+		}
+	}
+
+	return c, c.validate()
+}
+
+// readFile overrides the config with the settings of a YAML file, which mustn't have unknown ones.
+func (c *config) readFile(path string) (err error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("%w: %s", errInvalidConfig, err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err = decoder.Decode(c); err != nil {
+		return fmt.Errorf("%w: %s: %s", errInvalidConfig, path, err)
+	}
+
+	return
+}
+
+// validate checks the port, the settings of the trees, and the ones of the picked storage.
+func (c *config) validate() (err error) {
+	var errs []error
+	if c.Port < 1 || c.Port > 65535 {
+		errs = append(errs, fmt.Errorf("port %d out of range 1-65535", c.Port))
+	}
+
+	if !slices.Contains(merkle.Arities, c.Tree.Arity) {
+		errs = append(errs, fmt.Errorf("unsupported tree.arity %d, must be one of %v", c.Tree.Arity, merkle.Arities))
+	}
+	if c.Tree.HashWorkers < 1 {
+		errs = append(errs, fmt.Errorf("tree.hashWorkers %d must be at least 1", c.Tree.HashWorkers))
+	}
+	switch protocol.TreeBackend(c.Tree.Backend) {
+	case protocol.TreeBackendTree:
+	case protocol.TreeBackendMountainRange:
+		if c.Tree.Arity != 2 {
+			errs = append(errs, fmt.Errorf("the %q tree.backend requires a tree.arity of 2", c.Tree.Backend))
+		}
+	default:
+		errs = append(errs, fmt.Errorf(
+			"unsupported tree.backend %q, must be %q or %q",
+			c.Tree.Backend, protocol.TreeBackendTree, protocol.TreeBackendMountainRange,
+		))
+	}
+
+	required := func(name, value string) {
+		if value == "" {
+			errs = append(errs, fmt.Errorf("%s is required by the %s storage", name, c.Storage.Kind))
+		}
+	}
+
+	switch c.Storage.Kind {
+	case storageMemory:
+	case storageFileSystem:
+		required("storage.fs.dir", c.Storage.FileSystem.Dir)
+	case storageSQLite:
+		required("storage.sqlite.path", c.Storage.SQLite.Path)
+	case storageS3:
+		required("storage.s3.accessKeyId", c.Storage.S3.AccessKeyID)
+		required("storage.s3.secretAccessKey", c.Storage.S3.SecretAccessKey)
+		required("storage.s3.bucket", c.Storage.S3.Bucket)
+		if endpoint, parseErr := url.Parse(c.Storage.S3.Endpoint); parseErr != nil || endpoint.Scheme == "" || endpoint.Host == "" {
+			errs = append(errs, fmt.Errorf("storage.s3.endpoint %q is not an absolute URL", c.Storage.S3.Endpoint))
+		}
+	default:
+		errs = append(errs, fmt.Errorf(
+			"unsupported storage %q, must be %q, %q, %q or %q",
+			c.Storage.Kind, storageMemory, storageFileSystem, storageSQLite, storageS3,
+		))
+	}
+
+	if len(errs) > 0 {
+		err = fmt.Errorf("%w: %w", errInvalidConfig, errors.Join(errs...))
+	}
+
+	return
+}
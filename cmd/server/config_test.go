@@ -0,0 +1,129 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+)
+
+// loadTestConfig loads the config of a command run with the given args, environment variables, and config file,
+// if any. Other variables of the environment are ignored.
+func loadTestConfig(t *testing.T, args []string, env map[string]string, file string) (config, error) {
+	defaults := defaultConfig()
+	for _, s := range defaults.settings() {
+		t.Setenv(s.env, "")
+	}
+	for _, s := range defaults.intSettings() {
+		t.Setenv(s.env, "")
+	}
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+
+	if file != "" {
+		path := filepath.Join(t.TempDir(), "mfu.yaml")
+		if err := os.WriteFile(path, []byte(file), 0644); err != nil {
+			t.Fatal(err)
+		}
+		args = append(args, "--config", path)
+	}
+
+	cmd := &cobra.Command{}
+	addConfigFlags(cmd)
+	if err := cmd.ParseFlags(args); err != nil {
+		t.Fatal(err)
+	}
+
+	return loadConfig(cmd)
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	defaults := defaultConfig()
+
+	cases := map[string]struct {
+		args     []string
+		env      map[string]string
+		file     string
+		expected func(c *config)
+	}{
+		"defaults": {
+			expected: func(c *config) {},
+		},
+		"file": {
+			file: "port: 9000\ntree:\n  backend: mmr\n  hashWorkers: 3\nstorage:\n  kind: fs\n  fs:\n    dir: data",
+			expected: func(c *config) {
+				c.Port, c.Tree.Backend, c.Tree.HashWorkers = 9000, "mmr", 3
+				c.Storage.Kind, c.Storage.FileSystem.Dir = storageFileSystem, "data"
+			},
+		},
+		"environment over file": {
+			file: "port: 9000\ntree:\n  arity: 4\n  hashWorkers: 3",
+			env:  map[string]string{"PORT": "9001", "TREE_ARITY": "8", "STORAGE": storageMemory},
+			expected: func(c *config) {
+				c.Port, c.Tree.Arity, c.Tree.HashWorkers = 9001, 8, 3
+				c.Storage.Kind = storageMemory
+			},
+		},
+		"flags over environment and file": {
+			args: []string{"--port", "9002", "--arity", "16", "--tree", "tree", "--hash-workers", "2"},
+			file: "port: 9000\ntree:\n  backend: mmr\n  arity: 2",
+			env:  map[string]string{"PORT": "9001", "TREE_ARITY": "4", "HASH_WORKERS": "5"},
+			expected: func(c *config) {
+				c.Port, c.Tree.Backend, c.Tree.Arity, c.Tree.HashWorkers = 9002, "tree", 16, 2
+			},
+		},
+		"credentials from the environment only": {
+			env: map[string]string{"AWS_ACCESS_KEY_ID": "id", "AWS_SECRET_ACCESS_KEY": "secret"},
+			expected: func(c *config) {
+				c.Storage.S3.AccessKeyID, c.Storage.S3.SecretAccessKey = "id", "secret"
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			expected := defaults
+			tc.expected(&expected)
+
+			c, err := loadTestConfig(t, tc.args, tc.env, tc.file)
+			assert.NoError(t, err)
+			assert.Equal(t, expected, c)
+		})
+	}
+
+	assert.Equal(t, runtime.NumCPU(), defaults.Tree.HashWorkers)
+}
+
+func TestLoadConfigValidation(t *testing.T) {
+	cases := map[string]struct {
+		args  []string
+		env   map[string]string
+		file  string
+		error string
+	}{
+		"port out of range":      {args: []string{"--port", "0"}, error: "port 0 out of range"},
+		"malformed port":         {env: map[string]string{"PORT": "http"}, error: "PORT"},
+		"malformed arity":        {env: map[string]string{"TREE_ARITY": "two"}, error: "TREE_ARITY"},
+		"unsupported arity":      {args: []string{"--arity", "3"}, error: "unsupported tree.arity 3"},
+		"no hash workers":        {file: "tree:\n  hashWorkers: 0", error: "tree.hashWorkers 0"},
+		"unsupported backend":    {env: map[string]string{"TREE": "list"}, error: `unsupported tree.backend "list"`},
+		"mountain range of 4":    {args: []string{"--tree", "mmr", "--arity", "4"}, error: "requires a tree.arity of 2"},
+		"unsupported storage":    {args: []string{"--storage", "tape"}, error: `unsupported storage "tape"`},
+		"missing storage dir":    {args: []string{"--storage", "fs", "--storage-dir", ""}, error: "storage.fs.dir is required"},
+		"malformed s3 endpoint":  {env: map[string]string{"AWS_ENDPOINT": "localhost"}, error: "not an absolute URL"},
+		"unknown key in file":    {file: "tree:\n  depth: 3", error: "field depth not found"},
+		"several invalid values": {args: []string{"--port", "70000", "--arity", "5"}, error: "tree.arity 5"},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := loadTestConfig(t, tc.args, tc.env, tc.file)
+			assert.ErrorIs(t, err, errInvalidConfig)
+			assert.ErrorContains(t, err, tc.error)
+		})
+	}
+}
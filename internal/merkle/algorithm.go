@@ -0,0 +1,84 @@
+package merkle
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"hash"
+	"sort"
+	"sync"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/sha3"
+)
+
+var (
+	ErrUnknownHashAlgorithm = errors.New("unknown hash algorithm")
+)
+
+// Names of the hash algorithms registered by default.
+const (
+	SHA256     = "sha256"
+	SHA512_256 = "sha512/256"
+	SHA3_256   = "sha3-256"
+	BLAKE2b256 = "blake2b-256"
+)
+
+// Algorithm is a named Hasher. Trees built with an Algorithm record its name,
+// so that they can always be verified with the same algorithm they have been built with.
+type Algorithm struct {
+	Name string
+	HashFactory
+}
+
+var (
+	algorithmsMu sync.RWMutex
+	algorithms   = map[string]Algorithm{}
+)
+
+func init() {
+	RegisterHashAlgorithm(SHA256, sha256.New)
+	RegisterHashAlgorithm(SHA512_256, sha512.New512_256)
+	RegisterHashAlgorithm(SHA3_256, sha3.New256)
+	RegisterHashAlgorithm(BLAKE2b256, func() hash.Hash {
+		// a nil key never fails
+		h, _ := blake2b.New256(nil)
+
+		return h
+	})
+}
+
+// RegisterHashAlgorithm makes a hash algorithm available by name, replacing any algorithm with the same name.
+func RegisterHashAlgorithm(name string, factory HashFactory) {
+	algorithmsMu.Lock()
+	defer algorithmsMu.Unlock()
+
+	algorithms[name] = Algorithm{Name: name, HashFactory: factory}
+}
+
+// HashAlgorithm returns the registered hash algorithm with the given name.
+func HashAlgorithm(name string) (Algorithm, error) {
+	algorithmsMu.RLock()
+	defer algorithmsMu.RUnlock()
+
+	algorithm, ok := algorithms[name]
+	if !ok {
+		return Algorithm{}, fmt.Errorf("%w: %q", ErrUnknownHashAlgorithm, name)
+	}
+
+	return algorithm, nil
+}
+
+// HashAlgorithms returns the sorted names of the registered hash algorithms.
+func HashAlgorithms() (names []string) {
+	algorithmsMu.RLock()
+	defer algorithmsMu.RUnlock()
+
+	for name := range algorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return
+}
@@ -0,0 +1,114 @@
+package merkle
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrUnsupportedArity = errors.New("unsupported tree arity")
+)
+
+// Arities are the supported numbers of children of the nodes of a tree.
+// Higher arities make shorter proofs, which hold more siblings per level, and cost more hashing per node.
+var Arities = []int{2, 4, 8, 16}
+
+// WithArity sets the number of children of the nodes of the tree, one of Arities. Trees are binary by default.
+func WithArity(arity int) Option {
+	return func(t *Tree) {
+		t.Arity = arity
+	}
+}
+
+// validateArity checks that the arity of the tree is supported.
+func (p Params) validateArity() error {
+	for _, arity := range Arities {
+		if p.Arity == arity {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %d", ErrUnsupportedArity, p.Arity)
+}
+
+// group returns the nodes of level whose parent is the node at index of the level above, left to right.
+func (t *Tree) group(level, index int) []Digest {
+	nodes := t.levels[level]
+
+	return nodes[index*t.Arity : min(index*t.Arity+t.Arity, len(nodes))]
+}
+
+// hashGroup computes the hash of the parent of the given nodes.
+// The last group of a level may be incomplete: it's padded with copies of its last node,
+// unless odd nodes are promoted, in which case it's hashed as it is, and a single node is promoted as it is.
+func (t *Tree) hashGroup(children []Digest) Digest {
+	if len(children) == 1 && t.OddNodes == OddNodesPromote {
+		return children[0]
+	}
+
+	if len(children) < t.Arity && t.OddNodes == OddNodesDuplicate {
+		padded := append(make([]Digest, 0, t.Arity), children...)
+		for len(padded) < t.Arity {
+			padded = append(padded, children[len(children)-1])
+		}
+		children = padded
+	}
+
+	if len(children) == 2 {
+		return t.Mode.hashChildren(children[0], children[1], t.Hasher)
+	}
+
+	return t.Mode.hashNode(children, t.Hasher)
+}
+
+// karyProof generates the proof of the leaf at index of a k-ary tree: for each level, all the siblings of the node
+// leading to the leaf, along with its position among them. Copies padding incomplete groups are left out.
+func (t *Tree) karyProof(index int) (proof []ProofHash) {
+	for level := 0; level < t.depth(); level, index = level+1, index/t.Arity {
+		children := t.group(level, index/t.Arity)
+		if len(children) == 1 && t.OddNodes == OddNodesPromote {
+			// The node is promoted to the next level as it is
+			continue
+		}
+
+		position := index % t.Arity
+		siblings := append(append([]Digest{}, children[:position]...), children[position+1:]...)
+		proof = append(proof, ProofHash{Siblings: siblings, Index: position})
+	}
+
+	return
+}
+
+// verifyKaryLeafHash verifies the proof of a leaf hash in a k-ary tree, whose number of leaves must be known:
+// at each level, the position of the node and the number of its siblings must be the expected ones.
+func (t *Tree) verifyKaryLeafHash(rootHash Digest, index int, leafHash Digest, proof []ProofHash) bool {
+	if index < 0 || index >= t.LeafCount {
+		return false
+	}
+
+	currentHash := leafHash
+	for size := t.LeafCount; size > 1; size, index = (size+t.Arity-1)/t.Arity, index/t.Arity {
+		first := index / t.Arity * t.Arity
+		count := min(t.Arity, size-first)
+		if count == 1 && t.OddNodes == OddNodesPromote {
+			continue
+		}
+
+		if len(proof) == 0 {
+			return false
+		}
+
+		p := proof[0]
+		proof = proof[1:]
+		if p.Index != index-first || len(p.Siblings) != count-1 {
+			// The proof does not lead to the requested index
+			return false
+		}
+
+		children := append(append(make([]Digest, 0, count), p.Siblings[:p.Index]...), currentHash)
+		currentHash = t.hashGroup(append(children, p.Siblings[p.Index:]...))
+	}
+
+	// All the levels of the proof must have been used
+	return len(proof) == 0 && t.rootHash(currentHash).Equal(rootHash)
+}
@@ -0,0 +1,178 @@
+package merkle
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKaryTree(t *testing.T) {
+	paramsCases := map[string]Params{
+		"legacy":              {},
+		"duplicate":           {Mode: ModeRFC6962},
+		"promote, leaf count": {Mode: ModeRFC6962, OddNodes: OddNodesPromote, CommitLeafCount: true},
+	}
+
+	for name, params := range paramsCases {
+		for _, arity := range Arities {
+			params.Arity = arity
+
+			t.Run(fmt.Sprintf("%s, %d-ary", name, arity), func(t *testing.T) {
+				for n := 1; n <= 40; n++ {
+					var blocks [][]byte
+					for i := 0; i < n; i++ {
+						blocks = append(blocks, []byte{byte(i)})
+					}
+
+					tree, err := NewTree(blocks, h, WithParams(params))
+					assert.NoError(t, err)
+					assert.Len(t, tree.Nodes, nodeCount(n, arity))
+					opts := []Option{WithParams(params), WithLeafCount(n)}
+
+					for i, block := range blocks {
+						proof, err := tree.ProofForIndex(i)
+						assert.NoError(t, err)
+						assert.True(t, VerifyProof(tree.RootHash(), i, block, proof, h, opts...), "%d leaves, leaf %d", n, i)
+						if n > 1 {
+							assert.False(t, VerifyProof(tree.RootHash(), (i+1)%n, block, proof, h, opts...))
+						}
+						assert.False(t, VerifyProof(tree.RootHash(), i, []byte("X"), proof, h, opts...))
+
+						// The tree updated incrementally is the same as the one built from scratch
+						updated, err := tree.Update(i, []byte("X"))
+						assert.NoError(t, err)
+
+						updatedBlocks := append([][]byte{}, blocks...)
+						updatedBlocks[i] = []byte("X")
+						expected, err := NewTree(updatedBlocks, h, WithParams(params))
+						assert.NoError(t, err)
+						assert.Equal(t, expected.Nodes, updated.Nodes)
+
+						oldLeafHash, err := tree.LeafHash(i)
+						assert.NoError(t, err)
+						assert.True(t, VerifyUpdate(tree.RootHash(), updated.RootHash(), i, oldLeafHash, []byte("X"), proof, h, opts...))
+					}
+
+					if n > 1 {
+						appended, err := NewTree(blocks[:n/2], h, WithParams(params))
+						assert.NoError(t, err)
+						appended, err = appended.Append(blocks[n/2:])
+						assert.NoError(t, err)
+						assert.Equal(t, tree.Nodes, appended.Nodes)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestKaryTreeHashing(t *testing.T) {
+	blocks := blocksOf("A", "B", "C", "D", "E", "F")
+
+	tree, err := NewTree(blocks, h, WithMode(ModeRFC6962), WithOddNodes(OddNodesPromote), WithArity(4))
+	assert.NoError(t, err)
+
+	leaves := tree.leaves()
+	left := h.Digest(nodePrefix, leaves[0], leaves[1], leaves[2], leaves[3])
+	right := h.Digest(nodePrefix, leaves[4], leaves[5])
+	assert.Equal(t, h.Digest(nodePrefix, left, right), tree.RootHash())
+
+	// Binary trees are hashed as they have always been
+	binary, err := NewTree(blocks, h, WithMode(ModeRFC6962), WithArity(2))
+	assert.NoError(t, err)
+	legacy, err := NewTree(blocks, h, WithMode(ModeRFC6962))
+	assert.NoError(t, err)
+	assert.Equal(t, legacy.Nodes, binary.Nodes)
+}
+
+func TestKaryProofIsShorter(t *testing.T) {
+	blocks := make([][]byte, 4096)
+	for i := range blocks {
+		blocks[i] = []byte(fmt.Sprintf("block %d", i))
+	}
+
+	cases := map[int]struct {
+		levels   int
+		siblings int
+	}{
+		2:  {levels: 12, siblings: 12},
+		4:  {levels: 6, siblings: 18},
+		16: {levels: 3, siblings: 45},
+	}
+
+	for arity, tc := range cases {
+		t.Run(fmt.Sprintf("%d-ary", arity), func(t *testing.T) {
+			tree, err := NewTree(blocks, h, WithMode(ModeRFC6962), WithArity(arity))
+			assert.NoError(t, err)
+
+			proof, err := tree.ProofForIndex(1234)
+			assert.NoError(t, err)
+			assert.Len(t, proof, tc.levels)
+
+			siblings := 0
+			for _, p := range proof {
+				siblings += len(p.Siblings)
+				if p.Hash != nil {
+					siblings++
+				}
+			}
+			assert.Equal(t, tc.siblings, siblings)
+		})
+	}
+}
+
+func TestKaryProofInvalid(t *testing.T) {
+	blocks := blocksOf("A", "B", "C", "D", "E", "F", "G", "H", "I")
+	opts := []Option{WithMode(ModeRFC6962), WithArity(4)}
+
+	tree, err := NewTree(blocks, h, opts...)
+	assert.NoError(t, err)
+	opts = append(opts, WithLeafCount(len(blocks)))
+
+	proof, err := tree.ProofForIndex(5)
+	assert.NoError(t, err)
+	assert.True(t, VerifyProof(tree.RootHash(), 5, []byte("F"), proof, h, opts...))
+
+	cases := map[string]struct {
+		proof []ProofHash
+		opts  []Option
+	}{
+		"other position": {
+			proof: []ProofHash{{Siblings: proof[0].Siblings, Index: 2}, proof[1]},
+		},
+		"missing sibling": {
+			proof: []ProofHash{{Siblings: proof[0].Siblings[1:], Index: proof[0].Index}, proof[1]},
+		},
+		"missing level": {
+			proof: proof[:1],
+		},
+		"binary tree": {
+			proof: proof,
+			opts:  []Option{WithArity(2)},
+		},
+		"unsupported arity": {
+			proof: proof,
+			opts:  []Option{WithArity(3)},
+		},
+		"unknown leaf count": {
+			proof: proof,
+			opts:  []Option{WithLeafCount(0)},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			assert.False(t, VerifyProof(tree.RootHash(), 5, []byte("F"), tc.proof, h, append(opts, tc.opts...)...))
+		})
+	}
+
+	_, err = NewTree(blocks, h, WithArity(3))
+	assert.ErrorIs(t, err, ErrUnsupportedArity)
+
+	_, err = tree.MultiProofForIndices([]int{1, 2})
+	assert.ErrorIs(t, err, ErrUnsupportedArity)
+
+	_, err = tree.ConsistencyProof(4)
+	assert.ErrorIs(t, err, ErrConsistencyUnsupported)
+}
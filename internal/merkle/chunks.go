@@ -0,0 +1,80 @@
+package merkle
+
+import (
+	"errors"
+	"io"
+)
+
+// DefaultChunkSize is the size of the chunks files are split into, unless configured otherwise: 1 MiB.
+const DefaultChunkSize = 1 << 20
+
+var (
+	ErrInvalidChunkSize = errors.New("the chunk size must be positive")
+)
+
+// chunkParams are the params of the trees of the chunks of a file.
+// Their shape is unambiguous even without committing to the number of chunks,
+// and a file made of a single chunk keeps the leaf hash it has as a whole block in ModeRFC6962 trees.
+var chunkParams = Params{Mode: ModeRFC6962, OddNodes: OddNodesPromote}
+
+// FileLeafHash reads a file from r, and returns its leaf hash in a tree with the given params.
+// When the params set a ChunkSize, the file is split into chunks of that size, and its leaf hash is the root hash
+// of the tree of its chunks: the file is read one chunk at a time, and it can be verified one chunk at a time as well,
+// against the hashes returned by ChunkHashes.
+func FileLeafHash(r io.Reader, hasher Hasher, params Params) (leafHash Digest, err error) {
+	if params.ChunkSize == 0 {
+		var block []byte
+		if block, err = io.ReadAll(r); err != nil {
+			return
+		}
+
+		return params.Mode.hashLeaf(block, hasher), nil
+	}
+
+	chunkHashes, err := ChunkHashes(r, params.ChunkSize, hasher)
+	if err != nil {
+		return
+	}
+
+	return ChunkTreeRoot(chunkHashes, hasher)
+}
+
+// ChunkHashes reads a file from r, split into chunks of chunkSize bytes, and returns the hashes of its chunks.
+// Only the last chunk may be shorter, and an empty file is made of a single empty chunk.
+func ChunkHashes(r io.Reader, chunkSize int, hasher Hasher) (chunkHashes []Digest, err error) {
+	if chunkSize <= 0 {
+		return nil, ErrInvalidChunkSize
+	}
+
+	chunk := make([]byte, chunkSize)
+	for {
+		n, readErr := io.ReadFull(r, chunk)
+		if readErr == io.EOF && len(chunkHashes) > 0 {
+			// the previous chunk was the last one
+			return chunkHashes, nil
+		}
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			return nil, readErr
+		}
+
+		chunkHashes = append(chunkHashes, ChunkHash(chunk[:n], hasher))
+		if readErr != nil {
+			return chunkHashes, nil
+		}
+	}
+}
+
+// ChunkHash returns the hash of a chunk, i.e. its leaf hash in the tree of the chunks of its file.
+func ChunkHash(chunk []byte, hasher Hasher) Digest {
+	return chunkParams.Mode.hashLeaf(chunk, hasher)
+}
+
+// ChunkTreeRoot returns the root hash of the tree of the chunks with the given hashes, i.e. the leaf hash of their file.
+func ChunkTreeRoot(chunkHashes []Digest, hasher Hasher) (root Digest, err error) {
+	tree, err := NewTreeFromLeafHashes(chunkHashes, hasher, WithParams(chunkParams))
+	if err != nil {
+		return
+	}
+
+	return tree.RootHash(), nil
+}
@@ -0,0 +1,80 @@
+package merkle
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChunkHashes(t *testing.T) {
+	cases := map[string]struct {
+		size           int
+		expectedChunks int
+	}{
+		"empty file":             {size: 0, expectedChunks: 1},
+		"shorter than a chunk":   {size: 3, expectedChunks: 1},
+		"exactly one chunk":      {size: 4, expectedChunks: 1},
+		"last chunk is shorter":  {size: 9, expectedChunks: 3},
+		"last chunk is complete": {size: 12, expectedChunks: 3},
+		"one byte after a chunk": {size: 5, expectedChunks: 2},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			file := bytes.Repeat([]byte{'x'}, tc.size)
+
+			chunkHashes, err := ChunkHashes(bytes.NewReader(file), 4, h)
+			assert.NoError(t, err)
+			assert.Len(t, chunkHashes, tc.expectedChunks)
+
+			for i, chunkHash := range chunkHashes {
+				chunk := file[i*4 : min(i*4+4, len(file))]
+				assert.Equal(t, ChunkHash(chunk, h), chunkHash)
+			}
+
+			// The leaf hash of the file is the root hash of the tree of its chunks
+			leafHash, err := FileLeafHash(bytes.NewReader(file), h, Params{ChunkSize: 4})
+			assert.NoError(t, err)
+			root, err := ChunkTreeRoot(chunkHashes, h)
+			assert.NoError(t, err)
+			assert.Equal(t, root, leafHash)
+		})
+	}
+
+	_, err := ChunkHashes(bytes.NewReader(nil), 0, h)
+	assert.ErrorIs(t, err, ErrInvalidChunkSize)
+}
+
+func TestFileLeafHash(t *testing.T) {
+	file := []byte("content of the file")
+
+	// Without chunks, a file is a whole leaf
+	for _, mode := range []Mode{ModeLegacy, ModeRFC6962} {
+		leafHash, err := FileLeafHash(bytes.NewReader(file), h, Params{Mode: mode})
+		assert.NoError(t, err)
+		assert.Equal(t, mode.hashLeaf(file, h), leafHash)
+	}
+
+	// A file made of a single chunk keeps its leaf hash
+	leafHash, err := FileLeafHash(bytes.NewReader(file), h, Params{Mode: ModeRFC6962, ChunkSize: DefaultChunkSize})
+	assert.NoError(t, err)
+	assert.Equal(t, ModeRFC6962.hashLeaf(file, h), leafHash)
+
+	// The leaf hashes of the files can be proven in the tree of the files
+	params := Params{Mode: ModeRFC6962, OddNodes: OddNodesPromote, CommitLeafCount: true, ChunkSize: 4}
+	var leafHashes []Digest
+	for _, f := range [][]byte{file, []byte("another file"), {}} {
+		leafHash, err = FileLeafHash(bytes.NewReader(f), h, params)
+		assert.NoError(t, err)
+		leafHashes = append(leafHashes, leafHash)
+	}
+
+	tree, err := NewTreeFromLeafHashes(leafHashes, h, WithParams(params))
+	assert.NoError(t, err)
+	for i, leafHash := range leafHashes {
+		proof, err := tree.ProofForIndex(i)
+		assert.NoError(t, err)
+		assert.True(t, VerifyLeafProof(tree.RootHash(), i, leafHash, proof, h, WithParams(params), WithLeafCount(len(leafHashes))))
+	}
+}
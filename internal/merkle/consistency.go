@@ -0,0 +1,119 @@
+package merkle
+
+import (
+	"errors"
+)
+
+var (
+	ErrInvalidTreeSize        = errors.New("the old tree size must be between 1 and the size of the tree")
+	ErrConsistencyUnsupported = errors.New("consistency proofs require binary trees promoting odd nodes")
+)
+
+// ConsistencyProof generates a proof that the tree made of the first oldSize leaves is a prefix of this tree,
+// as defined by RFC 9162 (2.1.4). It's only available for binary trees promoting odd nodes, which have the RFC shape.
+// When the root hash commits to the leaf count, and oldSize is a power of two,
+// the proof starts with the root node hash of the old tree, which the verifier can't take from its root hash.
+func (t *Tree) ConsistencyProof(oldSize int) (proof []Digest, err error) {
+	if t.OddNodes != OddNodesPromote || t.Arity != 2 {
+		return nil, ErrConsistencyUnsupported
+	}
+
+	if oldSize < 1 || oldSize > t.LeafCount {
+		return nil, ErrInvalidTreeSize
+	}
+
+	return consistencyProof(t.subtree, oldSize, t.LeafCount, t.CommitLeafCount), nil
+}
+
+// consistencyProof generates the consistency proof from oldSize to size leaves,
+// subtree giving the hash of the subtree spanning the leaves [lo, hi) in the tree of size leaves.
+func consistencyProof(subtree func(lo, hi int) Digest, oldSize, size int, commitLeafCount bool) (proof []Digest) {
+	// SUBPROOF(m, D[lo:lo+n], b):
+	// complete is true as long as the subtrees walked are the ones the old tree hash is computed from
+	var subproof func(lo, m, n int, complete bool)
+	subproof = func(lo, m, n int, complete bool) {
+		if m == n {
+			if !complete {
+				proof = append(proof, subtree(lo, lo+n))
+			}
+
+			return
+		}
+
+		k := splitPoint(n)
+		if m <= k {
+			subproof(lo, m, k, complete)
+			proof = append(proof, subtree(lo+k, lo+n))
+		} else {
+			subproof(lo+k, m-k, n-k, false)
+			proof = append(proof, subtree(lo, lo+k))
+		}
+	}
+
+	// When oldSize is a power of two, the root node of the old tree is the leftmost perfect subtree spanning oldSize leaves
+	if commitLeafCount && oldSize < size && isPowerOfTwo(oldSize) {
+		proof = append(proof, subtree(0, oldSize))
+	}
+	subproof(0, oldSize, size, true)
+
+	return
+}
+
+// VerifyConsistency verifies a proof that the tree of oldSize leaves, with root hash oldRoot,
+// is a prefix of the tree of newSize leaves, with root hash newRoot, as defined by RFC 9162 (2.1.4.2).
+// It returns true if the proof is valid, and false otherwise.
+// The options describe the trees the proof has been generated from, which must be binary and promoting odd nodes.
+func VerifyConsistency(oldRoot Digest, oldSize int, newRoot Digest, newSize int, proof []Digest, hasher Hasher, opts ...Option) bool {
+	t := newTree(hasher, opts...)
+
+	if t.OddNodes != OddNodesPromote || t.Arity != 2 || oldSize < 1 || oldSize > newSize {
+		return false
+	}
+
+	oldTree, currentTree := *t, *t
+	oldTree.LeafCount, currentTree.LeafCount = oldSize, newSize
+
+	if oldSize == newSize {
+		return len(proof) == 0 && oldRoot.Equal(newRoot)
+	}
+
+	// The old tree is a complete subtree of the new one, hence its hash is the first one of the path
+	if isPowerOfTwo(oldSize) && !t.CommitLeafCount {
+		proof = append([]Digest{oldRoot}, proof...)
+	}
+
+	if len(proof) == 0 {
+		return false
+	}
+
+	fn, sn := oldSize-1, newSize-1
+	for fn&1 == 1 {
+		fn, sn = fn>>1, sn>>1
+	}
+
+	fr, sr := proof[0], proof[0]
+	for _, c := range proof[1:] {
+		if sn == 0 {
+			return false
+		}
+
+		if fn&1 == 1 || fn == sn {
+			fr = t.Mode.hashChildren(c, fr, hasher)
+			sr = t.Mode.hashChildren(c, sr, hasher)
+
+			for fn&1 == 0 && fn != 0 {
+				fn, sn = fn>>1, sn>>1
+			}
+		} else {
+			sr = t.Mode.hashChildren(sr, c, hasher)
+		}
+
+		fn, sn = fn>>1, sn>>1
+	}
+
+	return sn == 0 && oldTree.rootHash(fr).Equal(oldRoot) && currentTree.rootHash(sr).Equal(newRoot)
+}
+
+func isPowerOfTwo(n int) bool {
+	return n > 0 && n&(n-1) == 0
+}
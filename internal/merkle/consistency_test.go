@@ -0,0 +1,106 @@
+package merkle
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMerkleTreeAppend(t *testing.T) {
+	blocks := blocksOf("A", "B", "C", "D", "E", "F", "G")
+
+	for _, params := range []Params{
+		{Mode: ModeRFC6962},
+		{Mode: ModeRFC6962, OddNodes: OddNodesPromote, CommitLeafCount: true},
+	} {
+		for m := 1; m < len(blocks); m++ {
+			oldTree, err := NewTree(blocks[:m], h, WithParams(params))
+			assert.NoError(t, err)
+			oldRoot := oldTree.RootHash()
+
+			tree, err := oldTree.Append(blocks[m:])
+			assert.NoError(t, err)
+
+			wantTree, err := NewTree(blocks, h, WithParams(params))
+			assert.NoError(t, err)
+			assert.Equal(t, wantTree.RootHash(), tree.RootHash())
+			assert.Equal(t, len(blocks), tree.LeafCount)
+
+			// The old tree is left untouched
+			assert.Equal(t, oldRoot, oldTree.RootHash())
+		}
+	}
+
+	tree, err := NewTree(blocks, h)
+	assert.NoError(t, err)
+
+	_, err = tree.Append(nil)
+	assert.ErrorIs(t, err, ErrEmptyTreeInput)
+}
+
+func TestMerkleConsistencyProof(t *testing.T) {
+	var blocks [][]byte
+	for i := 0; i < 20; i++ {
+		blocks = append(blocks, []byte{byte(i)})
+	}
+
+	for name, params := range map[string]Params{
+		"rfc6962":             {Mode: ModeRFC6962, OddNodes: OddNodesPromote},
+		"rfc6962, leaf count": {Mode: ModeRFC6962, OddNodes: OddNodesPromote, CommitLeafCount: true},
+		"legacy":              {OddNodes: OddNodesPromote},
+	} {
+		t.Run(name, func(t *testing.T) {
+			for n := 1; n <= len(blocks); n++ {
+				tree, err := NewTree(blocks[:n], h, WithParams(params))
+				assert.NoError(t, err)
+
+				for m := 1; m <= n; m++ {
+					oldTree, err := NewTree(blocks[:m], h, WithParams(params))
+					assert.NoError(t, err)
+
+					proof, err := tree.ConsistencyProof(m)
+					assert.NoError(t, err)
+					assert.True(t, VerifyConsistency(oldTree.RootHash(), m, tree.RootHash(), n, proof, h, WithParams(params)), "%d -> %d", m, n)
+
+					if m == n {
+						continue
+					}
+
+					// Tampered hashes, or a tree which is not a prefix, are rejected
+					for i := range proof {
+						tampered := append([]Digest{}, proof...)
+						tampered[i] = h.Digest(tampered[i])
+						assert.False(t, VerifyConsistency(oldTree.RootHash(), m, tree.RootHash(), n, tampered, h, WithParams(params)))
+					}
+
+					otherTree, err := NewTree(append(blocksOf("X"), blocks[1:m]...), h, WithParams(params))
+					assert.NoError(t, err)
+					assert.False(t, VerifyConsistency(otherTree.RootHash(), m, tree.RootHash(), n, proof, h, WithParams(params)))
+
+					// The new size is bound to the proof only if the root commits to it
+					if params.CommitLeafCount {
+						assert.False(t, VerifyConsistency(oldTree.RootHash(), m, tree.RootHash(), n+1, proof, h, WithParams(params)))
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestMerkleConsistencyProofInvalid(t *testing.T) {
+	blocks := blocksOf("A", "B", "C")
+
+	tree, err := NewTree(blocks, h, WithOddNodes(OddNodesPromote))
+	assert.NoError(t, err)
+
+	for _, size := range []int{0, 4} {
+		_, err = tree.ConsistencyProof(size)
+		assert.ErrorIs(t, err, ErrInvalidTreeSize)
+	}
+
+	duplicateTree, err := NewTree(blocks, h)
+	assert.NoError(t, err)
+
+	_, err = duplicateTree.ConsistencyProof(2)
+	assert.ErrorIs(t, err, ErrConsistencyUnsupported)
+}
@@ -0,0 +1,62 @@
+package merkle
+
+import (
+	"errors"
+)
+
+var (
+	ErrIncomparableTrees = errors.New("trees built with different params or hash algorithms can't be compared")
+)
+
+// Diff returns the positions (0-based) of the leaves that differ between the trees a and b, in increasing order,
+// including the ones found in only one of them. Both trees are walked down together from their roots,
+// skipping the subtrees found with the same hash, and spanning the same leaves, in both:
+// the cost grows with the number of differences, rather than the number of leaves.
+func Diff(a, b *Tree) (indices []int, err error) {
+	if a.Params != b.Params || a.HashAlgorithm != b.HashAlgorithm {
+		return nil, ErrIncomparableTrees
+	}
+
+	var walk func(level, index int)
+	walk = func(level, index int) {
+		hashA, spanA := a.span(level, index)
+		hashB, spanB := b.span(level, index)
+		if spanA == 0 && spanB == 0 {
+			return
+		}
+
+		if spanA == spanB && hashA.Equal(hashB) {
+			// an identical subtree
+			return
+		}
+
+		if level == 0 {
+			indices = append(indices, index)
+
+			return
+		}
+
+		for child := index * a.Arity; child < (index+1)*a.Arity; child++ {
+			walk(level-1, child)
+		}
+	}
+
+	walk(max(a.depth(), b.depth()), 0)
+
+	return
+}
+
+// span returns the hash of the node at index of level, and the number of leaves it spans,
+// which is 0 when the tree has no such node.
+func (t *Tree) span(level, index int) (hash Digest, leaves int) {
+	if level >= len(t.levels) || index >= len(t.levels[level]) {
+		return nil, 0
+	}
+
+	width := 1
+	for l := 0; l < level; l++ {
+		width *= t.Arity
+	}
+
+	return t.levels[level][index], min((index+1)*width, t.leafCount()) - index*width
+}
@@ -0,0 +1,95 @@
+package merkle
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiff(t *testing.T) {
+	blocks := make([][]byte, 37)
+	for i := range blocks {
+		blocks[i] = []byte(fmt.Sprintf("block %d", i))
+	}
+
+	changed := func(n int, indices ...int) [][]byte {
+		changed := append([][]byte{}, blocks[:n]...)
+		for _, i := range indices {
+			changed[i] = []byte("changed")
+		}
+
+		return changed
+	}
+
+	cases := map[string]struct {
+		a, b [][]byte
+		want []int
+	}{
+		"identical": {
+			a: blocks,
+			b: changed(37),
+		},
+		"one changed": {
+			a:    blocks,
+			b:    changed(37, 12),
+			want: []int{12},
+		},
+		"several changed": {
+			a:    blocks,
+			b:    changed(37, 0, 1, 17, 36),
+			want: []int{0, 1, 17, 36},
+		},
+		"appended": {
+			a:    blocks[:30],
+			b:    blocks,
+			want: []int{30, 31, 32, 33, 34, 35, 36},
+		},
+		"removed and changed": {
+			a:    blocks,
+			b:    changed(33, 5),
+			want: []int{5, 33, 34, 35, 36},
+		},
+		"appended copy of the last leaf": {
+			a:    blocks[:5],
+			b:    append(changed(5), blocks[4]),
+			want: []int{5},
+		},
+	}
+
+	paramsCases := map[string]Params{
+		"duplicate":           {Mode: ModeRFC6962},
+		"promote, leaf count": {Mode: ModeRFC6962, OddNodes: OddNodesPromote, CommitLeafCount: true},
+		"4-ary":               {Mode: ModeRFC6962, OddNodes: OddNodesPromote, Arity: 4},
+	}
+
+	for paramsName, params := range paramsCases {
+		for name, tc := range cases {
+			t.Run(paramsName+", "+name, func(t *testing.T) {
+				a, err := NewTree(tc.a, h, WithParams(params))
+				assert.NoError(t, err)
+				b, err := NewTree(tc.b, h, WithParams(params))
+				assert.NoError(t, err)
+
+				indices, err := Diff(a, b)
+				assert.NoError(t, err)
+				assert.Equal(t, tc.want, indices)
+
+				// The diff is symmetric
+				indices, err = Diff(b, a)
+				assert.NoError(t, err)
+				assert.Equal(t, tc.want, indices)
+			})
+		}
+	}
+}
+
+func TestDiffIncomparable(t *testing.T) {
+	a, err := NewTree(blocksOf("A", "B"), h, WithMode(ModeRFC6962))
+	assert.NoError(t, err)
+	b, err := NewTree(blocksOf("A", "B"), h, WithMode(ModeRFC6962), WithOddNodes(OddNodesPromote))
+	assert.NoError(t, err)
+
+	_, err = Diff(a, b)
+	assert.ErrorIs(t, err, ErrIncomparableTrees)
+}
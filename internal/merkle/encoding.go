@@ -0,0 +1,314 @@
+package merkle
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// TreeFormatVersion is the version of the binary format trees are serialized in.
+// Version 1 lacks the arity, its trees being binary.
+const TreeFormatVersion = 2
+
+// treeMagic starts every serialized tree, telling it apart from the gob-encoded ones stored before.
+var treeMagic = []byte("MFUT")
+
+var (
+	ErrInvalidTreeFormat            = errors.New("invalid serialized merkle tree")
+	ErrUnsupportedTreeFormatVersion = errors.New("unsupported serialized merkle tree version")
+)
+
+// flags of the serialized params
+const (
+	flagCommitLeafCount = 1 << iota
+)
+
+// TreeHeader is the header of a serialized tree. It tells where each node is,
+// so that nodes can be read on their own, e.g. with ranged requests, see ReadNode.
+//
+// The binary format is deterministic, all integers being big-endian:
+//
+//	magic "MFUT" | version u8 | mode u8 | odd nodes u8 | flags u8 | arity u8 | chunk size u32 | leaf count u64 |
+//	hash size u8 | hash algorithm length u8 | hash algorithm | nodes
+//
+// The nodes follow as in Tree.Nodes: level by level from the leaves up, each node taking hash size bytes.
+type TreeHeader struct {
+	Version       uint8
+	HashAlgorithm string
+	HashSize      int
+	LeafCount     int
+	Params
+}
+
+// Size returns the number of bytes of the header, i.e. the offset of the first node.
+func (h TreeHeader) Size() int64 {
+	return int64(len(treeMagic) + fixedHeaderSize(h.Version) + len(h.HashAlgorithm))
+}
+
+// fixedHeaderSize returns the number of bytes between the magic and the hash algorithm in the given version.
+func fixedHeaderSize(version uint8) int {
+	if version == 1 {
+		return 18
+	}
+
+	return 19
+}
+
+// NodeOffset returns the offset, from the start of the serialized tree, of the node at index of level,
+// leaves being at level 0.
+func (h TreeHeader) NodeOffset(level, index int) (offset int64, err error) {
+	if level < 0 || index < 0 {
+		return 0, ErrIndexOutOfRange
+	}
+
+	nodes := 0
+	size := h.LeafCount
+	for ; level > 0 && size > 1; level-- {
+		nodes += size
+		size = (size + h.Arity - 1) / h.Arity
+	}
+	if level > 0 || index >= size {
+		return 0, ErrIndexOutOfRange
+	}
+
+	return h.Size() + int64(nodes+index)*int64(h.HashSize), nil
+}
+
+// Header returns the header the tree is serialized with.
+func (t *Tree) Header() TreeHeader {
+	header := TreeHeader{
+		Version:       TreeFormatVersion,
+		HashAlgorithm: t.HashAlgorithm,
+		LeafCount:     t.LeafCount,
+		Params:        t.Params,
+	}
+	if len(t.Nodes) > 0 {
+		header.HashSize = len(t.Nodes[0])
+	}
+
+	return header
+}
+
+// Serialize encodes the tree in the binary format described by TreeHeader.
+func (t *Tree) Serialize() (treeBytes []byte, err error) {
+	header := t.Header()
+
+	var buf bytes.Buffer
+	if err = writeHeader(&buf, treeMagic, header); err != nil {
+		return
+	}
+
+	if err = writeNodes(&buf, header, t.Nodes); err != nil {
+		return
+	}
+
+	return buf.Bytes(), nil
+}
+
+// writeHeader writes the header of a serialized tree, or mountain range, starting with magic, in the format of its version.
+func writeHeader(buf *bytes.Buffer, magic []byte, header TreeHeader) error {
+	if len(header.HashAlgorithm) > 0xff {
+		return fmt.Errorf("%w: hash algorithm name too long", ErrInvalidTreeFormat)
+	}
+
+	var flags uint8
+	if header.CommitLeafCount {
+		flags |= flagCommitLeafCount
+	}
+
+	buf.Write(magic)
+	buf.Write([]byte{header.Version, uint8(header.Mode), uint8(header.OddNodes), flags})
+	if header.Version > 1 {
+		buf.WriteByte(uint8(header.Arity))
+	} else if header.Arity != 2 {
+		return fmt.Errorf("%w: version %d is for binary trees only", ErrInvalidTreeFormat, header.Version)
+	}
+	buf.Write(binary.BigEndian.AppendUint32(nil, uint32(header.ChunkSize)))
+	buf.Write(binary.BigEndian.AppendUint64(nil, uint64(header.LeafCount)))
+	buf.Write([]byte{uint8(header.HashSize), uint8(len(header.HashAlgorithm))})
+	buf.WriteString(header.HashAlgorithm)
+
+	return nil
+}
+
+// writeNodes writes the given nodes, which must all be of the hash size of the header.
+func writeNodes(buf *bytes.Buffer, header TreeHeader, nodes []Digest) error {
+	for _, node := range nodes {
+		if len(node) != header.HashSize {
+			return fmt.Errorf("%w: nodes of different sizes", ErrInvalidTreeFormat)
+		}
+
+		buf.Write(node)
+	}
+
+	return nil
+}
+
+// Deserialize decodes a serialized tree, restoring its hasher from the recorded hash algorithm.
+// Trees serialized with gob, before the binary format, are still read.
+// Those serialized before the algorithm was recorded come without a hasher, which must be set by the caller.
+func Deserialize(r io.Reader) (t *Tree, err error) {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(len(treeMagic)); err != nil || !bytes.Equal(magic, treeMagic) {
+		return deserializeGob(br)
+	}
+
+	header, err := ReadTreeHeader(br)
+	if err != nil {
+		return
+	}
+
+	t = &Tree{
+		LeafCount:     header.LeafCount,
+		HashAlgorithm: header.HashAlgorithm,
+		Params:        header.Params,
+	}
+	if t.Hasher, err = header.hasher(); err != nil {
+		return nil, err
+	}
+
+	if t.Nodes, err = readNodes(br, header, nodeCount(header.LeafCount, header.Arity)); err != nil {
+		return nil, err
+	}
+	t.index()
+
+	return
+}
+
+// hasher returns the hasher of the recorded hash algorithm, if any, checking its hash size.
+func (h TreeHeader) hasher() (hasher Hasher, err error) {
+	if h.HashAlgorithm == "" {
+		return
+	}
+
+	if hasher, err = HashAlgorithm(h.HashAlgorithm); err != nil {
+		return nil, err
+	}
+
+	if len(hasher.Digest()) != h.HashSize {
+		return nil, fmt.Errorf("%w: hash size %d", ErrInvalidTreeFormat, h.HashSize)
+	}
+
+	return
+}
+
+// readNodes reads count nodes of the hash size of the header.
+// Memory grows with the bytes actually read, rather than with the count found in the header, which may be forged.
+func readNodes(r io.Reader, header TreeHeader, count int) (nodes []Digest, err error) {
+	var buf bytes.Buffer
+	size := int64(count) * int64(header.HashSize)
+	if n, err := io.CopyN(&buf, r, size); err != nil {
+		return nil, fmt.Errorf("%w: %d bytes of nodes out of %d: %s", ErrInvalidTreeFormat, n, size, err)
+	}
+	nodeBytes := buf.Bytes()
+
+	nodes = make([]Digest, count)
+	for i := range nodes {
+		nodes[i] = nodeBytes[i*header.HashSize : (i+1)*header.HashSize]
+	}
+
+	return
+}
+
+// ReadTreeHeader reads the header of a serialized tree.
+func ReadTreeHeader(r io.Reader) (header TreeHeader, err error) {
+	return readHeader(r, treeMagic)
+}
+
+// readHeader reads the header of a serialized tree, or mountain range, starting with magic.
+func readHeader(r io.Reader, magic []byte) (header TreeHeader, err error) {
+	prefix := make([]byte, len(magic)+1)
+	if _, err = io.ReadFull(r, prefix); err != nil {
+		err = fmt.Errorf("%w: %s", ErrInvalidTreeFormat, err)
+
+		return
+	}
+
+	if !bytes.Equal(prefix[:len(magic)], magic) {
+		err = fmt.Errorf("%w: bad magic", ErrInvalidTreeFormat)
+
+		return
+	}
+
+	if header.Version = prefix[len(magic)]; header.Version < 1 || header.Version > TreeFormatVersion {
+		err = fmt.Errorf("%w: %d", ErrUnsupportedTreeFormatVersion, header.Version)
+
+		return
+	}
+
+	// The version, already read, keeps its place in fixed so that fields keep their offsets
+	fixed := make([]byte, fixedHeaderSize(header.Version))
+	fixed[0] = header.Version
+	if _, err = io.ReadFull(r, fixed[1:]); err != nil {
+		err = fmt.Errorf("%w: %s", ErrInvalidTreeFormat, err)
+
+		return
+	}
+
+	header.Mode, header.OddNodes = Mode(fixed[1]), OddNodes(fixed[2])
+	if fixed[3]&^flagCommitLeafCount != 0 {
+		err = fmt.Errorf("%w: unknown flags %#x", ErrInvalidTreeFormat, fixed[3])
+
+		return
+	}
+	header.CommitLeafCount = fixed[3]&flagCommitLeafCount != 0
+	if header.Arity = 2; header.Version > 1 {
+		header.Arity = int(fixed[4])
+		fixed = append(fixed[:4], fixed[5:]...)
+	}
+	header.ChunkSize = int(binary.BigEndian.Uint32(fixed[4:8]))
+	leafCount := binary.BigEndian.Uint64(fixed[8:16])
+	header.HashSize = int(fixed[16])
+
+	if header.HashSize == 0 || leafCount == 0 || leafCount > 1<<40 {
+		err = fmt.Errorf("%w: leaf count %d", ErrInvalidTreeFormat, leafCount)
+
+		return
+	}
+	header.LeafCount = int(leafCount)
+
+	if _, ok := modeNames[header.Mode]; !ok {
+		err = fmt.Errorf("%w: %w: %d", ErrInvalidTreeFormat, ErrUnknownMode, header.Mode)
+
+		return
+	}
+	if _, ok := oddNodesNames[header.OddNodes]; !ok {
+		err = fmt.Errorf("%w: %w: %d", ErrInvalidTreeFormat, ErrUnknownOddNodes, header.OddNodes)
+
+		return
+	}
+	if err = header.validateArity(); err != nil {
+		err = fmt.Errorf("%w: %w", ErrInvalidTreeFormat, err)
+
+		return
+	}
+
+	algorithm := make([]byte, fixed[17])
+	if _, err = io.ReadFull(r, algorithm); err != nil {
+		err = fmt.Errorf("%w: %s", ErrInvalidTreeFormat, err)
+
+		return
+	}
+	header.HashAlgorithm = string(algorithm)
+
+	return
+}
+
+// ReadNode reads the hash of the node at index of level from a serialized tree with the given header,
+// without reading the rest of the tree.
+func ReadNode(r io.ReaderAt, header TreeHeader, level, index int) (hash Digest, err error) {
+	offset, err := header.NodeOffset(level, index)
+	if err != nil {
+		return
+	}
+
+	hash = make(Digest, header.HashSize)
+	if _, err = r.ReadAt(hash, offset); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidTreeFormat, err)
+	}
+
+	return
+}
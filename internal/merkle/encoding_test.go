@@ -0,0 +1,240 @@
+package merkle
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTreeEncoding(t *testing.T) {
+	paramsCases := map[string]Params{
+		"legacy":              {},
+		"duplicate":           {Mode: ModeRFC6962},
+		"promote, leaf count": {Mode: ModeRFC6962, OddNodes: OddNodesPromote, CommitLeafCount: true, ChunkSize: 1024},
+		"4-ary":               {Mode: ModeRFC6962, OddNodes: OddNodesPromote, Arity: 4},
+		"16-ary, duplicate":   {Mode: ModeRFC6962, Arity: 16},
+	}
+
+	algorithm, err := HashAlgorithm(SHA512_256)
+	assert.NoError(t, err)
+
+	for name, params := range paramsCases {
+		t.Run(name, func(t *testing.T) {
+			for n := 1; n <= 9; n++ {
+				var blocks [][]byte
+				for i := 0; i < n; i++ {
+					blocks = append(blocks, []byte{byte(i)})
+				}
+
+				tree, err := NewTree(blocks, algorithm, WithParams(params))
+				assert.NoError(t, err)
+
+				treeBytes, err := tree.Serialize()
+				assert.NoError(t, err)
+
+				// The encoding is deterministic
+				again, err := tree.Serialize()
+				assert.NoError(t, err)
+				assert.Equal(t, treeBytes, again)
+
+				deserialized, err := Deserialize(bytes.NewReader(treeBytes))
+				assert.NoError(t, err)
+				assert.Equal(t, tree.Nodes, deserialized.Nodes)
+				assert.Equal(t, tree.Params, deserialized.Params)
+				assert.Equal(t, n, deserialized.LeafCount)
+				assert.Equal(t, SHA512_256, deserialized.HashAlgorithm)
+				assert.Equal(t, tree.RootHash(), deserialized.RootHash())
+
+				// Single nodes are read from their offset
+				header, err := ReadTreeHeader(bytes.NewReader(treeBytes))
+				assert.NoError(t, err)
+				assert.Equal(t, n, header.LeafCount)
+				for level, nodes := range tree.levels {
+					for i, node := range nodes {
+						hash, err := ReadNode(bytes.NewReader(treeBytes), header, level, i)
+						assert.NoError(t, err)
+						assert.Equal(t, node, hash)
+					}
+
+					_, err = ReadNode(bytes.NewReader(treeBytes), header, level, len(nodes))
+					assert.ErrorIs(t, err, ErrIndexOutOfRange)
+				}
+				_, err = ReadNode(bytes.NewReader(treeBytes), header, len(tree.levels), 0)
+				assert.ErrorIs(t, err, ErrIndexOutOfRange)
+			}
+		})
+	}
+}
+
+func TestTreeEncodingInvalid(t *testing.T) {
+	tree, err := NewTree(blocksOf("A", "B", "C"), h, WithMode(ModeRFC6962))
+	assert.NoError(t, err)
+
+	treeBytes, err := tree.Serialize()
+	assert.NoError(t, err)
+
+	cases := map[string]struct {
+		treeBytes []byte
+		wantErr   error
+	}{
+		"truncated nodes": {
+			treeBytes: treeBytes[:len(treeBytes)-1],
+			wantErr:   ErrInvalidTreeFormat,
+		},
+		"truncated header": {
+			treeBytes: treeBytes[:10],
+			wantErr:   ErrInvalidTreeFormat,
+		},
+		"unknown version": {
+			treeBytes: append(append(append([]byte{}, treeMagic...), 9), treeBytes[5:]...),
+			wantErr:   ErrUnsupportedTreeFormatVersion,
+		},
+		"unknown mode": {
+			treeBytes: append(append(append([]byte{}, treeBytes[:5]...), 9), treeBytes[6:]...),
+			wantErr:   ErrUnknownMode,
+		},
+		"unknown flags": {
+			treeBytes: append(append(append([]byte{}, treeBytes[:7]...), 0x80), treeBytes[8:]...),
+			wantErr:   ErrInvalidTreeFormat,
+		},
+		"unsupported arity": {
+			treeBytes: append(append(append([]byte{}, treeBytes[:8]...), 3), treeBytes[9:]...),
+			wantErr:   ErrUnsupportedArity,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := Deserialize(bytes.NewReader(tc.treeBytes))
+			assert.ErrorIs(t, err, tc.wantErr)
+		})
+	}
+}
+
+func TestTreeEncodingVersion1(t *testing.T) {
+	tree, err := NewTree(blocksOf("A", "B", "C", "D", "E"), h, WithMode(ModeRFC6962), WithOddNodes(OddNodesPromote))
+	assert.NoError(t, err)
+
+	treeBytes, err := tree.Serialize()
+	assert.NoError(t, err)
+
+	// Version 1 is version 2 without the arity, its trees being binary
+	v1 := append(append(append([]byte{}, treeMagic...), 1), treeBytes[5:8]...)
+	v1 = append(v1, treeBytes[9:]...)
+
+	deserialized, err := Deserialize(bytes.NewReader(v1))
+	assert.NoError(t, err)
+	assert.Equal(t, tree.Nodes, deserialized.Nodes)
+	assert.Equal(t, tree.Params, deserialized.Params)
+
+	header, err := ReadTreeHeader(bytes.NewReader(v1))
+	assert.NoError(t, err)
+	hash, err := ReadNode(bytes.NewReader(v1), header, 3, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, tree.root(), hash)
+}
+
+func TestTreeEncodingGob(t *testing.T) {
+	// Trees stored before the binary format are graphs of nodes, where promoted nodes are found once
+	for _, oddNodes := range []OddNodes{OddNodesDuplicate, OddNodesPromote} {
+		for n := 1; n <= 9; n++ {
+			var blocks [][]byte
+			for i := 0; i < n; i++ {
+				blocks = append(blocks, []byte{byte(i)})
+			}
+
+			tree, err := NewTree(blocks, h, WithMode(ModeRFC6962), WithOddNodes(oddNodes))
+			assert.NoError(t, err)
+
+			var toGob func(lo, hi int) *gobNode
+			toGob = func(lo, hi int) *gobNode {
+				node := &gobNode{Hash: tree.subtree(lo, hi)}
+				if hi-lo > 1 {
+					mid := lo + splitPoint(hi-lo)
+					node.Left = toGob(lo, mid)
+					if node.Right = node.Left; !tree.isPadding(mid) {
+						node.Right = toGob(mid, hi)
+					}
+				}
+
+				return node
+			}
+
+			var buf bytes.Buffer
+			assert.NoError(t, gob.NewEncoder(&buf).Encode(gobTree{
+				Root:      toGob(0, tree.width()),
+				LeafCount: n,
+				Mode:      ModeRFC6962,
+				OddNodes:  oddNodes,
+			}))
+
+			deserialized, err := Deserialize(&buf)
+			assert.NoError(t, err)
+			assert.Equal(t, tree.Nodes, deserialized.Nodes, "%s, %d leaves", oddNodes, n)
+		}
+	}
+}
+
+func TestTreeEncodingGobInvalid(t *testing.T) {
+	leaf := func() *gobNode {
+		return &gobNode{Hash: h.Digest([]byte("A"))}
+	}
+	parent := func(left, right *gobNode) *gobNode {
+		return &gobNode{Hash: h.Digest(left.Hash, right.Hash), Left: left, Right: right}
+	}
+
+	chain := leaf()
+	for i := 0; i < 70; i++ {
+		chain = &gobNode{Hash: chain.Hash, Left: chain}
+	}
+
+	cases := map[string]struct {
+		tree    gobTree
+		wantErr error
+	}{
+		"negative leaf count": {
+			tree:    gobTree{Root: leaf(), LeafCount: -3},
+			wantErr: ErrInvalidTreeFormat,
+		},
+		"forged leaf count": {
+			tree:    gobTree{Root: parent(leaf(), leaf()), LeafCount: 1 << 40},
+			wantErr: ErrInvalidTreeFormat,
+		},
+		"forged depth": {
+			tree:    gobTree{Root: chain},
+			wantErr: ErrInvalidTreeFormat,
+		},
+		"missing node": {
+			tree:    gobTree{Root: &gobNode{Hash: leaf().Hash, Left: leaf()}, LeafCount: 2},
+			wantErr: ErrInvalidTreeFormat,
+		},
+		"nodes of different sizes": {
+			tree:    gobTree{Root: parent(leaf(), &gobNode{Hash: Digest{1}}), LeafCount: 2},
+			wantErr: ErrInvalidTreeFormat,
+		},
+		"empty node": {
+			tree:    gobTree{Root: parent(leaf(), &gobNode{}), LeafCount: 2},
+			wantErr: ErrInvalidTreeFormat,
+		},
+		"unknown mode": {
+			tree:    gobTree{Root: leaf(), LeafCount: 1, Mode: 9},
+			wantErr: ErrUnknownMode,
+		},
+		"hash size of another algorithm": {
+			tree:    gobTree{Root: &gobNode{Hash: Digest{1}}, LeafCount: 1, HashAlgorithm: SHA256},
+			wantErr: ErrInvalidTreeFormat,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			assert.NoError(t, gob.NewEncoder(&buf).Encode(tc.tree))
+
+			_, err := Deserialize(&buf)
+			assert.ErrorIs(t, err, tc.wantErr)
+		})
+	}
+}
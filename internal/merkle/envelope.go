@@ -0,0 +1,246 @@
+package merkle
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// proofMagic starts every serialized proof, whose header is the one of the tree it's been generated from, see TreeHeader.
+var proofMagic = []byte("MFUP")
+
+var (
+	ErrInvalidProofFormat = errors.New("invalid serialized merkle proof")
+)
+
+// Proof is a self-describing Merkle proof: besides the steps from the leaf to the root, it tells the tree they lead to,
+// i.e. its hash algorithm, params, number of leaves and root hash, so that it can be stored and verified on its own,
+// long after the tree is gone. See VerifyProofEnvelope.
+type Proof struct {
+	// Version is the version of the format of the tree header, see TreeFormatVersion.
+	Version       uint8       `json:"version"`
+	HashAlgorithm string      `json:"hashAlgorithm"`
+	Index         int         `json:"index"`
+	LeafCount     int         `json:"leafCount"`
+	RootHash      Digest      `json:"rootHash"`
+	Steps         []ProofStep `json:"steps"`
+	Params
+}
+
+// ProofStep is a step of a Proof, from a node on the path of the leaf to its parent:
+// Siblings are the siblings of the node, left to right, and Position the position of the node among its siblings.
+// In binary trees, a node at position 0 is the left child, and its only sibling goes on the right.
+type ProofStep struct {
+	Siblings []Digest `json:"siblings"`
+	Position int      `json:"position"`
+}
+
+// Proof generates the proof of the leaf at position i (0-based), as ProofForIndex does, in its self-describing envelope.
+func (t *Tree) Proof(i int) (proof *Proof, err error) {
+	hashes, err := t.ProofForIndex(i)
+	if err != nil {
+		return
+	}
+
+	return newProof(t.Header(), t.RootHash(), i, hashes), nil
+}
+
+// Proof generates the proof of the leaf at position i (0-based), as ProofForIndex does, in its self-describing envelope.
+func (m *MountainRange) Proof(i int) (proof *Proof, err error) {
+	hashes, err := m.ProofForIndex(i)
+	if err != nil {
+		return
+	}
+
+	return newProof(m.Header(), m.RootHash(), i, hashes), nil
+}
+
+func newProof(header TreeHeader, rootHash Digest, index int, hashes []ProofHash) *Proof {
+	proof := &Proof{
+		Version:       header.Version,
+		HashAlgorithm: header.HashAlgorithm,
+		Index:         index,
+		LeafCount:     header.LeafCount,
+		RootHash:      rootHash,
+		Steps:         make([]ProofStep, len(hashes)),
+		Params:        header.Params,
+	}
+
+	for i, p := range hashes {
+		switch {
+		case header.Arity != 2:
+			proof.Steps[i] = ProofStep{Siblings: append([]Digest{}, p.Siblings...), Position: p.Index}
+		case p.Position == "L":
+			// The sibling goes on the right of the node
+			proof.Steps[i] = ProofStep{Siblings: []Digest{p.Hash}, Position: 0}
+		default:
+			proof.Steps[i] = ProofStep{Siblings: []Digest{p.Hash}, Position: 1}
+		}
+	}
+
+	return proof
+}
+
+// Hashes returns the steps of the proof as ProofForIndex does, to be verified with VerifyProof.
+// It fails if a step can't be found in the proofs of trees of the params of the proof.
+func (p *Proof) Hashes() (hashes []ProofHash, err error) {
+	hashes = make([]ProofHash, len(p.Steps))
+	for i, step := range p.Steps {
+		if p.Arity != 2 {
+			hashes[i] = ProofHash{Siblings: step.Siblings, Index: step.Position}
+
+			continue
+		}
+
+		if len(step.Siblings) != 1 || step.Position < 0 || step.Position > 1 {
+			return nil, fmt.Errorf("%w: step %d of a binary tree", ErrInvalidProofFormat, i)
+		}
+
+		if step.Position == 0 {
+			hashes[i] = ProofHash{Hash: step.Siblings[0], Position: "L"}
+		} else {
+			hashes[i] = ProofHash{Hash: step.Siblings[0], Position: "R"}
+		}
+	}
+
+	return
+}
+
+// VerifyProofEnvelope verifies a self-describing proof for a given block, at leaf position index (0-based), and root hash,
+// as VerifyProof does. The options describe the tree the proof is expected to come from, e.g. WithMode:
+// the proof is rejected unless it's been generated from a tree of the same params and hash algorithm,
+// and, when WithLeafCount is given, the same number of leaves.
+func VerifyProofEnvelope(rootHash Digest, index int, block []byte, proof *Proof, hasher Hasher, opts ...Option) bool {
+	t := newTree(hasher, opts...)
+
+	return t.verifyProofEnvelope(rootHash, index, t.Mode.hashLeaf(block, hasher), proof)
+}
+
+// VerifyLeafProofEnvelope verifies a self-describing proof for the leaf hash at position index (0-based),
+// as VerifyProofEnvelope does for a block.
+func VerifyLeafProofEnvelope(rootHash Digest, index int, leafHash Digest, proof *Proof, hasher Hasher, opts ...Option) bool {
+	return newTree(hasher, opts...).verifyProofEnvelope(rootHash, index, leafHash, proof)
+}
+
+func (t *Tree) verifyProofEnvelope(rootHash Digest, index int, leafHash Digest, proof *Proof) bool {
+	if proof == nil || proof.Version < 1 || proof.Version > TreeFormatVersion {
+		return false
+	}
+
+	// The proof must come from the expected tree
+	if proof.HashAlgorithm != t.HashAlgorithm || proof.Params != t.Params || proof.Index != index || !proof.RootHash.Equal(rootHash) {
+		return false
+	}
+	if t.LeafCount != 0 && proof.LeafCount != t.LeafCount {
+		return false
+	}
+
+	hashes, err := proof.Hashes()
+	if err != nil {
+		return false
+	}
+	t.LeafCount = proof.LeafCount
+
+	return t.verifyLeafHash(rootHash, index, leafHash, hashes)
+}
+
+// MarshalBinary encodes the proof in a compact binary format: the header of the tree it's been generated from,
+// see TreeHeader, with its own magic "MFUP", followed by, all integers being big-endian:
+//
+//	index u64 | root hash | step count u8 | steps
+//
+// each step being: position u8 | sibling count u8 | siblings, each taking hash size bytes.
+func (p *Proof) MarshalBinary() (proofBytes []byte, err error) {
+	header := TreeHeader{
+		Version:       p.Version,
+		HashAlgorithm: p.HashAlgorithm,
+		HashSize:      len(p.RootHash),
+		LeafCount:     p.LeafCount,
+		Params:        p.Params,
+	}
+	if p.Version < 1 || p.Version > TreeFormatVersion {
+		return nil, fmt.Errorf("%w: %w: %d", ErrInvalidProofFormat, ErrUnsupportedTreeFormatVersion, p.Version)
+	}
+	if len(p.Steps) > 0xff {
+		return nil, fmt.Errorf("%w: too many steps", ErrInvalidProofFormat)
+	}
+
+	var buf bytes.Buffer
+	if err = writeHeader(&buf, proofMagic, header); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidProofFormat, err)
+	}
+
+	buf.Write(binary.BigEndian.AppendUint64(nil, uint64(p.Index)))
+	buf.Write(p.RootHash)
+	buf.WriteByte(uint8(len(p.Steps)))
+	for _, step := range p.Steps {
+		if step.Position < 0 || step.Position > 0xff || len(step.Siblings) > 0xff {
+			return nil, fmt.Errorf("%w: invalid step", ErrInvalidProofFormat)
+		}
+
+		buf.Write([]byte{uint8(step.Position), uint8(len(step.Siblings))})
+		if err = writeNodes(&buf, header, step.Siblings); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidProofFormat, err)
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary decodes a proof encoded by MarshalBinary.
+func (p *Proof) UnmarshalBinary(proofBytes []byte) (err error) {
+	r := bytes.NewReader(proofBytes)
+	header, err := readHeader(r, proofMagic)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidProofFormat, err)
+	}
+
+	fixed := make([]byte, 8)
+	if _, err = io.ReadFull(r, fixed); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidProofFormat, err)
+	}
+	index := binary.BigEndian.Uint64(fixed)
+	if index >= uint64(header.LeafCount) {
+		return fmt.Errorf("%w: index %d", ErrInvalidProofFormat, index)
+	}
+
+	rootHash, err := readNodes(r, header, 1)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidProofFormat, err)
+	}
+
+	stepCount, err := r.ReadByte()
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidProofFormat, err)
+	}
+
+	steps := make([]ProofStep, stepCount)
+	for i := range steps {
+		if _, err = io.ReadFull(r, fixed[:2]); err != nil {
+			return fmt.Errorf("%w: %s", ErrInvalidProofFormat, err)
+		}
+
+		steps[i].Position = int(fixed[0])
+		if steps[i].Siblings, err = readNodes(r, header, int(fixed[1])); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidProofFormat, err)
+		}
+	}
+
+	if r.Len() > 0 {
+		return fmt.Errorf("%w: %d trailing bytes", ErrInvalidProofFormat, r.Len())
+	}
+
+	*p = Proof{
+		Version:       header.Version,
+		HashAlgorithm: header.HashAlgorithm,
+		Index:         int(index),
+		LeafCount:     header.LeafCount,
+		RootHash:      rootHash[0],
+		Steps:         steps,
+		Params:        header.Params,
+	}
+
+	return
+}
@@ -0,0 +1,216 @@
+package merkle
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProofEnvelope(t *testing.T) {
+	algorithm, err := HashAlgorithm(SHA256)
+	assert.NoError(t, err)
+
+	blocks := blocksOf("A", "B", "C", "D", "E", "F", "G")
+
+	paramsCases := map[string]Params{
+		"legacy":              {},
+		"duplicate":           {Mode: ModeRFC6962},
+		"promote, leaf count": {Mode: ModeRFC6962, OddNodes: OddNodesPromote, CommitLeafCount: true},
+		"4-ary":               {Mode: ModeRFC6962, Arity: 4},
+	}
+
+	for name, params := range paramsCases {
+		t.Run(name, func(t *testing.T) {
+			tree, err := NewTree(blocks, algorithm, WithParams(params))
+			assert.NoError(t, err)
+			opts := []Option{WithParams(params)}
+
+			for i, block := range blocks {
+				proof, err := tree.Proof(i)
+				assert.NoError(t, err)
+				assert.Equal(t, TreeFormatVersion, int(proof.Version))
+				assert.Equal(t, len(blocks), proof.LeafCount)
+				assert.Equal(t, tree.RootHash(), proof.RootHash)
+
+				// The steps are the ones of ProofForIndex
+				hashes, err := proof.Hashes()
+				assert.NoError(t, err)
+				treeProof, err := tree.ProofForIndex(i)
+				assert.NoError(t, err)
+				assert.Equal(t, treeProof, hashes)
+
+				// The leaf count comes with the proof
+				assert.True(t, VerifyProofEnvelope(tree.RootHash(), i, block, proof, algorithm, opts...))
+				assert.True(t, VerifyProofEnvelope(tree.RootHash(), i, block, proof, algorithm, append(opts, WithLeafCount(len(blocks)))...))
+				assert.False(t, VerifyProofEnvelope(tree.RootHash(), i, []byte("X"), proof, algorithm, opts...))
+
+				// Both encodings round trip
+				proofBytes, err := proof.MarshalBinary()
+				assert.NoError(t, err)
+				var decoded Proof
+				assert.NoError(t, decoded.UnmarshalBinary(proofBytes))
+				assert.Equal(t, proof, &decoded)
+
+				proofJson, err := json.Marshal(proof)
+				assert.NoError(t, err)
+				decoded = Proof{}
+				assert.NoError(t, json.Unmarshal(proofJson, &decoded))
+				assert.Equal(t, proof, &decoded)
+				assert.True(t, VerifyProofEnvelope(tree.RootHash(), i, block, &decoded, algorithm, opts...))
+			}
+		})
+	}
+}
+
+func TestProofEnvelopeMountainRange(t *testing.T) {
+	mountainRange, err := NewMountainRange(h, WithOddNodes(OddNodesPromote))
+	assert.NoError(t, err)
+
+	blocks := blocksOf("A", "B", "C", "D", "E")
+	for _, block := range blocks {
+		mountainRange.Append(block)
+	}
+
+	tree, err := NewTree(blocks, h, WithOddNodes(OddNodesPromote))
+	assert.NoError(t, err)
+
+	for i, block := range blocks {
+		proof, err := mountainRange.Proof(i)
+		assert.NoError(t, err)
+		treeProof, err := tree.Proof(i)
+		assert.NoError(t, err)
+		assert.Equal(t, treeProof, proof)
+		assert.True(t, VerifyProofEnvelope(mountainRange.RootHash(), i, block, proof, h, WithOddNodes(OddNodesPromote)))
+	}
+}
+
+func TestProofEnvelopeMismatch(t *testing.T) {
+	algorithm, err := HashAlgorithm(SHA256)
+	assert.NoError(t, err)
+	other, err := HashAlgorithm(SHA3_256)
+	assert.NoError(t, err)
+
+	blocks := blocksOf("A", "B", "C", "D", "E")
+	opts := []Option{WithMode(ModeRFC6962), WithOddNodes(OddNodesPromote)}
+
+	tree, err := NewTree(blocks, algorithm, opts...)
+	assert.NoError(t, err)
+
+	proof, err := tree.Proof(2)
+	assert.NoError(t, err)
+	assert.True(t, VerifyProofEnvelope(tree.RootHash(), 2, []byte("C"), proof, algorithm, opts...))
+
+	changed := func(change func(p *Proof)) *Proof {
+		changed := *proof
+		changed.Steps = append([]ProofStep{}, proof.Steps...)
+		change(&changed)
+
+		return &changed
+	}
+
+	cases := map[string]struct {
+		index  int
+		proof  *Proof
+		hasher Hasher
+		opts   []Option
+	}{
+		"no proof": {},
+		"unknown version": {
+			proof: changed(func(p *Proof) { p.Version = TreeFormatVersion + 1 }),
+		},
+		"other hash algorithm": {
+			proof:  proof,
+			hasher: other,
+		},
+		"recorded hash algorithm": {
+			proof: changed(func(p *Proof) { p.HashAlgorithm = SHA3_256 }),
+		},
+		"other mode": {
+			proof: proof,
+			opts:  []Option{WithMode(ModeLegacy)},
+		},
+		"recorded params": {
+			proof: changed(func(p *Proof) { p.CommitLeafCount = true }),
+		},
+		"other leaf count": {
+			proof: proof,
+			opts:  []Option{WithLeafCount(6)},
+		},
+		"recorded leaf count": {
+			proof: changed(func(p *Proof) { p.LeafCount = 9 }),
+		},
+		"other index": {
+			index: 3,
+			proof: proof,
+		},
+		"recorded index": {
+			proof: changed(func(p *Proof) { p.Index = 3 }),
+		},
+		"recorded root hash": {
+			proof: changed(func(p *Proof) { p.RootHash = algorithm.Digest([]byte("X")) }),
+		},
+		"other position": {
+			proof: changed(func(p *Proof) {
+				p.Steps[0] = ProofStep{Siblings: p.Steps[0].Siblings, Position: 1 - p.Steps[0].Position}
+			}),
+		},
+		"two siblings in a binary tree": {
+			proof: changed(func(p *Proof) {
+				p.Steps[0] = ProofStep{Siblings: append(p.Steps[0].Siblings, p.Steps[0].Siblings...), Position: 0}
+			}),
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			index, hasher := 2, Hasher(algorithm)
+			if tc.index != 0 {
+				index = tc.index
+			}
+			if tc.hasher != nil {
+				hasher = tc.hasher
+			}
+
+			assert.False(t, VerifyProofEnvelope(tree.RootHash(), index, []byte("C"), tc.proof, hasher, append(opts, tc.opts...)...))
+		})
+	}
+}
+
+func TestProofEnvelopeBinaryInvalid(t *testing.T) {
+	tree, err := NewTree(blocksOf("A", "B", "C"), h, WithMode(ModeRFC6962))
+	assert.NoError(t, err)
+
+	proof, err := tree.Proof(1)
+	assert.NoError(t, err)
+	proofBytes, err := proof.MarshalBinary()
+	assert.NoError(t, err)
+
+	treeBytes, err := tree.Serialize()
+	assert.NoError(t, err)
+
+	cases := map[string][]byte{
+		"empty":          nil,
+		"tree":           treeBytes,
+		"truncated":      proofBytes[:len(proofBytes)-1],
+		"trailing bytes": append(append([]byte{}, proofBytes...), 0),
+	}
+
+	for name, proofBytes := range cases {
+		t.Run(name, func(t *testing.T) {
+			var decoded Proof
+			assert.ErrorIs(t, decoded.UnmarshalBinary(proofBytes), ErrInvalidProofFormat)
+		})
+	}
+
+	// The index must be one of the leaves
+	outOfRange := *proof
+	outOfRange.Index = 3
+	outOfRangeBytes, err := outOfRange.MarshalBinary()
+	assert.NoError(t, err)
+	var decoded Proof
+	assert.ErrorIs(t, decoded.UnmarshalBinary(outOfRangeBytes), ErrInvalidProofFormat)
+
+	// The binary format is compact
+	assert.Len(t, proofBytes, len(proofMagic)+fixedHeaderSize(TreeFormatVersion)+len(proof.HashAlgorithm)+8+32+1+2*(2+32))
+}
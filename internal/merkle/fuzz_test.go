@@ -0,0 +1,215 @@
+package merkle
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fuzzParams picks the params of a fuzzed tree from the bits of b: mode, odd nodes, leaf count commitment and arity.
+func fuzzParams(b uint8) Params {
+	return Params{
+		Mode:            Mode(b & 1),
+		OddNodes:        OddNodes(b >> 1 & 1),
+		CommitLeafCount: b>>2&1 == 1,
+		Arity:           Arities[b>>3&3],
+	}
+}
+
+// fuzzBlocks splits data into at most 64 blocks, separated by commas.
+func fuzzBlocks(data []byte) [][]byte {
+	blocks := bytes.Split(data, []byte(","))
+	if len(blocks) > 64 {
+		blocks = blocks[:64]
+	}
+
+	return blocks
+}
+
+func FuzzTree(f *testing.F) {
+	f.Add([]byte("A"), uint8(0))
+	f.Add([]byte("A,B,C"), uint8(1))
+	f.Add([]byte("A,B,C,D,E"), uint8(3))
+	f.Add([]byte("A,A,A"), uint8(7))
+	f.Add([]byte(",,,,,,,,,"), uint8(9))
+	f.Add([]byte("A,B,C,D,E,F,G,H,I,J,K,L,M,N,O,P,Q"), uint8(26))
+	f.Add([]byte("AB,,CD,E"), uint8(31))
+
+	f.Fuzz(func(t *testing.T, data []byte, b uint8) {
+		params := fuzzParams(b)
+		blocks := fuzzBlocks(data)
+		opts := []Option{WithParams(params), WithLeafCount(len(blocks))}
+
+		tree, err := NewTree(blocks, h, WithParams(params))
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		// A tree of other leaves, hence another root hash
+		otherBlocks := append([][]byte{}, blocks...)
+		otherBlocks[len(blocks)/2] = append([]byte("other "), blocks[len(blocks)/2]...)
+		other, err := NewTree(otherBlocks, h, WithParams(params))
+		if !assert.NoError(t, err) || !assert.NotEqual(t, tree.RootHash(), other.RootHash()) {
+			return
+		}
+
+		for i, block := range blocks {
+			proof, err := tree.ProofForIndex(i)
+			if !assert.NoError(t, err) {
+				return
+			}
+
+			// Every leaf verifies
+			assert.True(t, VerifyProof(tree.RootHash(), i, block, proof, h, opts...), "leaf %d", i)
+
+			// ProofForBlock proves the first leaf of the same content
+			first := 0
+			for !bytes.Equal(blocks[first], block) {
+				first++
+			}
+			assert.True(t, VerifyProof(tree.RootHash(), first, block, tree.ProofForBlock(block), h, opts...), "leaf %d", first)
+
+			// Tampered leaves fail
+			assert.False(t, VerifyProof(tree.RootHash(), i, append([]byte("tampered "), block...), proof, h, opts...))
+
+			// Tampered siblings fail, but the copies padding odd levels of binary trees, which aren't hashed.
+			// In k-ary trees, the last node of a level may be alone in its group, without siblings.
+			var padding []bool
+			if params.Arity == 2 {
+				_, padding, _ = newTree(h, opts...).path(i, len(proof))
+			}
+			for step := range proof {
+				siblings := len(proof[step].Siblings)
+				if params.Arity == 2 {
+					siblings = 1
+				}
+				if padding != nil && padding[step] {
+					continue
+				}
+
+				for sibling := 0; sibling < siblings; sibling++ {
+					tampered := tamperProof(proof, step, sibling)
+					assert.False(t, VerifyProof(tree.RootHash(), i, block, tampered, h, opts...), "leaf %d, step %d", i, step)
+				}
+			}
+
+			// Proofs never verify against another root
+			assert.False(t, VerifyProof(other.RootHash(), i, block, proof, h, opts...), "leaf %d", i)
+		}
+	})
+}
+
+// tamperProof returns a copy of proof with a bit of the given sibling of step flipped.
+func tamperProof(proof []ProofHash, step, sibling int) []ProofHash {
+	tampered := append([]ProofHash{}, proof...)
+	flip := func(d Digest) Digest {
+		d = append(Digest{}, d...)
+		d[0] ^= 1
+
+		return d
+	}
+
+	if p := tampered[step]; p.Hash != nil {
+		tampered[step].Hash = flip(p.Hash)
+	} else {
+		tampered[step].Siblings = append([]Digest{}, p.Siblings...)
+		tampered[step].Siblings[sibling] = flip(p.Siblings[sibling])
+	}
+
+	return tampered
+}
+
+func FuzzDeserialize(f *testing.F) {
+	algorithm, err := HashAlgorithm(SHA256)
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	for b := uint8(0); b < 32; b++ {
+		tree, err := NewTree(blocksOf("A", "B", "C", "D", "E"), algorithm, WithParams(fuzzParams(b)))
+		if err != nil {
+			f.Fatal(err)
+		}
+
+		treeBytes, err := tree.Serialize()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(treeBytes)
+	}
+
+	var buf bytes.Buffer
+	if err = gob.NewEncoder(&buf).Encode(gobTree{
+		Root:      &gobNode{Hash: Digest{1}, Left: &gobNode{Hash: Digest{2}}, Right: &gobNode{Hash: Digest{3}}},
+		LeafCount: 2,
+	}); err != nil {
+		f.Fatal(err)
+	}
+	f.Add(buf.Bytes())
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		tree, err := Deserialize(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+
+		if tree.Hasher == nil {
+			tree.Hasher = h
+		}
+
+		// A tree read back can be used, and serialized again as it is
+		tree.RootHash()
+		_, err = tree.ProofForIndex(0)
+		assert.NoError(t, err)
+		_, err = tree.ProofForIndex(tree.leafCount() - 1)
+		assert.NoError(t, err)
+
+		treeBytes, err := tree.Serialize()
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		deserialized, err := Deserialize(bytes.NewReader(treeBytes))
+		if assert.NoError(t, err) {
+			assert.Equal(t, tree.Nodes, deserialized.Nodes)
+			assert.Equal(t, tree.Params, deserialized.Params)
+		}
+	})
+}
+
+func FuzzProofEnvelope(f *testing.F) {
+	for b := uint8(0); b < 32; b++ {
+		tree, err := NewTree(blocksOf("A", "B", "C", "D", "E"), h, WithParams(fuzzParams(b)))
+		if err != nil {
+			f.Fatal(err)
+		}
+
+		proof, err := tree.Proof(int(b) % 5)
+		if err != nil {
+			f.Fatal(err)
+		}
+
+		proofBytes, err := proof.MarshalBinary()
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(proofBytes)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var proof Proof
+		if err := proof.UnmarshalBinary(data); err != nil {
+			return
+		}
+
+		// A proof read back can be verified, and encoded again as it is
+		VerifyProofEnvelope(proof.RootHash, proof.Index, []byte("A"), &proof, h, WithParams(proof.Params))
+
+		proofBytes, err := proof.MarshalBinary()
+		if assert.NoError(t, err) {
+			assert.Equal(t, data, proofBytes)
+		}
+	})
+}
@@ -0,0 +1,66 @@
+package merkle
+
+import (
+	"bytes"
+	"encoding/hex"
+	"hash"
+)
+
+// Digest is a raw hash value. It is encoded as hex only at the edges: in its string form and in JSON.
+type Digest []byte
+
+func ParseDigest(s string) (Digest, error) {
+	return hex.DecodeString(s)
+}
+
+func (d Digest) String() string {
+	return hex.EncodeToString(d)
+}
+
+func (d Digest) Equal(other Digest) bool {
+	return bytes.Equal(d, other)
+}
+
+func (d Digest) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Digest) UnmarshalText(text []byte) (err error) {
+	*d, err = ParseDigest(string(text))
+
+	return
+}
+
+// Hasher computes raw digests. It must be safe for concurrent use, see WithHashWorkers.
+type Hasher interface {
+	// Digest returns the hash of the concatenation of parts.
+	Digest(parts ...[]byte) Digest
+}
+
+// HashFactory adapts a hash.Hash constructor, such as sha256.New, to a Hasher.
+type HashFactory func() hash.Hash
+
+func (f HashFactory) Digest(parts ...[]byte) Digest {
+	hasher := f()
+	for _, p := range parts {
+		hasher.Write(p)
+	}
+
+	return hasher.Sum(nil)
+}
+
+// HashFn is the string-based hash function the package used to be built on, returning hex digests.
+// It's kept as a compatibility adapter: the hex digests it returns are decoded into raw ones.
+type HashFn func(string) string
+
+func (fn HashFn) Digest(parts ...[]byte) Digest {
+	h := fn(string(bytes.Join(parts, nil)))
+
+	d, err := hex.DecodeString(h)
+	if err != nil {
+		// not a hex digest, hence it's used as it is
+		return Digest(h)
+	}
+
+	return d
+}
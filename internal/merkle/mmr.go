@@ -0,0 +1,271 @@
+package merkle
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"math/bits"
+)
+
+var (
+	ErrMountainRangeParams = errors.New("mountain ranges are binary trees promoting odd nodes")
+)
+
+// mountainRangeMagic starts every serialized mountain range, whose header is the one of trees, see TreeHeader.
+var mountainRangeMagic = []byte("MFUR")
+
+// Prover generates the proofs of a set of leaves: it's implemented by Tree and MountainRange.
+type Prover interface {
+	RootHash() Digest
+	LeafHash(index int) (Digest, error)
+	ProofForIndex(i int) ([]ProofHash, error)
+	Proof(i int) (*Proof, error)
+	MultiProofForIndices(indices []int) (*MultiProof, error)
+	ConsistencyProof(oldSize int) ([]Digest, error)
+	Header() TreeHeader
+}
+
+var _ Prover = (*Tree)(nil)
+var _ Prover = (*MountainRange)(nil)
+
+// MountainRange is a Merkle Mountain Range: an append-only list of perfect binary trees, the mountains,
+// of strictly decreasing heights, one for each bit set in the number of leaves.
+// Appending a leaf hashes at most one node per level, merging the mountains of the same height, and never changes
+// the other nodes: there is no rebalancing, unlike appending to a Tree, which is rebuilt.
+//
+// Its root hash bags the peaks of the mountains from right to left, which is the root hash of the Tree of the same leaves
+// promoting odd nodes: its proofs are the ones of the tree, verified with VerifyProof and VerifyConsistency,
+// and consistency proofs tell whether the peaks bag of an earlier range is a prefix.
+type MountainRange struct {
+	// Levels holds the nodes of the mountains level by level, from the leaves up, each level left to right.
+	// A level has half the nodes of the one below, rounded down: the last node of an odd level is a peak,
+	// waiting for a mountain of the same height to be appended.
+	Levels        [][]Digest
+	LeafCount     int
+	HashAlgorithm string
+	Hasher        Hasher
+	Params
+}
+
+// NewMountainRange creates an empty mountain range, to be appended to.
+// Options are the ones of NewTree: the range must be binary and promote odd nodes.
+func NewMountainRange(hasher Hasher, opts ...Option) (m *MountainRange, err error) {
+	t := newTree(hasher, opts...)
+	if t.OddNodes != OddNodesPromote || t.Arity != 2 {
+		return nil, ErrMountainRangeParams
+	}
+
+	return &MountainRange{
+		HashAlgorithm: t.HashAlgorithm,
+		Hasher:        hasher,
+		Params:        t.Params,
+	}, nil
+}
+
+// Append appends a leaf holding the given block, in O(log n).
+func (m *MountainRange) Append(block []byte) {
+	m.AppendLeafHash(m.Mode.hashLeaf(block, m.Hasher))
+}
+
+// AppendLeafHash appends a leaf of the given hash, e.g. computed by FileLeafHash, in O(log n).
+func (m *MountainRange) AppendLeafHash(leafHash Digest) {
+	if len(m.Levels) == 0 {
+		m.Levels = [][]Digest{nil}
+	}
+	m.Levels[0] = append(m.Levels[0], leafHash)
+	m.LeafCount++
+
+	// Merge the two last mountains as long as they have the same height
+	for level := 0; len(m.Levels[level])%2 == 0; level++ {
+		nodes := m.Levels[level]
+		parent := m.Mode.hashChildren(nodes[len(nodes)-2], nodes[len(nodes)-1], m.Hasher)
+		if level+1 == len(m.Levels) {
+			m.Levels = append(m.Levels, nil)
+		}
+		m.Levels[level+1] = append(m.Levels[level+1], parent)
+	}
+}
+
+// AppendLeafHashes appends leaves of the given hashes, as AppendLeafHash does.
+func (m *MountainRange) AppendLeafHashes(leafHashes []Digest) {
+	for _, leafHash := range leafHashes {
+		m.AppendLeafHash(leafHash)
+	}
+}
+
+// Clone returns a copy of the range, to be appended to while the range itself is left untouched.
+func (m *MountainRange) Clone() *MountainRange {
+	clone := *m
+	clone.Levels = make([][]Digest, len(m.Levels))
+	for level, nodes := range m.Levels {
+		clone.Levels[level] = append([]Digest{}, nodes...)
+	}
+
+	return &clone
+}
+
+// Peaks returns the hashes of the peaks of the mountains, from the highest one on the left to the lowest one.
+func (m *MountainRange) Peaks() (peaks []Digest) {
+	for level := len(m.Levels) - 1; level >= 0; level-- {
+		if nodes := m.Levels[level]; len(nodes)%2 == 1 {
+			peaks = append(peaks, nodes[len(nodes)-1])
+		}
+	}
+
+	return
+}
+
+// RootHash returns the root hash of the range: the bag of its peaks, from right to left,
+// committing to its number of leaves when required. An empty range has no root hash.
+func (m *MountainRange) RootHash() Digest {
+	peaks := m.Peaks()
+	if len(peaks) == 0 {
+		return nil
+	}
+
+	bag := peaks[len(peaks)-1]
+	for i := len(peaks) - 2; i >= 0; i-- {
+		bag = m.Mode.hashChildren(peaks[i], bag, m.Hasher)
+	}
+
+	if !m.CommitLeafCount {
+		return bag
+	}
+
+	return m.Mode.hashLeafCount(m.LeafCount, bag, m.Hasher)
+}
+
+// LeafHash returns the hash of the leaf at index (0-based).
+func (m *MountainRange) LeafHash(index int) (leafHash Digest, err error) {
+	if index < 0 || index >= m.LeafCount {
+		return nil, ErrIndexOutOfRange
+	}
+
+	return m.Levels[0][index], nil
+}
+
+// ProofForIndex generates a Merkle proof for the leaf at position i (0-based): the siblings of the leaf
+// up to the peak of its mountain, then the peaks, or bags of peaks, it's bagged with.
+func (m *MountainRange) ProofForIndex(i int) (proof []ProofHash, err error) {
+	if i < 0 || i >= m.LeafCount {
+		return nil, ErrIndexOutOfRange
+	}
+
+	for lo, hi := 0, m.LeafCount; hi-lo > 1; {
+		mid := lo + splitPoint(hi-lo)
+		if i < mid {
+			proof, hi = append(proof, ProofHash{Hash: m.subtree(mid, hi), Position: "L"}), mid
+		} else {
+			proof, lo = append(proof, ProofHash{Hash: m.subtree(lo, mid), Position: "R"}), mid
+		}
+	}
+	reverse(proof)
+
+	return
+}
+
+// MultiProofForIndices generates a multiproof for the leaves at the given positions (0-based),
+// which must be sorted in increasing order.
+func (m *MountainRange) MultiProofForIndices(indices []int) (proof *MultiProof, err error) {
+	if err = validateIndices(indices, m.LeafCount); err != nil {
+		return
+	}
+
+	return multiProof(indices, m.LeafCount, m.subtree, func(int) bool { return false }), nil
+}
+
+// ConsistencyProof generates a proof that the range made of the first oldSize leaves is a prefix of this range,
+// i.e. that the peaks bag of the earlier range is found in this one: see Tree.ConsistencyProof.
+func (m *MountainRange) ConsistencyProof(oldSize int) (proof []Digest, err error) {
+	if oldSize < 1 || oldSize > m.LeafCount {
+		return nil, ErrInvalidTreeSize
+	}
+
+	return consistencyProof(m.subtree, oldSize, m.LeafCount, m.CommitLeafCount), nil
+}
+
+// subtree returns the hash of the root of the subtree spanning the leaves [lo, hi), as found while descending
+// with splitPoint: a node of a mountain when it spans a power of two leaves, or else the bag of the ones it spans.
+func (m *MountainRange) subtree(lo, hi int) Digest {
+	if size := hi - lo; isPowerOfTwo(size) {
+		level := bits.TrailingZeros(uint(size))
+
+		return m.Levels[level][lo>>level]
+	}
+
+	mid := lo + splitPoint(hi-lo)
+
+	return m.Mode.hashChildren(m.subtree(lo, mid), m.subtree(mid, hi), m.Hasher)
+}
+
+// Header returns the header the range is serialized with.
+func (m *MountainRange) Header() TreeHeader {
+	header := TreeHeader{
+		Version:       TreeFormatVersion,
+		HashAlgorithm: m.HashAlgorithm,
+		LeafCount:     m.LeafCount,
+		Params:        m.Params,
+	}
+	if m.LeafCount > 0 {
+		header.HashSize = len(m.Levels[0][0])
+	}
+
+	return header
+}
+
+// Serialize encodes the range in the binary format of trees, see TreeHeader, with its own magic "MFUR".
+// The nodes follow level by level, from the leaves up.
+func (m *MountainRange) Serialize() (rangeBytes []byte, err error) {
+	if m.LeafCount == 0 {
+		return nil, ErrEmptyTreeInput
+	}
+
+	header := m.Header()
+
+	var buf bytes.Buffer
+	if err = writeHeader(&buf, mountainRangeMagic, header); err != nil {
+		return
+	}
+
+	for _, nodes := range m.Levels {
+		if err = writeNodes(&buf, header, nodes); err != nil {
+			return
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+// DeserializeMountainRange decodes a serialized mountain range, restoring its hasher from the recorded hash algorithm.
+func DeserializeMountainRange(r io.Reader) (m *MountainRange, err error) {
+	br := bufio.NewReader(r)
+	header, err := readHeader(br, mountainRangeMagic)
+	if err != nil {
+		return
+	}
+
+	if header.OddNodes != OddNodesPromote || header.Arity != 2 {
+		return nil, ErrMountainRangeParams
+	}
+
+	m = &MountainRange{
+		LeafCount:     header.LeafCount,
+		HashAlgorithm: header.HashAlgorithm,
+		Params:        header.Params,
+	}
+	if m.Hasher, err = header.hasher(); err != nil {
+		return nil, err
+	}
+
+	for size := header.LeafCount; size > 0; size /= 2 {
+		nodes, err := readNodes(br, header, size)
+		if err != nil {
+			return nil, err
+		}
+
+		m.Levels = append(m.Levels, nodes)
+	}
+
+	return
+}
@@ -0,0 +1,124 @@
+package merkle
+
+import (
+	"bytes"
+	"math/bits"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMountainRange(t *testing.T) {
+	paramsCases := map[string]Params{
+		"legacy, promote":     {OddNodes: OddNodesPromote},
+		"promote":             {Mode: ModeRFC6962, OddNodes: OddNodesPromote},
+		"promote, leaf count": {Mode: ModeRFC6962, OddNodes: OddNodesPromote, CommitLeafCount: true},
+	}
+
+	for name, params := range paramsCases {
+		t.Run(name, func(t *testing.T) {
+			mountainRange, err := NewMountainRange(h, WithParams(params))
+			assert.NoError(t, err)
+			assert.Nil(t, mountainRange.RootHash())
+
+			var blocks [][]byte
+			for n := 1; n <= 40; n++ {
+				block := []byte{byte(n - 1)}
+				blocks = append(blocks, block)
+
+				// Appending never changes the nodes already there
+				before := mountainRange.Clone()
+				mountainRange.Append(block)
+				for level, nodes := range before.Levels {
+					assert.Equal(t, nodes, mountainRange.Levels[level][:len(nodes)])
+				}
+				assert.Len(t, mountainRange.Peaks(), bits.OnesCount(uint(n)))
+
+				// The range has the root hash, and the proofs, of the tree of the same leaves
+				tree, err := NewTree(blocks, h, WithParams(params))
+				assert.NoError(t, err)
+				assert.Equal(t, tree.RootHash(), mountainRange.RootHash(), "%d leaves", n)
+				opts := []Option{WithParams(params), WithLeafCount(n)}
+
+				var indices []int
+				for i, block := range blocks {
+					proof, err := mountainRange.ProofForIndex(i)
+					assert.NoError(t, err)
+					treeProof, err := tree.ProofForIndex(i)
+					assert.NoError(t, err)
+					assert.Equal(t, treeProof, proof)
+					assert.True(t, VerifyProof(mountainRange.RootHash(), i, block, proof, h, opts...))
+
+					if i%3 == 0 {
+						indices = append(indices, i)
+					}
+				}
+
+				multiProof, err := mountainRange.MultiProofForIndices(indices)
+				assert.NoError(t, err)
+				treeMultiProof, err := tree.MultiProofForIndices(indices)
+				assert.NoError(t, err)
+				assert.Equal(t, treeMultiProof, multiProof)
+
+				// The peaks bag of every earlier range is a prefix
+				for oldSize := 1; oldSize <= n; oldSize++ {
+					oldTree, err := NewTree(blocks[:oldSize], h, WithParams(params))
+					assert.NoError(t, err)
+
+					proof, err := mountainRange.ConsistencyProof(oldSize)
+					assert.NoError(t, err)
+					assert.True(t, VerifyConsistency(oldTree.RootHash(), oldSize, mountainRange.RootHash(), n, proof, h, WithParams(params)))
+				}
+			}
+
+			_, err = mountainRange.ProofForIndex(40)
+			assert.ErrorIs(t, err, ErrIndexOutOfRange)
+			_, err = mountainRange.ConsistencyProof(41)
+			assert.ErrorIs(t, err, ErrInvalidTreeSize)
+		})
+	}
+}
+
+func TestMountainRangeSerialization(t *testing.T) {
+	algorithm, err := HashAlgorithm(SHA256)
+	assert.NoError(t, err)
+
+	mountainRange, err := NewMountainRange(algorithm, WithMode(ModeRFC6962), WithOddNodes(OddNodesPromote), WithLeafCountCommitment())
+	assert.NoError(t, err)
+
+	_, err = mountainRange.Serialize()
+	assert.ErrorIs(t, err, ErrEmptyTreeInput)
+
+	for _, block := range blocksOf("A", "B", "C", "D", "E", "F", "G") {
+		mountainRange.Append(block)
+	}
+
+	rangeBytes, err := mountainRange.Serialize()
+	assert.NoError(t, err)
+
+	deserialized, err := DeserializeMountainRange(bytes.NewReader(rangeBytes))
+	assert.NoError(t, err)
+	assert.Equal(t, mountainRange.Levels, deserialized.Levels)
+	assert.Equal(t, mountainRange.Params, deserialized.Params)
+	assert.Equal(t, mountainRange.RootHash(), deserialized.RootHash())
+
+	// Appending goes on after a round trip
+	deserialized.Append([]byte("H"))
+	tree, err := NewTree(blocksOf("A", "B", "C", "D", "E", "F", "G", "H"), algorithm, WithParams(mountainRange.Params))
+	assert.NoError(t, err)
+	assert.Equal(t, tree.RootHash(), deserialized.RootHash())
+
+	// Trees aren't mountain ranges
+	treeBytes, err := tree.Serialize()
+	assert.NoError(t, err)
+	_, err = DeserializeMountainRange(bytes.NewReader(treeBytes))
+	assert.ErrorIs(t, err, ErrInvalidTreeFormat)
+}
+
+func TestMountainRangeParams(t *testing.T) {
+	_, err := NewMountainRange(h, WithMode(ModeRFC6962))
+	assert.ErrorIs(t, err, ErrMountainRangeParams)
+
+	_, err = NewMountainRange(h, WithOddNodes(OddNodesPromote), WithArity(4))
+	assert.ErrorIs(t, err, ErrMountainRangeParams)
+}
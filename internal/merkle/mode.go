@@ -0,0 +1,117 @@
+package merkle
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrUnknownMode = errors.New("unknown merkle tree mode")
+)
+
+// Mode defines how leaves and internal nodes are hashed.
+type Mode uint8
+
+const (
+	// ModeLegacy hashes leaves as hash(data) and internal nodes as hash(hex(left) + hex(right)),
+	// i.e. it chains the hex-encoded digests, as the former string-based HashFn did.
+	// Trees built before domain separation and raw digests were introduced use this mode.
+	ModeLegacy Mode = iota
+
+	// ModeRFC6962 hashes leaves as hash(0x00 || data) and internal nodes as hash(0x01 || left || right),
+	// over raw digests (RFC 6962, 2.1), so that the concatenated children hashes of an internal node
+	// can't be passed off as a leaf.
+	ModeRFC6962
+)
+
+var (
+	leafPrefix      = []byte{0x00}
+	nodePrefix      = []byte{0x01}
+	leafCountPrefix = []byte{0x02}
+)
+
+var modeNames = map[Mode]string{
+	ModeLegacy:  "legacy",
+	ModeRFC6962: "rfc6962",
+}
+
+func ParseMode(name string) (Mode, error) {
+	for m, n := range modeNames {
+		if n == name {
+			return m, nil
+		}
+	}
+
+	return 0, fmt.Errorf("%w: %s", ErrUnknownMode, name)
+}
+
+func (m Mode) String() string {
+	if name, ok := modeNames[m]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("mode(%d)", m)
+}
+
+func (m Mode) MarshalText() ([]byte, error) {
+	if _, ok := modeNames[m]; !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownMode, m)
+	}
+
+	return []byte(m.String()), nil
+}
+
+func (m *Mode) UnmarshalText(text []byte) (err error) {
+	*m, err = ParseMode(string(text))
+
+	return
+}
+
+// hashLeaf computes the hash of a leaf holding the given data.
+func (m Mode) hashLeaf(data []byte, hasher Hasher) Digest {
+	if m == ModeRFC6962 {
+		return hasher.Digest(leafPrefix, data)
+	}
+
+	return hasher.Digest(data)
+}
+
+// hashChildren computes the hash of an internal node from the hashes of its children.
+func (m Mode) hashChildren(left, right Digest, hasher Hasher) Digest {
+	if m == ModeRFC6962 {
+		return hasher.Digest(nodePrefix, left, right)
+	}
+
+	return hasher.Digest([]byte(left.String() + right.String()))
+}
+
+// hashNode computes the hash of an internal node of a k-ary tree from the hashes of its children, left to right.
+// For two children, it's the same as hashChildren.
+func (m Mode) hashNode(children []Digest, hasher Hasher) Digest {
+	if m == ModeRFC6962 {
+		parts := [][]byte{nodePrefix}
+		for _, child := range children {
+			parts = append(parts, child)
+		}
+
+		return hasher.Digest(parts...)
+	}
+
+	var hexChildren []byte
+	for _, child := range children {
+		hexChildren = append(hexChildren, child.String()...)
+	}
+
+	return hasher.Digest(hexChildren)
+}
+
+// hashLeafCount commits the number of leaves into the root hash of a tree.
+func (m Mode) hashLeafCount(leafCount int, root Digest, hasher Hasher) Digest {
+	count := binary.BigEndian.AppendUint64(nil, uint64(leafCount))
+	if m == ModeRFC6962 {
+		return hasher.Digest(leafCountPrefix, count, root)
+	}
+
+	return hasher.Digest(count, root)
+}
@@ -0,0 +1,165 @@
+package merkle
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+var (
+	ErrInvalidIndices = errors.New("leaf indices must be a non-empty, strictly increasing sequence")
+)
+
+// MultiProof proves several leaves of the same tree at once.
+// Hashes holds the roots of the subtrees not containing any of the proven leaves, in depth-first order:
+// that's the smallest set of hashes needed to recompute the root, since sibling hashes shared by several leaves,
+// or computable from the proven leaves themselves, are never included.
+type MultiProof struct {
+	Indices []int
+	Hashes  []Digest
+}
+
+// MultiProofForIndices generates a multiproof for the leaves at the given positions (0-based),
+// which must be sorted in increasing order. Multiproofs are only available for binary trees.
+func (t *Tree) MultiProofForIndices(indices []int) (proof *MultiProof, err error) {
+	if t.Arity != 2 {
+		return nil, fmt.Errorf("%w: multiproofs require binary trees", ErrUnsupportedArity)
+	}
+	if err = validateIndices(indices, t.leafCount()); err != nil {
+		return
+	}
+
+	return multiProof(indices, t.width(), t.subtree, t.isPadding), nil
+}
+
+// multiProof generates the multiproof of the leaves at indices of a tree spanning width leaves,
+// subtree giving the hash of the subtree spanning the leaves [lo, hi), and isPadding telling the subtrees padding it.
+func multiProof(indices []int, width int, subtree func(lo, hi int) Digest, isPadding func(lo int) bool) (proof *MultiProof) {
+	proof = &MultiProof{Indices: indices}
+
+	// Walk down the subtrees containing at least one of the indices, collecting the roots of the other ones
+	var walk func(lo, hi int, indices []int)
+	walk = func(lo, hi int, indices []int) {
+		if len(indices) == 0 {
+			proof.Hashes = append(proof.Hashes, subtree(lo, hi))
+
+			return
+		}
+
+		if hi-lo == 1 {
+			// one of the proven leaves
+			return
+		}
+
+		mid := lo + splitPoint(hi-lo)
+		k := sort.SearchInts(indices, mid)
+
+		walk(lo, mid, indices[:k])
+		if isPadding(mid) {
+			// a copy of the left subtree, the verifier can compute it on its own
+			return
+		}
+		walk(mid, hi, indices[k:])
+	}
+
+	walk(0, width, indices)
+
+	return
+}
+
+// VerifyMultiProof verifies a multiproof for the given blocks, at the leaf positions listed in the proof, and root hash.
+// It returns true if the proof is valid, and false otherwise.
+// The options describe the tree the proof has been generated from: its number of leaves, set by WithLeafCount, is required.
+func VerifyMultiProof(rootHash Digest, blocks [][]byte, proof *MultiProof, hasher Hasher, opts ...Option) bool {
+	t := newTree(hasher, opts...)
+
+	leafHashes := make([]Digest, len(blocks))
+	for i, block := range blocks {
+		leafHashes[i] = t.Mode.hashLeaf(block, hasher)
+	}
+
+	return t.verifyMultiProof(rootHash, leafHashes, proof)
+}
+
+// VerifyLeafMultiProof verifies a multiproof for the given leaf hashes, as VerifyMultiProof does for blocks.
+func VerifyLeafMultiProof(rootHash Digest, leafHashes []Digest, proof *MultiProof, hasher Hasher, opts ...Option) bool {
+	return newTree(hasher, opts...).verifyMultiProof(rootHash, leafHashes, proof)
+}
+
+func (t *Tree) verifyMultiProof(rootHash Digest, leafHashes []Digest, proof *MultiProof) bool {
+	if proof == nil || len(leafHashes) != len(proof.Indices) || t.LeafCount == 0 || t.Arity != 2 {
+		return false
+	}
+	if err := validateIndices(proof.Indices, t.LeafCount); err != nil {
+		return false
+	}
+
+	hashes, nextLeaf := proof.Hashes, 0
+
+	// Recompute the root with the same walk the proof has been generated with,
+	// taking the hashes of the subtrees not containing any index from the proof
+	var compute func(lo, hi int, indices []int) (Digest, bool)
+	compute = func(lo, hi int, indices []int) (hash Digest, ok bool) {
+		if len(indices) == 0 {
+			if len(hashes) == 0 {
+				return nil, false
+			}
+			hash, hashes = hashes[0], hashes[1:]
+
+			return hash, true
+		}
+
+		if hi-lo == 1 {
+			hash = leafHashes[nextLeaf]
+			nextLeaf++
+
+			return hash, true
+		}
+
+		mid := lo + splitPoint(hi-lo)
+		k := sort.SearchInts(indices, mid)
+
+		left, ok := compute(lo, mid, indices[:k])
+		if !ok {
+			return
+		}
+
+		right := left
+		if !t.isPadding(mid) {
+			if right, ok = compute(mid, hi, indices[k:]); !ok {
+				return
+			}
+		}
+
+		return t.Mode.hashChildren(left, right, t.Hasher), true
+	}
+
+	root, ok := compute(0, t.Params.width(t.LeafCount), proof.Indices)
+
+	// The proof is valid if all of its hashes have been used, and the computed root hash matches
+	return ok && len(hashes) == 0 && t.rootHash(root).Equal(rootHash)
+}
+
+// isPadding tells whether the subtree starting at leaf position lo is made only of the copies
+// that pad odd levels when odd nodes are duplicated: in that case, it's a copy of its left sibling.
+func (t *Tree) isPadding(lo int) bool {
+	return t.OddNodes == OddNodesDuplicate && lo >= t.leafCount()
+}
+
+func validateIndices(indices []int, leafCount int) error {
+	if len(indices) == 0 {
+		return ErrInvalidIndices
+	}
+
+	for i, index := range indices {
+		if index < 0 || index >= leafCount {
+			return ErrIndexOutOfRange
+		}
+
+		if i > 0 && index <= indices[i-1] {
+			return ErrInvalidIndices
+		}
+	}
+
+	return nil
+}
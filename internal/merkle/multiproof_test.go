@@ -0,0 +1,105 @@
+package merkle
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMerkleMultiProof(t *testing.T) {
+	paramsCases := map[string]Params{
+		"duplicate":           {Mode: ModeRFC6962},
+		"promote, leaf count": {Mode: ModeRFC6962, OddNodes: OddNodesPromote, CommitLeafCount: true},
+		"legacy":              {},
+	}
+
+	for name, params := range paramsCases {
+		t.Run(name, func(t *testing.T) {
+			for n := 1; n <= 9; n++ {
+				var blocks [][]byte
+				for i := 0; i < n; i++ {
+					blocks = append(blocks, []byte{byte(i)})
+				}
+
+				tree, err := NewTree(blocks, h, WithParams(params))
+				assert.NoError(t, err)
+
+				// every non-empty subset of the leaves
+				for subset := 1; subset < 1<<n; subset++ {
+					var indices []int
+					var provenBlocks [][]byte
+					for i := 0; i < n; i++ {
+						if subset&(1<<i) != 0 {
+							indices = append(indices, i)
+							provenBlocks = append(provenBlocks, blocks[i])
+						}
+					}
+
+					proof, err := tree.MultiProofForIndices(indices)
+					assert.NoError(t, err)
+					assert.True(t, VerifyMultiProof(tree.RootHash(), provenBlocks, proof, h, WithParams(params), WithLeafCount(n)))
+
+					// A tampered block is rejected
+					tampered := append([][]byte{[]byte("X")}, provenBlocks[1:]...)
+					assert.False(t, VerifyMultiProof(tree.RootHash(), tampered, proof, h, WithParams(params), WithLeafCount(n)))
+				}
+			}
+		})
+	}
+}
+
+func TestMerkleMultiProofIsCompact(t *testing.T) {
+	blocks := blocksOf("A", "B", "C", "D", "E", "F", "G", "H")
+
+	tree, err := NewTree(blocks, h, WithMode(ModeRFC6962))
+	assert.NoError(t, err)
+
+	// The siblings of A and B are, respectively, B and A: only the roots of [C,D] and [E,F,G,H] are needed
+	proof, err := tree.MultiProofForIndices([]int{0, 1})
+	assert.NoError(t, err)
+	assert.Equal(t, []Digest{tree.levels[1][1], tree.levels[2][1]}, proof.Hashes)
+
+	proof, err = tree.MultiProofForIndices([]int{1, 4, 7})
+	assert.NoError(t, err)
+	assert.Len(t, proof.Hashes, 4)
+
+	// Duplicated nodes are never part of the proof
+	tree, err = NewTree(blocks[:5], h, WithMode(ModeRFC6962))
+	assert.NoError(t, err)
+
+	proof, err = tree.MultiProofForIndices([]int{4})
+	assert.NoError(t, err)
+	assert.Equal(t, []Digest{tree.levels[2][0]}, proof.Hashes)
+	assert.True(t, VerifyMultiProof(tree.RootHash(), blocks[4:5], proof, h, WithMode(ModeRFC6962), WithLeafCount(5)))
+}
+
+func TestMerkleMultiProofInvalid(t *testing.T) {
+	blocks := blocksOf("A", "B", "C", "D", "E")
+
+	tree, err := NewTree(blocks, h, WithMode(ModeRFC6962))
+	assert.NoError(t, err)
+
+	for _, indices := range [][]int{{}, {1, 1}, {3, 2}} {
+		_, err = tree.MultiProofForIndices(indices)
+		assert.ErrorIs(t, err, ErrInvalidIndices)
+	}
+
+	for _, indices := range [][]int{{-1}, {0, 5}} {
+		_, err = tree.MultiProofForIndices(indices)
+		assert.ErrorIs(t, err, ErrIndexOutOfRange)
+	}
+
+	proof, err := tree.MultiProofForIndices([]int{0, 2})
+	assert.NoError(t, err)
+
+	opts := []Option{WithMode(ModeRFC6962), WithLeafCount(5)}
+	provenBlocks := [][]byte{blocks[0], blocks[2]}
+	assert.True(t, VerifyMultiProof(tree.RootHash(), provenBlocks, proof, h, opts...))
+
+	// Blocks at other positions, a missing or an extra hash, or an unknown leaf count are rejected
+	assert.False(t, VerifyMultiProof(tree.RootHash(), provenBlocks, &MultiProof{[]int{0, 3}, proof.Hashes}, h, opts...))
+	assert.False(t, VerifyMultiProof(tree.RootHash(), provenBlocks, &MultiProof{proof.Indices, proof.Hashes[1:]}, h, opts...))
+	assert.False(t, VerifyMultiProof(tree.RootHash(), provenBlocks, &MultiProof{proof.Indices, append(proof.Hashes, proof.Hashes[0])}, h, opts...))
+	assert.False(t, VerifyMultiProof(tree.RootHash(), provenBlocks, proof, h, WithMode(ModeRFC6962)))
+	assert.False(t, VerifyMultiProof(tree.RootHash(), provenBlocks[:1], proof, h, opts...))
+}
@@ -0,0 +1,74 @@
+package merkle
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrUnknownOddNodes = errors.New("unknown odd nodes strategy")
+)
+
+// OddNodes defines what happens to the last node of a level with an odd number of nodes.
+type OddNodes uint8
+
+const (
+	// OddNodesDuplicate pairs the unpaired node with a copy of itself.
+	// Trees built before the strategy was selectable use it, although it's ambiguous:
+	// e.g. the blocks [A,B,C] and [A,B,C,C] produce the same root (see CVE-2012-2459).
+	OddNodesDuplicate OddNodes = iota
+
+	// OddNodesPromote moves the unpaired node up to the next level, as it is.
+	// The resulting tree has the shape of RFC 6962 (2.1) unbalanced trees:
+	// the left subtree of every node is the largest perfect tree fitting in it.
+	OddNodesPromote
+)
+
+var oddNodesNames = map[OddNodes]string{
+	OddNodesDuplicate: "duplicate",
+	OddNodesPromote:   "promote",
+}
+
+func ParseOddNodes(name string) (OddNodes, error) {
+	for o, n := range oddNodesNames {
+		if n == name {
+			return o, nil
+		}
+	}
+
+	return 0, fmt.Errorf("%w: %s", ErrUnknownOddNodes, name)
+}
+
+func (o OddNodes) String() string {
+	if name, ok := oddNodesNames[o]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("oddnodes(%d)", o)
+}
+
+func (o OddNodes) MarshalText() ([]byte, error) {
+	if _, ok := oddNodesNames[o]; !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownOddNodes, o)
+	}
+
+	return []byte(o.String()), nil
+}
+
+func (o *OddNodes) UnmarshalText(text []byte) (err error) {
+	*o, err = ParseOddNodes(string(text))
+
+	return
+}
+
+// splitPoint returns the size of the left subtree of a node spanning n > 1 leaves:
+// the largest power of two smaller than n.
+// With OddNodesDuplicate, trees span a power of two leaves, hence the split is always in the middle.
+func splitPoint(n int) (k int) {
+	k = 1
+	for k<<1 < n {
+		k <<= 1
+	}
+
+	return
+}
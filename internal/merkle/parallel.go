@@ -0,0 +1,66 @@
+package merkle
+
+import (
+	"sync"
+)
+
+// minHashesPerWorker is the least number of hashes worth handing to a worker of its own:
+// smaller levels are hashed on the calling goroutine.
+const minHashesPerWorker = 256
+
+// WithHashWorkers builds the tree with up to workers goroutines hashing its leaves, and each of its levels, at once.
+// The tree is the same whatever the number of workers: trees are built serially by default, or if workers is below 2.
+func WithHashWorkers(workers int) Option {
+	return func(t *Tree) {
+		t.hashWorkers = workers
+	}
+}
+
+// ComputeLeafHashes computes the hashes of count leaves, calling leafHash for each index
+// on up to workers goroutines at once, e.g. to hash many files with FileLeafHash.
+// The hashes are returned in order, or the first error encountered, if any.
+func ComputeLeafHashes(count, workers int, leafHash func(i int) (Digest, error)) (leafHashes []Digest, err error) {
+	leafHashes = make([]Digest, count)
+	errs := make([]error, count)
+
+	// Leaves may be expensive to hash on their own, e.g. when they are files: each one is worth a worker
+	forEach(count, workers, 1, func(i int) {
+		leafHashes[i], errs[i] = leafHash(i)
+	})
+
+	for _, err = range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return
+}
+
+// forEach calls fn for each index in [0, n), splitting the indices into contiguous ranges
+// of at least minPerWorker indices, each handled by one of up to workers goroutines.
+func forEach(n, workers, minPerWorker int, fn func(i int)) {
+	workers = min(workers, n/minPerWorker)
+	if workers < 2 {
+		for i := 0; i < n; i++ {
+			fn(i)
+		}
+
+		return
+	}
+
+	var wg sync.WaitGroup
+	size := (n + workers - 1) / workers
+	for lo := 0; lo < n; lo += size {
+		wg.Add(1)
+		go func(lo, hi int) {
+			defer wg.Done()
+
+			for i := lo; i < hi; i++ {
+				fn(i)
+			}
+		}(lo, min(lo+size, n))
+	}
+
+	wg.Wait()
+}
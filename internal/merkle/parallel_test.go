@@ -0,0 +1,103 @@
+package merkle
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParallelTree(t *testing.T) {
+	paramsCases := map[string]Params{
+		"legacy":              {},
+		"duplicate":           {Mode: ModeRFC6962},
+		"promote, leaf count": {Mode: ModeRFC6962, OddNodes: OddNodesPromote, CommitLeafCount: true},
+	}
+
+	for name, params := range paramsCases {
+		t.Run(name, func(t *testing.T) {
+			for _, n := range []int{1, 2, 3, 255, 256, 511, 1000, 4099} {
+				blocks := make([][]byte, n)
+				for i := range blocks {
+					blocks[i] = []byte(fmt.Sprintf("block %d", i))
+				}
+
+				serial, err := NewTree(blocks, h, WithParams(params))
+				assert.NoError(t, err)
+
+				// The tree is the same whatever the number of workers
+				for _, workers := range []int{0, 2, 3, 8} {
+					tree, err := NewTree(blocks, h, WithParams(params), WithHashWorkers(workers))
+					assert.NoError(t, err)
+					assert.Equal(t, serial.Nodes, tree.Nodes, "%d leaves, %d workers", n, workers)
+				}
+
+				if n > 1 {
+					prefix, err := NewTree(blocks[:n/2], h, WithParams(params))
+					assert.NoError(t, err)
+
+					appended, err := prefix.Append(blocks[n/2:], WithHashWorkers(4))
+					assert.NoError(t, err)
+					assert.Equal(t, serial.Nodes, appended.Nodes)
+					assert.Equal(t, serial.Params, appended.Params)
+				}
+			}
+		})
+	}
+}
+
+func TestComputeLeafHashes(t *testing.T) {
+	blocks := blocksOf("A", "B", "C", "D", "E")
+
+	for _, workers := range []int{0, 1, 2, 16} {
+		leafHashes, err := ComputeLeafHashes(len(blocks), workers, func(i int) (Digest, error) {
+			return ModeRFC6962.hashLeaf(blocks[i], h), nil
+		})
+		assert.NoError(t, err)
+
+		for i, block := range blocks {
+			assert.Equal(t, ModeRFC6962.hashLeaf(block, h), leafHashes[i])
+		}
+	}
+
+	errFailed := errors.New("failed")
+	_, err := ComputeLeafHashes(len(blocks), 4, func(i int) (Digest, error) {
+		if i == 3 {
+			return nil, errFailed
+		}
+
+		return h.Digest(blocks[i]), nil
+	})
+	assert.ErrorIs(t, err, errFailed)
+}
+
+func BenchmarkNewTree(b *testing.B) {
+	blocks := make([][]byte, 50_000)
+	for i := range blocks {
+		blocks[i] = []byte(fmt.Sprintf("block %d", i))
+	}
+
+	params := Params{Mode: ModeRFC6962, OddNodes: OddNodesPromote, CommitLeafCount: true}
+
+	workerCounts := []int{1, 2, 4, 8}
+	if runtime.NumCPU() > 8 {
+		workerCounts = append(workerCounts, runtime.NumCPU())
+	}
+
+	for _, workers := range workerCounts {
+		name := fmt.Sprintf("%d workers", workers)
+		if workers == 1 {
+			name = "serial"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := NewTree(blocks, h, WithParams(params), WithHashWorkers(workers)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
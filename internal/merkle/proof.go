@@ -1,70 +1,177 @@
 package merkle
 
+import (
+	"errors"
+)
+
+var (
+	ErrIndexOutOfRange = errors.New("leaf index is out of range")
+)
+
+// ProofHash is a step of a proof, from a node on the path of the leaf to its parent.
+// In binary trees, Hash is the sibling of the node, and Position tells whether the node is on the left (L) or right (R).
+// In k-ary trees, Siblings are all the siblings of the node, left to right, and Index the position of the node among them.
 type ProofHash struct {
-	Hash     string
-	Position string
+	Hash     Digest   `json:",omitempty"`
+	Position string   `json:",omitempty"`
+	Siblings []Digest `json:",omitempty"`
+	Index    int      `json:",omitempty"`
 }
 
-// ProofForBlock generates a Merkle proof for a given block.
-// The proof consists of a slice of hashes from the Merkle tree.
-func (t *Tree) ProofForBlock(block string) (proof []ProofHash) {
-	// Compute the hash of the block with the same hash function used to build the tree
-	blockHash := t.HashFn(block)
-
-	// Define a recursive function to find the proof
-	var findProof func(node *Node) bool
-	findProof = func(node *Node) bool {
-		// If the node is nil, we've hit a leaf node without finding the block
-		if node == nil {
-			return false
+// ProofForIndex generates a Merkle proof for the leaf at position i (0-based).
+// The proof is built by walking up from the leaf at i to the root, one step per level,
+// so it is bound to the requested position even when several leaves share the same content.
+func (t *Tree) ProofForIndex(i int) (proof []ProofHash, err error) {
+	if i < 0 || i >= t.leafCount() {
+		return nil, ErrIndexOutOfRange
+	}
+
+	if t.Arity != 2 {
+		return t.karyProof(i), nil
+	}
+
+	for level, index := 0, i; level < t.depth(); level, index = level+1, index/2 {
+		sibling, ok := t.sibling(level, index)
+		if !ok {
+			// The node is promoted to the next level as it is
+			continue
 		}
 
-		// If the node's data matches the block hash, we've found the block
-		if node.Data == blockHash {
-			return true
+		if index%2 == 0 {
+			// The node is on the left, hence its sibling goes on the right
+			proof = append(proof, ProofHash{Hash: sibling, Position: "L"})
+		} else {
+			// The node is on the right, hence its sibling goes on the left
+			proof = append(proof, ProofHash{Hash: sibling, Position: "R"})
 		}
+	}
 
-		// Recursively search the left subtree
-		if findProof(node.Left) {
-			// If the block was found in the left subtree, add the right sibling to the proof
-			proof = append(proof, ProofHash{node.Right.Data, "L"})
+	return
+}
 
-			return true
-		}
+// ProofForBlock generates a Merkle proof for a given block.
+// The proof consists of a slice of hashes from the Merkle tree.
+//
+// Deprecated: the block is looked up by content, so the proof of the first matching leaf is returned
+// when several leaves share the same content. Use ProofForIndex instead.
+func (t *Tree) ProofForBlock(block []byte) (proof []ProofHash) {
+	// Compute the hash of the block with the same hasher used to build the tree
+	blockHash := t.Mode.hashLeaf(block, t.Hasher)
 
-		// Recursively search the right subtree
-		if findProof(node.Right) {
-			// If the block was found in the right subtree, add the left sibling to the proof
-			proof = append(proof, ProofHash{node.Left.Data, "R"})
+	// Look for the first leaf with the hash of the block
+	for i, leafHash := range t.leaves() {
+		if leafHash.Equal(blockHash) {
+			proof, _ = t.ProofForIndex(i)
 
-			return true
+			return proof
 		}
-
-		return false
 	}
 
-	// Start the search at the root of the tree
-	findProof(t.Root)
-
-	return proof
+	return nil
 }
 
-// VerifyProof verifies a Merkle proof for a given block and root hash.
+// VerifyProof verifies a Merkle proof for a given block, at leaf position index (0-based), and root hash.
 // It returns true if the proof is valid, and false otherwise.
-func VerifyProof(rootHash string, block string, proof []ProofHash, hashFn HashFn) bool {
-	currentHash := hashFn(block)
+// Besides matching the root hash, the left/right path of the proof must lead to the given index:
+// a valid proof for another leaf, even one with the same content, is rejected.
+// The options describe the tree the proof has been generated from, e.g. WithMode.
+// The number of leaves of the tree, set by WithLeafCount, is required for trees that promote odd nodes,
+// commit to their leaf count or aren't binary.
+func VerifyProof(rootHash Digest, index int, block []byte, proof []ProofHash, hasher Hasher, opts ...Option) bool {
+	t := newTree(hasher, opts...)
+
+	return t.verifyLeafHash(rootHash, index, t.Mode.hashLeaf(block, hasher), proof)
+}
+
+// VerifyLeafProof verifies a Merkle proof for the leaf hash at position index (0-based), as VerifyProof does for a block.
+func VerifyLeafProof(rootHash Digest, index int, leafHash Digest, proof []ProofHash, hasher Hasher, opts ...Option) bool {
+	return newTree(hasher, opts...).verifyLeafHash(rootHash, index, leafHash, proof)
+}
+
+func (t *Tree) verifyLeafHash(rootHash Digest, index int, leafHash Digest, proof []ProofHash) bool {
+	if t.Arity != 2 {
+		return t.validateArity() == nil && t.verifyKaryLeafHash(rootHash, index, leafHash, proof)
+	}
+
+	path, padding, ok := t.path(index, len(proof))
+	if !ok {
+		return false
+	}
+
+	currentHash := leafHash
 
 	// Iterate over the proof hashes
-	for _, p := range proof {
+	for level, p := range proof {
+		if p.Position != path[level] {
+			// The proof does not lead to the requested index
+			return false
+		}
+
+		sibling := p.Hash
+		if padding[level] {
+			// The sibling is a copy of the current subtree, so it changes along with the leaf
+			sibling = currentHash
+		}
+
 		// Depending on the position of the sibling in the tree,
 		// concatenate it with the current hash and compute the new current hash
 		if p.Position == "L" {
-			currentHash = hashFn(currentHash + p.Hash)
-		} else if p.Position == "R" {
-			currentHash = hashFn(p.Hash + currentHash)
+			currentHash = t.Mode.hashChildren(currentHash, sibling, t.Hasher)
+		} else {
+			currentHash = t.Mode.hashChildren(sibling, currentHash, t.Hasher)
 		}
 	}
 
 	// The proof is valid if the final computed hash matches the root hash
-	return currentHash == rootHash
+	return t.rootHash(currentHash).Equal(rootHash)
+}
+
+// path returns the bottom-up positions of the siblings along the path from the leaf at index to the root,
+// as they are expected to be found in a proof of the given length,
+// and whether each sibling is a copy padding an odd level, which can be told only knowing the number of leaves.
+func (t *Tree) path(index, proofLength int) (path []string, padding []bool, ok bool) {
+	if index < 0 {
+		return nil, nil, false
+	}
+
+	if t.LeafCount == 0 {
+		// Without knowing how many leaves there are, only perfect trees can be walked:
+		// the bits of the index, from the least significant one, tell whether the leaf is on the left or on the right.
+		if t.OddNodes != OddNodesDuplicate || t.CommitLeafCount || index>>proofLength != 0 {
+			return nil, nil, false
+		}
+
+		for level := 0; level < proofLength; level++ {
+			if index&(1<<level) == 0 {
+				path = append(path, "L")
+			} else {
+				path = append(path, "R")
+			}
+		}
+
+		return path, make([]bool, proofLength), true
+	}
+
+	if index >= t.LeafCount {
+		return nil, nil, false
+	}
+
+	for lo, hi := 0, t.Params.width(t.LeafCount); hi-lo > 1; {
+		mid := lo + splitPoint(hi-lo)
+		if index < mid {
+			path, padding, hi = append(path, "L"), append(padding, t.isPadding(mid)), mid
+		} else {
+			path, padding, lo = append(path, "R"), append(padding, false), mid
+		}
+	}
+	reverse(path)
+	reverse(padding)
+
+	return path, padding, len(path) == proofLength
+}
+
+func reverse[T any](s []T) {
+	for l, r := 0, len(s)-1; l < r; l, r = l+1, r-1 {
+		s[l], s[r] = s[r], s[l]
+	}
 }
@@ -8,32 +8,153 @@ import (
 
 func TestMerkleProof(t *testing.T) {
 	cases := map[string]struct {
-		blocks  []string
+		blocks  [][]byte
 		wantErr error
 	}{
+		"single-block tree": {
+			blocks: blocksOf("A"),
+		},
 		"even-sized tree": {
-			blocks: []string{"A", "B", "C", "D", "E", "F"},
+			blocks: blocksOf("A", "B", "C", "D", "E", "F"),
 		},
 		"odd-sized tree": {
-			blocks: []string{"A", "B", "C", "D", "E"},
+			blocks: blocksOf("A", "B", "C", "D", "E"),
 		},
 		"duplicates": {
-			blocks: []string{"A", "B", "B", "A"},
+			blocks: blocksOf("A", "B", "B", "A"),
 		},
 	}
 
-	for name, tc := range cases {
+	for _, mode := range []Mode{ModeLegacy, ModeRFC6962} {
+		for name, tc := range cases {
+			t.Run(mode.String()+"/"+name, func(t *testing.T) {
+				tree, err := NewTree(tc.blocks, h, WithMode(mode))
+				assert.NoError(t, err)
+
+				for i, b := range tc.blocks {
+					proof, err := tree.ProofForIndex(i)
+					assert.NoError(t, err)
+					assert.True(t, VerifyProof(tree.root(), i, b, proof, h, WithMode(mode)))
+					assert.False(t, VerifyProof(tree.root(), i, []byte("X"), proof, h, WithMode(mode)))
+				}
+
+				_, err = tree.ProofForIndex(len(tc.blocks))
+				assert.ErrorIs(t, err, ErrIndexOutOfRange)
+
+				_, err = tree.ProofForIndex(-1)
+				assert.ErrorIs(t, err, ErrIndexOutOfRange)
+			})
+		}
+	}
+}
+
+func TestMerkleProofModeMismatch(t *testing.T) {
+	blocks := blocksOf("A", "B", "C", "D")
+
+	tree, err := NewTree(blocks, h, WithMode(ModeRFC6962))
+	assert.NoError(t, err)
+
+	proof, err := tree.ProofForIndex(1)
+	assert.NoError(t, err)
+	assert.True(t, VerifyProof(tree.root(), 1, []byte("B"), proof, h, WithMode(ModeRFC6962)))
+	assert.False(t, VerifyProof(tree.root(), 1, []byte("B"), proof, h))
+}
+
+func TestMerkleProofSecondPreimage(t *testing.T) {
+	blocks := blocksOf("A", "B", "C", "D")
+
+	// The children hashes of the root's left child are forged as a "file" at index 0,
+	// with the right child of the root as its only sibling.
+	siblings := func(tree *Tree) []ProofHash {
+		return []ProofHash{{Hash: tree.levels[1][1], Position: "L"}}
+	}
+
+	// Without domain separation, the forged block is accepted
+	legacyTree, err := NewTree(blocks, h)
+	assert.NoError(t, err)
+	forged := []byte(legacyTree.levels[0][0].String() + legacyTree.levels[0][1].String())
+	assert.True(t, VerifyProof(legacyTree.root(), 0, forged, siblings(legacyTree), h))
+
+	rfcTree, err := NewTree(blocks, h, WithMode(ModeRFC6962))
+	assert.NoError(t, err)
+	forged = append(append([]byte{}, rfcTree.levels[0][0]...), rfcTree.levels[0][1]...)
+	assert.False(t, VerifyProof(rfcTree.root(), 0, forged, siblings(rfcTree), h, WithMode(ModeRFC6962)))
+	forged = append(append([]byte{}, nodePrefix...), forged...)
+	assert.False(t, VerifyProof(rfcTree.root(), 0, forged, siblings(rfcTree), h, WithMode(ModeRFC6962)))
+}
+
+func TestMerkleProofIsBoundToIndex(t *testing.T) {
+	blocks := blocksOf("A", "B", "C", "A")
+
+	tree, err := NewTree(blocks, h)
+	assert.NoError(t, err)
+
+	// Leaves 0 and 3 share the same content, but their proofs are not interchangeable
+	proof, err := tree.ProofForIndex(0)
+	assert.NoError(t, err)
+	assert.True(t, VerifyProof(tree.root(), 0, []byte("A"), proof, h))
+	assert.False(t, VerifyProof(tree.root(), 3, []byte("A"), proof, h))
+
+	proof, err = tree.ProofForIndex(3)
+	assert.NoError(t, err)
+	assert.True(t, VerifyProof(tree.root(), 3, []byte("A"), proof, h))
+	assert.False(t, VerifyProof(tree.root(), 0, []byte("A"), proof, h))
+
+	// An index that does not fit in the proof path is rejected
+	assert.False(t, VerifyProof(tree.root(), 7, []byte("A"), proof, h))
+}
+
+func TestMerkleProofParams(t *testing.T) {
+	paramsCases := map[string]Params{
+		"duplicate":              {Mode: ModeRFC6962},
+		"duplicate, leaf count":  {Mode: ModeRFC6962, CommitLeafCount: true},
+		"promote":                {Mode: ModeRFC6962, OddNodes: OddNodesPromote},
+		"promote, leaf count":    {Mode: ModeRFC6962, OddNodes: OddNodesPromote, CommitLeafCount: true},
+		"legacy mode, promote":   {OddNodes: OddNodesPromote},
+		"legacy mode, duplicate": {},
+	}
+
+	for name, params := range paramsCases {
 		t.Run(name, func(t *testing.T) {
-			tree, err := NewTree(tc.blocks, h)
-			assert.NoError(t, err)
+			for n := 1; n <= 9; n++ {
+				var blocks [][]byte
+				for i := 0; i < n; i++ {
+					blocks = append(blocks, []byte{byte(i)})
+				}
 
-			for _, b := range tc.blocks {
-				proof := tree.ProofForBlock(b)
-				assert.True(t, VerifyProof(tree.Root.Data, b, proof, h))
-			}
+				tree, err := NewTree(blocks, h, WithParams(params))
+				assert.NoError(t, err)
 
-			proof := tree.ProofForBlock("X")
-			assert.False(t, VerifyProof(tree.Root.Data, "X", proof, h))
+				for i, b := range blocks {
+					proof, err := tree.ProofForIndex(i)
+					assert.NoError(t, err)
+					assert.True(t, VerifyProof(tree.RootHash(), i, b, proof, h, WithParams(params), WithLeafCount(n)))
+
+					assert.False(t, VerifyProof(tree.RootHash(), (i+1)%(n+1), b, proof, h, WithParams(params), WithLeafCount(n)))
+
+					// The leaf count is bound to the proof only if the root commits to it
+					if params.CommitLeafCount {
+						assert.False(t, VerifyProof(tree.RootHash(), i, b, proof, h, WithParams(params), WithLeafCount(n+1)))
+					}
+				}
+			}
 		})
 	}
 }
+
+func TestMerkleProofRequiresLeafCount(t *testing.T) {
+	blocks := blocksOf("A", "B", "C")
+
+	for _, opts := range [][]Option{
+		{WithOddNodes(OddNodesPromote)},
+		{WithLeafCountCommitment()},
+	} {
+		tree, err := NewTree(blocks, h, opts...)
+		assert.NoError(t, err)
+
+		proof, err := tree.ProofForIndex(0)
+		assert.NoError(t, err)
+		assert.False(t, VerifyProof(tree.RootHash(), 0, blocks[0], proof, h, opts...))
+		assert.True(t, VerifyProof(tree.RootHash(), 0, blocks[0], proof, h, append(opts, WithLeafCount(3))...))
+	}
+}
@@ -0,0 +1,372 @@
+package merkle
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// SparseTree is a sparse Merkle tree: a perfect binary tree with a leaf for each possible key,
+// where the key of a file is the hash of its name, so that the tree is as deep as a digest is long in bits.
+// Leaves without a value, and the subtrees made only of them, have default hashes, hence only the paths
+// leading to the leaves with a value are actually computed.
+// It proves either the value of a name (inclusion) or that there's none (exclusion).
+// It's always hashed as ModeRFC6962 trees are, an empty leaf being a digest made of zeros.
+// The hashes of the subtrees computed along the way are cached, see hashSubtree, so that the root and proofs
+// are computed from the changed paths only.
+type SparseTree struct {
+	HashAlgorithm string
+	Hasher        Hasher
+
+	values   map[string]Digest // value hashes, by key
+	keys     []Digest          // the keys of values, sorted
+	defaults []Digest          // hashes of the empty subtrees, by height
+
+	mu    sync.Mutex        // guards nodes, which are cached as the tree is read
+	nodes map[string]Digest // hashes of subtrees, by nodeID
+}
+
+// SparseProof proves the value of a name in a sparse tree, or its absence when ValueHash is empty.
+// Empty subtrees are left out of Siblings: Bitmap tells which siblings, from the bottom, are listed.
+type SparseProof struct {
+	ValueHash Digest   `json:"valueHash,omitempty"`
+	Bitmap    []byte   `json:"bitmap"`
+	Siblings  []Digest `json:"siblings"`
+}
+
+// NewSparseTree creates an empty sparse tree, using the given hasher for both keys and nodes.
+func NewSparseTree(hasher Hasher) *SparseTree {
+	t := &SparseTree{
+		Hasher:   hasher,
+		values:   make(map[string]Digest),
+		defaults: sparseDefaults(hasher),
+		nodes:    make(map[string]Digest),
+	}
+	if algorithm, ok := hasher.(Algorithm); ok {
+		t.HashAlgorithm = algorithm.Name
+	}
+
+	return t
+}
+
+// Put sets the value hash of name, e.g. the leaf hash of its file, replacing its current one if any.
+func (t *SparseTree) Put(name string, valueHash Digest) {
+	key := t.key(name)
+	if _, found := t.values[string(key)]; !found {
+		i := t.searchKey(key)
+		t.keys = append(t.keys, nil)
+		copy(t.keys[i+1:], t.keys[i:])
+		t.keys[i] = key
+	}
+	t.values[string(key)] = valueHash
+	t.invalidate(key)
+}
+
+// Remove removes the value of name, if any.
+func (t *SparseTree) Remove(name string) {
+	key := t.key(name)
+	if _, found := t.values[string(key)]; !found {
+		return
+	}
+
+	i := t.searchKey(key)
+	t.keys = append(t.keys[:i], t.keys[i+1:]...)
+	delete(t.values, string(key))
+	t.invalidate(key)
+}
+
+// searchKey returns the position of key among the sorted keys, or the one it would be inserted at.
+func (t *SparseTree) searchKey(key Digest) int {
+	return sort.Search(len(t.keys), func(i int) bool { return bytes.Compare(t.keys[i], key) >= 0 })
+}
+
+// invalidate forgets the hashes of the subtrees the leaf of key is in, i.e. the ones along its path.
+func (t *SparseTree) invalidate(key Digest) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for depth := 0; depth < len(t.defaults)-1; depth++ {
+		delete(t.nodes, nodeID(key, depth))
+	}
+}
+
+// Contains tells whether name has a value.
+func (t *SparseTree) Contains(name string) bool {
+	_, found := t.values[string(t.key(name))]
+
+	return found
+}
+
+// RootHash returns the root hash of the tree.
+func (t *SparseTree) RootHash() Digest {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.hashSubtree(t.keys, 0)
+}
+
+// Clone returns a copy of the tree, which can be changed while the tree is being read.
+func (t *SparseTree) Clone() *SparseTree {
+	clone := &SparseTree{
+		HashAlgorithm: t.HashAlgorithm,
+		Hasher:        t.Hasher,
+		values:        make(map[string]Digest, len(t.values)),
+		keys:          append([]Digest(nil), t.keys...),
+		defaults:      t.defaults,
+	}
+	for key, valueHash := range t.values {
+		clone.values[key] = valueHash
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	clone.nodes = make(map[string]Digest, len(t.nodes))
+	for id, hash := range t.nodes {
+		clone.nodes[id] = hash
+	}
+
+	return clone
+}
+
+// Proof generates the proof of the value of name, which is an exclusion proof if name has no value.
+func (t *SparseTree) Proof(name string) *SparseProof {
+	key := t.key(name)
+	proof := &SparseProof{
+		ValueHash: t.values[string(key)],
+		Bitmap:    make([]byte, len(key)),
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Descend from the root along the path of the key, narrowing down the keys under the current node
+	keys := t.keys
+	height := len(t.defaults) - 1
+	for depth := 0; depth < height; depth++ {
+		split := sort.Search(len(keys), func(i int) bool { return keyBit(keys[i], depth) })
+
+		var siblingKeys []Digest
+		if keyBit(key, depth) {
+			siblingKeys, keys = keys[:split], keys[split:]
+		} else {
+			siblingKeys, keys = keys[split:], keys[:split]
+		}
+
+		// Empty siblings are left out of the proof
+		if len(siblingKeys) > 0 {
+			level := height - 1 - depth
+			proof.Bitmap[level/8] |= 1 << (level % 8)
+			proof.Siblings = append(proof.Siblings, t.hashSubtree(siblingKeys, depth+1))
+		}
+	}
+
+	// The siblings have been collected top-down, while the proof is verified bottom-up
+	reverse(proof.Siblings)
+
+	return proof
+}
+
+// key returns the key of name, i.e. the position of its leaf.
+func (t *SparseTree) key(name string) Digest {
+	return t.Hasher.Digest([]byte(name))
+}
+
+// hashSubtree returns the hash of the subtree at the given depth spanning the given sorted keys,
+// which the keys under any node are contiguous among, as they're laid out as their leaves.
+// The hashes of the subtrees holding a single key, or keys on both sides, are cached: there are about
+// two of them per key, while the other subtrees are the few nodes between them.
+func (t *SparseTree) hashSubtree(keys []Digest, depth int) (hash Digest) {
+	height := len(t.defaults) - 1 - depth
+	if len(keys) == 0 {
+		return t.defaults[height]
+	}
+
+	if height == 0 {
+		return sparseLeafHash(keys[0], t.values[string(keys[0])], t.Hasher)
+	}
+
+	// Keys whose bit at depth is 0 are on the left, the others on the right
+	split := sort.Search(len(keys), func(i int) bool { return keyBit(keys[i], depth) })
+	cached := len(keys) == 1 || (split > 0 && split < len(keys))
+
+	id := nodeID(keys[0], depth)
+	if hash, found := t.nodes[id]; found && cached {
+		return hash
+	}
+
+	hash = ModeRFC6962.hashChildren(t.hashSubtree(keys[:split], depth+1), t.hashSubtree(keys[split:], depth+1), t.Hasher)
+	if cached {
+		t.nodes[id] = hash
+	}
+
+	return
+}
+
+// nodeID identifies the node at depth on the path of key: its depth, and the bits of key above it.
+func nodeID(key Digest, depth int) string {
+	id := append([]byte{byte(depth >> 8), byte(depth)}, key[:(depth+7)/8]...)
+	if depth%8 != 0 {
+		id[len(id)-1] &= 0xff << (8 - depth%8)
+	}
+
+	return string(id)
+}
+
+// VerifySparseInclusion verifies that valueHash is the value hash of name in the sparse tree of rootHash.
+func VerifySparseInclusion(rootHash Digest, name string, valueHash Digest, proof *SparseProof, hasher Hasher) bool {
+	if len(valueHash) == 0 || !proof.ValueHash.Equal(valueHash) {
+		return false
+	}
+
+	root, ok := sparseRoot(hasher.Digest([]byte(name)), valueHash, proof, hasher)
+
+	return ok && root.Equal(rootHash)
+}
+
+// VerifySparseExclusion verifies that name has no value in the sparse tree of rootHash.
+func VerifySparseExclusion(rootHash Digest, name string, proof *SparseProof, hasher Hasher) bool {
+	if len(proof.ValueHash) != 0 {
+		return false
+	}
+
+	root, ok := sparseRoot(hasher.Digest([]byte(name)), nil, proof, hasher)
+
+	return ok && root.Equal(rootHash)
+}
+
+// VerifySparsePut verifies the proof of name in the sparse tree of oldRoot, whether it has a value or not,
+// and returns the root hash of the tree once the value hash of name is set to valueHash, with no other change:
+// since the siblings of the leaf are left untouched, the same proof leads the new value to the new root.
+func VerifySparsePut(oldRoot Digest, name string, valueHash Digest, proof *SparseProof, hasher Hasher) (newRoot Digest, ok bool) {
+	key := hasher.Digest([]byte(name))
+	if root, ok := sparseRoot(key, proof.ValueHash, proof, hasher); !ok || !root.Equal(oldRoot) || len(valueHash) == 0 {
+		return nil, false
+	}
+
+	return sparseRoot(key, valueHash, proof, hasher)
+}
+
+// VerifySparseRemove verifies the proof of the value of name in the sparse tree of oldRoot,
+// and returns the root hash of the tree once the value is removed, with no other change. See VerifySparsePut.
+func VerifySparseRemove(oldRoot Digest, name string, proof *SparseProof, hasher Hasher) (newRoot Digest, ok bool) {
+	if len(proof.ValueHash) == 0 {
+		return nil, false
+	}
+
+	key := hasher.Digest([]byte(name))
+	if root, ok := sparseRoot(key, proof.ValueHash, proof, hasher); !ok || !root.Equal(oldRoot) {
+		return nil, false
+	}
+
+	return sparseRoot(key, nil, proof, hasher)
+}
+
+// sparseRoot computes the root hash the proof leads to, when the key has the given value hash, or none if empty.
+func sparseRoot(key, valueHash Digest, proof *SparseProof, hasher Hasher) (root Digest, ok bool) {
+	defaults := sparseDefaults(hasher)
+	height := len(defaults) - 1
+	if len(proof.Bitmap) != len(key) {
+		return nil, false
+	}
+
+	root = defaults[0]
+	if len(valueHash) != 0 {
+		root = sparseLeafHash(key, valueHash, hasher)
+	}
+
+	siblings := proof.Siblings
+	for level := 0; level < height; level++ {
+		sibling := defaults[level]
+		if proof.Bitmap[level/8]&(1<<(level%8)) != 0 {
+			if len(siblings) == 0 {
+				return nil, false
+			}
+			sibling, siblings = siblings[0], siblings[1:]
+		}
+
+		// The bit of the key at the depth of the current node tells whether it's on the left or on the right
+		if keyBit(key, height-1-level) {
+			root = ModeRFC6962.hashChildren(sibling, root, hasher)
+		} else {
+			root = ModeRFC6962.hashChildren(root, sibling, hasher)
+		}
+	}
+
+	// All the siblings must have been used
+	return root, len(siblings) == 0
+}
+
+// sparseDefaults returns the hashes of the empty subtrees, from the empty leaf up to the empty tree.
+func sparseDefaults(hasher Hasher) []Digest {
+	emptyLeaf := make(Digest, len(hasher.Digest()))
+	defaults := []Digest{emptyLeaf}
+	for height := 0; height < len(emptyLeaf)*8; height++ {
+		defaults = append(defaults, ModeRFC6962.hashChildren(defaults[height], defaults[height], hasher))
+	}
+
+	return defaults
+}
+
+func sparseLeafHash(key, valueHash Digest, hasher Hasher) Digest {
+	return hasher.Digest(leafPrefix, key, valueHash)
+}
+
+// keyBit tells whether the bit of key at depth, starting from the most significant one, is set.
+func keyBit(key Digest, depth int) bool {
+	return key[depth/8]&(0x80>>(depth%8)) != 0
+}
+
+// gobSparseTree is the serialized form of SparseTree.
+type gobSparseTree struct {
+	HashAlgorithm string
+	Values        map[string][]byte
+}
+
+func (t *SparseTree) Serialize() (treeBytes []byte, err error) {
+	values := make(map[string][]byte, len(t.values))
+	for key, valueHash := range t.values {
+		values[key] = valueHash
+	}
+
+	var buf bytes.Buffer
+	if err = gob.NewEncoder(&buf).Encode(gobSparseTree{
+		HashAlgorithm: t.HashAlgorithm,
+		Values:        values,
+	}); err != nil {
+		return
+	}
+
+	return buf.Bytes(), nil
+}
+
+// DeserializeSparseTree decodes a serialized sparse tree, restoring its hasher from the recorded hash algorithm.
+func DeserializeSparseTree(r io.Reader) (t *SparseTree, err error) {
+	var tree gobSparseTree
+	if err = gob.NewDecoder(r).Decode(&tree); err != nil {
+		return
+	}
+
+	algorithm, err := HashAlgorithm(tree.HashAlgorithm)
+	if err != nil {
+		return
+	}
+
+	t = NewSparseTree(algorithm)
+	size := len(algorithm.Digest())
+	for key, valueHash := range tree.Values {
+		// keys are the positions of leaves, which must be within the tree
+		if len(key) != size || len(valueHash) == 0 {
+			return nil, fmt.Errorf("%w: sparse tree key of %d bytes, or empty value", ErrInvalidTreeFormat, len(key))
+		}
+
+		t.values[key] = valueHash
+		t.keys = append(t.keys, Digest(key))
+	}
+	sort.Slice(t.keys, func(i, j int) bool { return bytes.Compare(t.keys[i], t.keys[j]) < 0 })
+
+	return
+}
@@ -0,0 +1,192 @@
+package merkle
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSparseTreeProofs(t *testing.T) {
+	cases := map[string]struct {
+		names []string
+	}{
+		"empty tree": {},
+		"single name": {
+			names: []string{"a.txt"},
+		},
+		"several names": {
+			names: []string{"a.txt", "b.txt", "c.txt", "d.txt", "e.txt"},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			tree := NewSparseTree(h)
+			for _, n := range tc.names {
+				tree.Put(n, h.Digest([]byte("content of "+n)))
+			}
+
+			for _, n := range tc.names {
+				proof := tree.Proof(n)
+				assert.True(t, VerifySparseInclusion(tree.RootHash(), n, h.Digest([]byte("content of "+n)), proof, h))
+				assert.False(t, VerifySparseInclusion(tree.RootHash(), n, h.Digest([]byte("X")), proof, h))
+				assert.False(t, VerifySparseExclusion(tree.RootHash(), n, proof, h))
+			}
+
+			for _, n := range []string{"report.csv", "A.txt"} {
+				assert.False(t, tree.Contains(n))
+
+				proof := tree.Proof(n)
+				assert.True(t, VerifySparseExclusion(tree.RootHash(), n, proof, h))
+				// In an empty tree, all the leaves are empty: the proof holds for any other name
+				assert.Equal(t, !tree.Contains("a.txt"), VerifySparseExclusion(tree.RootHash(), "a.txt", proof, h))
+				assert.False(t, VerifySparseInclusion(tree.RootHash(), n, nil, proof, h))
+			}
+		})
+	}
+}
+
+func TestSparseTreeRootIsOrderIndependent(t *testing.T) {
+	a, b := NewSparseTree(h), NewSparseTree(h)
+	for i := 0; i < 10; i++ {
+		a.Put(fmt.Sprintf("%d.txt", i), h.Digest([]byte{byte(i)}))
+		b.Put(fmt.Sprintf("%d.txt", 9-i), h.Digest([]byte{byte(9 - i)}))
+	}
+	assert.Equal(t, a.RootHash(), b.RootHash())
+
+	// Removing a name brings the root back to the one of the tree without it
+	a.Put("extra.txt", h.Digest([]byte("extra")))
+	assert.NotEqual(t, a.RootHash(), b.RootHash())
+	a.Remove("extra.txt")
+	assert.Equal(t, a.RootHash(), b.RootHash())
+}
+
+func TestSparseTreeChanges(t *testing.T) {
+	tree := NewSparseTree(h)
+	tree.Put("a.txt", h.Digest([]byte("A")))
+	tree.Put("b.txt", h.Digest([]byte("B")))
+
+	// Adding a name
+	oldRoot := tree.RootHash()
+	proof := tree.Proof("c.txt")
+	tree.Put("c.txt", h.Digest([]byte("C")))
+	newRoot, ok := VerifySparsePut(oldRoot, "c.txt", h.Digest([]byte("C")), proof, h)
+	assert.True(t, ok)
+	assert.Equal(t, tree.RootHash(), newRoot)
+
+	_, ok = VerifySparsePut(tree.RootHash(), "c.txt", h.Digest([]byte("C")), proof, h)
+	assert.False(t, ok)
+
+	// Replacing the value of a name
+	oldRoot = tree.RootHash()
+	proof = tree.Proof("a.txt")
+	tree.Put("a.txt", h.Digest([]byte("AA")))
+	newRoot, ok = VerifySparsePut(oldRoot, "a.txt", h.Digest([]byte("AA")), proof, h)
+	assert.True(t, ok)
+	assert.Equal(t, tree.RootHash(), newRoot)
+
+	// Removing a name
+	oldRoot = tree.RootHash()
+	proof = tree.Proof("b.txt")
+	tree.Remove("b.txt")
+	newRoot, ok = VerifySparseRemove(oldRoot, "b.txt", proof, h)
+	assert.True(t, ok)
+	assert.Equal(t, tree.RootHash(), newRoot)
+
+	// Names without a value can't be removed
+	_, ok = VerifySparseRemove(tree.RootHash(), "b.txt", tree.Proof("b.txt"), h)
+	assert.False(t, ok)
+}
+
+func TestSparseTreeSerialization(t *testing.T) {
+	algorithm, err := HashAlgorithm(SHA3_256)
+	assert.NoError(t, err)
+
+	tree := NewSparseTree(algorithm)
+	tree.Put("a.txt", h.Digest([]byte("A")))
+	tree.Put("b.txt", h.Digest([]byte("B")))
+
+	treeBytes, err := tree.Serialize()
+	assert.NoError(t, err)
+
+	deserialized, err := DeserializeSparseTree(bytes.NewReader(treeBytes))
+	assert.NoError(t, err)
+	assert.Equal(t, SHA3_256, deserialized.HashAlgorithm)
+	assert.Equal(t, tree.RootHash(), deserialized.RootHash())
+	assert.True(t, deserialized.Contains("a.txt"))
+	assert.False(t, deserialized.Contains("c.txt"))
+}
+
+func TestSparseTreeCachedRoot(t *testing.T) {
+	tree := NewSparseTree(h)
+	names := make(map[string]Digest)
+	for i := 0; i < 200; i++ {
+		// Names are added, changed and removed, with the root and proofs read in between
+		name := fmt.Sprintf("%d.txt", i%70)
+		switch {
+		case i%7 == 3:
+			tree.Remove(name)
+			delete(names, name)
+		default:
+			names[name] = h.Digest([]byte(fmt.Sprint(i)))
+			tree.Put(name, names[name])
+		}
+		proof := tree.Proof(name)
+		root := tree.RootHash()
+
+		// The root is the one of a tree built at once, without cached nodes
+		fresh := NewSparseTree(h)
+		for n, valueHash := range names {
+			fresh.Put(n, valueHash)
+		}
+		if !assert.Equal(t, fresh.RootHash(), root, "after change %d", i) {
+			return
+		}
+
+		if valueHash, found := names[name]; found {
+			assert.True(t, VerifySparseInclusion(root, name, valueHash, proof, h))
+		} else {
+			assert.True(t, VerifySparseExclusion(root, name, proof, h))
+		}
+	}
+
+	// A clone is changed on its own
+	clone := tree.Clone()
+	clone.Put("new.txt", h.Digest([]byte("new")))
+	assert.NotEqual(t, tree.RootHash(), clone.RootHash())
+	assert.False(t, tree.Contains("new.txt"))
+}
+
+func TestDeserializeSparseTreeKeys(t *testing.T) {
+	key := string(h.Digest([]byte("a.txt")))
+	cases := map[string]struct {
+		values map[string][]byte
+		err    error
+	}{
+		"valid keys":     {map[string][]byte{key: {1}}, nil},
+		"short key":      {map[string][]byte{key[:3]: {1}}, ErrInvalidTreeFormat},
+		"empty key":      {map[string][]byte{"": {1}}, ErrInvalidTreeFormat},
+		"long key":       {map[string][]byte{key + "x": {1}}, ErrInvalidTreeFormat},
+		"empty value":    {map[string][]byte{key: {}}, ErrInvalidTreeFormat},
+		"no keys at all": {nil, nil},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := gob.NewEncoder(&buf).Encode(gobSparseTree{HashAlgorithm: SHA256, Values: tc.values}); err != nil {
+				t.Fatal(err)
+			}
+
+			tree, err := DeserializeSparseTree(&buf)
+			assert.ErrorIs(t, err, tc.err)
+			if err == nil {
+				// Trees read back are usable
+				assert.NotPanics(t, func() { _ = tree.Proof("a.txt") })
+			}
+		})
+	}
+}
@@ -1,83 +1,470 @@
 package merkle
 
 import (
-	"bytes"
 	"encoding/gob"
 	"errors"
+	"fmt"
 	"io"
+	"math/bits"
 )
 
 var (
 	ErrEmptyTreeInput = errors.New("cannot build a merkle tree from empty data")
 )
 
-type HashFn func(string) string
+// Params describe how a tree is laid out and hashed.
+// Their zero value describes the trees built before they were selectable.
+type Params struct {
+	Mode     Mode     `json:"mode"`
+	OddNodes OddNodes `json:"oddNodes"`
 
-// Tree contains the root node of a merkle tree
+	// CommitLeafCount makes the root hash commit to the number of leaves.
+	CommitLeafCount bool `json:"commitLeafCount"`
+
+	// ChunkSize is the size of the chunks the files of the leaves are split into, see FileLeafHash.
+	// Files are whole leaves when it's 0.
+	ChunkSize int `json:"chunkSize"`
+
+	// Arity is the number of children of each internal node, see WithArity.
+	// Trees built with 0 are binary, and record 2.
+	Arity int `json:"arity"`
+}
+
+// Tree contains the hashes of the nodes of a merkle tree, laid out in a flat array.
 type Tree struct {
-	Root *Node
-	HashFn
+	// Nodes holds the hashes of the nodes level by level, from the leaves up to the root, each level left to right.
+	// A level has the nodes of the one below divided by the arity, rounded up: the copies padding incomplete levels
+	// are not stored.
+	Nodes         []Digest
+	LeafCount     int
+	HashAlgorithm string
+	Hasher        Hasher
+	Params
+
+	levels      [][]Digest // the levels of Nodes, from the leaves up
+	hashWorkers int        // see WithHashWorkers
+}
+
+// Option customizes how a tree is built, or which tree a proof is verified against.
+type Option func(*Tree)
+
+// WithMode sets the hashing mode of the tree. Without it, trees are built in ModeLegacy, the zero Mode,
+// so that trees stored before modes were recorded still verify: it hashes hex-concatenated digests,
+// without domain separation, and new trees should use ModeRFC6962, as the client and server do.
+func WithMode(mode Mode) Option {
+	return func(t *Tree) {
+		t.Mode = mode
+	}
+}
+
+// WithOddNodes sets how odd levels of the tree are handled. Trees are built with OddNodesDuplicate by default.
+func WithOddNodes(oddNodes OddNodes) Option {
+	return func(t *Tree) {
+		t.OddNodes = oddNodes
+	}
+}
+
+// WithLeafCountCommitment makes the root hash of the tree commit to its number of leaves.
+func WithLeafCountCommitment() Option {
+	return func(t *Tree) {
+		t.CommitLeafCount = true
+	}
+}
+
+// WithParams sets all the parameters of the tree at once.
+func WithParams(params Params) Option {
+	return func(t *Tree) {
+		t.Params = params
+	}
 }
 
-// NewTree creates a new Merkle tree from a slice of blocks using a given hash function.
+// WithLeafCount sets the number of leaves of the tree a proof is verified against.
+// It's meaningless when building a tree, which counts its leaves on its own,
+// but it's required to verify proofs of trees that promote odd nodes or commit to their leaf count.
+func WithLeafCount(leafCount int) Option {
+	return func(t *Tree) {
+		t.LeafCount = leafCount
+	}
+}
+
+func newTree(hasher Hasher, opts ...Option) *Tree {
+	t := &Tree{Hasher: hasher}
+	if algorithm, ok := hasher.(Algorithm); ok {
+		t.HashAlgorithm = algorithm.Name
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+	if t.Arity == 0 {
+		// Trees used to be binary only
+		t.Arity = 2
+	}
+
+	return t
+}
+
+// NewTree creates a new Merkle tree from a slice of blocks using a given hasher.
+// Options, such as WithMode, are recorded in the tree, so that proofs can later be generated consistently.
 // It returns a pointer to the new tree and any error encountered.
-// The resulting Merkle tree is binary and balanced, with each leaf node containing one of the input blocks.
-func NewTree(blocks []string, hashFn HashFn) (tree *Tree, err error) {
-	tree = &Tree{HashFn: hashFn}
+// The resulting Merkle tree is binary by default, see WithArity, with each leaf node containing one of the input blocks.
+// It's perfectly balanced when odd levels are padded by duplicating their last node,
+// otherwise leaves may sit at different depths.
+func NewTree(blocks [][]byte, hasher Hasher, opts ...Option) (tree *Tree, err error) {
+	tree = newTree(hasher, opts...)
+	tree.LeafCount = len(blocks)
 
 	if len(blocks) == 0 {
 		return nil, ErrEmptyTreeInput
 	}
+	if err = tree.validateArity(); err != nil {
+		return nil, err
+	}
+
+	// Hash each block into a leaf
+	leafHashes := make([]Digest, len(blocks))
+	forEach(len(blocks), tree.hashWorkers, minHashesPerWorker, func(i int) {
+		leafHashes[i] = tree.Mode.hashLeaf(blocks[i], hasher)
+	})
+
+	tree.build(leafHashes)
 
-	var nodes []Node
+	return
+}
 
-	// Create a leaf node for each block
-	for _, block := range blocks {
-		nodes = append(nodes, *NewNode(nil, nil, block, hashFn))
+// NewTreeFromLeafHashes creates a new Merkle tree whose leaves have the given hashes, e.g. computed by FileLeafHash.
+func NewTreeFromLeafHashes(leafHashes []Digest, hasher Hasher, opts ...Option) (tree *Tree, err error) {
+	tree = newTree(hasher, opts...)
+	tree.LeafCount = len(leafHashes)
+
+	if len(leafHashes) == 0 {
+		return nil, ErrEmptyTreeInput
+	}
+	if err = tree.validateArity(); err != nil {
+		return nil, err
 	}
 
-	// Repeatedly combine pairs of nodes to create a new level in the tree,
-	// until there is only one node left, which is the root of the Merkle tree.
-	// This process ensures that the tree is binary (each non-leaf node has two children)
-	// and balanced (all leaf nodes are at the same depth).
-	for len(nodes) > 1 {
-		if len(nodes)%2 == 1 {
-			nodes = append(nodes, nodes[len(nodes)-1])
-		}
+	tree.build(leafHashes)
 
-		// Combine pairs of nodes to create the next level of the tree
-		var level []Node
-		for i := 0; i < len(nodes); i += 2 {
-			level = append(level, *NewNode(&nodes[i], &nodes[i+1], "", hashFn))
-		}
+	return
+}
 
-		// Replace the current level with the next level
-		nodes = level
+// Append returns a new tree, with the given blocks appended to the leaves of the tree.
+// The tree itself is left untouched: proofs can still be generated from it.
+// Options, such as WithHashWorkers, tell how the new tree is built, while its params are the ones of the tree.
+func (t *Tree) Append(blocks [][]byte, opts ...Option) (tree *Tree, err error) {
+	leafHashes := make([]Digest, len(blocks))
+	for i, block := range blocks {
+		leafHashes[i] = t.Mode.hashLeaf(block, t.Hasher)
 	}
 
-	// The last remaining node is the root of the tree
-	tree.Root = &nodes[0]
+	return t.AppendLeafHashes(leafHashes, opts...)
+}
+
+// AppendLeafHashes returns a new tree, with leaves of the given hashes appended, as Append does for blocks.
+func (t *Tree) AppendLeafHashes(leafHashes []Digest, opts ...Option) (tree *Tree, err error) {
+	if len(leafHashes) == 0 {
+		return nil, ErrEmptyTreeInput
+	}
+
+	tree = newTree(t.Hasher, append(opts, WithParams(t.Params))...)
+	tree.HashAlgorithm = t.HashAlgorithm
+
+	leaves := append(t.leaves(), leafHashes...)
+	tree.LeafCount = len(leaves)
+	tree.build(leaves)
 
 	return
 }
 
-func (t *Tree) Serialize() (treeBytes []byte, err error) {
-	var buf bytes.Buffer
-	encoder := gob.NewEncoder(&buf)
+// build builds the tree on top of the given leaf hashes.
+func (t *Tree) build(leafHashes []Digest) {
+	t.Nodes = make([]Digest, nodeCount(len(leafHashes), t.Arity))
+	copy(t.Nodes, leafHashes)
+	t.index()
 
-	if err = encoder.Encode(*t); err != nil {
-		return
+	// Combine groups of nodes into the next level, until there is only one node left, which is the root.
+	// The nodes of a level only depend on the level below, hence they can be hashed concurrently.
+	for level := 1; level < len(t.levels); level++ {
+		forEach(len(t.levels[level]), t.hashWorkers, minHashesPerWorker, func(i int) {
+			t.levels[level][i] = t.parent(level, i)
+		})
+	}
+}
+
+// parent computes the hash of the node at index of level from its children, see hashGroup.
+func (t *Tree) parent(level, index int) Digest {
+	return t.hashGroup(t.group(level-1, index))
+}
+
+// index slices Nodes into its levels.
+func (t *Tree) index() {
+	t.levels = nil
+	for offset, size := 0, t.LeafCount; offset+size <= len(t.Nodes) && size > 0; size = (size + t.Arity - 1) / t.Arity {
+		t.levels = append(t.levels, t.Nodes[offset:offset+size])
+		offset += size
+		if size == 1 {
+			break
+		}
+	}
+}
+
+// node returns the hash of the node at index of level, in O(1).
+// Past the end of an odd level, that's the copy of its last node padding it.
+func (t *Tree) node(level, index int) Digest {
+	nodes := t.levels[level]
+	if index == len(nodes) && t.OddNodes == OddNodesDuplicate {
+		return nodes[index-1]
+	}
+
+	return nodes[index]
+}
+
+// sibling returns the hash of the sibling of the node at index of level, in O(1),
+// and whether it has one: the last node of an odd level promoting odd nodes has none.
+func (t *Tree) sibling(level, index int) (hash Digest, ok bool) {
+	sibling := index ^ 1
+	if sibling == len(t.levels[level]) && t.OddNodes == OddNodesPromote {
+		return nil, false
+	}
+
+	return t.node(level, sibling), true
+}
+
+// subtree returns the hash of the root of the subtree spanning the leaves [lo, hi),
+// as found while descending the tree with splitPoint.
+func (t *Tree) subtree(lo, hi int) Digest {
+	level := bits.Len(uint(hi - lo - 1))
+
+	return t.node(level, lo>>level)
+}
+
+// nodeCount returns the number of nodes of a tree with the given number of leaves and arity.
+func nodeCount(leafCount, arity int) (count int) {
+	for size := leafCount; ; size = (size + arity - 1) / arity {
+		count += size
+		if size <= 1 {
+			return
+		}
 	}
+}
+
+// leaves returns a copy of the leaf hashes of the tree, left to right.
+func (t *Tree) leaves() []Digest {
+	return append([]Digest{}, t.levels[0][:t.leafCount()]...)
+}
+
+// gobTree and gobNode are the serialized forms of the trees stored before the binary format, see Serialize.
+// gobNode.Data holds the hex digests of trees serialized when nodes were string-based.
+type gobTree struct {
+	Root            *gobNode
+	LeafCount       int
+	Mode            Mode
+	OddNodes        OddNodes
+	CommitLeafCount bool
+	HashAlgorithm   string
+	ChunkSize       int
+}
 
-	return buf.Bytes(), nil
+type gobNode struct {
+	Data  string
+	Hash  []byte
+	Left  *gobNode
+	Right *gobNode
 }
 
-func Deserialize(r io.Reader) (t *Tree, err error) {
-	var tree Tree
+// deserializeGob decodes a tree serialized as a graph of nodes with gob, laying its nodes out in levels.
+func deserializeGob(r io.Reader) (t *Tree, err error) {
+	var tree gobTree
 	decoder := gob.NewDecoder(r)
-	err = decoder.Decode(&tree)
+	if err = decoder.Decode(&tree); err != nil {
+		return
+	}
+
+	t = &Tree{
+		LeafCount:     tree.LeafCount,
+		HashAlgorithm: tree.HashAlgorithm,
+		Params: Params{
+			Mode:            tree.Mode,
+			OddNodes:        tree.OddNodes,
+			CommitLeafCount: tree.CommitLeafCount,
+			ChunkSize:       tree.ChunkSize,
+			Arity:           2,
+		},
+	}
+	if t.HashAlgorithm != "" {
+		if t.Hasher, err = HashAlgorithm(t.HashAlgorithm); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = t.validateGob(); err != nil {
+		return nil, err
+	}
+
+	// The graph is trusted no further than its own size: it must hold the leaves its leaf count tells,
+	// before any node is allocated
+	graphLeaves := tree.Root.leafCount()
+
+	// Trees serialized before the leaf count was recorded are perfect: they count the padded width of their bottom level
+	if t.LeafCount == 0 {
+		t.LeafCount = 1
+		for node := tree.Root; node != nil && node.Left != nil && t.LeafCount <= graphLeaves; node = node.Left {
+			t.LeafCount <<= 1
+		}
+	}
+
+	if t.LeafCount < 1 || t.LeafCount > graphLeaves || t.Params.width(t.LeafCount) != graphLeaves {
+		return nil, fmt.Errorf("%w: leaf count %d of a graph of %d leaves", ErrInvalidTreeFormat, tree.LeafCount, graphLeaves)
+	}
+
+	t.Nodes = make([]Digest, nodeCount(t.LeafCount, t.Arity))
+	t.index()
+
+	// Descend the graph as proofs do, placing each node at the level of the leaves it spans
+	var place func(n *gobNode, lo, hi int) error
+	place = func(n *gobNode, lo, hi int) (err error) {
+		if n == nil {
+			return ErrInvalidTreeFormat
+		}
+
+		level := bits.Len(uint(hi - lo - 1))
+		if i := lo >> level; i < len(t.levels[level]) {
+			if t.levels[level][i] = n.Hash; len(n.Hash) == 0 {
+				if t.levels[level][i], err = ParseDigest(n.Data); err != nil {
+					return
+				}
+			}
+		}
+
+		if hi-lo == 1 {
+			return
+		}
+
+		mid := lo + splitPoint(hi-lo)
+		if err = place(n.Left, lo, mid); err != nil {
+			return
+		}
+
+		return place(n.Right, mid, hi)
+	}
+
+	if err = place(tree.Root, 0, t.Params.width(t.LeafCount)); err != nil {
+		return nil, err
+	}
 
-	t = &tree
+	// Promoted nodes are found once in the graph, at the lowest of their levels
+	for level := 1; level < len(t.levels); level++ {
+		for i, hash := range t.levels[level] {
+			if hash == nil {
+				t.levels[level][i] = t.levels[level-1][2*i]
+			}
+		}
+	}
+
+	for _, node := range t.Nodes {
+		if len(node) == 0 || len(node) != len(t.Nodes[0]) {
+			return nil, fmt.Errorf("%w: nodes of different sizes", ErrInvalidTreeFormat)
+		}
+	}
+	if t.Hasher != nil && len(t.Hasher.Digest()) != len(t.Nodes[0]) {
+		return nil, fmt.Errorf("%w: hash size %d", ErrInvalidTreeFormat, len(t.Nodes[0]))
+	}
 
 	return
 }
+
+// validateGob checks the params of a tree decoded from gob, as readHeader does for the binary format.
+func (t *Tree) validateGob() error {
+	if _, ok := modeNames[t.Mode]; !ok {
+		return fmt.Errorf("%w: %w: %d", ErrInvalidTreeFormat, ErrUnknownMode, t.Mode)
+	}
+	if _, ok := oddNodesNames[t.OddNodes]; !ok {
+		return fmt.Errorf("%w: %w: %d", ErrInvalidTreeFormat, ErrUnknownOddNodes, t.OddNodes)
+	}
+	if t.ChunkSize < 0 {
+		return fmt.Errorf("%w: chunk size %d", ErrInvalidTreeFormat, t.ChunkSize)
+	}
+
+	return nil
+}
+
+// leafCount returns the number of nodes without children of the graph rooted at n.
+func (n *gobNode) leafCount() (count int) {
+	for stack := []*gobNode{n}; len(stack) > 0; {
+		n, stack = stack[len(stack)-1], stack[:len(stack)-1]
+		switch {
+		case n == nil:
+		case n.Left == nil && n.Right == nil:
+			count++
+		default:
+			stack = append(stack, n.Left, n.Right)
+		}
+	}
+
+	return
+}
+
+// RootHash returns the root hash of the tree, committing to its number of leaves when required.
+func (t *Tree) RootHash() Digest {
+	return t.rootHash(t.root())
+}
+
+// root returns the hash of the root node.
+func (t *Tree) root() Digest {
+	return t.levels[len(t.levels)-1][0]
+}
+
+// rootHash turns the hash of the root node into the root hash of the tree.
+func (t *Tree) rootHash(root Digest) Digest {
+	if !t.CommitLeafCount {
+		return root
+	}
+
+	return t.Mode.hashLeafCount(t.LeafCount, root, t.Hasher)
+}
+
+// leafCount returns the number of leaves the tree has been built from.
+// Trees serialized before the count was recorded report the padded width of their bottom level.
+func (t *Tree) leafCount() int {
+	if t.LeafCount > 0 {
+		return t.LeafCount
+	}
+
+	return 1 << t.depth()
+}
+
+// width returns the number of leaves spanned by the root of a tree with the given number of leaves:
+// the next power of two when odd nodes are duplicated, the number of leaves itself otherwise.
+func (p Params) width(leafCount int) int {
+	if p.OddNodes != OddNodesDuplicate {
+		return leafCount
+	}
+
+	width := 1
+	for width < leafCount {
+		width <<= 1
+	}
+
+	return width
+}
+
+// width returns the number of leaves spanned by the root: the padded width of the bottom level
+// when odd nodes are duplicated, the actual number of leaves otherwise.
+func (t *Tree) width() int {
+	if t.OddNodes == OddNodesDuplicate {
+		return 1 << t.depth()
+	}
+
+	return t.leafCount()
+}
+
+// depth returns the number of levels below the root.
+// When odd nodes are duplicated, the tree is perfect and every leaf sits at this depth,
+// otherwise it's the depth of the leftmost leaf, which is the deepest one.
+func (t *Tree) depth() int {
+	if len(t.levels) == 0 {
+		return 0
+	}
+
+	return len(t.levels) - 1
+}
@@ -1,73 +1,84 @@
 package merkle
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
-
-	"merkle-file-uploader/internal/utils"
 )
 
-var h = utils.Sha256
+var h = HashFactory(sha256.New)
 
-func TestMerkleTree(t *testing.T) {
-	var traverseTree func(*Node, int, map[string]struct{}) int
-	traverseTree = func(node *Node, depth int, blockHashes map[string]struct{}) int {
-		// Leaf nodes must be among the hashes of the blocks
-		if node.Left == nil && node.Right == nil {
-			if _, ok := blockHashes[node.Data]; !ok {
-				t.Errorf("leaf node hash is not a block hash: %s", node.Data)
-			}
+// sha256Hex is the string-based hash function legacy trees have been built with, returning hex digests.
+func sha256Hex(data string) string {
+	digest := sha256.Sum256([]byte(data))
 
-			return depth
-		}
+	return hex.EncodeToString(digest[:])
+}
 
-		leftDepth := traverseTree(node.Left, depth+1, blockHashes)
-		rightDepth := traverseTree(node.Right, depth+1, blockHashes)
-		if leftDepth != rightDepth {
-			t.Error("the tree is not balanced")
-		}
+func blocksOf(blocks ...string) (b [][]byte) {
+	for _, block := range blocks {
+		b = append(b, []byte(block))
+	}
+
+	return
+}
 
-		// Non-leaf nodes must be the hashes of their children's hashes
-		expectedHash := h(node.Left.Data + node.Right.Data)
-		if node.Data != expectedHash {
-			t.Errorf("node hash does not match children's hashes: got %s, want %s", node.Data, expectedHash)
+func TestMerkleTree(t *testing.T) {
+	checkLevels := func(tree *Tree, blocks [][]byte) {
+		// Leaf nodes must be the hashes of the blocks
+		for i, block := range blocks {
+			assert.Equal(t, h.Digest(leafPrefix, block), tree.levels[0][i])
 		}
 
-		return leftDepth
+		// Each level has half the nodes of the one below, up to the root
+		assert.Len(t, tree.levels[len(tree.levels)-1], 1)
+		assert.Len(t, tree.Nodes, nodeCount(len(blocks), 2))
+
+		// Non-leaf nodes must be the hashes of their children's hashes, the last node of odd levels being duplicated
+		for level := 1; level < len(tree.levels); level++ {
+			below := tree.levels[level-1]
+			assert.Len(t, tree.levels[level], (len(below)+1)/2)
+
+			for i, node := range tree.levels[level] {
+				left, right := below[2*i], below[min(2*i+1, len(below)-1)]
+				expectedHash := h.Digest(nodePrefix, left, right)
+				if !node.Equal(expectedHash) {
+					t.Errorf("node hash does not match children's hashes: got %s, want %s", node, expectedHash)
+				}
+			}
+		}
 	}
 
 	cases := map[string]struct {
-		blocks  []string
+		blocks  [][]byte
 		wantErr error
 	}{
 		"empty tree": {
-			blocks:  []string{},
+			blocks:  [][]byte{},
 			wantErr: ErrEmptyTreeInput,
 		},
 		"even-sized tree": {
-			blocks: []string{"A", "B", "C", "D", "E", "F"},
+			blocks: blocksOf("A", "B", "C", "D", "E", "F"),
 		},
 		"odd-sized tree": {
-			blocks: []string{"A", "B", "C", "D", "E"},
+			blocks: blocksOf("A", "B", "C", "D", "E"),
 		},
 		"duplicates": {
-			blocks: []string{"A", "B", "B", "A"},
+			blocks: blocksOf("A", "B", "B", "A"),
 		},
 	}
 
 	for name, tc := range cases {
 		t.Run(name, func(t *testing.T) {
-			emptyTree, err := NewTree([]string{}, nil)
+			emptyTree, err := NewTree([][]byte{}, nil)
 			assert.ErrorIs(t, err, ErrEmptyTreeInput)
 			assert.Nil(t, emptyTree)
 
-			blockHashes := map[string]struct{}{}
-			for _, block := range tc.blocks {
-				blockHashes[h(block)] = struct{}{}
-			}
-
-			tree, err := NewTree(tc.blocks, h)
+			tree, err := NewTree(tc.blocks, h, WithMode(ModeRFC6962))
 			if tc.wantErr != nil {
 				assert.ErrorIs(t, err, tc.wantErr)
 
@@ -75,10 +86,185 @@ func TestMerkleTree(t *testing.T) {
 			}
 
 			assert.NoError(t, err)
-			assert.NotNil(t, tree.Root)
+			assert.NotEmpty(t, tree.Nodes)
+
+			checkLevels(tree, tc.blocks)
+		})
+	}
+
+}
+
+func TestMerkleTreeLegacyMode(t *testing.T) {
+	// Legacy trees chain the hex digests of the string-based hash function
+	sha := sha256Hex
+	wantRoot := sha(sha(sha("A")+sha("B")) + sha(sha("C")+sha("C")))
+
+	for name, hasher := range map[string]Hasher{
+		"hash.Hash factory": h,
+		"HashFn adapter":    HashFn(sha256Hex),
+	} {
+		t.Run(name, func(t *testing.T) {
+			tree, err := NewTree(blocksOf("A", "B", "C"), hasher)
+			assert.NoError(t, err)
+			assert.Equal(t, wantRoot, tree.root().String())
+		})
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	cases := map[string]struct {
+		name     string
+		expected Mode
+		err      error
+	}{
+		"rfc6962": {"rfc6962", ModeRFC6962, nil},
+		"legacy":  {"legacy", ModeLegacy, nil},
+		"unknown": {"sha256", 0, ErrUnknownMode},
+		"empty":   {"", 0, ErrUnknownMode},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			mode, err := ParseMode(tc.name)
+			assert.ErrorIs(t, err, tc.err)
+			assert.Equal(t, tc.expected, mode)
+		})
+	}
+}
+
+func TestMerkleTreeSerialization(t *testing.T) {
+	tree, err := NewTree(blocksOf("A", "B", "C"), h, WithMode(ModeRFC6962))
+	assert.NoError(t, err)
+
+	treeBytes, err := tree.Serialize()
+	assert.NoError(t, err)
+
+	deserialized, err := Deserialize(bytes.NewReader(treeBytes))
+	assert.NoError(t, err)
+	assert.Equal(t, tree.Nodes, deserialized.Nodes)
+	assert.Equal(t, ModeRFC6962, deserialized.Mode)
+	assert.Equal(t, 3, deserialized.LeafCount)
+
+	// Trees serialized when nodes held hex strings, and before the mode was recorded, are read back as legacy ones
+	type stringNode struct {
+		Data  string
+		Left  *stringNode
+		Right *stringNode
+	}
+
+	sha := sha256Hex
+	legacyRoot := &stringNode{
+		Data:  sha(sha("A") + sha("B")),
+		Left:  &stringNode{Data: sha("A")},
+		Right: &stringNode{Data: sha("B")},
+	}
+
+	var buf bytes.Buffer
+	assert.NoError(t, gob.NewEncoder(&buf).Encode(struct{ Root *stringNode }{legacyRoot}))
+
+	deserialized, err = Deserialize(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, ModeLegacy, deserialized.Mode)
+	assert.Equal(t, legacyRoot.Data, deserialized.root().String())
+	deserialized.Hasher = h
+
+	proof, err := deserialized.ProofForIndex(1)
+	assert.NoError(t, err)
+	assert.True(t, VerifyProof(deserialized.root(), 1, []byte("B"), proof, h))
+}
+
+func TestMerkleTreeHashAlgorithms(t *testing.T) {
+	blocks := blocksOf("A", "B", "C")
+	roots := map[string]struct{}{}
+
+	for _, name := range HashAlgorithms() {
+		t.Run(name, func(t *testing.T) {
+			algorithm, err := HashAlgorithm(name)
+			assert.NoError(t, err)
+
+			tree, err := NewTree(blocks, algorithm, WithMode(ModeRFC6962))
+			assert.NoError(t, err)
+			assert.Equal(t, name, tree.HashAlgorithm)
 
-			traverseTree(tree.Root, 0, blockHashes)
+			roots[tree.root().String()] = struct{}{}
+
+			// The algorithm is restored from its recorded name
+			treeBytes, err := tree.Serialize()
+			assert.NoError(t, err)
+
+			deserialized, err := Deserialize(bytes.NewReader(treeBytes))
+			assert.NoError(t, err)
+			assert.Equal(t, name, deserialized.HashAlgorithm)
+
+			proof, err := deserialized.ProofForIndex(2)
+			assert.NoError(t, err)
+			assert.True(t, VerifyProof(tree.root(), 2, blocks[2], proof, deserialized.Hasher, WithMode(ModeRFC6962)))
 		})
 	}
 
+	assert.Len(t, roots, len(HashAlgorithms()))
+
+	_, err := HashAlgorithm("md5")
+	assert.ErrorIs(t, err, ErrUnknownHashAlgorithm)
+}
+
+func TestMerkleTreeOddNodes(t *testing.T) {
+	// RFC 6962 (2.1) definition of the Merkle Tree Hash, as a reference for trees that promote odd nodes
+	var mth func(blocks [][]byte) Digest
+	mth = func(blocks [][]byte) Digest {
+		if len(blocks) == 1 {
+			return h.Digest(leafPrefix, blocks[0])
+		}
+
+		k := splitPoint(len(blocks))
+
+		return h.Digest(nodePrefix, mth(blocks[:k]), mth(blocks[k:]))
+	}
+
+	for n := 1; n <= 17; n++ {
+		var blocks [][]byte
+		for i := 0; i < n; i++ {
+			blocks = append(blocks, []byte{byte(i)})
+		}
+
+		tree, err := NewTree(blocks, h, WithMode(ModeRFC6962), WithOddNodes(OddNodesPromote))
+		assert.NoError(t, err)
+		assert.Equal(t, mth(blocks), tree.RootHash(), "%d leaves", n)
+	}
+}
+
+func TestMerkleTreeLastNodeCollisions(t *testing.T) {
+	root := func(blocks [][]byte, opts ...Option) Digest {
+		tree, err := NewTree(blocks, h, append(opts, WithMode(ModeRFC6962))...)
+		assert.NoError(t, err)
+
+		return tree.RootHash()
+	}
+
+	cases := map[string]struct {
+		a, b [][]byte
+	}{
+		"trailing duplicate": {
+			a: blocksOf("A", "B", "C"),
+			b: blocksOf("A", "B", "C", "C"),
+		},
+		"trailing duplicate pair": {
+			a: blocksOf("A", "B", "C", "D", "E", "F"),
+			b: blocksOf("A", "B", "C", "D", "E", "F", "E", "F"),
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			// Duplicating the last node makes the two sets of blocks indistinguishable
+			assert.Equal(t, root(tc.a), root(tc.b))
+
+			assert.NotEqual(t, root(tc.a, WithOddNodes(OddNodesPromote)), root(tc.b, WithOddNodes(OddNodesPromote)))
+			assert.NotEqual(t, root(tc.a, WithLeafCountCommitment()), root(tc.b, WithLeafCountCommitment()))
+			assert.NotEqual(t,
+				root(tc.a, WithOddNodes(OddNodesPromote), WithLeafCountCommitment()),
+				root(tc.b, WithOddNodes(OddNodesPromote), WithLeafCountCommitment()),
+			)
+		})
+	}
 }
@@ -0,0 +1,102 @@
+package merkle
+
+// Update returns a new tree, with the block of the leaf at index (0-based) replaced.
+// Only the nodes along the path from the leaf to the root are recomputed: the other ones are copied
+// from the tree, which is left untouched.
+func (t *Tree) Update(index int, block []byte) (*Tree, error) {
+	return t.replaceLeaf(index, t.Mode.hashLeaf(block, t.Hasher))
+}
+
+// UpdateLeafHash returns a new tree, with the leaf at index (0-based) replaced by the given leaf hash, as Update does.
+func (t *Tree) UpdateLeafHash(index int, leafHash Digest) (*Tree, error) {
+	return t.replaceLeaf(index, leafHash)
+}
+
+// Delete returns a new tree, with the leaf at index (0-based) marked as deleted.
+// The leaf is not removed, so the positions of the other leaves, and the leaf count, don't change.
+// As Update, only the path from the leaf to the root is recomputed, and the tree is left untouched.
+func (t *Tree) Delete(index int) (*Tree, error) {
+	return t.replaceLeaf(index, deletedLeafHash(t.Hasher))
+}
+
+// LeafHash returns the hash of the leaf at index (0-based).
+func (t *Tree) LeafHash(index int) (leafHash Digest, err error) {
+	if index < 0 || index >= t.leafCount() {
+		return nil, ErrIndexOutOfRange
+	}
+
+	return t.levels[0][index], nil
+}
+
+// replaceLeaf returns a copy of the tree where the leaf at index has the given hash.
+func (t *Tree) replaceLeaf(index int, leafHash Digest) (tree *Tree, err error) {
+	if index < 0 || index >= t.leafCount() {
+		return nil, ErrIndexOutOfRange
+	}
+
+	tree = &Tree{
+		Nodes:         append([]Digest{}, t.Nodes...),
+		LeafCount:     t.LeafCount,
+		HashAlgorithm: t.HashAlgorithm,
+		Hasher:        t.Hasher,
+		Params:        t.Params,
+	}
+	tree.index()
+
+	// Recompute the path from the leaf up to the root, the copies padding odd levels following their node
+	tree.levels[0][index] = leafHash
+	for level := 1; level < len(tree.levels); level++ {
+		index /= tree.Arity
+		tree.levels[level][index] = tree.parent(level, index)
+	}
+
+	return
+}
+
+// VerifyUpdate verifies that newRoot is the root hash of the tree of oldRoot, with the leaf at index (0-based)
+// replaced by block, and no other change. oldLeafHash is the hash of the replaced leaf, and proof its Merkle proof
+// in the old tree: since its siblings are left untouched by the update, the same proof must lead block to newRoot.
+// The options describe the tree, as in VerifyProof.
+func VerifyUpdate(
+	oldRoot, newRoot Digest,
+	index int,
+	oldLeafHash Digest,
+	block []byte,
+	proof []ProofHash,
+	hasher Hasher,
+	opts ...Option,
+) bool {
+	newLeafHash := newTree(hasher, opts...).Mode.hashLeaf(block, hasher)
+
+	return VerifyLeafUpdate(oldRoot, newRoot, index, oldLeafHash, newLeafHash, proof, hasher, opts...)
+}
+
+// VerifyLeafUpdate verifies the update of the leaf at index (0-based) to newLeafHash, as VerifyUpdate does for a block.
+func VerifyLeafUpdate(
+	oldRoot, newRoot Digest,
+	index int,
+	oldLeafHash, newLeafHash Digest,
+	proof []ProofHash,
+	hasher Hasher,
+	opts ...Option,
+) bool {
+	t := newTree(hasher, opts...)
+
+	return t.verifyLeafHash(oldRoot, index, oldLeafHash, proof) &&
+		t.verifyLeafHash(newRoot, index, newLeafHash, proof)
+}
+
+// VerifyDelete verifies that newRoot is the root hash of the tree of oldRoot, with the leaf at index (0-based)
+// marked as deleted, and no other change. See VerifyUpdate.
+func VerifyDelete(oldRoot, newRoot Digest, index int, oldLeafHash Digest, proof []ProofHash, hasher Hasher, opts ...Option) bool {
+	t := newTree(hasher, opts...)
+
+	return t.verifyLeafHash(oldRoot, index, oldLeafHash, proof) &&
+		t.verifyLeafHash(newRoot, index, deletedLeafHash(hasher), proof)
+}
+
+// deletedLeafHash returns the hash marking a deleted leaf: a digest made of zeros,
+// which no block can be hashed to.
+func deletedLeafHash(hasher Hasher) Digest {
+	return make(Digest, len(hasher.Digest()))
+}
@@ -0,0 +1,99 @@
+package merkle
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMerkleUpdate(t *testing.T) {
+	paramsCases := map[string]Params{
+		"legacy":              {},
+		"duplicate":           {Mode: ModeRFC6962},
+		"promote, leaf count": {Mode: ModeRFC6962, OddNodes: OddNodesPromote, CommitLeafCount: true},
+	}
+
+	for name, params := range paramsCases {
+		t.Run(name, func(t *testing.T) {
+			for n := 1; n <= 9; n++ {
+				var blocks [][]byte
+				for i := 0; i < n; i++ {
+					blocks = append(blocks, []byte{byte(i)})
+				}
+
+				tree, err := NewTree(blocks, h, WithParams(params))
+				assert.NoError(t, err)
+				oldRoot := tree.RootHash()
+
+				for i := range blocks {
+					updated, err := tree.Update(i, []byte("X"))
+					assert.NoError(t, err)
+
+					// The updated tree is the same as the one built from scratch
+					updatedBlocks := append([][]byte{}, blocks...)
+					updatedBlocks[i] = []byte("X")
+					expected, err := NewTree(updatedBlocks, h, WithParams(params))
+					assert.NoError(t, err)
+					assert.Equal(t, expected.RootHash(), updated.RootHash())
+					assert.Equal(t, oldRoot, tree.RootHash())
+
+					oldLeafHash, err := tree.LeafHash(i)
+					assert.NoError(t, err)
+					proof, err := tree.ProofForIndex(i)
+					assert.NoError(t, err)
+
+					opts := []Option{WithParams(params), WithLeafCount(n)}
+					assert.True(t, VerifyUpdate(oldRoot, updated.RootHash(), i, oldLeafHash, []byte("X"), proof, h, opts...))
+					assert.False(t, VerifyUpdate(oldRoot, updated.RootHash(), i, oldLeafHash, []byte("Y"), proof, h, opts...))
+					assert.False(t, VerifyDelete(oldRoot, updated.RootHash(), i, oldLeafHash, proof, h, opts...))
+
+					// Every proof of the updated tree is valid
+					for j := range blocks {
+						proof, err := updated.ProofForIndex(j)
+						assert.NoError(t, err)
+						assert.True(t, VerifyProof(updated.RootHash(), j, updatedBlocks[j], proof, h, opts...))
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestMerkleDelete(t *testing.T) {
+	blocks := blocksOf("A", "B", "C", "D", "E")
+	params := Params{Mode: ModeRFC6962, OddNodes: OddNodesPromote, CommitLeafCount: true}
+	opts := []Option{WithParams(params), WithLeafCount(len(blocks))}
+
+	tree, err := NewTree(blocks, h, WithParams(params))
+	assert.NoError(t, err)
+
+	deleted, err := tree.Delete(2)
+	assert.NoError(t, err)
+	assert.Equal(t, tree.LeafCount, deleted.LeafCount)
+	assert.NotEqual(t, tree.RootHash(), deleted.RootHash())
+
+	oldLeafHash, err := tree.LeafHash(2)
+	assert.NoError(t, err)
+	proof, err := tree.ProofForIndex(2)
+	assert.NoError(t, err)
+	assert.True(t, VerifyDelete(tree.RootHash(), deleted.RootHash(), 2, oldLeafHash, proof, h, opts...))
+	assert.False(t, VerifyDelete(tree.RootHash(), deleted.RootHash(), 3, oldLeafHash, proof, h, opts...))
+
+	// The other leaves keep their positions, while the deleted one can't be proven anymore
+	for i, b := range blocks {
+		proof, err := deleted.ProofForIndex(i)
+		assert.NoError(t, err)
+		assert.Equal(t, i != 2, VerifyProof(deleted.RootHash(), i, b, proof, h, opts...))
+	}
+
+	// Deleting another leaf changes more than one leaf with respect to the original tree
+	deletedTwice, err := deleted.Delete(3)
+	assert.NoError(t, err)
+	assert.False(t, VerifyDelete(tree.RootHash(), deletedTwice.RootHash(), 2, oldLeafHash, proof, h, opts...))
+
+	_, err = tree.Delete(len(blocks))
+	assert.ErrorIs(t, err, ErrIndexOutOfRange)
+
+	_, err = tree.Update(-1, []byte("X"))
+	assert.ErrorIs(t, err, ErrIndexOutOfRange)
+}
@@ -0,0 +1,49 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/gorilla/mux"
+
+	"merkle-file-uploader/internal/storage"
+	"merkle-file-uploader/internal/utils"
+)
+
+// BatchIDParam is the path param of the routes of a batch, /batches/{id}/..., which are the routes
+// of the files uploaded outside of batches, scoped to the batch.
+const BatchIDParam = "id"
+
+// NewBatchHandler serves the route of the batch {id} with the handler newHandler creates for the repository of the batch.
+func NewBatchHandler(
+	repository storage.Repository,
+	newHandler func(storage.Repository) func(http.ResponseWriter, *http.Request),
+) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		batch, err := repository.Batch(r.Context(), mux.Vars(r)[BatchIDParam])
+		if errors.Is(err, storage.ErrBatchNotFound) {
+			utils.HttpError(w, http.StatusNotFound, err)
+
+			return
+		}
+		if err != nil {
+			utils.HttpError(w, http.StatusInternalServerError, err)
+
+			return
+		}
+
+		newHandler(batch)(w, r)
+	}
+}
+
+// BatchURL is the URL of the routes of the batch batchID on the server at serverURL,
+// or serverURL itself for the files uploaded outside of batches, whose batchID is empty.
+func BatchURL(serverURL, batchID string) string {
+	if batchID == "" {
+		return serverURL
+	}
+
+	return fmt.Sprintf("%s/batches/%s", serverURL, url.PathEscape(batchID))
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 
 	"merkle-file-uploader/internal/merkle"
@@ -16,54 +17,107 @@ import (
 var (
 	ErrFailedDownload     = errors.New("failed to download file")
 	ErrFailedVerification = errors.New("the file integrity is compromised")
+	ErrFileNotAbsent      = errors.New("the file is not absent")
+	ErrFailedDiff         = errors.New("failed to compare uploads")
 )
 
 type HttpDownloader struct {
 	client   *http.Client
 	baseURL  string
-	rootHash string
-	hashFn   merkle.HashFn
+	rootHash merkle.Digest
+	params   merkle.Params
 }
 
-func NewHttpDownloader(httpClient *http.Client, baseURL, rootHash string, hashFn merkle.HashFn) *HttpDownloader {
+func NewHttpDownloader(httpClient *http.Client, baseURL string, rootHash merkle.Digest, params merkle.Params) *HttpDownloader {
 	return &HttpDownloader{
 		client:   httpClient,
 		baseURL:  baseURL,
 		rootHash: rootHash,
-		hashFn:   hashFn,
+		params:   params,
 	}
 }
 
+// DownloadFileAt downloads the file at index into destination, verifying it against the merkle root.
+// When files are split into chunks, the proof of the file is verified first, then each chunk as it arrives:
+// only verified chunks are written, and the download is aborted at the first corrupt one.
 func (h *HttpDownloader) DownloadFileAt(index int, destination *os.File) (err error) {
-	downloadResponse, err := http.Get(fmt.Sprintf("%s/download/%d", h.baseURL, index))
+	proofResponse, err := h.client.Get(fmt.Sprintf("%s/proof/%d", h.baseURL, index))
 	if err != nil {
-		err = fmt.Errorf("%w: error sending GET /download request: %s", ErrFailedDownload, err)
+		err = fmt.Errorf("%w: error sending GET /proof request: %s", ErrFailedDownload, err)
 
 		return
 	}
-	defer func() { _ = downloadResponse.Body.Close() }()
+	defer func() { _ = proofResponse.Body.Close() }()
 
-	if downloadResponse.StatusCode == http.StatusNotFound {
+	if proofResponse.StatusCode == http.StatusNotFound {
 		err = fmt.Errorf("%w: file not found at index %d", ErrFailedDownload, index)
 
 		return
 	}
 
-	proofResponse, err := http.Get(fmt.Sprintf("%s/proof/%d", h.baseURL, index))
+	var merkleProof protocol.MerkleProofResponse
+	if err = json.NewDecoder(proofResponse.Body).Decode(&merkleProof); err != nil {
+		err = fmt.Errorf("%w: error decoding merkle proof response body: %s", ErrFailedDownload, err)
+
+		return
+	}
+
+	if merkleProof.Proof == nil {
+		err = fmt.Errorf("%w: the server sent no merkle proof envelope", ErrFailedDownload)
+
+		return
+	}
+
+	// The proof must come from a tree built with the same params the merkle root has been computed with
+	if merkleProof.Proof.Params != h.params {
+		err = fmt.Errorf("%w: merkle proof params %+v do not match the expected %+v", ErrFailedDownload, merkleProof.Proof.Params, h.params)
+
+		return
+	}
+
+	// The proof is verified with the hash algorithm the tree has been built with
+	algorithm, err := merkle.HashAlgorithm(merkleProof.Proof.HashAlgorithm)
 	if err != nil {
-		err = fmt.Errorf("%w: error sending GET /proof request: %s", ErrFailedDownload, err)
+		err = fmt.Errorf("%w: %s", ErrFailedDownload, err)
 
 		return
 	}
-	defer func() { _ = proofResponse.Body.Close() }()
 
-	var merkleProof protocol.MerkleProofResponse
-	if err = json.NewDecoder(proofResponse.Body).Decode(&merkleProof); err != nil {
-		err = fmt.Errorf("%w: error decoding merkle proof response body: %s", ErrFailedDownload, err)
+	// The leaf of a file split into chunks is the root of the tree of its chunks
+	if h.params.ChunkSize > 0 {
+		// deleted files have no chunks
+		if len(merkleProof.ChunkHashes) == 0 {
+			return fmt.Errorf("%w: file not found at index %d", ErrFailedDownload, index)
+		}
+
+		leafHash, err := merkle.ChunkTreeRoot(merkleProof.ChunkHashes, algorithm)
+		if err != nil {
+			return fmt.Errorf("%w: invalid chunk hashes: %s", ErrFailedVerification, err)
+		}
+
+		if !h.verifyLeafHash(index, leafHash, merkleProof, algorithm) {
+			return fmt.Errorf("%w: merkle root does not match: %s", ErrFailedVerification, h.rootHash)
+		}
+	}
+
+	downloadResponse, err := h.client.Get(fmt.Sprintf("%s/download/%d", h.baseURL, index))
+	if err != nil {
+		err = fmt.Errorf("%w: error sending GET /download request: %s", ErrFailedDownload, err)
+
+		return
+	}
+	defer func() { _ = downloadResponse.Body.Close() }()
+
+	if downloadResponse.StatusCode == http.StatusNotFound {
+		err = fmt.Errorf("%w: file not found at index %d", ErrFailedDownload, index)
 
 		return
 	}
 
+	if h.params.ChunkSize > 0 {
+		return copyChunks(destination, downloadResponse.Body, merkleProof.ChunkHashes, h.params.ChunkSize, algorithm)
+	}
+
 	fileContent, err := io.ReadAll(downloadResponse.Body)
 	if err != nil {
 		err = fmt.Errorf("%w: error reading download response body %s", ErrFailedDownload, err)
@@ -71,16 +125,219 @@ func (h *HttpDownloader) DownloadFileAt(index int, destination *os.File) (err er
 		return
 	}
 
-	if verified := merkle.VerifyProof(h.rootHash, string(fileContent), merkleProof.MerkleProof, h.hashFn); !verified {
+	leafHash, err := merkle.FileLeafHash(bytes.NewReader(fileContent), algorithm, h.params)
+	if err != nil {
+		return
+	}
+
+	if !h.verifyLeafHash(index, leafHash, merkleProof, algorithm) {
 		err = fmt.Errorf("%w: merkle root does not match: %s", ErrFailedDownload, h.rootHash)
 
 		return
 	}
 
-	reader := io.NopCloser(bytes.NewReader(fileContent))
-	if _, err = io.Copy(destination, reader); err != nil {
+	if _, err = destination.Write(fileContent); err != nil {
 		err = fmt.Errorf("%w: error reading downloaded file: %s", ErrFailedDownload, err)
 	}
 
 	return
 }
+
+func (h *HttpDownloader) verifyLeafHash(
+	index int,
+	leafHash merkle.Digest,
+	merkleProof protocol.MerkleProofResponse,
+	algorithm merkle.Algorithm,
+) bool {
+	return merkle.VerifyLeafProofEnvelope(h.rootHash, protocol.LeafIndex(index), leafHash, merkleProof.Proof, algorithm, merkle.WithParams(h.params))
+}
+
+// Proof downloads the proof of the file at index in its binary envelope, to be stored and verified later on,
+// e.g. with VerifyProofFile. It must lead to the merkle root.
+func (h *HttpDownloader) Proof(index int) (proof *merkle.Proof, err error) {
+	response, err := h.client.Get(fmt.Sprintf("%s/proof/%d?%s=%s", h.baseURL, index, protocol.ProofFormatParam, protocol.ProofFormatBinary))
+	if err != nil {
+		return nil, fmt.Errorf("%w: error sending GET /proof request: %s", ErrFailedDownload, err)
+	}
+	defer func() { _ = response.Body.Close() }()
+
+	if response.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: file not found at index %d", ErrFailedDownload, index)
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: GET /proof responded with %s", ErrFailedDownload, response.Status)
+	}
+
+	proofBytes, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: error reading merkle proof response body: %s", ErrFailedDownload, err)
+	}
+
+	proof = &merkle.Proof{}
+	if err = proof.UnmarshalBinary(proofBytes); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrFailedDownload, err)
+	}
+
+	if !proof.RootHash.Equal(h.rootHash) || proof.Index != protocol.LeafIndex(index) {
+		return nil, fmt.Errorf("%w: the proof of file %d does not lead to the merkle root: %s", ErrFailedVerification, index, h.rootHash)
+	}
+
+	return
+}
+
+// VerifyProofFile verifies, offline, that file is the one proven by proof in the tree of the given root hash and params,
+// returning its index, starting from 1.
+func VerifyProofFile(file io.Reader, proof *merkle.Proof, rootHash merkle.Digest, params merkle.Params) (index int, err error) {
+	algorithm, err := merkle.HashAlgorithm(proof.HashAlgorithm)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", ErrFailedVerification, err)
+	}
+
+	leafHash, err := merkle.FileLeafHash(file, algorithm, params)
+	if err != nil {
+		return
+	}
+
+	if !merkle.VerifyLeafProofEnvelope(rootHash, proof.Index, leafHash, proof, algorithm, merkle.WithParams(params)) {
+		return 0, fmt.Errorf("%w: the proof does not match the file and the merkle root: %s", ErrFailedVerification, rootHash)
+	}
+
+	return protocol.FileIndex(proof.Index), nil
+}
+
+// copyChunks copies a file from r to w one chunk at a time, writing each chunk only once it matches its hash.
+// It stops at the first corrupt chunk, as well as if the file is longer or shorter than its chunks.
+func copyChunks(w io.Writer, r io.Reader, chunkHashes []merkle.Digest, chunkSize int, hasher merkle.Hasher) (err error) {
+	chunk := make([]byte, chunkSize)
+	for i, chunkHash := range chunkHashes {
+		n, err := io.ReadFull(r, chunk)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("%w: error reading chunk #%d: %s", ErrFailedDownload, i+1, err)
+		}
+
+		// only the last chunk may be shorter
+		isShort := n < chunkSize && i < len(chunkHashes)-1
+		if isShort || !merkle.ChunkHash(chunk[:n], hasher).Equal(chunkHash) {
+			return fmt.Errorf("%w: chunk #%d of %d is corrupt", ErrFailedVerification, i+1, len(chunkHashes))
+		}
+
+		if _, err = w.Write(chunk[:n]); err != nil {
+			return fmt.Errorf("%w: error writing chunk #%d: %s", ErrFailedDownload, i+1, err)
+		}
+	}
+
+	if n, _ := io.ReadFull(r, chunk[:1]); n > 0 {
+		err = fmt.Errorf("%w: the file is longer than its %d chunks", ErrFailedVerification, len(chunkHashes))
+	}
+
+	return
+}
+
+// FileMetadata returns the metadata of the file at index, as stored by the server, e.g. its original name.
+func (h *HttpDownloader) FileMetadata(index int) (metadata protocol.FileMetadataResponse, err error) {
+	response, err := h.client.Get(fmt.Sprintf("%s/metadata/%d", h.baseURL, index))
+	if err != nil {
+		err = fmt.Errorf("%w: error sending GET /metadata request: %s", ErrFailedDownload, err)
+
+		return
+	}
+	defer func() { _ = response.Body.Close() }()
+
+	if response.StatusCode == http.StatusNotFound {
+		err = fmt.Errorf("%w: file not found at index %d", ErrFailedDownload, index)
+
+		return
+	}
+	if response.StatusCode != http.StatusOK {
+		err = fmt.Errorf("%w: GET /metadata responded with %s", ErrFailedDownload, response.Status)
+
+		return
+	}
+
+	if err = json.NewDecoder(response.Body).Decode(&metadata); err != nil {
+		err = fmt.Errorf("%w: error decoding metadata response body: %s", ErrFailedDownload, err)
+	}
+
+	return
+}
+
+// VerifyAbsent verifies that no file named name has been uploaded, against the root of the sparse merkle tree.
+func (h *HttpDownloader) VerifyAbsent(name string, sparseRoot merkle.Digest) (err error) {
+	proofResponse, err := h.client.Get(fmt.Sprintf("%s/proof/by-name/%s", h.baseURL, url.PathEscape(name)))
+	if err != nil {
+		err = fmt.Errorf("%w: error sending GET /proof/by-name request: %s", ErrFailedVerification, err)
+
+		return
+	}
+	defer func() { _ = proofResponse.Body.Close() }()
+
+	if proofResponse.StatusCode != http.StatusOK {
+		err = fmt.Errorf("%w: unexpected http status: %s", ErrFailedVerification, proofResponse.Status)
+
+		return
+	}
+
+	var sparseProof protocol.SparseProofResponse
+	if err = json.NewDecoder(proofResponse.Body).Decode(&sparseProof); err != nil {
+		err = fmt.Errorf("%w: error decoding sparse merkle proof response body: %s", ErrFailedVerification, err)
+
+		return
+	}
+
+	algorithm, err := merkle.HashAlgorithm(sparseProof.HashAlgorithm)
+	if err != nil {
+		err = fmt.Errorf("%w: %s", ErrFailedVerification, err)
+
+		return
+	}
+
+	if len(sparseProof.ValueHash) != 0 {
+		err = fmt.Errorf("%w: %s has been uploaded", ErrFileNotAbsent, name)
+
+		return
+	}
+
+	if !merkle.VerifySparseExclusion(sparseRoot, name, &sparseProof.SparseProof, algorithm) {
+		err = fmt.Errorf("%w: sparse merkle root does not match: %s", ErrFailedVerification, sparseRoot)
+	}
+
+	return
+}
+
+// Diff returns the indices of the files that differ between the uploads of root hashes rootA and rootB,
+// as compared by the server on its stored trees, without downloading any file.
+func (h *HttpDownloader) Diff(rootA, rootB merkle.Digest) (indices []int, err error) {
+	diffResponse, err := h.client.Get(fmt.Sprintf("%s/diff/%s/%s", h.baseURL, rootA, rootB))
+	if err != nil {
+		err = fmt.Errorf("%w: error sending GET /diff request: %s", ErrFailedDiff, err)
+
+		return
+	}
+	defer func() { _ = diffResponse.Body.Close() }()
+
+	if diffResponse.StatusCode == http.StatusNotFound {
+		err = fmt.Errorf("%w: no upload found with both root hashes", ErrFailedDiff)
+
+		return
+	}
+	if diffResponse.StatusCode != http.StatusOK {
+		err = fmt.Errorf("%w: unexpected http status: %s", ErrFailedDiff, diffResponse.Status)
+
+		return
+	}
+
+	var diff protocol.DiffResponse
+	if err = json.NewDecoder(diffResponse.Body).Decode(&diff); err != nil {
+		err = fmt.Errorf("%w: error decoding diff response body: %s", ErrFailedDiff, err)
+
+		return
+	}
+
+	if !diff.RootA.Equal(rootA) || !diff.RootB.Equal(rootB) {
+		err = fmt.Errorf("%w: the server compared other root hashes", ErrFailedDiff)
+
+		return
+	}
+
+	return diff.Indices, nil
+}
@@ -3,8 +3,12 @@ package download
 import (
 	"errors"
 	"fmt"
+	"io"
+	"mime"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
 
@@ -14,6 +18,9 @@ import (
 	"merkle-file-uploader/internal/utils"
 )
 
+// errMalformedRange fails parsing a Range header the server doesn't serve, which is then ignored.
+var errMalformedRange = errors.New("malformed or unsupported range")
+
 func NewDownloadHandler(repository storage.Repository) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
@@ -22,14 +29,19 @@ func NewDownloadHandler(repository storage.Repository) func(http.ResponseWriter,
 			return
 		}
 
-		index, err := indexFromRequest(r)
+		index, err := utils.IndexFromRequest(r)
 		if err != nil {
 			utils.HttpError(w, http.StatusBadRequest, err)
 
 			return
 		}
 
-		fileContent, err := repository.RetrieveFileByIndex(r.Context(), index)
+		// a single range of bytes may be requested instead, e.g. to resume a download
+		if r.Header.Get("Range") != "" && serveRange(w, r, repository, index) {
+			return
+		}
+
+		metadata, content, err := repository.RetrieveFileByIndex(r.Context(), index)
 		if err == storage.ErrStoredFileNotFound {
 			utils.HttpError(w, http.StatusNotFound, fmt.Errorf("{index} not found: %d", index))
 
@@ -41,13 +53,244 @@ func NewDownloadHandler(repository storage.Repository) func(http.ResponseWriter,
 			return
 		}
 
-		_, err = w.Write(fileContent.Content)
+		defer func() { _ = content.Close() }()
+
+		setFileHeaders(w, metadata)
+		w.Header().Set("Content-Length", strconv.Itoa(metadata.Size))
+
+		// the content is streamed, a failure past the headers can only cut the response short
+		_, err = io.Copy(w, content)
+
+		return
+	}
+}
+
+// serveRange serves the range of bytes of the file at index requested by the Range header, as in RFC 9110,
+// and tells whether it did: ranges that are malformed, more than one, or of a file that changed since,
+// as told by If-Range, are ignored, for the whole file to be served instead.
+func serveRange(w http.ResponseWriter, r *http.Request, repository storage.Repository, index int) (served bool) {
+	metadata, err := repository.RetrieveFileMetadata(r.Context(), index)
+	if errors.Is(err, storage.ErrStoredFileNotFound) {
+		utils.HttpError(w, http.StatusNotFound, fmt.Errorf("{index} not found: %d", index))
+
+		return true
+	}
+	if err != nil {
+		utils.HttpError(w, http.StatusInternalServerError, err)
+
+		return true
+	}
+
+	if ifRange := r.Header.Get("If-Range"); ifRange != "" && ifRange != eTag(metadata) {
+		return false
+	}
+
+	offset, length, err := parseRange(r.Header.Get("Range"), metadata.Size)
+	if errors.Is(err, errMalformedRange) {
+		return false
+	}
+	if err != nil {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", metadata.Size))
+		utils.HttpError(w, http.StatusRequestedRangeNotSatisfiable, err)
+
+		return true
+	}
+
+	metadata, content, err := repository.RetrieveFileRange(r.Context(), index, offset, length)
+	if errors.Is(err, storage.ErrRangeNotSatisfiable) {
+		// the file has been replaced by a smaller one since
+		return false
+	}
+	if errors.Is(err, storage.ErrStoredFileNotFound) {
+		utils.HttpError(w, http.StatusNotFound, fmt.Errorf("{index} not found: %d", index))
+
+		return true
+	}
+	if err != nil {
+		utils.HttpError(w, http.StatusInternalServerError, err)
+
+		return true
+	}
+
+	defer func() { _ = content.Close() }()
+
+	// the range may go past the end of the file, which it's cut to
+	length = min(length, metadata.Size-offset)
+	setFileHeaders(w, metadata)
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, metadata.Size))
+	w.Header().Set("Content-Length", strconv.Itoa(length))
+	w.WriteHeader(http.StatusPartialContent)
+	_, _ = io.Copy(w, content)
+
+	return true
+}
+
+// setFileHeaders sets the headers of a download of a file, but its length.
+func setFileHeaders(w http.ResponseWriter, metadata storage.FileMetadata) {
+	// the file is saved under its original name, as sent by the client
+	if disposition := mime.FormatMediaType("attachment", map[string]string{"filename": metadata.Name}); disposition != "" {
+		w.Header().Set("Content-Disposition", disposition)
+	}
+	if metadata.ContentType != "" {
+		w.Header().Set("Content-Type", metadata.ContentType)
+	}
+	if tag := eTag(metadata); tag != "" {
+		w.Header().Set("ETag", tag)
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+}
+
+// eTag tags a file with its leaf hash, which changes along with its content, or none for the files stored before
+// leaf hashes were recorded.
+func eTag(metadata storage.FileMetadata) string {
+	if len(metadata.LeafHash) == 0 {
+		return ""
+	}
+
+	return `"` + metadata.LeafHash.String() + `"`
+}
+
+// NewMetadataHandler serves the metadata of the file at {index}, without its content.
+func NewMetadataHandler(repository storage.Repository) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			utils.HttpError(w, http.StatusMethodNotAllowed, errors.New(r.Method))
+
+			return
+		}
+
+		index, err := utils.IndexFromRequest(r)
+		if err != nil {
+			utils.HttpError(w, http.StatusBadRequest, err)
+
+			return
+		}
+
+		metadata, err := repository.RetrieveFileMetadata(r.Context(), index)
+		if errors.Is(err, storage.ErrStoredFileNotFound) {
+			utils.HttpError(w, http.StatusNotFound, fmt.Errorf("{index} not found: %d", index))
+
+			return
+		}
+		if err != nil {
+			utils.HttpError(w, http.StatusInternalServerError, err)
+
+			return
+		}
+
+		response := protocol.FileMetadataResponse{
+			Index:       metadata.Index,
+			Name:        metadata.Name,
+			Size:        metadata.Size,
+			ContentType: metadata.ContentType,
+			LeafHash:    metadata.LeafHash,
+		}
+		if !metadata.UploadedAt.IsZero() {
+			response.UploadedAt = &metadata.UploadedAt
+		}
+
+		if err = utils.HttpOkJson(w, response); err != nil {
+			utils.HttpError(w, http.StatusInternalServerError, err)
+		}
+	}
+}
+
+func NewProofHandler(
+	repository storage.Repository,
+	defaultAlgorithm merkle.Algorithm,
+	backend protocol.TreeBackend,
+) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			utils.HttpError(w, http.StatusMethodNotAllowed, errors.New(r.Method))
+
+			return
+		}
+
+		index, err := utils.IndexFromRequest(r)
+		if err != nil {
+			utils.HttpError(w, http.StatusBadRequest, err)
+
+			return
+		}
+
+		merkleTree, hasher, err := retrieveProver(r, repository, defaultAlgorithm, backend)
+		if errors.Is(err, storage.ErrTreeNotFound) {
+			utils.HttpError(w, http.StatusNotFound, err)
+
+			return
+		}
+		if err != nil {
+			utils.HttpError(w, http.StatusInternalServerError, err)
+
+			return
+		}
+		header := merkleTree.Header()
+
+		proof, err := merkleTree.Proof(protocol.LeafIndex(index))
+		if errors.Is(err, merkle.ErrIndexOutOfRange) {
+			utils.HttpError(w, http.StatusNotFound, fmt.Errorf("{index} not found: %d", index))
+
+			return
+		}
+		if err != nil {
+			utils.HttpError(w, http.StatusInternalServerError, err)
+
+			return
+		}
+
+		if r.URL.Query().Get(protocol.ProofFormatParam) == protocol.ProofFormatBinary {
+			proofBytes, err := proof.MarshalBinary()
+			if err != nil {
+				utils.HttpError(w, http.StatusInternalServerError, err)
+
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/octet-stream")
+			_, err = w.Write(proofBytes)
+
+			return
+		}
+
+		merkleProof, err := proof.Hashes()
+		if err != nil {
+			utils.HttpError(w, http.StatusInternalServerError, err)
+
+			return
+		}
+
+		var chunkHashes []merkle.Digest
+		if header.ChunkSize > 0 {
+			if chunkHashes, err = fileChunkHashes(r, repository, merkleTree, index, hasher); err != nil {
+				utils.HttpError(w, http.StatusInternalServerError, err)
+
+				return
+			}
+		}
+
+		if err = utils.HttpOkJson(w, protocol.MerkleProofResponse{
+			Proof:         proof,
+			MerkleProof:   merkleProof,
+			ChunkHashes:   chunkHashes,
+			HashAlgorithm: header.HashAlgorithm,
+			LeafCount:     header.LeafCount,
+			Params:        header.Params,
+		}); err != nil {
+			utils.HttpError(w, http.StatusInternalServerError, err)
+		}
 
 		return
 	}
 }
 
-func NewProofHandler(repository storage.Repository, hashFn merkle.HashFn) func(http.ResponseWriter, *http.Request) {
+// NewMultiProofHandler serves a single multiproof for several files, whose indices are passed in as
+// a comma-separated list, e.g. /proof?indices=2,5,9
+func NewMultiProofHandler(
+	repository storage.Repository,
+	defaultAlgorithm merkle.Algorithm,
+	backend protocol.TreeBackend,
+) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			utils.HttpError(w, http.StatusMethodNotAllowed, errors.New(r.Method))
@@ -55,55 +298,306 @@ func NewProofHandler(repository storage.Repository, hashFn merkle.HashFn) func(h
 			return
 		}
 
-		index, err := indexFromRequest(r)
+		indices, err := indicesFromRequest(r)
 		if err != nil {
 			utils.HttpError(w, http.StatusBadRequest, err)
 
 			return
 		}
 
-		merkleTree, err := repository.RetrieveTree(r.Context())
+		merkleTree, _, err := retrieveProver(r, repository, defaultAlgorithm, backend)
+		if errors.Is(err, storage.ErrTreeNotFound) {
+			utils.HttpError(w, http.StatusNotFound, err)
+
+			return
+		}
 		if err != nil {
 			utils.HttpError(w, http.StatusInternalServerError, err)
 
 			return
 		}
-		merkleTree.HashFn = hashFn
 
-		fileByIndex, err := repository.RetrieveFileByIndex(r.Context(), index)
+		leafIndices := make([]int, len(indices))
+		for i, index := range indices {
+			leafIndices[i] = protocol.LeafIndex(index)
+		}
+
+		merkleMultiProof, err := merkleTree.MultiProofForIndices(leafIndices)
+		if errors.Is(err, merkle.ErrIndexOutOfRange) {
+			utils.HttpError(w, http.StatusNotFound, fmt.Errorf("{indices} not found: %v", indices))
+
+			return
+		}
+		if errors.Is(err, merkle.ErrInvalidIndices) {
+			utils.HttpError(w, http.StatusBadRequest, err)
+
+			return
+		}
+		if errors.Is(err, merkle.ErrUnsupportedArity) {
+			utils.HttpError(w, http.StatusNotImplemented, err)
+
+			return
+		}
 		if err != nil {
-			statusCode := http.StatusInternalServerError
-			if errors.Is(err, storage.ErrStoredFileNotFound) {
-				statusCode = http.StatusNotFound
+			utils.HttpError(w, http.StatusInternalServerError, err)
+
+			return
+		}
+
+		header := merkleTree.Header()
+		if err = utils.HttpOkJson(w, protocol.MerkleMultiProofResponse{
+			Indices:          indices,
+			MerkleMultiProof: merkleMultiProof.Hashes,
+			HashAlgorithm:    header.HashAlgorithm,
+			LeafCount:        header.LeafCount,
+			Params:           header.Params,
+		}); err != nil {
+			utils.HttpError(w, http.StatusInternalServerError, err)
+		}
+
+		return
+	}
+}
+
+// NewSparseProofHandler serves the proof that a file named {name} has been uploaded, or that it has not.
+func NewSparseProofHandler(repository storage.Repository) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			utils.HttpError(w, http.StatusMethodNotAllowed, errors.New(r.Method))
+
+			return
+		}
+
+		name := mux.Vars(r)["name"]
+		if name == "" {
+			utils.HttpError(w, http.StatusBadRequest, errors.New("{name} path param is not passed in"))
+
+			return
+		}
+
+		sparseTree, err := repository.RetrieveSparseTree(r.Context())
+		if errors.Is(err, storage.ErrTreeNotFound) {
+			utils.HttpError(w, http.StatusNotFound, err)
+
+			return
+		}
+		if err != nil {
+			utils.HttpError(w, http.StatusInternalServerError, err)
+
+			return
+		}
+
+		if err = utils.HttpOkJson(w, protocol.SparseProofResponse{
+			Name:          name,
+			HashAlgorithm: sparseTree.HashAlgorithm,
+			SparseProof:   *sparseTree.Proof(name),
+		}); err != nil {
+			utils.HttpError(w, http.StatusInternalServerError, err)
+		}
+
+		return
+	}
+}
+
+// NewDiffHandler serves the indices of the files that differ between the uploads of root hashes {rootA} and {rootB},
+// comparing their stored trees without reading any file.
+func NewDiffHandler(repository storage.Repository) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			utils.HttpError(w, http.StatusMethodNotAllowed, errors.New(r.Method))
+
+			return
+		}
+
+		var trees [2]*merkle.Tree
+		for i, param := range []string{"rootA", "rootB"} {
+			rootHash, err := merkle.ParseDigest(mux.Vars(r)[param])
+			if err != nil || len(rootHash) == 0 {
+				utils.HttpError(w, http.StatusBadRequest, fmt.Errorf("{%s} path param must be a hex digest", param))
+
+				return
+			}
+
+			trees[i], err = repository.RetrieveTreeByRoot(r.Context(), rootHash)
+			if errors.Is(err, storage.ErrTreeNotFound) {
+				utils.HttpError(w, http.StatusNotFound, fmt.Errorf("{%s} not found: %s", param, rootHash))
+
+				return
+			}
+			if err != nil {
+				utils.HttpError(w, http.StatusInternalServerError, err)
+
+				return
 			}
+		}
+
+		leafIndices, err := merkle.Diff(trees[0], trees[1])
+		if errors.Is(err, merkle.ErrIncomparableTrees) {
+			utils.HttpError(w, http.StatusConflict, err)
 
-			utils.HttpError(w, statusCode, err)
+			return
+		}
+		if err != nil {
+			utils.HttpError(w, http.StatusInternalServerError, err)
 
 			return
 		}
 
-		merkleProof := merkleTree.ProofForBlock(string(fileByIndex.Content))
-		if err = utils.HttpOkJson(w, protocol.MerkleProofResponse{MerkleProof: merkleProof}); err != nil {
+		indices := make([]int, len(leafIndices))
+		for i, leafIndex := range leafIndices {
+			indices[i] = protocol.FileIndex(leafIndex)
+		}
+
+		if err = utils.HttpOkJson(w, protocol.DiffResponse{
+			RootA:      trees[0].RootHash(),
+			RootB:      trees[1].RootHash(),
+			LeafCountA: trees[0].LeafCount,
+			LeafCountB: trees[1].LeafCount,
+			Indices:    indices,
+		}); err != nil {
 			utils.HttpError(w, http.StatusInternalServerError, err)
 		}
+	}
+}
+
+// retrieveProver retrieves what proofs are generated from, depending on the tree backend: the stored mountain range,
+// or the stored tree, along with the hasher it's been built with.
+func retrieveProver(
+	r *http.Request,
+	repository storage.Repository,
+	defaultAlgorithm merkle.Algorithm,
+	backend protocol.TreeBackend,
+) (prover merkle.Prover, hasher merkle.Hasher, err error) {
+	if backend == protocol.TreeBackendMountainRange {
+		mountainRange, err := repository.RetrieveMountainRange(r.Context())
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return mountainRange, mountainRange.Hasher, nil
+	}
 
+	merkleTree, err := repository.RetrieveTree(r.Context())
+	if err != nil {
 		return
 	}
+
+	// trees stored before the hash algorithm was recorded have been built with the default one
+	if merkleTree.HashAlgorithm == "" {
+		merkleTree.HashAlgorithm = defaultAlgorithm.Name
+		merkleTree.Hasher = defaultAlgorithm
+	}
+
+	return merkleTree, merkleTree.Hasher, nil
 }
 
-func indexFromRequest(r *http.Request) (index int, err error) {
-	vars := mux.Vars(r)
-	indexParam, isIndexSet := vars["index"]
-	if !isIndexSet {
-		err = errors.New("{index} path param is not passed in")
+// fileChunkHashes returns the chunk hashes of the file at index, as recorded when it's been stored, or else hashes its
+// content again, e.g. for the files stored before they were recorded. Recorded ones are checked against the leaf hash
+// of the file, a failed replacement may have left them stale. Deleted files have no chunks.
+func fileChunkHashes(
+	r *http.Request,
+	repository storage.Repository,
+	prover merkle.Prover,
+	index int,
+	hasher merkle.Hasher,
+) (chunkHashes []merkle.Digest, err error) {
+	chunkHashes, err = repository.RetrieveChunkHashes(r.Context(), index)
+	if errors.Is(err, storage.ErrStoredFileNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return
+	}
 
+	leafHash, err := prover.LeafHash(protocol.LeafIndex(index))
+	if err != nil {
 		return
 	}
+	if len(chunkHashes) > 0 {
+		if root, err := merkle.ChunkTreeRoot(chunkHashes, hasher); err == nil && root.Equal(leafHash) {
+			return chunkHashes, nil
+		}
+	}
 
-	index, err = strconv.Atoi(indexParam)
+	_, content, err := repository.RetrieveFileByIndex(r.Context(), index)
+	if errors.Is(err, storage.ErrStoredFileNotFound) {
+		return nil, nil
+	}
 	if err != nil {
-		err = fmt.Errorf("{index} path param must be numeric: %s", err)
+		return
 	}
+	defer func() { _ = content.Close() }()
+
+	return merkle.ChunkHashes(content, prover.Header().ChunkSize, hasher)
+}
+
+// parseRange parses the Range header of a single range of bytes, e.g. bytes=0-499, bytes=500- or bytes=-500,
+// into its offset and length within a file of the given size, or storage.ErrRangeNotSatisfiable if outside of it.
+func parseRange(header string, size int) (offset, length int, err error) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, fmt.Errorf("%w: %s", errMalformedRange, header)
+	}
+
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, fmt.Errorf("%w: %s", errMalformedRange, header)
+	}
+
+	// the last bytes of the file
+	if first == "" {
+		suffix, err := strconv.Atoi(last)
+		if err != nil || suffix < 0 {
+			return 0, 0, fmt.Errorf("%w: %s", errMalformedRange, header)
+		}
+		if suffix == 0 || size == 0 {
+			return 0, 0, storage.ErrRangeNotSatisfiable
+		}
+
+		suffix = min(suffix, size)
+
+		return size - suffix, suffix, nil
+	}
+
+	start, err := strconv.Atoi(first)
+	if err != nil || start < 0 {
+		return 0, 0, fmt.Errorf("%w: %s", errMalformedRange, header)
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.Atoi(last); err != nil || end < start {
+			return 0, 0, fmt.Errorf("%w: %s", errMalformedRange, header)
+		}
+		end = min(end, size-1)
+	}
+	if start >= size {
+		return 0, 0, storage.ErrRangeNotSatisfiable
+	}
+
+	return start, end - start + 1, nil
+}
+
+func indicesFromRequest(r *http.Request) (indices []int, err error) {
+	indicesParam := r.URL.Query().Get("indices")
+	if indicesParam == "" {
+		err = errors.New("{indices} query param is not passed in")
+
+		return
+	}
+
+	for _, indexParam := range strings.Split(indicesParam, ",") {
+		var index int
+		index, err = strconv.Atoi(strings.TrimSpace(indexParam))
+		if err != nil {
+			err = fmt.Errorf("{indices} query param must be a comma-separated list of numbers: %s", err)
+
+			return
+		}
+
+		indices = append(indices, index)
+	}
+
+	sort.Ints(indices)
 
 	return
 }
@@ -0,0 +1,13 @@
+package protocol
+
+// Stored files are indexed starting from 1, while the leaves of their merkle tree are 0-based.
+
+// LeafIndex is the index of the leaf of the stored file at fileIndex.
+func LeafIndex(fileIndex int) int {
+	return fileIndex - 1
+}
+
+// FileIndex is the index of the stored file at the leaf leafIndex, see LeafIndex.
+func FileIndex(leafIndex int) int {
+	return leafIndex + 1
+}
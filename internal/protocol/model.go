@@ -1,16 +1,123 @@
 package protocol
 
-import "merkle-file-uploader/internal/merkle"
+import (
+	"time"
+
+	"merkle-file-uploader/internal/merkle"
+)
+
+// Multipart form fields of an upload request
+const (
+	FilesField         = "files"
+	HashAlgorithmField = "hashAlgorithm"
+	AppendField        = "append"
+)
+
+// ProofFormatParam is the query parameter of a proof request asking for its format:
+// ProofFormatBinary for the merkle.Proof envelope alone, binary-encoded, or else the MerkleProofResponse JSON.
+const (
+	ProofFormatParam  = "format"
+	ProofFormatBinary = "binary"
+)
+
+// TreeBackend is the structure the server keeps the leaves of the uploaded files in.
+type TreeBackend string
+
+const (
+	// TreeBackendTree is a merkle tree, rebuilt by every upload, whose files can be changed afterwards.
+	TreeBackendTree TreeBackend = "tree"
+	// TreeBackendMountainRange is an ever-growing Merkle Mountain Range, which files can only be appended to.
+	TreeBackendMountainRange TreeBackend = "mmr"
+)
 
 type UploadedFile struct {
 	Name  string `json:"name"`
 	Index int    `json:"index"`
 }
 
+// UploadedFilesResponse lists the uploaded files, and the ID of the batch they've been uploaded to, if a new one.
+// MerkleRoot and Params are the ones of the tree the server has built, for the client to check them against its own.
 type UploadedFilesResponse struct {
 	UploadedFiles []UploadedFile `json:"uploadedFiles"`
+	BatchID       string         `json:"batchId,omitempty"`
+	MerkleRoot    merkle.Digest  `json:"merkleRoot"`
+	merkle.Params
+}
+
+// AppendedFilesResponse proves that the tree the files have been appended to is a prefix of the new one,
+// and that the appended files are the last leaves of the new tree.
+// SparseProofs prove the absence of the names of the appended files, one after the other, from the sparse tree.
+type AppendedFilesResponse struct {
+	UploadedFilesResponse
+	OldLeafCount     int                   `json:"oldLeafCount"`
+	LeafCount        int                   `json:"leafCount"`
+	ConsistencyProof []merkle.Digest       `json:"consistencyProof"`
+	MerkleMultiProof []merkle.Digest       `json:"merkleMultiProof"`
+	SparseProofs     []*merkle.SparseProof `json:"sparseProofs"`
+}
+
+// ChangedFileResponse proves that the file at Index is the only one that has changed:
+// MerkleProof proves OldLeafHash in the old tree, and its siblings lead the new leaf to MerkleRoot.
+// SparseProofs prove, one after the other, the removal of OldName from the sparse tree,
+// then, when the file is replaced, its new name being set.
+type ChangedFileResponse struct {
+	Index         int                   `json:"index"`
+	MerkleRoot    merkle.Digest         `json:"merkleRoot"`
+	OldLeafHash   merkle.Digest         `json:"oldLeafHash"`
+	MerkleProof   []merkle.ProofHash    `json:"merkleProof"`
+	OldName       string                `json:"oldName"`
+	SparseProofs  []*merkle.SparseProof `json:"sparseProofs"`
+	HashAlgorithm string                `json:"hashAlgorithm"`
+	LeafCount     int                   `json:"leafCount"`
+	merkle.Params
 }
 
+// MerkleProofResponse proves the leaf of a file with Proof, which tells the tree it leads to.
+// MerkleProof, HashAlgorithm, LeafCount and Params are the bare proof and its tree, as sent to older clients.
+// When the files are split into chunks (see merkle.Params.ChunkSize),
+// ChunkHashes lists the hashes of the chunks of the file, whose tree has the leaf hash as root hash,
+// so that the file can be verified chunk by chunk while it's downloaded.
 type MerkleProofResponse struct {
-	MerkleProof []merkle.ProofHash `json:"merkleProof"`
+	Proof         *merkle.Proof      `json:"proof"`
+	MerkleProof   []merkle.ProofHash `json:"merkleProof"`
+	ChunkHashes   []merkle.Digest    `json:"chunkHashes,omitempty"`
+	HashAlgorithm string             `json:"hashAlgorithm"`
+	LeafCount     int                `json:"leafCount"`
+	merkle.Params
+}
+
+// SparseProofResponse proves that a file named Name has been uploaded, or its absence if ValueHash is empty.
+type SparseProofResponse struct {
+	Name          string `json:"name"`
+	HashAlgorithm string `json:"hashAlgorithm"`
+	merkle.SparseProof
+}
+
+// FileMetadataResponse describes an uploaded file, as stored by the server.
+// UploadedAt and LeafHash are missing for the files uploaded before they were recorded.
+type FileMetadataResponse struct {
+	Index       int           `json:"index"`
+	Name        string        `json:"name"`
+	Size        int           `json:"size"`
+	ContentType string        `json:"contentType,omitempty"`
+	UploadedAt  *time.Time    `json:"uploadedAt,omitempty"`
+	LeafHash    merkle.Digest `json:"leafHash,omitempty"`
+}
+
+// DiffResponse lists the indices of the files that differ between the uploads of root hashes RootA and RootB,
+// including the ones found in only one of them.
+type DiffResponse struct {
+	RootA      merkle.Digest `json:"rootA"`
+	RootB      merkle.Digest `json:"rootB"`
+	LeafCountA int           `json:"leafCountA"`
+	LeafCountB int           `json:"leafCountB"`
+	Indices    []int         `json:"indices"`
+}
+
+type MerkleMultiProofResponse struct {
+	Indices          []int           `json:"indices"`
+	MerkleMultiProof []merkle.Digest `json:"merkleMultiProof"`
+	HashAlgorithm    string          `json:"hashAlgorithm"`
+	LeafCount        int             `json:"leafCount"`
+	merkle.Params
 }
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"path/filepath"
 
 	"merkle-file-uploader/internal/merkle"
 	"merkle-file-uploader/internal/protocol"
@@ -13,85 +14,443 @@ import (
 )
 
 var (
-	ErrFailedUpload = errors.New("failed to upload files")
+	ErrFailedUpload       = errors.New("failed to upload files")
+	ErrNotAppendable      = errors.New("files can't be appended to the stored merkle tree")
+	ErrFailedVerification = errors.New("the changes made by the server can't be verified")
+	ErrFailedUpdate       = errors.New("failed to update file")
+	ErrDuplicateFileName  = errors.New("a file with the same name has already been uploaded")
+	ErrAppendOnly         = errors.New("the uploaded files are an append-only log, files can only be appended to it")
+	ErrNotReplaceable     = errors.New("the storage can't replace the uploaded files at once, upload them to a new batch")
 )
 
+// Roots are the root hashes the client keeps in place of the uploaded files:
+// the one of the merkle tree, proving files by index, and the one of the sparse merkle tree, proving them by name.
+// BatchID is the batch the files have been uploaded to, empty for the files uploaded outside of batches.
+type Roots struct {
+	MerkleRoot merkle.Digest
+	SparseRoot merkle.Digest
+	BatchID    string
+}
+
 type HttpUploader struct {
-	client  *http.Client
-	baseURL string
-	hashFn  merkle.HashFn
+	client      *http.Client
+	baseURL     string
+	algorithm   merkle.Algorithm
+	params      merkle.Params
+	hashWorkers int
 }
 
-func NewHttpUploader(httpClient *http.Client, baseURL string, hashFn merkle.HashFn) *HttpUploader {
+// NewHttpUploader creates an uploader hashing files, and building their tree, with up to hashWorkers goroutines at once.
+func NewHttpUploader(
+	httpClient *http.Client,
+	baseURL string,
+	algorithm merkle.Algorithm,
+	params merkle.Params,
+	hashWorkers int,
+) *HttpUploader {
 	return &HttpUploader{
-		client:  httpClient,
-		baseURL: baseURL,
-		hashFn:  hashFn,
+		client:      httpClient,
+		baseURL:     baseURL,
+		algorithm:   algorithm,
+		params:      params,
+		hashWorkers: hashWorkers,
 	}
 }
 
+// UploadFilesFrom uploads files to a new batch, whose ID comes with the roots.
 func (h *HttpUploader) UploadFilesFrom(filePaths []string) (
 	uploadedFiles []protocol.UploadedFile,
-	merkleRoot string,
+	roots Roots,
 	err error,
 ) {
-	requestBody, formDataContentType, err := utils.MultipartFormFromFiles(filePaths)
+	var decodedResponse protocol.UploadedFilesResponse
+	if err = h.postFiles(fmt.Sprintf("%s/batches", h.baseURL), filePaths, nil, &decodedResponse); err != nil {
+		return
+	}
+
+	if decodedResponse.BatchID == "" {
+		err = fmt.Errorf("%w: the server hasn't created a batch", ErrFailedUpload)
+
+		return
+	}
+
+	roots, err = h.computeRoots(filePaths)
 	if err != nil {
-		err = fmt.Errorf("%w: error preparing POST request body: %s", ErrFailedUpload, err)
+		err = fmt.Errorf("%w: error computing merkle roots: %s", ErrFailedUpload, err)
+
+		return
+	}
+	roots.BatchID = decodedResponse.BatchID
+
+	// the root is kept only if the server has built the same tree, e.g. not one of another arity
+	if err = h.checkParams(decodedResponse.Params); err != nil {
+		return
+	}
+	if !decodedResponse.MerkleRoot.Equal(roots.MerkleRoot) {
+		err = fmt.Errorf("%w: the merkle root of the server is %s, not %s", ErrFailedVerification, decodedResponse.MerkleRoot, roots.MerkleRoot)
 
 		return
 	}
 
-	response, err := http.Post(fmt.Sprintf("%s/upload", h.baseURL), formDataContentType, &requestBody)
+	return decodedResponse.UploadedFiles, roots, nil
+}
+
+// AppendFilesFrom appends files to the ones already uploaded, whose roots are given, in the same batch.
+// The new roots are returned only once the server has proven that the tree of the already uploaded files
+// is a prefix of the new one, that the appended files are its last leaves,
+// and that their names have been added to the sparse tree, where they were missing.
+func (h *HttpUploader) AppendFilesFrom(filePaths []string, roots Roots) (
+	uploadedFiles []protocol.UploadedFile,
+	newRoots Roots,
+	err error,
+) {
+	var decodedResponse protocol.AppendedFilesResponse
+	uploadURL := fmt.Sprintf("%s/upload", protocol.BatchURL(h.baseURL, roots.BatchID))
+	if err = h.postFiles(uploadURL, filePaths, map[string]string{protocol.AppendField: "true"}, &decodedResponse); err != nil {
+		return
+	}
+
+	if err = h.checkParams(decodedResponse.Params); err != nil {
+		return
+	}
+
+	if !merkle.VerifyConsistency(
+		roots.MerkleRoot,
+		decodedResponse.OldLeafCount,
+		decodedResponse.MerkleRoot,
+		decodedResponse.LeafCount,
+		decodedResponse.ConsistencyProof,
+		h.algorithm,
+		merkle.WithParams(h.params),
+	) {
+		err = fmt.Errorf("%w: the new merkle root is not consistent with %s", ErrFailedVerification, roots.MerkleRoot)
+
+		return
+	}
+
+	leafHashes, err := h.fileLeafHashes(filePaths)
 	if err != nil {
-		err = fmt.Errorf("%w: error sending POST request: %s", ErrFailedUpload, err)
+		return
+	}
+
+	multiProof := &merkle.MultiProof{Hashes: decodedResponse.MerkleMultiProof}
+	for i := decodedResponse.OldLeafCount; i < decodedResponse.LeafCount; i++ {
+		multiProof.Indices = append(multiProof.Indices, i)
+	}
+
+	if !merkle.VerifyLeafMultiProof(
+		decodedResponse.MerkleRoot,
+		leafHashes,
+		multiProof,
+		h.algorithm,
+		merkle.WithParams(h.params),
+		merkle.WithLeafCount(decodedResponse.LeafCount),
+	) {
+		err = fmt.Errorf("%w: the files are not the last leaves of the new merkle tree", ErrFailedVerification)
+
+		return
+	}
+
+	// The names are added one after the other, each proof leading from the root of the previous addition
+	if len(decodedResponse.SparseProofs) != len(filePaths) {
+		err = fmt.Errorf("%w: unexpected number of sparse merkle proofs", ErrFailedVerification)
+
+		return
+	}
+
+	newRoots = Roots{MerkleRoot: decodedResponse.MerkleRoot, SparseRoot: roots.SparseRoot, BatchID: roots.BatchID}
+	for i, proof := range decodedResponse.SparseProofs {
+		name := filepath.Base(filePaths[i])
+		if newRoots.SparseRoot, err = putName(newRoots.SparseRoot, name, leafHashes[i], proof, h.algorithm); err != nil {
+			return
+		}
+	}
+
+	return decodedResponse.UploadedFiles, newRoots, nil
+}
+
+// UpdateFileAt replaces the uploaded file at index with the one at filePath.
+// The new roots are returned only once the server has proven that they differ from the given ones
+// by that file only.
+func (h *HttpUploader) UpdateFileAt(index int, filePath string, roots Roots) (newRoots Roots, err error) {
+	leafHashes, err := h.fileLeafHashes([]string{filePath})
+	if err != nil {
+		err = fmt.Errorf("%w: %s", ErrFailedUpdate, err)
+
+		return
+	}
+
+	requestBody, formDataContentType := utils.MultipartFormFromFiles(protocol.FilesField, []string{filePath}, nil)
+	request, err := http.NewRequest(http.MethodPut, h.fileURL(roots, index), requestBody)
+	if err != nil {
+		_ = requestBody.Close()
+		err = fmt.Errorf("%w: error preparing PUT request: %s", ErrFailedUpdate, err)
+
+		return
+	}
+	request.Header.Set("Content-Type", formDataContentType)
+
+	decodedResponse, algorithm, err := h.changeFile(request, index, 2)
+	if err != nil {
+		return
+	}
+
+	if !merkle.VerifyLeafUpdate(
+		roots.MerkleRoot,
+		decodedResponse.MerkleRoot,
+		protocol.LeafIndex(index),
+		decodedResponse.OldLeafHash,
+		leafHashes[0],
+		decodedResponse.MerkleProof,
+		algorithm,
+		merkle.WithParams(h.params),
+		merkle.WithLeafCount(decodedResponse.LeafCount),
+	) {
+		err = fmt.Errorf("%w: the file at index %d is not the only change to %s", ErrFailedVerification, index, roots.MerkleRoot)
+
+		return
+	}
+
+	sparseRoot, err := removeName(roots.SparseRoot, decodedResponse, algorithm)
+	if err != nil {
+		return
+	}
+
+	sparseRoot, err = putName(sparseRoot, filepath.Base(filePath), leafHashes[0], decodedResponse.SparseProofs[1], algorithm)
+	if err != nil {
+		return
+	}
+
+	return Roots{MerkleRoot: decodedResponse.MerkleRoot, SparseRoot: sparseRoot, BatchID: roots.BatchID}, nil
+}
+
+// DeleteFileAt deletes the uploaded file at index.
+// The new roots are returned only once the server has proven that they differ from the given ones
+// by the deletion of that file only.
+func (h *HttpUploader) DeleteFileAt(index int, roots Roots) (newRoots Roots, err error) {
+	request, err := http.NewRequest(http.MethodDelete, h.fileURL(roots, index), nil)
+	if err != nil {
+		err = fmt.Errorf("%w: error preparing DELETE request: %s", ErrFailedUpdate, err)
+
+		return
+	}
+
+	decodedResponse, algorithm, err := h.changeFile(request, index, 1)
+	if err != nil {
+		return
+	}
+
+	if !merkle.VerifyDelete(
+		roots.MerkleRoot,
+		decodedResponse.MerkleRoot,
+		protocol.LeafIndex(index),
+		decodedResponse.OldLeafHash,
+		decodedResponse.MerkleProof,
+		algorithm,
+		merkle.WithParams(h.params),
+		merkle.WithLeafCount(decodedResponse.LeafCount),
+	) {
+		err = fmt.Errorf("%w: the deletion of the file at index %d is not the only change to %s", ErrFailedVerification, index, roots.MerkleRoot)
+
+		return
+	}
+
+	sparseRoot, err := removeName(roots.SparseRoot, decodedResponse, algorithm)
+	if err != nil {
+		return
+	}
+
+	return Roots{MerkleRoot: decodedResponse.MerkleRoot, SparseRoot: sparseRoot, BatchID: roots.BatchID}, nil
+}
+
+// checkParams checks that the server builds trees with the params of the client, which are the ones roots are
+// computed and proofs verified with.
+func (h *HttpUploader) checkParams(params merkle.Params) error {
+	if params != h.params {
+		return fmt.Errorf("%w: the server builds trees with other parameters: %+v", ErrFailedVerification, params)
+	}
+
+	return nil
+}
+
+// fileURL is the URL of the uploaded file at index, in the batch of the roots.
+func (h *HttpUploader) fileURL(roots Roots, index int) string {
+	return fmt.Sprintf("%s/files/%d", protocol.BatchURL(h.baseURL, roots.BatchID), index)
+}
+
+// changeFile sends a request changing the file at index, and decodes the proof of the change,
+// expected to hold sparseProofsCount sparse merkle proofs, to be verified with the returned hash algorithm.
+func (h *HttpUploader) changeFile(request *http.Request, index int, sparseProofsCount int) (
+	decodedResponse protocol.ChangedFileResponse,
+	algorithm merkle.Algorithm,
+	err error,
+) {
+	response, err := h.client.Do(request)
+	if err != nil {
+		err = fmt.Errorf("%w: error sending %s request: %s", ErrFailedUpdate, request.Method, err)
 
 		return
 	}
+	defer func() { _ = response.Body.Close() }()
 
 	if response.StatusCode != http.StatusOK {
-		err = fmt.Errorf("%w: unexpected http status: %s", ErrFailedUpload, response.Status)
+		err = fmt.Errorf("%w: unexpected http status: %s", ErrFailedUpdate, response.Status)
 
 		return
 	}
 
-	var decodedResponse protocol.UploadedFilesResponse
 	if err = json.NewDecoder(response.Body).Decode(&decodedResponse); err != nil {
-		err = fmt.Errorf("%w: error decoding json response: %s", ErrFailedUpload, err)
+		err = fmt.Errorf("%w: error decoding json response: %s", ErrFailedUpdate, err)
 
 		return
 	}
 
-	defer func() { _ = response.Body.Close() }()
+	// the proof is verified against the tree the client expects, with the algorithm the tree has been built with
+	if decodedResponse.Index != index || decodedResponse.Params != h.params {
+		err = fmt.Errorf("%w: unexpected tree parameters", ErrFailedVerification)
+
+		return
+	}
+
+	if len(decodedResponse.SparseProofs) != sparseProofsCount {
+		err = fmt.Errorf("%w: unexpected number of sparse merkle proofs", ErrFailedVerification)
+
+		return
+	}
+
+	if algorithm, err = merkle.HashAlgorithm(decodedResponse.HashAlgorithm); err != nil {
+		err = fmt.Errorf("%w: %s", ErrFailedVerification, err)
+	}
+
+	return
+}
+
+// removeName verifies the removal of the old name of a changed file from the sparse tree of sparseRoot,
+// and returns the new root. The value of the name must be the changed file, as proven in the merkle tree:
+// the value hashes of the sparse tree are the leaf hashes of the files in the merkle tree.
+func removeName(
+	sparseRoot merkle.Digest,
+	decodedResponse protocol.ChangedFileResponse,
+	algorithm merkle.Algorithm,
+) (newSparseRoot merkle.Digest, err error) {
+	proof := decodedResponse.SparseProofs[0]
+	if !proof.ValueHash.Equal(decodedResponse.OldLeafHash) {
+		err = fmt.Errorf("%w: %s is not the name of the changed file", ErrFailedVerification, decodedResponse.OldName)
+
+		return
+	}
+
+	newSparseRoot, ok := merkle.VerifySparseRemove(sparseRoot, decodedResponse.OldName, proof, algorithm)
+	if !ok {
+		err = fmt.Errorf("%w: %s is not in the sparse merkle tree of %s", ErrFailedVerification, decodedResponse.OldName, sparseRoot)
+	}
 
-	merkleRoot, err = h.computeMerkleRoot(filePaths)
+	return
+}
+
+// putName verifies the addition of a name, which must be missing, to the sparse tree of sparseRoot,
+// and returns the new root.
+func putName(
+	sparseRoot merkle.Digest,
+	name string,
+	leafHash merkle.Digest,
+	proof *merkle.SparseProof,
+	algorithm merkle.Algorithm,
+) (newSparseRoot merkle.Digest, err error) {
+	if len(proof.ValueHash) != 0 {
+		err = fmt.Errorf("%w: %s has already been uploaded", ErrFailedVerification, name)
+
+		return
+	}
+
+	newSparseRoot, ok := merkle.VerifySparsePut(sparseRoot, name, leafHash, proof, algorithm)
+	if !ok {
+		err = fmt.Errorf("%w: %s can't be added to the sparse merkle tree of %s", ErrFailedVerification, name, sparseRoot)
+	}
+
+	return
+}
+
+// postFiles uploads the files to uploadURL, along with the given form fields, and decodes the json response.
+func (h *HttpUploader) postFiles(uploadURL string, filePaths []string, fields map[string]string, decodedResponse any) (err error) {
+	formFields := map[string]string{protocol.HashAlgorithmField: h.algorithm.Name}
+	for name, value := range fields {
+		formFields[name] = value
+	}
+
+	// the files are streamed as they are sent, the request body is closed once it's sent, or fails
+	requestBody, formDataContentType := utils.MultipartFormFromFiles(protocol.FilesField, filePaths, formFields)
+	request, err := http.NewRequest(http.MethodPost, uploadURL, requestBody)
 	if err != nil {
-		err = fmt.Errorf("%w: error computing merkle root: %s", ErrFailedUpload, err)
+		_ = requestBody.Close()
+		err = fmt.Errorf("%w: error preparing POST request: %s", ErrFailedUpload, err)
 
 		return
 	}
+	request.Header.Set("Content-Type", formDataContentType)
+
+	response, err := h.client.Do(request)
+	if err != nil {
+		err = fmt.Errorf("%w: error sending POST request: %s", ErrFailedUpload, err)
+
+		return
+	}
+	defer func() { _ = response.Body.Close() }()
+
+	if response.StatusCode != http.StatusOK {
+		err = fmt.Errorf("%w: unexpected http status: %s", ErrFailedUpload, response.Status)
 
-	return decodedResponse.UploadedFiles, merkleRoot, nil
+		return
+	}
+
+	if err = json.NewDecoder(response.Body).Decode(decodedResponse); err != nil {
+		err = fmt.Errorf("%w: error decoding json response: %s", ErrFailedUpload, err)
+	}
+
+	return
 }
 
-func (h *HttpUploader) computeMerkleRoot(filePaths []string) (merkleRoot string, err error) {
-	var blocks []string
-	for _, f := range filePaths {
-		var fileContent []byte
-		fileContent, err = os.ReadFile(f)
-		if err != nil {
-			err = fmt.Errorf("%w: error reading file for hashing: %s", ErrFailedUpload, err)
+// computeRoots computes the roots of the files on the client side, as they are uploaded by name.
+func (h *HttpUploader) computeRoots(filePaths []string) (roots Roots, err error) {
+	leafHashes, err := h.fileLeafHashes(filePaths)
+	if err != nil {
+		return
+	}
 
-			return
-		}
+	tree, err := merkle.NewTreeFromLeafHashes(leafHashes, h.algorithm,
+		merkle.WithParams(h.params),
+		merkle.WithHashWorkers(h.hashWorkers),
+	)
+	if err != nil {
+		return
+	}
+
+	sparseTree := merkle.NewSparseTree(h.algorithm)
+	for i, f := range filePaths {
+		sparseTree.Put(filepath.Base(f), leafHashes[i])
+	}
 
-		blocks = append(blocks, string(fileContent))
+	return Roots{MerkleRoot: tree.RootHash(), SparseRoot: sparseTree.RootHash()}, nil
+}
+
+// fileLeafHashes computes the leaf hashes of the files concurrently, reading each one a chunk at a time.
+func (h *HttpUploader) fileLeafHashes(filePaths []string) (leafHashes []merkle.Digest, err error) {
+	leafHashes, err = merkle.ComputeLeafHashes(len(filePaths), h.hashWorkers, func(i int) (merkle.Digest, error) {
+		return fileLeafHash(filePaths[i], h.algorithm, h.params)
+	})
+	if err != nil {
+		err = fmt.Errorf("%w: error reading file for hashing: %s", ErrFailedUpload, err)
 	}
 
-	tree, err := merkle.NewTree(blocks, h.hashFn)
+	return
+}
+
+func fileLeafHash(filePath string, algorithm merkle.Algorithm, params merkle.Params) (leafHash merkle.Digest, err error) {
+	file, err := os.Open(filePath)
 	if err != nil {
 		return
 	}
+	defer func() { _ = file.Close() }()
 
-	return tree.Root.Data, nil
+	return merkle.FileLeafHash(file, algorithm, params)
 }
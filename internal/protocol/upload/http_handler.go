@@ -4,7 +4,12 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
 
 	"merkle-file-uploader/internal/merkle"
 	"merkle-file-uploader/internal/protocol"
@@ -12,7 +17,45 @@ import (
 	"merkle-file-uploader/internal/utils"
 )
 
-func NewUploadHandler(repository storage.Repository, hashFn merkle.HashFn) func(http.ResponseWriter, *http.Request) {
+// treeMu serializes the handlers replacing the stored tree.
+var treeMu sync.Mutex
+
+// errUnreadableFile is a client error failing an upload, which is rolled back.
+var errUnreadableFile = errors.New("unable to read file")
+
+// NewUploadHandler stores the uploaded files, and builds their tree with up to hashWorkers goroutines hashing at once.
+// With the mountain range backend, the files are an append-only log: they're appended to the stored range,
+// and can't be uploaded anew once there's one.
+func NewUploadHandler(
+	repository storage.Repository,
+	defaultAlgorithm merkle.Algorithm,
+	params merkle.Params,
+	hashWorkers int,
+	backend protocol.TreeBackend,
+) func(http.ResponseWriter, *http.Request) {
+	return newUploadHandler(repository, defaultAlgorithm, params, hashWorkers, backend, false)
+}
+
+// NewBatchUploadHandler creates a batch, and stores the uploaded files in it as NewUploadHandler does.
+// The response tells the ID of the batch, whose files are then served under /batches/{id}.
+func NewBatchUploadHandler(
+	repository storage.Repository,
+	defaultAlgorithm merkle.Algorithm,
+	params merkle.Params,
+	hashWorkers int,
+	backend protocol.TreeBackend,
+) func(http.ResponseWriter, *http.Request) {
+	return newUploadHandler(repository, defaultAlgorithm, params, hashWorkers, backend, true)
+}
+
+func newUploadHandler(
+	repository storage.Repository,
+	defaultAlgorithm merkle.Algorithm,
+	params merkle.Params,
+	hashWorkers int,
+	backend protocol.TreeBackend,
+	newBatch bool,
+) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			utils.HttpError(w, http.StatusMethodNotAllowed, errors.New(r.Method))
@@ -27,67 +70,594 @@ func NewUploadHandler(repository storage.Repository, hashFn merkle.HashFn) func(
 			return
 		}
 
-		if err := repository.DeleteAllFiles(r.Context()); err != nil {
-			utils.HttpError(w, http.StatusInternalServerError, fmt.Errorf("error while resetting storage: %s", err))
+		// the client picks the hash algorithm, older clients don't send it at all
+		algorithm := defaultAlgorithm
+		if name := r.FormValue(protocol.HashAlgorithmField); name != "" {
+			var err error
+			if algorithm, err = merkle.HashAlgorithm(name); err != nil {
+				utils.HttpError(w, http.StatusBadRequest, err)
+
+				return
+			}
+		}
+
+		isAppend := r.FormValue(protocol.AppendField) == "true"
+		if newBatch && isAppend {
+			utils.HttpError(w, http.StatusConflict, fmt.Errorf("%w: a new batch has no files yet", ErrNotAppendable))
 
 			return
 		}
 
-		var uploadedFiles []protocol.UploadedFile
-		var blocks []string
+		// the files are replaced by deleting them first, which a failing upload mustn't leave halfway
+		if !newBatch && !isAppend && !repository.Atomic() {
+			utils.HttpError(w, http.StatusConflict, ErrNotReplaceable)
 
-		files := r.MultipartForm.File["files"]
-		for _, fileHeader := range files {
-			file, err := fileHeader.Open()
+			return
+		}
+
+		treeMu.Lock()
+		defer treeMu.Unlock()
+
+		var oldTree *merkle.Tree
+		var oldRange *merkle.MountainRange
+		sparseTree := merkle.NewSparseTree(algorithm)
+		if !newBatch && (backend == protocol.TreeBackendMountainRange || isAppend) {
+			var err error
+			if backend == protocol.TreeBackendMountainRange {
+				oldRange, sparseTree, err = appendableMountainRange(r, repository, algorithm, isAppend)
+			} else {
+				oldTree, sparseTree, err = appendableTrees(r, repository, algorithm)
+			}
 			if err != nil {
-				utils.HttpError(w, http.StatusBadRequest, fmt.Errorf("unable to open file: %s", err))
+				statusCode := http.StatusInternalServerError
+				if errors.Is(err, ErrNotAppendable) || errors.Is(err, ErrAppendOnly) || errors.Is(err, storage.ErrTreeNotFound) {
+					statusCode = http.StatusConflict
+				}
+
+				utils.HttpError(w, statusCode, err)
 
 				return
 			}
-			_ = file.Close()
+		}
 
-			data, err := io.ReadAll(file)
-			if err != nil {
-				utils.HttpError(w, http.StatusBadRequest, fmt.Errorf("unable to read file: %s", err))
+		// files are keyed by name in the sparse tree
+		files := r.MultipartForm.File[protocol.FilesField]
+		names := make(map[string]bool)
+		for _, fileHeader := range files {
+			if names[fileHeader.Filename] || sparseTree.Contains(fileHeader.Filename) {
+				utils.HttpError(w, http.StatusConflict, fmt.Errorf("%w: %s", ErrDuplicateFileName, fileHeader.Filename))
+
+				return
+			}
+			names[fileHeader.Filename] = true
+		}
+
+		// appended files must be hashed as the ones already in the tree
+		oldLeafCount := 0
+		if oldTree != nil {
+			params, oldLeafCount = oldTree.Params, oldTree.LeafCount
+		}
+		if oldRange != nil {
+			params, oldLeafCount = oldRange.Params, oldRange.LeafCount
+		}
 
+		// files are hashed concurrently, then stored one after the other, along with their chunk hashes
+		chunkHashes := make([][]merkle.Digest, len(files))
+		leafHashes, err := merkle.ComputeLeafHashes(len(files), hashWorkers, func(i int) (leafHash merkle.Digest, err error) {
+			file, err := files[i].Open()
+			if err != nil {
 				return
 			}
+			defer func() { _ = file.Close() }()
+
+			leafHash, chunkHashes[i], err = hashFile(file, algorithm, params)
+
+			return
+		})
+		if err != nil {
+			utils.HttpError(w, http.StatusBadRequest, fmt.Errorf("unable to read file: %s", err))
+
+			return
+		}
+
+		// the files and trees are stored at once, or not at all if the storage has transactions
+		var uploadedFiles []protocol.UploadedFile
+		var sparseProofs []*merkle.SparseProof
+		var merkleTree merkle.Prover
+		var batchID string
+		uploadedAt := time.Now().UTC()
+		err = repository.Transaction(r.Context(), func(tx storage.Repository) (err error) {
+			switch {
+			case newBatch:
+				if batchID, err = tx.CreateBatch(r.Context()); err != nil {
+					return fmt.Errorf("error while creating batch: %s", err)
+				}
+				if tx, err = tx.Batch(r.Context(), batchID); err != nil {
+					return
+				}
+			case !isAppend:
+				if err = tx.DeleteAllFiles(r.Context()); err != nil {
+					return fmt.Errorf("error while resetting storage: %s", err)
+				}
+			}
+
+			for i, fileHeader := range files {
+				index, err := storeFile(r, tx, fileHeader, storage.FileMetadata{
+					Name:       fileHeader.Filename,
+					UploadedAt: uploadedAt,
+					LeafHash:   leafHashes[i],
+				}, chunkHashes[i])
+				if err != nil {
+					return err
+				}
+
+				uploadedFiles = append(uploadedFiles, protocol.UploadedFile{
+					Name:  fileHeader.Filename,
+					Index: index,
+				})
+
+				if isAppend {
+					sparseProofs = append(sparseProofs, sparseTree.Proof(fileHeader.Filename))
+				}
+				sparseTree.Put(fileHeader.Filename, leafHashes[i])
+			}
 
-			i, err := repository.StoreFile(r.Context(), storage.StoredFile{
-				Name:    fileHeader.Filename,
-				Content: data,
-			})
+			switch {
+			case backend == protocol.TreeBackendMountainRange:
+				merkleTree, err = appendToMountainRange(oldRange, leafHashes, algorithm, params)
+			case isAppend:
+				merkleTree, err = oldTree.AppendLeafHashes(leafHashes, merkle.WithHashWorkers(hashWorkers))
+			default:
+				merkleTree, err = merkle.NewTreeFromLeafHashes(leafHashes, algorithm,
+					merkle.WithParams(params),
+					merkle.WithHashWorkers(hashWorkers),
+				)
+			}
 			if err != nil {
+				return
+			}
+
+			return storeTrees(r, tx, merkleTree, sparseTree)
+		})
+		if errors.Is(err, errUnreadableFile) {
+			utils.HttpError(w, http.StatusBadRequest, err)
+
+			return
+		}
+		if err != nil {
+			utils.HttpError(w, http.StatusInternalServerError, err)
+
+			return
+		}
+
+		uploadedFilesResponse := protocol.UploadedFilesResponse{
+			UploadedFiles: uploadedFiles,
+			BatchID:       batchID,
+			MerkleRoot:    merkleTree.RootHash(),
+			Params:        merkleTree.Header().Params,
+		}
+		var response any = uploadedFilesResponse
+		if isAppend {
+			if response, err = appendedFilesResponse(oldLeafCount, merkleTree, uploadedFilesResponse, sparseProofs); err != nil {
 				utils.HttpError(w, http.StatusInternalServerError, err)
 
 				return
 			}
+		}
+
+		if err := utils.HttpOkJson(w, response); err != nil {
+			utils.HttpError(w, http.StatusInternalServerError, err)
+
+			return
+		}
+	}
+}
+
+// NewFileHandler replaces (PUT) or deletes (DELETE) the file at {index}, updating the stored tree accordingly.
+// The new file is sent as the only file of a multipart form, as in uploads.
+// A deleted file keeps its leaf, marked as deleted, so that the other files don't change index.
+// Files can't be changed with the mountain range backend, which is append-only.
+func NewFileHandler(
+	repository storage.Repository,
+	defaultAlgorithm merkle.Algorithm,
+	backend protocol.TreeBackend,
+) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+			utils.HttpError(w, http.StatusMethodNotAllowed, errors.New(r.Method))
+
+			return
+		}
 
-			uploadedFiles = append(uploadedFiles, protocol.UploadedFile{
-				Name:  fileHeader.Filename,
-				Index: i,
-			})
+		if backend == protocol.TreeBackendMountainRange {
+			utils.HttpError(w, http.StatusConflict, ErrAppendOnly)
 
-			blocks = append(blocks, string(data))
+			return
 		}
 
-		merkleTree, err := merkle.NewTree(blocks, hashFn)
+		index, err := utils.IndexFromRequest(r)
+		if err != nil {
+			utils.HttpError(w, http.StatusBadRequest, err)
+
+			return
+		}
+
+		var file storage.StoredFile
+		var content multipart.File
+		if r.Method == http.MethodPut {
+			if file, content, err = fileFromRequest(r); err != nil {
+				utils.HttpError(w, http.StatusBadRequest, err)
+
+				return
+			}
+			defer func() { _ = content.Close() }()
+			file.Index = index
+		}
+
+		treeMu.Lock()
+		defer treeMu.Unlock()
+
+		oldTree, err := repository.RetrieveTree(r.Context())
+		if errors.Is(err, storage.ErrTreeNotFound) {
+			utils.HttpError(w, http.StatusNotFound, err)
+
+			return
+		}
 		if err != nil {
 			utils.HttpError(w, http.StatusInternalServerError, err)
 
 			return
 		}
 
-		if err = repository.StoreTree(r.Context(), merkleTree); err != nil {
-			utils.HttpError(w, http.StatusInternalServerError, fmt.Errorf("unable to store the merkle tree: %s", err))
+		// trees stored before the hash algorithm was recorded have been built with the default one
+		if oldTree.HashAlgorithm == "" {
+			oldTree.HashAlgorithm = defaultAlgorithm.Name
+			oldTree.Hasher = defaultAlgorithm
+		}
+
+		oldLeafHash, err := oldTree.LeafHash(protocol.LeafIndex(index))
+		if errors.Is(err, merkle.ErrIndexOutOfRange) {
+			utils.HttpError(w, http.StatusNotFound, fmt.Errorf("{index} not found: %d", index))
+
+			return
+		}
+		if err != nil {
+			utils.HttpError(w, http.StatusInternalServerError, err)
 
 			return
 		}
 
-		if err := utils.HttpOkJson(w, protocol.UploadedFilesResponse{UploadedFiles: uploadedFiles}); err != nil {
+		merkleProof, err := oldTree.ProofForIndex(protocol.LeafIndex(index))
+		if err != nil {
 			utils.HttpError(w, http.StatusInternalServerError, err)
 
 			return
 		}
+
+		oldFile, err := repository.RetrieveFileMetadata(r.Context(), index)
+		if errors.Is(err, storage.ErrStoredFileNotFound) {
+			utils.HttpError(w, http.StatusNotFound, fmt.Errorf("{index} not found: %d", index))
+
+			return
+		}
+		if err != nil {
+			utils.HttpError(w, http.StatusInternalServerError, err)
+
+			return
+		}
+
+		sparseTree, err := repository.RetrieveSparseTree(r.Context())
+		if errors.Is(err, storage.ErrTreeNotFound) {
+			utils.HttpError(w, http.StatusNotFound, err)
+
+			return
+		}
+		if err != nil {
+			utils.HttpError(w, http.StatusInternalServerError, err)
+
+			return
+		}
+
+		var leafHash merkle.Digest
+		if r.Method == http.MethodPut {
+			// the content is hashed, then read again as it's stored
+			leafHash, file.ChunkHashes, err = hashFile(content, oldTree.Hasher, oldTree.Params)
+			if err == nil {
+				_, err = content.Seek(0, io.SeekStart)
+			}
+			if err != nil {
+				utils.HttpError(w, http.StatusInternalServerError, err)
+
+				return
+			}
+			file.LeafHash = leafHash
+		}
+
+		// the old name is removed from the sparse tree, then the new one is set, so that the file can be renamed
+		sparseTree = sparseTree.Clone()
+		sparseProofs := []*merkle.SparseProof{sparseTree.Proof(oldFile.Name)}
+		sparseTree.Remove(oldFile.Name)
+		if r.Method == http.MethodPut {
+			if sparseTree.Contains(file.Name) {
+				utils.HttpError(w, http.StatusConflict, fmt.Errorf("%w: %s", ErrDuplicateFileName, file.Name))
+
+				return
+			}
+
+			sparseProofs = append(sparseProofs, sparseTree.Proof(file.Name))
+			sparseTree.Put(file.Name, leafHash)
+		}
+
+		var merkleTree *merkle.Tree
+		err = repository.Transaction(r.Context(), func(tx storage.Repository) (err error) {
+			if r.Method == http.MethodPut {
+				if err = tx.ReplaceFile(r.Context(), file); err == nil {
+					merkleTree, err = oldTree.UpdateLeafHash(protocol.LeafIndex(index), leafHash)
+				}
+			} else {
+				if err = tx.DeleteFile(r.Context(), index); err == nil {
+					merkleTree, err = oldTree.Delete(protocol.LeafIndex(index))
+				}
+			}
+			if err != nil {
+				return
+			}
+
+			return storeTrees(r, tx, merkleTree, sparseTree)
+		})
+		if err != nil {
+			utils.HttpError(w, http.StatusInternalServerError, err)
+
+			return
+		}
+
+		if err = utils.HttpOkJson(w, protocol.ChangedFileResponse{
+			Index:         index,
+			MerkleRoot:    merkleTree.RootHash(),
+			OldLeafHash:   oldLeafHash,
+			MerkleProof:   merkleProof,
+			OldName:       oldFile.Name,
+			SparseProofs:  sparseProofs,
+			HashAlgorithm: merkleTree.HashAlgorithm,
+			LeafCount:     merkleTree.LeafCount,
+			Params:        merkleTree.Params,
+		}); err != nil {
+			utils.HttpError(w, http.StatusInternalServerError, err)
+		}
+	}
+}
+
+// storeFile stores an uploaded file, streaming its content from the parsed form, which keeps large files on disk.
+// Failing to read it fails with errUnreadableFile.
+func storeFile(
+	r *http.Request,
+	repository storage.Repository,
+	fileHeader *multipart.FileHeader,
+	metadata storage.FileMetadata,
+	chunkHashes []merkle.Digest,
+) (index int, err error) {
+	file, err := fileHeader.Open()
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s", errUnreadableFile, err)
+	}
+	defer func() { _ = file.Close() }()
+
+	if metadata.ContentType, err = contentType(fileHeader, file); err != nil {
+		return 0, fmt.Errorf("%w: %s", errUnreadableFile, err)
+	}
+
+	return repository.StoreFile(r.Context(), storage.StoredFile{FileMetadata: metadata, Content: file, ChunkHashes: chunkHashes})
+}
+
+// hashFile returns the leaf hash of a file in a tree with the given params, see merkle.FileLeafHash,
+// along with the hashes of its chunks, if the params split files into chunks.
+func hashFile(r io.Reader, hasher merkle.Hasher, params merkle.Params) (leafHash merkle.Digest, chunkHashes []merkle.Digest, err error) {
+	if params.ChunkSize == 0 {
+		leafHash, err = merkle.FileLeafHash(r, hasher, params)
+
+		return
+	}
+
+	if chunkHashes, err = merkle.ChunkHashes(r, params.ChunkSize, hasher); err != nil {
+		return
+	}
+
+	leafHash, err = merkle.ChunkTreeRoot(chunkHashes, hasher)
+
+	return
+}
+
+// fileFromRequest opens the only file of the multipart form of the request, whose content is to be closed.
+func fileFromRequest(r *http.Request) (file storage.StoredFile, content multipart.File, err error) {
+	// limit maxMultipartMemory
+	if err = r.ParseMultipartForm(10 << 20); err != nil {
+		err = fmt.Errorf("unable to parse multipart form: %s", err)
+
+		return
+	}
+
+	files := r.MultipartForm.File[protocol.FilesField]
+	if len(files) != 1 {
+		err = fmt.Errorf("exactly one file is expected, got %d", len(files))
+
+		return
+	}
+
+	if content, err = files[0].Open(); err != nil {
+		err = fmt.Errorf("unable to open file: %s", err)
+
+		return
+	}
+
+	file.Name = files[0].Filename
+	if file.ContentType, err = contentType(files[0], content); err != nil {
+		_ = content.Close()
+		err = fmt.Errorf("unable to read file: %s", err)
+
+		return
+	}
+	file.UploadedAt = time.Now().UTC()
+	file.Content = content
+
+	return
+}
+
+// contentType is the content type of an uploaded file: the one the client sent, unless missing or generic,
+// or else the one of its extension, or else the one sniffed from the start of its content, which is then rewound.
+func contentType(fileHeader *multipart.FileHeader, file multipart.File) (string, error) {
+	if sent := fileHeader.Header.Get("Content-Type"); sent != "" && sent != "application/octet-stream" {
+		if _, _, err := mime.ParseMediaType(sent); err == nil {
+			return sent, nil
+		}
+	}
+
+	if byExtension := mime.TypeByExtension(filepath.Ext(fileHeader.Filename)); byExtension != "" {
+		return byExtension, nil
+	}
+
+	// DetectContentType considers the first 512 bytes at most
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	return http.DetectContentType(head[:n]), nil
+}
+
+// appendableTrees retrieves the stored trees, which files are going to be appended to.
+// The sparse tree is a copy, to be changed.
+func appendableTrees(r *http.Request, repository storage.Repository, algorithm merkle.Algorithm) (
+	tree *merkle.Tree,
+	sparseTree *merkle.SparseTree,
+	err error,
+) {
+	tree, err = repository.RetrieveTree(r.Context())
+	if err != nil {
+		return
+	}
+
+	// the appended files must be hashed as the ones already in the tree,
+	// and consistency proofs are available only for binary trees promoting odd nodes
+	if tree.HashAlgorithm != algorithm.Name {
+		return nil, nil, fmt.Errorf("%w: the tree has been built with the %q hash algorithm", ErrNotAppendable, tree.HashAlgorithm)
+	}
+
+	if tree.OddNodes != merkle.OddNodesPromote || tree.Arity != 2 {
+		return nil, nil, fmt.Errorf("%w: %s", ErrNotAppendable, merkle.ErrConsistencyUnsupported)
+	}
+
+	if sparseTree, err = repository.RetrieveSparseTree(r.Context()); err != nil {
+		return nil, nil, err
 	}
+
+	return tree, sparseTree.Clone(), nil
+}
+
+// appendableMountainRange retrieves the stored mountain range, which files are going to be appended to,
+// along with a copy of the sparse tree, to be changed.
+// Without a stored range, files can be uploaded anew only: the range is created by the first upload.
+func appendableMountainRange(r *http.Request, repository storage.Repository, algorithm merkle.Algorithm, isAppend bool) (
+	mountainRange *merkle.MountainRange,
+	sparseTree *merkle.SparseTree,
+	err error,
+) {
+	mountainRange, err = repository.RetrieveMountainRange(r.Context())
+	if errors.Is(err, storage.ErrTreeNotFound) && !isAppend {
+		return nil, merkle.NewSparseTree(algorithm), nil
+	}
+	if err != nil {
+		return
+	}
+
+	if !isAppend {
+		return nil, nil, ErrAppendOnly
+	}
+
+	if mountainRange.HashAlgorithm != algorithm.Name {
+		return nil, nil, fmt.Errorf("%w: the tree has been built with the %q hash algorithm", ErrNotAppendable, mountainRange.HashAlgorithm)
+	}
+
+	if sparseTree, err = repository.RetrieveSparseTree(r.Context()); err != nil {
+		return nil, nil, err
+	}
+
+	return mountainRange, sparseTree.Clone(), nil
+}
+
+// appendToMountainRange appends the leaves to a copy of the stored mountain range, or to a new one if there's none yet.
+func appendToMountainRange(
+	oldRange *merkle.MountainRange,
+	leafHashes []merkle.Digest,
+	algorithm merkle.Algorithm,
+	params merkle.Params,
+) (mountainRange *merkle.MountainRange, err error) {
+	if len(leafHashes) == 0 {
+		return nil, merkle.ErrEmptyTreeInput
+	}
+
+	if oldRange != nil {
+		mountainRange = oldRange.Clone()
+	} else if mountainRange, err = merkle.NewMountainRange(algorithm, merkle.WithParams(params)); err != nil {
+		return
+	}
+	mountainRange.AppendLeafHashes(leafHashes)
+
+	return
+}
+
+// storeTrees stores both the merkle tree, or mountain range, and the sparse tree of the uploaded files.
+func storeTrees(r *http.Request, repository storage.Repository, tree merkle.Prover, sparseTree *merkle.SparseTree) (err error) {
+	switch tree := tree.(type) {
+	case *merkle.MountainRange:
+		err = repository.StoreMountainRange(r.Context(), tree)
+	case *merkle.Tree:
+		err = repository.StoreTree(r.Context(), tree)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to store the merkle tree: %s", err)
+	}
+
+	if err = repository.StoreSparseTree(r.Context(), sparseTree); err != nil {
+		return fmt.Errorf("unable to store the sparse merkle tree: %s", err)
+	}
+
+	return
+}
+
+// appendedFilesResponse proves that the tree of oldLeafCount leaves is a prefix of newTree,
+// and that the appended files are its last leaves.
+func appendedFilesResponse(
+	oldLeafCount int,
+	newTree merkle.Prover,
+	uploadedFilesResponse protocol.UploadedFilesResponse,
+	sparseProofs []*merkle.SparseProof,
+) (response protocol.AppendedFilesResponse, err error) {
+	consistencyProof, err := newTree.ConsistencyProof(oldLeafCount)
+	if err != nil {
+		return
+	}
+
+	leafCount := newTree.Header().LeafCount
+	var appendedIndices []int
+	for i := oldLeafCount; i < leafCount; i++ {
+		appendedIndices = append(appendedIndices, i)
+	}
+
+	multiProof, err := newTree.MultiProofForIndices(appendedIndices)
+	if err != nil {
+		return
+	}
+
+	return protocol.AppendedFilesResponse{
+		UploadedFilesResponse: uploadedFilesResponse,
+		OldLeafCount:          oldLeafCount,
+		LeafCount:             leafCount,
+		ConsistencyProof:      consistencyProof,
+		MerkleMultiProof:      multiProof.Hashes,
+		SparseProofs:          sparseProofs,
+	}, nil
 }
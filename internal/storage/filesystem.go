@@ -0,0 +1,892 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"merkle-file-uploader/internal/merkle"
+)
+
+const (
+	filesDir          = "files"
+	lastIndexFileName = "last-index"
+	metadataSuffix    = ".meta"
+	pendingSuffix     = ".pending"
+	tmpSuffix         = ".tmp"
+	deletedSuffix     = ".deleted"
+	transactionDir    = ".transaction"
+	committedSuffix   = ".committed"
+)
+
+// FileSystemStorage keeps files and trees on a local disk, under a root directory:
+//
+//	files/<index>               the content of a file
+//	files/<index>.meta          its metadata sidecar, see fileMetadata
+//	last-index                  the highest index files have been stored at
+//	<tree file names>           the current trees, as named when the storage is created
+//	.merkletrees/<root hash>    every stored tree, by root hash
+//	batches/<id>/               the files and trees of a batch, laid out as above but for trees by root hash
+//	files.deleted/              the files being deleted, see DeleteAllFiles
+//	.transaction/               the files, last index and trees written by a transaction, see Transaction
+//
+// Every write goes to a temporary file first, which is synced and renamed over the target,
+// so that a crash leaves either the previous content or the new one. A file exists as long as its sidecar does:
+// it's written last when a file is stored or replaced, and removed first when it's deleted.
+// Writes interrupted by a crash are rolled back, or forward, by NewFileSystemStorage, see recover.
+type FileSystemStorage struct {
+	mu                    sync.RWMutex
+	txMu                  sync.Mutex // serializes transactions, see Transaction
+	staged                bool       // whether the storage is the one of a transaction
+	rootDir               string
+	lastIndex             int
+	merkleTreeFileName    string
+	sparseTreeFileName    string
+	mountainRangeFileName string
+
+	treesDir string // every stored tree, by root hash, shared by the batches
+	batches  *fileSystemBatches
+}
+
+var _ Repository = (*FileSystemStorage)(nil)
+
+// fileSystemBatches are the batches of a FileSystemStorage, by ID, each one being a storage of its own.
+type fileSystemBatches struct {
+	mu       sync.RWMutex
+	dir      string
+	storages map[string]*FileSystemStorage
+}
+
+// fileMetadata is the sidecar of a stored file. The size and hash of the content tell whether a crash
+// has interrupted its replacement, after the content has been renamed in place but before the sidecar.
+type fileMetadata struct {
+	Name        string        `json:"name"`
+	Size        int           `json:"size"`
+	SHA256      merkle.Digest `json:"sha256"`
+	ContentType string        `json:"contentType,omitempty"`
+	UploadedAt  time.Time     `json:"uploadedAt"`
+	LeafHash    merkle.Digest `json:"leafHash,omitempty"`
+
+	ChunkHashes []merkle.Digest `json:"chunkHashes,omitempty"`
+}
+
+// NewFileSystemStorage creates a storage under rootDir, creating it if needed,
+// and recovers the writes a crash may have interrupted, in its batches as well.
+func NewFileSystemStorage(
+	rootDir, merkleTreeFileName, sparseTreeFileName, mountainRangeFileName string,
+) (fsStorage *FileSystemStorage, err error) {
+	treesDir := filepath.Join(rootDir, treesByRootPrefix)
+	batches := &fileSystemBatches{
+		dir:      filepath.Join(rootDir, batchesPrefix),
+		storages: make(map[string]*FileSystemStorage),
+	}
+	for _, dir := range []string{treesDir, batches.dir} {
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	if err = removeTmpFiles(treesDir); err != nil {
+		return nil, err
+	}
+
+	fsStorage = &FileSystemStorage{
+		merkleTreeFileName:    merkleTreeFileName,
+		sparseTreeFileName:    sparseTreeFileName,
+		mountainRangeFileName: mountainRangeFileName,
+		treesDir:              treesDir,
+		batches:               batches,
+	}
+	if err = fsStorage.open(rootDir); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(batches.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || !validBatchID(entry.Name()) {
+			continue
+		}
+
+		if batches.storages[entry.Name()], err = fsStorage.openBatch(entry.Name()); err != nil {
+			return nil, err
+		}
+	}
+
+	return
+}
+
+// open opens the storage under rootDir, creating it if needed, and recovers the writes a crash may have interrupted.
+func (s *FileSystemStorage) open(rootDir string) (err error) {
+	s.rootDir = rootDir
+	if err = os.MkdirAll(filepath.Join(rootDir, filesDir), 0755); err != nil {
+		return
+	}
+
+	if err = s.recover(); err != nil {
+		return fmt.Errorf("error while recovering the storage in %s: %w", rootDir, err)
+	}
+
+	return
+}
+
+// openBatch opens the storage of the batch id, which shares the trees by root hash of s.
+func (s *FileSystemStorage) openBatch(id string) (batch *FileSystemStorage, err error) {
+	batch = &FileSystemStorage{
+		merkleTreeFileName:    s.merkleTreeFileName,
+		sparseTreeFileName:    s.sparseTreeFileName,
+		mountainRangeFileName: s.mountainRangeFileName,
+		treesDir:              s.treesDir,
+		batches:               s.batches,
+	}
+	if err = batch.open(filepath.Join(s.batches.dir, id)); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+func (s *FileSystemStorage) CreateBatch(_ context.Context) (id string, err error) {
+	if id, err = newBatchID(); err != nil {
+		return
+	}
+
+	s.batches.mu.Lock()
+	defer s.batches.mu.Unlock()
+
+	batch, err := s.openBatch(id)
+	if err != nil {
+		return "", err
+	}
+	if err = syncDir(s.batches.dir); err != nil {
+		return "", err
+	}
+	s.batches.storages[id] = batch
+
+	return
+}
+
+func (s *FileSystemStorage) Batch(_ context.Context, id string) (Repository, error) {
+	s.batches.mu.RLock()
+	defer s.batches.mu.RUnlock()
+
+	batch, found := s.batches.storages[id]
+	if !found {
+		return nil, ErrBatchNotFound
+	}
+
+	return batch, nil
+}
+
+// recover completes, or undoes, the writes interrupted by a crash, and restores the last index:
+//   - a transaction is completed if it's been committed, or else discarded, see Transaction;
+//   - a deletion of all the files is completed if their directory has been renamed aside, see DeleteAllFiles;
+//   - temporary files are removed: their rename never happened;
+//   - a pending sidecar is renamed in place if the content matches it, the content having been renamed already,
+//     or else it's removed, the content being still the previous one;
+//   - contents without a sidecar, left by an interrupted store, and sidecars without a content,
+//     left by an interrupted delete, are removed.
+func (s *FileSystemStorage) recover() (err error) {
+	if _, err = os.Stat(filepath.Join(s.rootDir, transactionDir+committedSuffix)); err == nil {
+		if err = s.commitStaged(); err != nil {
+			return
+		}
+	}
+	if err = os.RemoveAll(filepath.Join(s.rootDir, transactionDir)); err != nil {
+		return
+	}
+
+	if _, err = os.Stat(filepath.Join(s.rootDir, filesDir+deletedSuffix)); err == nil {
+		if err = s.removeDeletedFiles(); err != nil {
+			return
+		}
+	}
+
+	for _, dir := range []string{s.rootDir, filepath.Join(s.rootDir, filesDir)} {
+		if err = removeTmpFiles(dir); err != nil {
+			return
+		}
+	}
+
+	pendingFiles, err := filepath.Glob(filepath.Join(s.rootDir, filesDir, "*"+metadataSuffix+pendingSuffix))
+	if err != nil {
+		return
+	}
+
+	for _, pendingFile := range pendingFiles {
+		index, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(pendingFile), metadataSuffix+pendingSuffix))
+		if err != nil {
+			continue
+		}
+
+		if s.matchesMetadata(index, pendingFile) {
+			err = os.Rename(pendingFile, s.metadataPath(index))
+		} else {
+			err = os.Remove(pendingFile)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	entries, err := os.ReadDir(filepath.Join(s.rootDir, filesDir))
+	if err != nil {
+		return
+	}
+
+	found := make(map[string]bool)
+	for _, entry := range entries {
+		found[entry.Name()] = true
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		index, err := strconv.Atoi(strings.TrimSuffix(name, metadataSuffix))
+		if err != nil {
+			continue
+		}
+
+		switch {
+		case strings.HasSuffix(name, metadataSuffix) && !found[strconv.Itoa(index)]:
+			err = os.Remove(s.metadataPath(index))
+		case !strings.HasSuffix(name, metadataSuffix) && !found[name+metadataSuffix]:
+			err = os.Remove(s.filePath(index))
+		default:
+			s.lastIndex = max(s.lastIndex, index)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	lastIndex, err := os.ReadFile(filepath.Join(s.rootDir, lastIndexFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return
+	}
+
+	i, err := strconv.Atoi(strings.TrimSpace(string(lastIndex)))
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", lastIndexFileName, err)
+	}
+	s.lastIndex = max(s.lastIndex, i)
+
+	return nil
+}
+
+// removeTmpFiles removes the temporary files left in dir by writes a crash has interrupted, see writeFileAtomic.
+func removeTmpFiles(dir string) (err error) {
+	tmpFiles, err := filepath.Glob(filepath.Join(dir, "*"+tmpSuffix))
+	if err != nil {
+		return
+	}
+
+	for _, tmpFile := range tmpFiles {
+		if err = os.Remove(tmpFile); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// matchesMetadata tells whether the content of the file at index has the size and hash the given sidecar records.
+func (s *FileSystemStorage) matchesMetadata(index int, metadataPath string) bool {
+	metadata, err := readMetadata(metadataPath)
+	if err != nil {
+		return false
+	}
+
+	content, err := os.Open(s.filePath(index))
+	if err != nil {
+		return false
+	}
+	defer func() { _ = content.Close() }()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, content)
+
+	return err == nil && size == int64(metadata.Size) && bytes.Equal(hash.Sum(nil), metadata.SHA256)
+}
+
+func (s *FileSystemStorage) StoreFile(_ context.Context, file StoredFile) (i int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// The index is recorded before the file is stored, so that it's never handed out twice, even after a crash
+	i = s.lastIndex + 1
+	if err = writeFileAtomic(filepath.Join(s.rootDir, lastIndexFileName), []byte(strconv.Itoa(i))); err != nil {
+		return 0, err
+	}
+	s.lastIndex = i
+
+	file.Index = i
+	if err = s.putFile(file); err != nil {
+		return 0, err
+	}
+
+	return
+}
+
+// RetrieveFileByIndex opens the content of the file at index i, which is read as it was when opened,
+// even if it's replaced or deleted meanwhile.
+func (s *FileSystemStorage) RetrieveFileByIndex(_ context.Context, i int) (metadata FileMetadata, content io.ReadCloser, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if metadata, err = s.fileMetadata(i); err != nil {
+		return
+	}
+
+	if content, err = os.Open(s.filePath(i)); err != nil {
+		return metadata, nil, err
+	}
+
+	return
+}
+
+func (s *FileSystemStorage) RetrieveFileRange(_ context.Context, i, offset, length int) (metadata FileMetadata, content io.ReadCloser, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if metadata, err = s.fileMetadata(i); err != nil {
+		return
+	}
+	if offset >= metadata.Size {
+		return metadata, nil, ErrRangeNotSatisfiable
+	}
+
+	file, err := os.Open(s.filePath(i))
+	if err != nil {
+		return metadata, nil, err
+	}
+	if _, err = file.Seek(int64(offset), io.SeekStart); err != nil {
+		_ = file.Close()
+
+		return metadata, nil, err
+	}
+
+	return metadata, limitReadCloser(file, length), nil
+}
+
+func (s *FileSystemStorage) RetrieveFileMetadata(_ context.Context, i int) (metadata FileMetadata, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.fileMetadata(i)
+}
+
+// fileMetadata reads the metadata of the file at index i from its sidecar, or returns ErrStoredFileNotFound.
+func (s *FileSystemStorage) fileMetadata(i int) (metadata FileMetadata, err error) {
+	sidecar, err := readMetadata(s.metadataPath(i))
+	if errors.Is(err, os.ErrNotExist) {
+		return metadata, ErrStoredFileNotFound
+	}
+	if err != nil {
+		return
+	}
+
+	return FileMetadata{
+		Index:       i,
+		Name:        sidecar.Name,
+		Size:        sidecar.Size,
+		ContentType: sidecar.ContentType,
+		UploadedAt:  sidecar.UploadedAt,
+		LeafHash:    sidecar.LeafHash,
+	}, nil
+}
+
+// RetrieveChunkHashes reads the chunk hashes of the file at index i from its sidecar.
+func (s *FileSystemStorage) RetrieveChunkHashes(_ context.Context, i int) (chunkHashes []merkle.Digest, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sidecar, err := readMetadata(s.metadataPath(i))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrStoredFileNotFound
+	}
+	if err != nil {
+		return
+	}
+
+	return sidecar.ChunkHashes, nil
+}
+
+func (s *FileSystemStorage) ReplaceFile(_ context.Context, file StoredFile) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err = s.fileExists(file.Index); err != nil {
+		return
+	}
+
+	return s.putFile(file)
+}
+
+func (s *FileSystemStorage) DeleteFile(_ context.Context, i int) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err = s.fileExists(i); err != nil {
+		return
+	}
+
+	// The file is gone as soon as its sidecar is
+	if err = os.Remove(s.metadataPath(i)); err != nil {
+		return
+	}
+
+	return os.Remove(s.filePath(i))
+}
+
+// DeleteAllFiles deletes the files and trees of the storage, but the trees by root hash, see RetrieveTreeByRoot.
+// The files are deleted at once by renaming their directory aside, the rest is then removed:
+// a crash meanwhile leaves the directory aside, and the deletion is completed by recover.
+func (s *FileSystemStorage) DeleteAllFiles(_ context.Context) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// a deletion that failed halfway is completed first, the directory aside being in the way
+	deletedDir := filepath.Join(s.rootDir, filesDir+deletedSuffix)
+	if err = os.RemoveAll(deletedDir); err != nil {
+		return
+	}
+
+	if err = os.Rename(filepath.Join(s.rootDir, filesDir), deletedDir); err != nil {
+		return
+	}
+	if err = syncDir(s.rootDir); err != nil {
+		return
+	}
+	if err = os.MkdirAll(filepath.Join(s.rootDir, filesDir), 0755); err != nil {
+		return
+	}
+
+	if err = s.removeDeletedFiles(); err != nil {
+		return
+	}
+	s.lastIndex = 0
+
+	return
+}
+
+// removeDeletedFiles removes the last index and the trees of the storage, then the files renamed aside by DeleteAllFiles.
+func (s *FileSystemStorage) removeDeletedFiles() (err error) {
+	for _, name := range s.stateFileNames() {
+		if err = os.Remove(filepath.Join(s.rootDir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return
+		}
+	}
+	if err = syncDir(s.rootDir); err != nil {
+		return
+	}
+
+	return os.RemoveAll(filepath.Join(s.rootDir, filesDir+deletedSuffix))
+}
+
+// putFile streams the content of the file to a temporary file, hashing it on the way, then writes its pending sidecar,
+// renames the content in place, and finally renames the sidecar in place.
+func (s *FileSystemStorage) putFile(file StoredFile) (err error) {
+	hash := sha256.New()
+	tmpPath, size, err := writeTmpFile(s.filePath(file.Index), io.TeeReader(file.Content, hash))
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(tmpPath)
+		}
+	}()
+
+	metadata, err := json.Marshal(fileMetadata{
+		Name:        file.Name,
+		Size:        int(size),
+		SHA256:      hash.Sum(nil),
+		ContentType: file.ContentType,
+		UploadedAt:  file.UploadedAt,
+		LeafHash:    file.LeafHash,
+		ChunkHashes: file.ChunkHashes,
+	})
+	if err != nil {
+		return
+	}
+
+	pendingPath := s.metadataPath(file.Index) + pendingSuffix
+	if err = writeFileAtomic(pendingPath, metadata); err != nil {
+		return
+	}
+
+	if err = os.Rename(tmpPath, s.filePath(file.Index)); err != nil {
+		return
+	}
+	if err = syncDir(filepath.Dir(pendingPath)); err != nil {
+		return
+	}
+
+	if err = os.Rename(pendingPath, s.metadataPath(file.Index)); err != nil {
+		return
+	}
+
+	return syncDir(filepath.Dir(pendingPath))
+}
+
+// fileExists returns ErrStoredFileNotFound if there's no file at index i.
+func (s *FileSystemStorage) fileExists(i int) (err error) {
+	_, err = os.Stat(s.metadataPath(i))
+	if errors.Is(err, os.ErrNotExist) {
+		err = ErrStoredFileNotFound
+	}
+
+	return
+}
+
+func (s *FileSystemStorage) filePath(i int) string {
+	return filepath.Join(s.rootDir, filesDir, strconv.Itoa(i))
+}
+
+func (s *FileSystemStorage) metadataPath(i int) string {
+	return s.filePath(i) + metadataSuffix
+}
+
+func readMetadata(path string) (metadata fileMetadata, err error) {
+	metadataBytes, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(metadataBytes, &metadata)
+
+	return
+}
+
+func (s *FileSystemStorage) StoreTree(_ context.Context, tree *merkle.Tree) (err error) {
+	treeBytes, err := tree.Serialize()
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err = writeFileAtomic(filepath.Join(s.treesDir, tree.RootHash().String()), treeBytes); err != nil {
+		return
+	}
+
+	return writeFileAtomic(filepath.Join(s.rootDir, s.merkleTreeFileName), treeBytes)
+}
+
+func (s *FileSystemStorage) RetrieveTree(_ context.Context) (tree *merkle.Tree, err error) {
+	return s.retrieveTree(filepath.Join(s.rootDir, s.merkleTreeFileName))
+}
+
+func (s *FileSystemStorage) RetrieveTreeByRoot(_ context.Context, rootHash merkle.Digest) (tree *merkle.Tree, err error) {
+	return s.retrieveTree(filepath.Join(s.treesDir, rootHash.String()))
+}
+
+func (s *FileSystemStorage) retrieveTree(path string) (tree *merkle.Tree, err error) {
+	treeFile, err := s.openTreeFile(path)
+	if err != nil {
+		return
+	}
+	defer func() { _ = treeFile.Close() }()
+
+	return merkle.Deserialize(treeFile)
+}
+
+func (s *FileSystemStorage) StoreSparseTree(_ context.Context, tree *merkle.SparseTree) (err error) {
+	treeBytes, err := tree.Serialize()
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return writeFileAtomic(filepath.Join(s.rootDir, s.sparseTreeFileName), treeBytes)
+}
+
+func (s *FileSystemStorage) RetrieveSparseTree(_ context.Context) (tree *merkle.SparseTree, err error) {
+	treeFile, err := s.openTreeFile(filepath.Join(s.rootDir, s.sparseTreeFileName))
+	if err != nil {
+		return
+	}
+	defer func() { _ = treeFile.Close() }()
+
+	return merkle.DeserializeSparseTree(treeFile)
+}
+
+func (s *FileSystemStorage) StoreMountainRange(_ context.Context, mountainRange *merkle.MountainRange) (err error) {
+	rangeBytes, err := mountainRange.Serialize()
+	if err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return writeFileAtomic(filepath.Join(s.rootDir, s.mountainRangeFileName), rangeBytes)
+}
+
+func (s *FileSystemStorage) RetrieveMountainRange(_ context.Context) (mountainRange *merkle.MountainRange, err error) {
+	rangeFile, err := s.openTreeFile(filepath.Join(s.rootDir, s.mountainRangeFileName))
+	if err != nil {
+		return
+	}
+	defer func() { _ = rangeFile.Close() }()
+
+	return merkle.DeserializeMountainRange(rangeFile)
+}
+
+// stateFileNames are the names of the files of the storage next to its files directory: the last index and the trees.
+func (s *FileSystemStorage) stateFileNames() []string {
+	return []string{lastIndexFileName, s.merkleTreeFileName, s.sparseTreeFileName, s.mountainRangeFileName}
+}
+
+// Transaction runs fn against a copy of the storage, staged under .transaction/, which replaces it if fn succeeds,
+// or is discarded. The copy links to the files of the storage, which writes replace rather than change.
+// Writes made outside of transactions while one is running are lost, while batches and trees by root hash
+// are kept whatever fn returns. Transactions don't nest: fn runs in the transaction of a staged storage.
+func (s *FileSystemStorage) Transaction(_ context.Context, fn func(Repository) error) (err error) {
+	if s.staged {
+		return fn(s)
+	}
+
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+
+	// a commit that failed halfway is completed first
+	if _, err = os.Stat(filepath.Join(s.rootDir, transactionDir+committedSuffix)); err == nil {
+		s.mu.Lock()
+		s.lastIndex = 0
+		err = s.recover()
+		s.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+
+	tx, err := s.stage()
+	if err != nil {
+		return
+	}
+	if err = fn(tx); err != nil {
+		_ = os.RemoveAll(tx.rootDir)
+
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// once renamed, the transaction is committed, and completed by recover if a crash interrupts commitStaged
+	if err = os.Rename(tx.rootDir, filepath.Join(s.rootDir, transactionDir+committedSuffix)); err != nil {
+		_ = os.RemoveAll(tx.rootDir)
+
+		return
+	}
+	if err = syncDir(s.rootDir); err != nil {
+		return
+	}
+
+	if err = s.commitStaged(); err != nil {
+		return
+	}
+	s.lastIndex = tx.lastIndex
+
+	return
+}
+
+func (s *FileSystemStorage) Atomic() bool {
+	return true
+}
+
+// stage creates the storage of a transaction, under .transaction/, linking to the files, last index and trees of s.
+func (s *FileSystemStorage) stage() (tx *FileSystemStorage, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stagingDir := filepath.Join(s.rootDir, transactionDir)
+	if err = os.RemoveAll(stagingDir); err != nil {
+		return
+	}
+	if err = os.MkdirAll(filepath.Join(stagingDir, filesDir), 0755); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = os.RemoveAll(stagingDir)
+		}
+	}()
+
+	entries, err := os.ReadDir(filepath.Join(s.rootDir, filesDir))
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		if err = os.Link(filepath.Join(s.rootDir, filesDir, entry.Name()), filepath.Join(stagingDir, filesDir, entry.Name())); err != nil {
+			return
+		}
+	}
+	for _, name := range s.stateFileNames() {
+		if err = os.Link(filepath.Join(s.rootDir, name), filepath.Join(stagingDir, name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return
+		}
+	}
+	for _, dir := range []string{filepath.Join(stagingDir, filesDir), stagingDir} {
+		if err = syncDir(dir); err != nil {
+			return
+		}
+	}
+
+	return &FileSystemStorage{
+		staged:                true,
+		rootDir:               stagingDir,
+		lastIndex:             s.lastIndex,
+		merkleTreeFileName:    s.merkleTreeFileName,
+		sparseTreeFileName:    s.sparseTreeFileName,
+		mountainRangeFileName: s.mountainRangeFileName,
+		treesDir:              s.treesDir,
+		batches:               s.batches,
+	}, nil
+}
+
+// commitStaged replaces the files, last index and trees of the storage with the ones of the committed transaction,
+// then removes it. It can be run again after a crash: the files directory is moved in place only if it's still
+// staged, the previous one being renamed aside first, while the last index and trees are linked in place, or removed
+// if the transaction has removed them, until the transaction itself is removed.
+func (s *FileSystemStorage) commitStaged() (err error) {
+	committedDir := filepath.Join(s.rootDir, transactionDir+committedSuffix)
+	filesPath, deletedDir := filepath.Join(s.rootDir, filesDir), filepath.Join(s.rootDir, filesDir+deletedSuffix)
+
+	if _, err = os.Stat(filepath.Join(committedDir, filesDir)); err == nil {
+		if _, err = os.Stat(filesPath); err == nil {
+			if err = os.RemoveAll(deletedDir); err != nil {
+				return
+			}
+			if err = os.Rename(filesPath, deletedDir); err != nil {
+				return
+			}
+		}
+		if err = os.Rename(filepath.Join(committedDir, filesDir), filesPath); err != nil {
+			return
+		}
+	}
+
+	for _, name := range s.stateFileNames() {
+		path := filepath.Join(s.rootDir, name)
+		if err = os.Remove(path + tmpSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return
+		}
+
+		err = os.Link(filepath.Join(committedDir, name), path+tmpSuffix)
+		switch {
+		case err == nil:
+			err = os.Rename(path+tmpSuffix, path)
+		case errors.Is(err, os.ErrNotExist):
+			if err = os.Remove(path); errors.Is(err, os.ErrNotExist) {
+				err = nil
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+	if err = syncDir(s.rootDir); err != nil {
+		return
+	}
+
+	if err = os.RemoveAll(deletedDir); err != nil {
+		return
+	}
+	if err = os.RemoveAll(committedDir); err != nil {
+		return
+	}
+
+	return syncDir(s.rootDir)
+}
+
+// openTreeFile opens a tree file, or returns ErrTreeNotFound if missing.
+// Trees are replaced by renames, hence an open file keeps the tree it's been opened with.
+func (s *FileSystemStorage) openTreeFile(path string) (treeFile *os.File, err error) {
+	treeFile, err = os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		err = ErrTreeNotFound
+	}
+
+	return
+}
+
+// writeFileAtomic writes content to a temporary file next to path, syncs it and renames it to path,
+// so that path holds either its previous content or the new one, even after a crash.
+func writeFileAtomic(path string, content []byte) (err error) {
+	tmpPath, _, err := writeTmpFile(path, bytes.NewReader(content))
+	if err != nil {
+		return
+	}
+
+	if err = os.Rename(tmpPath, path); err != nil {
+		_ = os.Remove(tmpPath)
+
+		return
+	}
+
+	return syncDir(filepath.Dir(path))
+}
+
+// writeTmpFile streams content to a synced temporary file next to path, to be renamed over it,
+// and returns its path and size. Nothing is left behind if it fails.
+func writeTmpFile(path string, content io.Reader) (tmpPath string, size int64, err error) {
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*"+tmpSuffix)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_ = os.Remove(tmpFile.Name())
+		}
+	}()
+
+	if size, err = io.Copy(tmpFile, content); err != nil {
+		_ = tmpFile.Close()
+
+		return
+	}
+
+	if err = tmpFile.Sync(); err != nil {
+		_ = tmpFile.Close()
+
+		return
+	}
+
+	if err = tmpFile.Close(); err != nil {
+		return
+	}
+
+	return tmpFile.Name(), size, nil
+}
+
+// syncDir syncs a directory, so that the renames within it survive a crash.
+func syncDir(path string) (err error) {
+	dir, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer func() { _ = dir.Close() }()
+
+	return dir.Sync()
+}
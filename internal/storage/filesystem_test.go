@@ -0,0 +1,323 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestFileSystemStorage(t *testing.T, rootDir string) *FileSystemStorage {
+	fsStorage, err := NewFileSystemStorage(rootDir, ".merkletree", ".sparsetree", ".mountainrange")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return fsStorage
+}
+
+// storeTestFile stores a file named after its content.
+func storeTestFile(t *testing.T, repository Repository, content string) int {
+	i, err := repository.StoreFile(context.Background(), StoredFile{
+		FileMetadata: FileMetadata{Name: content + ".txt"},
+		Content:      strings.NewReader(content),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return i
+}
+
+// retrieveTestFile returns the name and content of the file at index i, or the error retrieving it.
+func retrieveTestFile(repository Repository, i int) (name, content string, err error) {
+	metadata, stored, err := repository.RetrieveFileByIndex(context.Background(), i)
+	if err != nil {
+		return
+	}
+	defer func() { _ = stored.Close() }()
+
+	data, err := io.ReadAll(stored)
+
+	return metadata.Name, string(data), err
+}
+
+func TestFileSystemRecover(t *testing.T) {
+	type file struct {
+		name, content string
+	}
+
+	// each case interrupts a write to the file at index 2, of a storage of 2 files, as a crash would,
+	// or a transaction replacing them with the file c
+	cases := map[string]struct {
+		crash     func(t *testing.T, s *FileSystemStorage)
+		expected  map[int]file // the files after recovery, by index
+		tree      bool         // whether the tree of the files is kept
+		nextIndex int
+	}{
+		"store before the sidecar": {
+			crash: func(t *testing.T, s *FileSystemStorage) {
+				assert.NoError(t, os.Remove(s.metadataPath(2)))
+			},
+			expected:  map[int]file{1: {"a.txt", "a"}},
+			tree:      true,
+			nextIndex: 3,
+		},
+		"replacement before the content": {
+			crash: func(t *testing.T, s *FileSystemStorage) {
+				writeTestSidecar(t, "new content", s.metadataPath(2)+pendingSuffix)
+				assert.NoError(t, os.WriteFile(s.filePath(2)+tmpSuffix, []byte("new content"), 0644))
+			},
+			expected:  map[int]file{1: {"a.txt", "a"}, 2: {"b.txt", "b"}},
+			tree:      true,
+			nextIndex: 3,
+		},
+		"replacement after the content": {
+			crash: func(t *testing.T, s *FileSystemStorage) {
+				writeTestSidecar(t, "new content", s.metadataPath(2)+pendingSuffix)
+				assert.NoError(t, os.WriteFile(s.filePath(2), []byte("new content"), 0644))
+			},
+			expected:  map[int]file{1: {"a.txt", "a"}, 2: {"new content.txt", "new content"}},
+			tree:      true,
+			nextIndex: 3,
+		},
+		"delete after the sidecar": {
+			crash: func(t *testing.T, s *FileSystemStorage) {
+				assert.NoError(t, os.Remove(s.filePath(2)))
+			},
+			expected:  map[int]file{1: {"a.txt", "a"}},
+			tree:      true,
+			nextIndex: 3,
+		},
+		"deletion of all the files": {
+			crash: func(t *testing.T, s *FileSystemStorage) {
+				assert.NoError(t, os.Rename(filepath.Join(s.rootDir, filesDir), filepath.Join(s.rootDir, filesDir+deletedSuffix)))
+			},
+			expected:  map[int]file{},
+			nextIndex: 1,
+		},
+		"transaction before the commit": {
+			crash: func(t *testing.T, s *FileSystemStorage) {
+				stageTestTransaction(t, s)
+			},
+			expected:  map[int]file{1: {"a.txt", "a"}, 2: {"b.txt", "b"}},
+			tree:      true,
+			nextIndex: 3,
+		},
+		"transaction after the commit": {
+			crash: func(t *testing.T, s *FileSystemStorage) {
+				tx := stageTestTransaction(t, s)
+				assert.NoError(t, os.Rename(tx.rootDir, filepath.Join(s.rootDir, transactionDir+committedSuffix)))
+			},
+			expected:  map[int]file{1: {"c.txt", "c"}},
+			nextIndex: 2,
+		},
+		"transaction halfway through the commit": {
+			crash: func(t *testing.T, s *FileSystemStorage) {
+				tx := stageTestTransaction(t, s)
+				committedDir := filepath.Join(s.rootDir, transactionDir+committedSuffix)
+				assert.NoError(t, os.Rename(tx.rootDir, committedDir))
+				assert.NoError(t, os.Rename(filepath.Join(s.rootDir, filesDir), filepath.Join(s.rootDir, filesDir+deletedSuffix)))
+				assert.NoError(t, os.Rename(filepath.Join(committedDir, filesDir), filepath.Join(s.rootDir, filesDir)))
+			},
+			expected:  map[int]file{1: {"c.txt", "c"}},
+			nextIndex: 2,
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			rootDir := t.TempDir()
+			fsStorage := newTestFileSystemStorage(t, rootDir)
+			storeTestFile(t, fsStorage, "a")
+			storeTestFile(t, fsStorage, "b")
+			assert.NoError(t, fsStorage.StoreTree(context.Background(), newTestTree(t, "a", "b")))
+
+			tc.crash(t, fsStorage)
+
+			recovered := newTestFileSystemStorage(t, rootDir)
+			for i := 1; i <= 2; i++ {
+				name, content, err := retrieveTestFile(recovered, i)
+				expected, found := tc.expected[i]
+				if !found {
+					assert.ErrorIs(t, err, ErrStoredFileNotFound, "file %d", i)
+
+					continue
+				}
+
+				assert.NoError(t, err)
+				assert.Equal(t, expected, file{name, content}, "file %d", i)
+			}
+
+			// no leftovers are kept
+			leftovers, err := filepath.Glob(filepath.Join(rootDir, "*", "*"+tmpSuffix))
+			assert.NoError(t, err)
+			assert.Empty(t, leftovers)
+			leftovers, err = filepath.Glob(filepath.Join(rootDir, filesDir, "*"+pendingSuffix))
+			assert.NoError(t, err)
+			assert.Empty(t, leftovers)
+			leftovers, err = filepath.Glob(filepath.Join(rootDir, transactionDir+"*"))
+			assert.NoError(t, err)
+			assert.Empty(t, leftovers)
+			assert.NoDirExists(t, filepath.Join(rootDir, filesDir+deletedSuffix))
+
+			// the trees are deleted along with all the files, after which indices start over, or else go on
+			_, err = recovered.RetrieveTree(context.Background())
+			if tc.tree {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, ErrTreeNotFound)
+			}
+			assert.Equal(t, tc.nextIndex, storeTestFile(t, recovered, "d"))
+		})
+	}
+}
+
+// stageTestTransaction stages a transaction of s replacing its files with the file c, without committing it.
+func stageTestTransaction(t *testing.T, s *FileSystemStorage) *FileSystemStorage {
+	tx, err := s.stage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, tx.DeleteAllFiles(context.Background()))
+	storeTestFile(t, tx, "c")
+
+	return tx
+}
+
+// writeTestSidecar writes the sidecar of a file of the given content, named after it, at path, as putFile would.
+func writeTestSidecar(t *testing.T, content, path string) {
+	tmp := newTestFileSystemStorage(t, t.TempDir())
+	j := storeTestFile(t, tmp, content)
+
+	sidecar, err := os.ReadFile(tmp.metadataPath(j))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, os.WriteFile(path, sidecar, 0644))
+}
+
+func TestFileSystemTransactionRollback(t *testing.T) {
+	errFailed := errors.New("failed")
+
+	// each case fails an upload replacing the files a and b, and their tree, after some of its writes
+	cases := map[string]struct {
+		fn func(t *testing.T, tx Repository) error
+	}{
+		"after deleting the files": {
+			fn: func(t *testing.T, tx Repository) error {
+				assert.NoError(t, tx.DeleteAllFiles(context.Background()))
+
+				return errFailed
+			},
+		},
+		"after storing new files": {
+			fn: func(t *testing.T, tx Repository) error {
+				assert.NoError(t, tx.DeleteAllFiles(context.Background()))
+				storeTestFile(t, tx, "c")
+
+				return errFailed
+			},
+		},
+		"after storing the new tree": {
+			fn: func(t *testing.T, tx Repository) error {
+				assert.NoError(t, tx.DeleteAllFiles(context.Background()))
+				storeTestFile(t, tx, "c")
+				assert.NoError(t, tx.StoreTree(context.Background(), newTestTree(t, "c")))
+
+				return errFailed
+			},
+		},
+		"after changing files": {
+			fn: func(t *testing.T, tx Repository) error {
+				assert.NoError(t, tx.DeleteFile(context.Background(), 1))
+				assert.NoError(t, tx.ReplaceFile(context.Background(), StoredFile{
+					FileMetadata: FileMetadata{Index: 2, Name: "c.txt"},
+					Content:      strings.NewReader("c"),
+				}))
+
+				return errFailed
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			rootDir := t.TempDir()
+			fsStorage := newTestFileSystemStorage(t, rootDir)
+			storeTestFile(t, fsStorage, "a")
+			storeTestFile(t, fsStorage, "b")
+			tree := newTestTree(t, "a", "b")
+			assert.NoError(t, fsStorage.StoreTree(context.Background(), tree))
+
+			err := fsStorage.Transaction(context.Background(), func(tx Repository) error {
+				return tc.fn(t, tx)
+			})
+			assert.ErrorIs(t, err, errFailed)
+			assert.NoDirExists(t, filepath.Join(rootDir, transactionDir))
+
+			// the files and tree are the ones before the transaction, on disk as well
+			for _, s := range []*FileSystemStorage{fsStorage, newTestFileSystemStorage(t, rootDir)} {
+				for i, expected := range map[int]string{1: "a", 2: "b"} {
+					name, content, err := retrieveTestFile(s, i)
+					assert.NoError(t, err)
+					assert.Equal(t, expected, content)
+					assert.Equal(t, expected+".txt", name)
+				}
+
+				stored, err := s.RetrieveTree(context.Background())
+				assert.NoError(t, err)
+				assert.Equal(t, tree.RootHash(), stored.RootHash())
+			}
+
+			// the index of the files stored by the transaction is handed out again
+			assert.Equal(t, 3, storeTestFile(t, fsStorage, "d"))
+		})
+	}
+}
+
+func TestFileSystemTransactionCommit(t *testing.T) {
+	rootDir := t.TempDir()
+	fsStorage := newTestFileSystemStorage(t, rootDir)
+	storeTestFile(t, fsStorage, "a")
+	storeTestFile(t, fsStorage, "b")
+
+	tree := newTestTree(t, "c")
+	err := fsStorage.Transaction(context.Background(), func(tx Repository) (err error) {
+		if err = tx.DeleteAllFiles(context.Background()); err != nil {
+			return
+		}
+
+		// the writes of the transaction are seen by the rest of it only
+		assert.Equal(t, 1, storeTestFile(t, tx, "c"))
+		_, content, err := retrieveTestFile(fsStorage, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, "a", content)
+
+		return tx.StoreTree(context.Background(), tree)
+	})
+	assert.NoError(t, err)
+
+	// the files and tree are replaced at once, on disk as well
+	for _, s := range []*FileSystemStorage{fsStorage, newTestFileSystemStorage(t, rootDir)} {
+		_, content, err := retrieveTestFile(s, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, "c", content)
+		_, _, err = retrieveTestFile(s, 2)
+		assert.ErrorIs(t, err, ErrStoredFileNotFound)
+
+		stored, err := s.RetrieveTree(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, tree.RootHash(), stored.RootHash())
+	}
+
+	leftovers, err := filepath.Glob(filepath.Join(rootDir, transactionDir+"*"))
+	assert.NoError(t, err)
+	assert.Empty(t, leftovers)
+	assert.Equal(t, 2, storeTestFile(t, fsStorage, "d"))
+}
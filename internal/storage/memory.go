@@ -1,7 +1,9 @@
 package storage
 
 import (
+	"bytes"
 	"context"
+	"io"
 	"sync"
 
 	"merkle-file-uploader/internal/merkle"
@@ -11,38 +13,148 @@ var _ Repository = (*InMemoryStorage)(nil)
 
 type InMemoryStorage struct {
 	mu    sync.RWMutex
+	txMu  sync.Mutex // serializes transactions, see Transaction
 	seq   int
-	files map[int]StoredFile
+	files map[int]inMemoryFile
 	tree  *merkle.Tree
+
+	sparseTree    *merkle.SparseTree
+	mountainRange *merkle.MountainRange
+
+	shared *inMemoryShared
+}
+
+// inMemoryFile is a stored file, whose content is kept in memory.
+type inMemoryFile struct {
+	FileMetadata
+	content     []byte
+	chunkHashes []merkle.Digest
+}
+
+// inMemoryShared is shared by a storage and its batches.
+type inMemoryShared struct {
+	mu      sync.RWMutex
+	trees   map[string]*merkle.Tree // by root hash, see RetrieveTreeByRoot
+	batches map[string]*InMemoryStorage
 }
 
 func NewInMemoryStorage() *InMemoryStorage {
+	return newInMemoryStorage(&inMemoryShared{
+		trees:   make(map[string]*merkle.Tree),
+		batches: make(map[string]*InMemoryStorage),
+	})
+}
+
+func newInMemoryStorage(shared *inMemoryShared) *InMemoryStorage {
 	return &InMemoryStorage{
-		files: make(map[int]StoredFile),
+		files:  make(map[int]inMemoryFile),
+		shared: shared,
 	}
 }
 
 func (s *InMemoryStorage) StoreFile(_ context.Context, file StoredFile) (int, error) {
+	// the content is read before locking, it may be streamed from afar
+	content, err := io.ReadAll(file.Content)
+	if err != nil {
+		return 0, err
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	s.seq++
 	file.Index = s.seq
-	s.files[s.seq] = file
+	s.files[s.seq] = newInMemoryFile(file, content)
 
 	return s.seq, nil
 }
 
-func (s *InMemoryStorage) RetrieveFileByIndex(_ context.Context, i int) (storedFile StoredFile, err error) {
+func (s *InMemoryStorage) RetrieveFileByIndex(_ context.Context, i int) (metadata FileMetadata, content io.ReadCloser, err error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
-	storedFile, found := s.files[i]
+	file, found := s.files[i]
 	if !found {
-		err = ErrStoredFileNotFound
+		return metadata, nil, ErrStoredFileNotFound
 	}
 
-	return
+	return file.FileMetadata, io.NopCloser(bytes.NewReader(file.content)), nil
+}
+
+func (s *InMemoryStorage) RetrieveFileRange(_ context.Context, i, offset, length int) (metadata FileMetadata, content io.ReadCloser, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	file, found := s.files[i]
+	if !found {
+		return metadata, nil, ErrStoredFileNotFound
+	}
+	if offset >= len(file.content) {
+		return file.FileMetadata, nil, ErrRangeNotSatisfiable
+	}
+
+	return file.FileMetadata, io.NopCloser(bytes.NewReader(file.content[offset:min(offset+length, len(file.content))])), nil
+}
+
+func (s *InMemoryStorage) RetrieveFileMetadata(_ context.Context, i int) (metadata FileMetadata, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	file, found := s.files[i]
+	if !found {
+		return metadata, ErrStoredFileNotFound
+	}
+
+	return file.FileMetadata, nil
+}
+
+func (s *InMemoryStorage) RetrieveChunkHashes(_ context.Context, i int) ([]merkle.Digest, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	file, found := s.files[i]
+	if !found {
+		return nil, ErrStoredFileNotFound
+	}
+
+	return file.chunkHashes, nil
+}
+
+func (s *InMemoryStorage) ReplaceFile(_ context.Context, file StoredFile) error {
+	content, err := io.ReadAll(file.Content)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, found := s.files[file.Index]; !found {
+		return ErrStoredFileNotFound
+	}
+
+	s.files[file.Index] = newInMemoryFile(file, content)
+
+	return nil
+}
+
+func newInMemoryFile(file StoredFile, content []byte) inMemoryFile {
+	file.Size = len(content)
+
+	return inMemoryFile{FileMetadata: file.FileMetadata, content: content, chunkHashes: file.ChunkHashes}
+}
+
+func (s *InMemoryStorage) DeleteFile(_ context.Context, i int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, found := s.files[i]; !found {
+		return ErrStoredFileNotFound
+	}
+
+	delete(s.files, i)
+
+	return nil
 }
 
 func (s *InMemoryStorage) DeleteAllFiles(_ context.Context) (err error) {
@@ -50,7 +162,7 @@ func (s *InMemoryStorage) DeleteAllFiles(_ context.Context) (err error) {
 	defer s.mu.Unlock()
 
 	s.seq = 0
-	s.files = make(map[int]StoredFile)
+	s.files = make(map[int]inMemoryFile)
 
 	return nil
 }
@@ -61,9 +173,143 @@ func (s *InMemoryStorage) StoreTree(_ context.Context, tree *merkle.Tree) error
 
 	s.tree = tree
 
+	s.shared.mu.Lock()
+	defer s.shared.mu.Unlock()
+
+	s.shared.trees[tree.RootHash().String()] = tree
+
 	return nil
 }
 
 func (s *InMemoryStorage) RetrieveTree(_ context.Context) (*merkle.Tree, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.tree == nil {
+		return nil, ErrTreeNotFound
+	}
+
 	return s.tree, nil
 }
+
+func (s *InMemoryStorage) RetrieveTreeByRoot(_ context.Context, rootHash merkle.Digest) (*merkle.Tree, error) {
+	s.shared.mu.RLock()
+	defer s.shared.mu.RUnlock()
+
+	tree, found := s.shared.trees[rootHash.String()]
+	if !found {
+		return nil, ErrTreeNotFound
+	}
+
+	return tree, nil
+}
+
+func (s *InMemoryStorage) StoreSparseTree(_ context.Context, tree *merkle.SparseTree) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sparseTree = tree
+
+	return nil
+}
+
+func (s *InMemoryStorage) RetrieveSparseTree(_ context.Context) (*merkle.SparseTree, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.sparseTree == nil {
+		return nil, ErrTreeNotFound
+	}
+
+	return s.sparseTree, nil
+}
+
+func (s *InMemoryStorage) StoreMountainRange(_ context.Context, mountainRange *merkle.MountainRange) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.mountainRange = mountainRange
+
+	return nil
+}
+
+func (s *InMemoryStorage) RetrieveMountainRange(_ context.Context) (*merkle.MountainRange, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.mountainRange == nil {
+		return nil, ErrTreeNotFound
+	}
+
+	return s.mountainRange, nil
+}
+
+// Transaction runs fn against a copy of the storage, which replaces it if fn succeeds.
+// Writes made outside of transactions while one is running are lost,
+// while batches and trees by root hash are kept whatever fn returns.
+func (s *InMemoryStorage) Transaction(_ context.Context, fn func(Repository) error) (err error) {
+	s.txMu.Lock()
+	defer s.txMu.Unlock()
+
+	tx := s.clone()
+	if err = fn(tx); err != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seq, s.files, s.tree = tx.seq, tx.files, tx.tree
+	s.sparseTree, s.mountainRange = tx.sparseTree, tx.mountainRange
+
+	return
+}
+
+func (s *InMemoryStorage) Atomic() bool {
+	return true
+}
+
+// clone copies the storage, sharing the stored files and trees, which are replaced rather than changed.
+func (s *InMemoryStorage) clone() *InMemoryStorage {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	clone := &InMemoryStorage{
+		seq:           s.seq,
+		files:         make(map[int]inMemoryFile, len(s.files)),
+		tree:          s.tree,
+		sparseTree:    s.sparseTree,
+		mountainRange: s.mountainRange,
+		shared:        s.shared,
+	}
+	for i, file := range s.files {
+		clone.files[i] = file
+	}
+
+	return clone
+}
+
+func (s *InMemoryStorage) CreateBatch(_ context.Context) (id string, err error) {
+	if id, err = newBatchID(); err != nil {
+		return
+	}
+
+	s.shared.mu.Lock()
+	defer s.shared.mu.Unlock()
+
+	s.shared.batches[id] = newInMemoryStorage(s.shared)
+
+	return
+}
+
+func (s *InMemoryStorage) Batch(_ context.Context, id string) (Repository, error) {
+	s.shared.mu.RLock()
+	defer s.shared.mu.RUnlock()
+
+	batch, found := s.shared.batches[id]
+	if !found {
+		return nil, ErrBatchNotFound
+	}
+
+	return batch, nil
+}
@@ -3,31 +3,101 @@ package storage
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math/rand"
+	"mime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
 
 	"merkle-file-uploader/internal/merkle"
 )
 
+// User-defined metadata of a stored file: its original name, RFC 2047-encoded as metadata must be ASCII,
+// the time it's been uploaded at, RFC 3339, and its leaf hash, hex-encoded.
+// Its size and content type are the ones of the object.
+const (
+	nameMetadataKey       = "name"
+	uploadedAtMetadataKey = "uploaded-at"
+	leafHashMetadataKey   = "leaf-hash"
+)
+
+// chunkHashesSuffix suffixes the key of a file to get the one of its chunk hashes, a JSON array of hex digests,
+// too many to fit in its user-defined metadata.
+const chunkHashesSuffix = ".chunks"
+
+// lastIndexKey is the key of the counter of the highest index files have been stored at, relative to the prefix
+// of the storage, see allocateIndex.
+const lastIndexKey = "last-index"
+
+// maxIndexAttempts caps the attempts to allocate an index, each failing if a concurrent write claims it first.
+const maxIndexAttempts = 50
+
+// Files bigger than a part are put with a multipart upload, whose parts are uploaded by concurrent requests.
+// S3 requires parts of 5 MiB at least, but the last one, and 10000 parts at most.
+const (
+	defaultPartSize    = 8 << 20
+	defaultPartUploads = 4
+	maxParts           = 10000
+)
+
+var (
+	errIndexContention     = errors.New("too many concurrent writes to allocate an index")
+	errTooManyParts        = fmt.Errorf("the file is bigger than %d parts", maxParts)
+	errNoConditionalWrites = errors.New("the bucket ignores conditional writes, which file indices are allocated with")
+)
+
+// conditionalWritesProbeKey is the key of the object conditional writes are checked with, suffixed by a random one
+// so that several servers checking at once don't get in the way of each other, see checkConditionalWrites.
+const conditionalWritesProbeKey = ".conditional-writes-"
+
+// treesByRootPrefix prefixes the keys every stored tree is also kept under, by root hash, so that trees of
+// earlier uploads can still be retrieved: they're not deleted along with the files.
+const treesByRootPrefix = ".merkletrees/"
+
 type S3Storage struct {
-	client             *s3.Client
-	bucket             string
-	merkleTreeFileName string
+	client                *s3.Client
+	bucket                string
+	prefix                string // of the keys of the files and trees of a batch, see Batch
+	merkleTreeFileName    string
+	sparseTreeFileName    string
+	mountainRangeFileName string
+	partSize              int // see putMultipart
+	partUploads           int
+	conditionalWrites     *conditionalWritesCheck // shared by the batches of the storage
+}
+
+type conditionalWritesCheck struct {
+	mu      sync.Mutex
+	checked bool
 }
 
 var _ Repository = (*S3Storage)(nil)
 
-func NewS3Storage(accessKeyId, secretAccessKey, endpoint, bucket, merkleTreeFileName string) (s3Storage *S3Storage, err error) {
+func NewS3Storage(
+	accessKeyId, secretAccessKey, endpoint, bucket, merkleTreeFileName, sparseTreeFileName, mountainRangeFileName string,
+) (s3Storage *S3Storage, err error) {
 	s3Storage = &S3Storage{
-		bucket:             bucket,
-		merkleTreeFileName: merkleTreeFileName,
+		bucket:                bucket,
+		merkleTreeFileName:    merkleTreeFileName,
+		sparseTreeFileName:    sparseTreeFileName,
+		mountainRangeFileName: mountainRangeFileName,
+		partSize:              defaultPartSize,
+		partUploads:           defaultPartUploads,
+		conditionalWrites:     &conditionalWritesCheck{},
 	}
 
 	cfg, err := config.LoadDefaultConfig(
@@ -53,26 +123,183 @@ func NewS3Storage(accessKeyId, secretAccessKey, endpoint, bucket, merkleTreeFile
 }
 
 func (s *S3Storage) StoreFile(ctx context.Context, file StoredFile) (i int, err error) {
-	filesCount, err := s.countFiles(ctx)
+	if i, err = s.allocateIndex(ctx); err != nil {
+		return
+	}
+	file.Index = i
+
+	err = s.putFile(ctx, file)
+
+	return
+}
+
+// allocateIndex increments the counter of the last index, and returns the new one, never handed out twice,
+// even to concurrent writers. The counter is written only if unchanged since it's been read, as told by its ETag,
+// or only if still missing, and read again otherwise, so the bucket must support conditional writes.
+// A missing counter starts from the files already stored, which are listed, e.g. when they predate it.
+func (s *S3Storage) allocateIndex(ctx context.Context) (i int, err error) {
+	if err = s.checkConditionalWrites(ctx); err != nil {
+		return
+	}
+
+	for attempt := 0; attempt < maxIndexAttempts; attempt++ {
+		if attempt > 0 {
+			// concurrent writers back off for random times, so that one of them wins the next attempt
+			select {
+			case <-ctx.Done():
+				return 0, ctx.Err()
+			case <-time.After(time.Duration(rand.Intn(10*min(attempt, 10))+1) * time.Millisecond):
+			}
+		}
+
+		lastIndex, eTag, err := s.lastIndexCounter(ctx)
+		if err != nil {
+			return 0, err
+		}
+
+		precondition := smithyhttp.SetHeaderValue("If-None-Match", "*")
+		if eTag != "" {
+			precondition = smithyhttp.SetHeaderValue("If-Match", eTag)
+		}
+
+		i = lastIndex + 1
+		_, err = s.client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(s.prefix + lastIndexKey),
+			Body:   strings.NewReader(strconv.Itoa(i)),
+		}, s3.WithAPIOptions(precondition))
+		if hasErrorCode(err, "PreconditionFailed", "ConditionalRequestConflict") {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		return i, nil
+	}
+
+	return 0, errIndexContention
+}
+
+// checkConditionalWrites fails with errNoConditionalWrites if the bucket ignores conditional writes, as older
+// LocalStack versions do, rather than letting concurrent uploads get the same index. It's checked once, by writes
+// to a probe object that must fail, which is deleted afterwards.
+func (s *S3Storage) checkConditionalWrites(ctx context.Context) (err error) {
+	s.conditionalWrites.mu.Lock()
+	defer s.conditionalWrites.mu.Unlock()
+
+	if s.conditionalWrites.checked {
+		return
+	}
+
+	key := fmt.Sprintf("%s%016x", conditionalWritesProbeKey, rand.Uint64())
+	if _, err = s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Body:   strings.NewReader("probe"),
+	}); err != nil {
+		return
+	}
+	defer func() {
+		_, deleteErr := s.client.DeleteObject(context.WithoutCancel(ctx), &s3.DeleteObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(key),
+		})
+		if err == nil {
+			err = deleteErr
+		}
+	}()
+
+	// the probe exists, and its ETag isn't the one of any content
+	for name, value := range map[string]string{"If-None-Match": "*", "If-Match": `"mismatch"`} {
+		_, err = s.client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket: aws.String(s.bucket),
+			Key:    aws.String(key),
+			Body:   strings.NewReader("probe"),
+		}, s3.WithAPIOptions(smithyhttp.SetHeaderValue(name, value)))
+		if err == nil {
+			return fmt.Errorf("%w: %s is ignored", errNoConditionalWrites, name)
+		}
+		if !hasErrorCode(err, "PreconditionFailed", "ConditionalRequestConflict") {
+			return
+		}
+	}
+
+	s.conditionalWrites.checked = true
+
+	return nil
+}
+
+// lastIndexCounter reads the counter of the last index along with its ETag, which is empty if it's missing.
+func (s *S3Storage) lastIndexCounter(ctx context.Context) (lastIndex int, eTag string, err error) {
+	resp, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.prefix + lastIndexKey),
+	})
+	var nsk *types.NoSuchKey
+	if errors.As(err, &nsk) {
+		lastIndex, err = s.lastIndex(ctx)
+
+		return lastIndex, "", err
+	}
 	if err != nil {
 		return
 	}
+	defer func() { _ = resp.Body.Close() }()
 
-	i = filesCount + 1
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
 
-	_, err = s.client.PutObject(ctx, &s3.PutObjectInput{
+	if lastIndex, err = strconv.Atoi(string(content)); err != nil {
+		return 0, "", fmt.Errorf("invalid %s counter: %s", lastIndexKey, err)
+	}
+
+	return lastIndex, aws.ToString(resp.ETag), nil
+}
+
+// hasErrorCode tells whether err is an S3 error with one of the given codes, e.g. PreconditionFailed
+// when a conditional write failed, the object having been written concurrently.
+func hasErrorCode(err error, codes ...string) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+
+	for _, code := range codes {
+		if apiErr.ErrorCode() == code {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *S3Storage) RetrieveFileByIndex(ctx context.Context, i int) (metadata FileMetadata, content io.ReadCloser, err error) {
+	resp, err := s.client.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(s.bucket),
-		Key:    aws.String(fmt.Sprintf("%d", i)),
-		Body:   bytes.NewReader(file.Content),
+		Key:    aws.String(s.fileKey(i)),
 	})
+	var nsk *types.NoSuchKey
+	if errors.As(err, &nsk) {
+		err = ErrStoredFileNotFound
 
-	return
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	return s3FileMetadata(i, resp.Metadata, resp.ContentType, resp.ContentLength), resp.Body, nil
 }
 
-func (s *S3Storage) RetrieveFileByIndex(ctx context.Context, i int) (storedFile StoredFile, err error) {
+// RetrieveFileRange gets the range of the object only, as S3 serves ranged GETs.
+func (s *S3Storage) RetrieveFileRange(ctx context.Context, i, offset, length int) (metadata FileMetadata, content io.ReadCloser, err error) {
 	resp, err := s.client.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(s.bucket),
-		Key:    aws.String(fmt.Sprintf("%d", i)),
+		Key:    aws.String(s.fileKey(i)),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
 	})
 	var nsk *types.NoSuchKey
 	if errors.As(err, &nsk) {
@@ -80,42 +307,355 @@ func (s *S3Storage) RetrieveFileByIndex(ctx context.Context, i int) (storedFile
 
 		return
 	}
+	if hasErrorCode(err, "InvalidRange") {
+		err = ErrRangeNotSatisfiable
+
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	// the length of the response is the one of the range, the size of the object follows it: bytes 0-9/1234
+	size := resp.ContentLength
+	if _, total, found := strings.Cut(aws.ToString(resp.ContentRange), "/"); found {
+		if n, err := strconv.ParseInt(total, 10, 64); err == nil {
+			size = &n
+		}
+	}
+
+	return s3FileMetadata(i, resp.Metadata, resp.ContentType, size), resp.Body, nil
+}
+
+func (s *S3Storage) RetrieveFileMetadata(ctx context.Context, i int) (metadata FileMetadata, err error) {
+	resp, err := s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.fileKey(i)),
+	})
+	var nf *types.NotFound
+	if errors.As(err, &nf) {
+		return metadata, ErrStoredFileNotFound
+	}
+	if err != nil {
+		return
+	}
+
+	return s3FileMetadata(i, resp.Metadata, resp.ContentType, resp.ContentLength), nil
+}
+
+// RetrieveChunkHashes gets the object of the chunk hashes of the file at index i, which is missing if it's been stored
+// without. It's written after the content, and may be left over from the content a failed replacement has replaced:
+// chunk hashes are to be checked against the leaf hash of the file.
+func (s *S3Storage) RetrieveChunkHashes(ctx context.Context, i int) (chunkHashes []merkle.Digest, err error) {
+	resp, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.fileKey(i) + chunkHashesSuffix),
+	})
+	var nsk *types.NoSuchKey
+	if errors.As(err, &nsk) {
+		return nil, s.fileExists(ctx, i)
+	}
 	if err != nil {
 		return
 	}
 	defer func() { _ = resp.Body.Close() }()
 
-	storedFile.Index = i
-	storedFile.Name = fmt.Sprintf("%d", i) // TODO: preserve original filename in `StoreFile`
-	storedFile.Content, err = io.ReadAll(resp.Body)
+	err = json.NewDecoder(resp.Body).Decode(&chunkHashes)
 
 	return
 }
 
-func (s *S3Storage) DeleteAllFiles(ctx context.Context) (err error) {
-	objs, err := s.client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
+// s3FileMetadata decodes the metadata of the file at index i from the ones of its object.
+// Files stored before their name was preserved are named after their index.
+func s3FileMetadata(i int, metadata map[string]string, contentType *string, contentLength *int64) FileMetadata {
+	name, err := new(mime.WordDecoder).DecodeHeader(metadata[nameMetadataKey])
+	if err != nil || name == "" {
+		name = fmt.Sprintf("%d", i)
+	}
+	uploadedAt, _ := time.Parse(time.RFC3339Nano, metadata[uploadedAtMetadataKey])
+	leafHash, _ := merkle.ParseDigest(metadata[leafHashMetadataKey])
+
+	return FileMetadata{
+		Index:       i,
+		Name:        name,
+		Size:        int(aws.ToInt64(contentLength)),
+		ContentType: aws.ToString(contentType),
+		UploadedAt:  uploadedAt,
+		LeafHash:    leafHash,
+	}
+}
+
+func (s *S3Storage) ReplaceFile(ctx context.Context, file StoredFile) (err error) {
+	if err = s.fileExists(ctx, file.Index); err != nil {
+		return
+	}
+
+	if err = s.putFile(ctx, file); err != nil || len(file.ChunkHashes) > 0 {
+		return
+	}
+
+	// the chunk hashes of the previous content are stale
+	_, err = s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
 		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.fileKey(file.Index) + chunkHashesSuffix),
 	})
-	if err != nil {
+
+	return
+}
+
+func (s *S3Storage) DeleteFile(ctx context.Context, i int) (err error) {
+	if err = s.fileExists(ctx, i); err != nil {
 		return
 	}
 
-	for _, object := range objs.Contents {
-		_, err = s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+	for _, key := range []string{s.fileKey(i), s.fileKey(i) + chunkHashesSuffix} {
+		if _, err = s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
 			Bucket: aws.String(s.bucket),
-			Key:    object.Key,
+			Key:    aws.String(key),
+		}); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (s *S3Storage) putFile(ctx context.Context, file StoredFile) (err error) {
+	metadata := map[string]string{nameMetadataKey: mime.QEncoding.Encode("utf-8", file.Name)}
+	if !file.UploadedAt.IsZero() {
+		metadata[uploadedAtMetadataKey] = file.UploadedAt.UTC().Format(time.RFC3339Nano)
+	}
+	if len(file.LeafHash) > 0 {
+		metadata[leafHashMetadataKey] = file.LeafHash.String()
+	}
+
+	var contentType *string
+	if file.ContentType != "" {
+		contentType = aws.String(file.ContentType)
+	}
+
+	// the first part tells whether the content fits in a single request
+	part, err := readPart(file.Content, s.partSize)
+	if err != nil {
+		return
+	}
+	if len(part) < s.partSize {
+		_, err = s.client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:      aws.String(s.bucket),
+			Key:         aws.String(s.fileKey(file.Index)),
+			Body:        bytes.NewReader(part),
+			ContentType: contentType,
+			Metadata:    metadata,
 		})
+	} else {
+		err = s.putMultipart(ctx, &s3.CreateMultipartUploadInput{
+			Bucket:      aws.String(s.bucket),
+			Key:         aws.String(s.fileKey(file.Index)),
+			ContentType: contentType,
+			Metadata:    metadata,
+		}, part, file.Content)
+	}
+	if err != nil || len(file.ChunkHashes) == 0 {
+		return
+	}
+
+	chunkHashes, err := json.Marshal(file.ChunkHashes)
+	if err != nil {
+		return
+	}
+
+	_, err = s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.fileKey(file.Index) + chunkHashesSuffix),
+		Body:   bytes.NewReader(chunkHashes),
+	})
+
+	return
+}
+
+// putMultipart puts an object with a multipart upload, from its first part, read already, and the rest of content.
+// The parts are read one at a time, and uploaded by up to partUploads concurrent requests, so that only a few of them
+// are held in memory at once. The upload is aborted if anything fails, for its parts not to be left behind.
+func (s *S3Storage) putMultipart(
+	ctx context.Context,
+	input *s3.CreateMultipartUploadInput,
+	first []byte,
+	content io.Reader,
+) (err error) {
+	upload, err := s.client.CreateMultipartUpload(ctx, input)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			// the upload is aborted even if ctx is done, e.g. when the client has gone away
+			_, _ = s.client.AbortMultipartUpload(context.WithoutCancel(ctx), &s3.AbortMultipartUploadInput{
+				Bucket:   input.Bucket,
+				Key:      input.Key,
+				UploadId: upload.UploadId,
+			})
+		}
+	}()
+
+	completedParts, err := s.uploadParts(ctx, input, upload.UploadId, first, content)
+	if err != nil {
+		return
+	}
+
+	_, err = s.client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          input.Bucket,
+		Key:             input.Key,
+		UploadId:        upload.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: completedParts},
+	})
+
+	return
+}
+
+// uploadParts uploads the parts of a multipart upload, and returns them in order, or the first error encountered,
+// which stops the uploads still running.
+func (s *S3Storage) uploadParts(
+	ctx context.Context,
+	input *s3.CreateMultipartUploadInput,
+	uploadID *string,
+	part []byte,
+	content io.Reader,
+) (completedParts []types.CompletedPart, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type numberedPart struct {
+		number  int32
+		content []byte
+	}
+	parts := make(chan numberedPart)
+
+	var mu sync.Mutex
+	var uploadErr error
+	var wg sync.WaitGroup
+	for w := 0; w < s.partUploads; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for p := range parts {
+				resp, err := s.client.UploadPart(ctx, &s3.UploadPartInput{
+					Bucket:     input.Bucket,
+					Key:        input.Key,
+					UploadId:   uploadID,
+					PartNumber: aws.Int32(p.number),
+					Body:       bytes.NewReader(p.content),
+				})
+
+				mu.Lock()
+				if err != nil && uploadErr == nil {
+					uploadErr = err
+					cancel()
+				}
+				if err == nil {
+					completedParts = append(completedParts, types.CompletedPart{ETag: resp.ETag, PartNumber: aws.Int32(p.number)})
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	// the next part is read while the previous ones are uploaded, until the content ends, or an upload fails
+	for number := int32(1); len(part) > 0 && ctx.Err() == nil; number++ {
+		if number > maxParts {
+			err = errTooManyParts
+
+			break
+		}
+
+		select {
+		case parts <- numberedPart{number: number, content: part}:
+		case <-ctx.Done():
+		}
+
+		if part, err = readPart(content, s.partSize); err != nil {
+			break
+		}
+	}
+	close(parts)
+	wg.Wait()
+
+	if err == nil {
+		err = uploadErr
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(completedParts, func(i, j int) bool {
+		return aws.ToInt32(completedParts[i].PartNumber) < aws.ToInt32(completedParts[j].PartNumber)
+	})
+
+	return
+}
+
+// readPart reads the next part of content, size bytes long unless the content ends first.
+func readPart(content io.Reader, size int) (part []byte, err error) {
+	return io.ReadAll(io.LimitReader(content, int64(size)))
+}
+
+func (s *S3Storage) fileKey(i int) string {
+	return s.prefix + strconv.Itoa(i)
+}
+
+// fileExists returns ErrStoredFileNotFound if there's no file at index i.
+func (s *S3Storage) fileExists(ctx context.Context, i int) (err error) {
+	_, err = s.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.fileKey(i)),
+	})
+	var nf *types.NotFound
+	if errors.As(err, &nf) {
+		err = ErrStoredFileNotFound
+	}
+
+	return
+}
+
+// DeleteAllFiles deletes the files and trees of the storage. Trees by root hash and batches are kept:
+// they're under prefixes of their own, listed apart from the objects of the storage.
+func (s *S3Storage) DeleteAllFiles(ctx context.Context) (err error) {
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket:    aws.String(s.bucket),
+		Prefix:    aws.String(s.prefix),
+		Delimiter: aws.String("/"),
+	})
+	for paginator.HasMorePages() {
+		var page *s3.ListObjectsV2Output
+		page, err = paginator.NextPage(ctx)
 		if err != nil {
 			return
 		}
+
+		for _, object := range page.Contents {
+			_, err = s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+				Bucket: aws.String(s.bucket),
+				Key:    object.Key,
+			})
+			if err != nil {
+				return
+			}
+		}
 	}
 
 	return nil
 }
 
-func (s *S3Storage) countFiles(ctx context.Context) (count int, err error) {
+// lastIndex returns the highest index files have been stored at, listing them: see allocateIndex for the counter of it.
+// Deleted files leave gaps, hence it can't be told by counting the files.
+func (s *S3Storage) lastIndex(ctx context.Context) (lastIndex int, err error) {
 	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
-		Bucket: aws.String(s.bucket),
+		Bucket:    aws.String(s.bucket),
+		Prefix:    aws.String(s.prefix),
+		Delimiter: aws.String("/"),
 	})
 	for paginator.HasMorePages() {
 		var page *s3.ListObjectsV2Output
@@ -124,7 +664,12 @@ func (s *S3Storage) countFiles(ctx context.Context) (count int, err error) {
 			return
 		}
 
-		count += len(page.Contents)
+		// only files are stored under numeric keys
+		for _, object := range page.Contents {
+			if i, err := strconv.Atoi(strings.TrimPrefix(aws.ToString(object.Key), s.prefix)); err == nil && i > lastIndex {
+				lastIndex = i
+			}
+		}
 	}
 
 	return
@@ -136,25 +681,161 @@ func (s *S3Storage) StoreTree(ctx context.Context, tree *merkle.Tree) (err error
 		return
 	}
 
+	if err = s.putTreeObject(ctx, treesByRootPrefix+tree.RootHash().String(), treeBytes); err != nil {
+		return
+	}
+
+	return s.putTreeObject(ctx, s.merkleTreeFileName, treeBytes)
+}
+
+func (s *S3Storage) RetrieveTree(ctx context.Context) (tree *merkle.Tree, err error) {
+	return s.retrieveTree(ctx, s.merkleTreeFileName)
+}
+
+func (s *S3Storage) RetrieveTreeByRoot(ctx context.Context, rootHash merkle.Digest) (tree *merkle.Tree, err error) {
+	return s.retrieveTree(ctx, treesByRootPrefix+rootHash.String())
+}
+
+func (s *S3Storage) retrieveTree(ctx context.Context, key string) (tree *merkle.Tree, err error) {
+	body, err := s.getTreeObject(ctx, key)
+	if err != nil {
+		return
+	}
+	defer func() { _ = body.Close() }()
+
+	tree, err = merkle.Deserialize(body)
+
+	return
+}
+
+func (s *S3Storage) StoreSparseTree(ctx context.Context, tree *merkle.SparseTree) (err error) {
+	treeBytes, err := tree.Serialize()
+	if err != nil {
+		return
+	}
+
+	return s.putTreeObject(ctx, s.sparseTreeFileName, treeBytes)
+}
+
+func (s *S3Storage) RetrieveSparseTree(ctx context.Context) (tree *merkle.SparseTree, err error) {
+	body, err := s.getTreeObject(ctx, s.sparseTreeFileName)
+	if err != nil {
+		return
+	}
+	defer func() { _ = body.Close() }()
+
+	tree, err = merkle.DeserializeSparseTree(body)
+
+	return
+}
+
+func (s *S3Storage) StoreMountainRange(ctx context.Context, mountainRange *merkle.MountainRange) (err error) {
+	rangeBytes, err := mountainRange.Serialize()
+	if err != nil {
+		return
+	}
+
+	return s.putTreeObject(ctx, s.mountainRangeFileName, rangeBytes)
+}
+
+func (s *S3Storage) RetrieveMountainRange(ctx context.Context) (mountainRange *merkle.MountainRange, err error) {
+	body, err := s.getTreeObject(ctx, s.mountainRangeFileName)
+	if err != nil {
+		return
+	}
+	defer func() { _ = body.Close() }()
+
+	mountainRange, err = merkle.DeserializeMountainRange(body)
+
+	return
+}
+
+// CreateBatch creates a batch, marked by an empty object named after it, see Batch.
+func (s *S3Storage) CreateBatch(ctx context.Context) (id string, err error) {
+	if id, err = newBatchID(); err != nil {
+		return
+	}
+
 	_, err = s.client.PutObject(ctx, &s3.PutObjectInput{
 		Bucket: aws.String(s.bucket),
-		Key:    aws.String(s.merkleTreeFileName),
-		Body:   bytes.NewReader(treeBytes),
+		Key:    aws.String(batchesPrefix + id),
+		Body:   bytes.NewReader(nil),
 	})
+	if err != nil {
+		return "", err
+	}
 
 	return
 }
 
-func (s *S3Storage) RetrieveTree(ctx context.Context) (tree *merkle.Tree, err error) {
-	resp, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+// Batch returns the storage of a batch, whose files and trees are kept under the prefix batches/<id>/.
+func (s *S3Storage) Batch(ctx context.Context, id string) (batch Repository, err error) {
+	if !validBatchID(id) {
+		return nil, ErrBatchNotFound
+	}
+
+	_, err = s.client.HeadObject(ctx, &s3.HeadObjectInput{
 		Bucket: aws.String(s.bucket),
-		Key:    aws.String(s.merkleTreeFileName),
+		Key:    aws.String(batchesPrefix + id),
 	})
+	var nf *types.NotFound
+	if errors.As(err, &nf) {
+		return nil, ErrBatchNotFound
+	}
 	if err != nil {
 		return
 	}
 
-	tree, err = merkle.Deserialize(resp.Body)
+	// the names of the trees of a batch are relative to its prefix, as the ones of the storage are to the bucket
+	prefix := batchesPrefix + id + "/"
+
+	return &S3Storage{
+		client:                s.client,
+		bucket:                s.bucket,
+		prefix:                prefix,
+		merkleTreeFileName:    prefix + strings.TrimPrefix(s.merkleTreeFileName, s.prefix),
+		sparseTreeFileName:    prefix + strings.TrimPrefix(s.sparseTreeFileName, s.prefix),
+		mountainRangeFileName: prefix + strings.TrimPrefix(s.mountainRangeFileName, s.prefix),
+		partSize:              s.partSize,
+		partUploads:           s.partUploads,
+		conditionalWrites:     s.conditionalWrites,
+	}, nil
+}
+
+// Transaction runs fn against the storage itself: S3 has no transactions across objects, the writes land as they go.
+func (s *S3Storage) Transaction(_ context.Context, fn func(Repository) error) error {
+	return fn(s)
+}
+
+func (s *S3Storage) Atomic() bool {
+	return false
+}
+
+func (s *S3Storage) putTreeObject(ctx context.Context, key string, content []byte) (err error) {
+	_, err = s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(content),
+	})
 
 	return
 }
+
+// getTreeObject returns the body of a tree object, or ErrTreeNotFound if missing.
+func (s *S3Storage) getTreeObject(ctx context.Context, key string) (body io.ReadCloser, err error) {
+	resp, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	var nsk *types.NoSuchKey
+	if errors.As(err, &nsk) {
+		err = ErrTreeNotFound
+
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	return resp.Body, nil
+}
@@ -0,0 +1,584 @@
+package storage
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"merkle-file-uploader/internal/merkle"
+)
+
+const testBucket = "mfu-test"
+
+// fakeS3 is a local stand-in for an S3 bucket, serving the path-style requests of S3Storage:
+// objects are put, with conditional writes or in parts, got, by range too, headed, deleted, and listed in pages.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]fakeObject
+	uploads map[string]*fakeUpload // multipart uploads in progress, by ID
+	seq     int
+
+	pageSize         int  // of the listings, all the keys being listed at once if 0
+	ignoreConditions bool // of conditional writes, as older LocalStack versions do
+
+	failPart        int // the number of the parts whose uploads fail, if any
+	runningParts    int
+	maxRunningParts int
+}
+
+type fakeObject struct {
+	content []byte
+	eTag    string
+	header  http.Header
+	parts   int // of the multipart upload the object has been put with, if any
+}
+
+type fakeUpload struct {
+	key    string
+	header http.Header
+	parts  map[int][]byte
+}
+
+func newFakeS3Storage(t *testing.T) (*S3Storage, *fakeS3) {
+	fake := &fakeS3{objects: make(map[string]fakeObject), uploads: make(map[string]*fakeUpload)}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	s3Storage, err := NewS3Storage("test", "test", server.URL, testBucket, ".merkletree", ".sparsetree", ".mountainrange")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s3Storage, fake
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Has("partNumber") {
+		// parts take a while to upload, so that concurrent uploads overlap, see maxRunningParts
+		f.mu.Lock()
+		f.runningParts++
+		f.maxRunningParts = max(f.maxRunningParts, f.runningParts)
+		f.mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		f.mu.Lock()
+		f.runningParts--
+		f.mu.Unlock()
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/"+testBucket), "/")
+	if key == "" && r.Method == http.MethodGet {
+		f.list(w, r)
+
+		return
+	}
+	if query.Has("uploads") || query.Has("uploadId") {
+		f.multipart(w, r, key)
+
+		return
+	}
+
+	object, found := f.objects[key]
+	switch r.Method {
+	case http.MethodPut:
+		if ifMatch := r.Header.Get("If-Match"); !f.ignoreConditions &&
+			(ifMatch != "" && (!found || ifMatch != object.eTag) || r.Header.Get("If-None-Match") == "*" && found) {
+			fakeS3Error(w, http.StatusPreconditionFailed, "PreconditionFailed")
+
+			return
+		}
+
+		content, _ := io.ReadAll(r.Body)
+		f.objects[key] = fakeObject{content: content, eTag: fakeETag(content), header: objectHeader(r)}
+		w.Header().Set("ETag", f.objects[key].eTag)
+	case http.MethodGet, http.MethodHead:
+		if !found {
+			fakeS3Error(w, http.StatusNotFound, "NoSuchKey")
+
+			return
+		}
+
+		content, statusCode := object.content, http.StatusOK
+		if byteRange := r.Header.Get("Range"); byteRange != "" {
+			var start, end int
+			if _, err := fmt.Sscanf(byteRange, "bytes=%d-%d", &start, &end); err != nil || start >= len(content) {
+				fakeS3Error(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+
+				return
+			}
+
+			end = min(end, len(content)-1)
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(content)))
+			content, statusCode = content[start:end+1], http.StatusPartialContent
+		}
+
+		for name, values := range object.header {
+			w.Header()[name] = values
+		}
+		w.Header().Set("ETag", object.eTag)
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		w.WriteHeader(statusCode)
+		if r.Method == http.MethodGet {
+			_, _ = w.Write(content)
+		}
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// multipart serves the requests of multipart uploads: created, their parts uploaded, then completed or aborted.
+func (f *fakeS3) multipart(w http.ResponseWriter, r *http.Request, key string) {
+	query := r.URL.Query()
+	if query.Has("uploads") {
+		f.seq++
+		id := fmt.Sprint(f.seq)
+		f.uploads[id] = &fakeUpload{key: key, header: objectHeader(r), parts: make(map[int][]byte)}
+		fakeS3XML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			Bucket   string
+			Key      string
+			UploadId string
+		}{Bucket: testBucket, Key: key, UploadId: id})
+
+		return
+	}
+
+	id := query.Get("uploadId")
+	upload, found := f.uploads[id]
+	if !found || upload.key != key {
+		fakeS3Error(w, http.StatusNotFound, "NoSuchUpload")
+
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		number, _ := strconv.Atoi(query.Get("partNumber"))
+		if number == f.failPart {
+			fakeS3Error(w, http.StatusBadRequest, "BadDigest")
+
+			return
+		}
+
+		content, _ := io.ReadAll(r.Body)
+		upload.parts[number] = content
+		w.Header().Set("ETag", fakeETag(content))
+	case http.MethodPost:
+		var completion struct {
+			Parts []struct {
+				ETag       string
+				PartNumber int
+			} `xml:"Part"`
+		}
+		_ = xml.NewDecoder(r.Body).Decode(&completion)
+
+		var content []byte
+		for i, part := range completion.Parts {
+			if part.PartNumber != i+1 || part.ETag != fakeETag(upload.parts[part.PartNumber]) {
+				fakeS3Error(w, http.StatusBadRequest, "InvalidPart")
+
+				return
+			}
+			content = append(content, upload.parts[part.PartNumber]...)
+		}
+
+		f.objects[key] = fakeObject{content: content, eTag: fakeETag(content), header: upload.header, parts: len(completion.Parts)}
+		delete(f.uploads, id)
+		fakeS3XML(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Bucket  string
+			Key     string
+			ETag    string
+		}{Bucket: testBucket, Key: key, ETag: f.objects[key].eTag})
+	case http.MethodDelete:
+		delete(f.uploads, id)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// list lists the keys, and common prefixes, after the continuation token, which is the last one of the previous page.
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	type content struct {
+		Key string
+	}
+	type commonPrefix struct {
+		Prefix string
+	}
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Name                  string
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+		Contents              []content
+		CommonPrefixes        []commonPrefix
+	}{Name: testBucket}
+
+	prefix, delimiter := r.URL.Query().Get("prefix"), r.URL.Query().Get("delimiter")
+	entries := make(map[string]bool) // keys, and common prefixes, which are true
+	for key := range f.objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			entries[key[:len(prefix)+i+1]] = true
+		} else {
+			entries[key] = false
+		}
+	}
+
+	var sorted []string
+	for entry := range entries {
+		if entry > r.URL.Query().Get("continuation-token") {
+			sorted = append(sorted, entry)
+		}
+	}
+	sort.Strings(sorted)
+	if f.pageSize > 0 && len(sorted) > f.pageSize {
+		sorted = sorted[:f.pageSize]
+		result.IsTruncated, result.NextContinuationToken = true, sorted[len(sorted)-1]
+	}
+
+	for _, entry := range sorted {
+		if entries[entry] {
+			result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: entry})
+		} else {
+			result.Contents = append(result.Contents, content{Key: entry})
+		}
+	}
+
+	fakeS3XML(w, result)
+}
+
+func fakeS3XML(w http.ResponseWriter, result any) {
+	w.Header().Set("Content-Type", "application/xml")
+	_ = xml.NewEncoder(w).Encode(result)
+}
+
+// objectHeader keeps the headers of a request that are stored along with the object.
+func objectHeader(r *http.Request) http.Header {
+	header := http.Header{}
+	for name, values := range r.Header {
+		if name == "Content-Type" || strings.HasPrefix(name, "X-Amz-Meta-") {
+			header[name] = values
+		}
+	}
+
+	return header
+}
+
+func fakeETag(content []byte) string {
+	sum := md5.Sum(content)
+
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func fakeS3Error(w http.ResponseWriter, statusCode int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(statusCode)
+	_, _ = fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func (f *fakeS3) put(key, content string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.objects[key] = fakeObject{content: []byte(content), eTag: `"` + key + `"`, header: http.Header{}}
+}
+
+func TestS3StoreFileConcurrently(t *testing.T) {
+	s3Storage, _ := newFakeS3Storage(t)
+
+	const writers, filesPerWriter = 8, 4
+	indices := make(chan int, writers*filesPerWriter)
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			for f := 0; f < filesPerWriter; f++ {
+				i, err := s3Storage.StoreFile(context.Background(), StoredFile{
+					FileMetadata: FileMetadata{Name: fmt.Sprintf("%d-%d.txt", w, f)},
+					Content:      strings.NewReader(fmt.Sprintf("content %d-%d", w, f)),
+				})
+				assert.NoError(t, err)
+				indices <- i
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(indices)
+
+	// every index is handed out once, without gaps
+	seen := make(map[int]bool)
+	for i := range indices {
+		assert.False(t, seen[i], "index %d handed out twice", i)
+		seen[i] = true
+	}
+	for i := 1; i <= writers*filesPerWriter; i++ {
+		assert.True(t, seen[i], "index %d not handed out", i)
+
+		// each file is stored at its own index, along with its own metadata
+		metadata, content, err := s3Storage.RetrieveFileByIndex(context.Background(), i)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		data, err := io.ReadAll(content)
+		assert.NoError(t, err)
+		assert.NoError(t, content.Close())
+		assert.Equal(t, i, metadata.Index)
+		assert.Equal(t, "content "+strings.TrimSuffix(metadata.Name, ".txt"), string(data))
+	}
+}
+
+func TestS3StoreFileIndex(t *testing.T) {
+	cases := map[string]struct {
+		objects  map[string]string
+		expected int
+	}{
+		"empty bucket":                     {nil, 1},
+		"counter":                          {map[string]string{lastIndexKey: "7", "7": "x"}, 8},
+		"files stored before the counter":  {map[string]string{"1": "a", "2": "b", "5": "c", ".merkletree": "t"}, 6},
+		"files of batches are not counted": {map[string]string{"1": "a", batchesPrefix + "ab/9": "b"}, 2},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			s3Storage, fake := newFakeS3Storage(t)
+			for key, content := range tc.objects {
+				fake.put(key, content)
+			}
+
+			i, err := s3Storage.StoreFile(context.Background(), StoredFile{Content: strings.NewReader("new")})
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, i)
+
+			// the counter goes on from the new index
+			i, err = s3Storage.StoreFile(context.Background(), StoredFile{Content: strings.NewReader("next")})
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected+1, i)
+		})
+	}
+}
+
+func TestS3DeleteAllFilesResetsIndex(t *testing.T) {
+	s3Storage, _ := newFakeS3Storage(t)
+
+	for range []int{1, 2, 3} {
+		_, err := s3Storage.StoreFile(context.Background(), StoredFile{Content: strings.NewReader("x")})
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, s3Storage.DeleteAllFiles(context.Background()))
+
+	i, err := s3Storage.StoreFile(context.Background(), StoredFile{Content: strings.NewReader("x")})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, i)
+}
+
+func TestS3DeleteAllFilesPages(t *testing.T) {
+	s3Storage, fake := newFakeS3Storage(t)
+	fake.pageSize = 2
+
+	// the files, their chunk hashes, the counter and the trees span several pages of listings
+	for range []int{1, 2, 3, 4, 5} {
+		_, err := s3Storage.StoreFile(context.Background(), StoredFile{
+			Content:     strings.NewReader("x"),
+			ChunkHashes: []merkle.Digest{{1}},
+		})
+		assert.NoError(t, err)
+	}
+	tree, err := merkle.NewTree([][]byte{[]byte("x")}, merkle.HashFactory(sha256.New))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, s3Storage.StoreTree(context.Background(), tree))
+
+	assert.NoError(t, s3Storage.DeleteAllFiles(context.Background()))
+
+	// only the trees kept by root hash are left
+	var keys []string
+	for key := range fake.objects {
+		keys = append(keys, key)
+	}
+	assert.Equal(t, []string{treesByRootPrefix + tree.RootHash().String()}, keys)
+}
+
+func TestS3ConditionalWrites(t *testing.T) {
+	s3Storage, fake := newFakeS3Storage(t)
+	fake.ignoreConditions = true
+
+	_, err := s3Storage.StoreFile(context.Background(), StoredFile{Content: strings.NewReader("x")})
+	assert.ErrorIs(t, err, errNoConditionalWrites)
+
+	// nothing is stored, not even the probe
+	assert.Empty(t, fake.objects)
+
+	// the bucket is checked again until it supports them, then only once
+	fake.ignoreConditions = false
+	for _, expected := range []int{1, 2} {
+		i, err := s3Storage.StoreFile(context.Background(), StoredFile{Content: strings.NewReader("x")})
+		assert.NoError(t, err)
+		assert.Equal(t, expected, i)
+	}
+
+	fake.ignoreConditions = true
+	_, err = s3Storage.StoreFile(context.Background(), StoredFile{Content: strings.NewReader("x")})
+	assert.NoError(t, err)
+	for key := range fake.objects {
+		assert.False(t, strings.HasPrefix(key, conditionalWritesProbeKey), "probe %s left behind", key)
+	}
+}
+
+func TestS3StoreFileMultipart(t *testing.T) {
+	cases := map[string]struct {
+		size  int
+		parts int // 0 if put at once
+	}{
+		"empty":               {0, 0},
+		"smaller than a part": {4, 0},
+		"one part":            {5, 1},
+		"a part and a bit":    {6, 2},
+		"many parts":          {23, 5},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			s3Storage, fake := newFakeS3Storage(t)
+			s3Storage.partSize, s3Storage.partUploads = 5, 3
+
+			content := strings.Repeat("0123456789", 3)[:tc.size]
+			i, err := s3Storage.StoreFile(context.Background(), StoredFile{
+				FileMetadata: FileMetadata{Name: "été.txt", ContentType: "text/plain"},
+				// the content can't seek, it's read a part at a time
+				Content: iotest.HalfReader(strings.NewReader(content)),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			metadata, stored, err := s3Storage.RetrieveFileByIndex(context.Background(), i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := io.ReadAll(stored)
+			assert.NoError(t, err)
+			assert.NoError(t, stored.Close())
+
+			assert.Equal(t, content, string(data))
+			assert.Equal(t, tc.size, metadata.Size)
+			assert.Equal(t, "été.txt", metadata.Name)
+			assert.Equal(t, "text/plain", metadata.ContentType)
+			assert.Equal(t, tc.parts, fake.objects["1"].parts)
+			assert.Empty(t, fake.uploads)
+			if tc.parts > 2 {
+				assert.Greater(t, fake.maxRunningParts, 1, "parts uploaded one at a time")
+			}
+		})
+	}
+}
+
+func TestS3StoreFileMultipartAborted(t *testing.T) {
+	s3Storage, fake := newFakeS3Storage(t)
+	s3Storage.partSize, s3Storage.partUploads = 5, 3
+	fake.failPart = 2
+
+	_, err := s3Storage.StoreFile(context.Background(), StoredFile{Content: strings.NewReader(strings.Repeat("x", 23))})
+	assert.Error(t, err)
+
+	// the upload is aborted, and no object is left behind
+	assert.Empty(t, fake.uploads)
+	_, err = s3Storage.RetrieveFileMetadata(context.Background(), 1)
+	assert.ErrorIs(t, err, ErrStoredFileNotFound)
+}
+
+func TestS3RetrieveFileRange(t *testing.T) {
+	s3Storage, _ := newFakeS3Storage(t)
+	if _, err := s3Storage.StoreFile(context.Background(), StoredFile{Content: strings.NewReader("0123456789")}); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]struct {
+		index    int
+		offset   int
+		length   int
+		expected string
+		err      error
+	}{
+		"start":        {1, 0, 4, "0123", nil},
+		"middle":       {1, 3, 2, "34", nil},
+		"past the end": {1, 6, 10, "6789", nil},
+		"last byte":    {1, 9, 1, "9", nil},
+		"outside":      {1, 10, 1, "", ErrRangeNotSatisfiable},
+		"missing file": {2, 0, 1, "", ErrStoredFileNotFound},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			metadata, content, err := s3Storage.RetrieveFileRange(context.Background(), tc.index, tc.offset, tc.length)
+			if tc.err != nil {
+				assert.ErrorIs(t, err, tc.err)
+
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := io.ReadAll(content)
+			assert.NoError(t, err)
+			assert.NoError(t, content.Close())
+			assert.Equal(t, tc.expected, string(data))
+			// the size is the one of the whole file
+			assert.Equal(t, 10, metadata.Size)
+		})
+	}
+}
+
+func TestS3ChunkHashes(t *testing.T) {
+	s3Storage, _ := newFakeS3Storage(t)
+	chunkHashes := []merkle.Digest{{1, 2}, {3, 4}}
+
+	i, err := s3Storage.StoreFile(context.Background(), StoredFile{Content: strings.NewReader("x"), ChunkHashes: chunkHashes})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := s3Storage.RetrieveChunkHashes(context.Background(), i)
+	assert.NoError(t, err)
+	assert.Equal(t, chunkHashes, stored)
+
+	// the chunk hashes of the previous content aren't kept by a replacement without
+	assert.NoError(t, s3Storage.ReplaceFile(context.Background(), StoredFile{
+		FileMetadata: FileMetadata{Index: i},
+		Content:      strings.NewReader("y"),
+	}))
+	stored, err = s3Storage.RetrieveChunkHashes(context.Background(), i)
+	assert.NoError(t, err)
+	assert.Nil(t, stored)
+
+	assert.NoError(t, s3Storage.DeleteFile(context.Background(), i))
+	_, err = s3Storage.RetrieveChunkHashes(context.Background(), i)
+	assert.ErrorIs(t, err, ErrStoredFileNotFound)
+}
@@ -0,0 +1,737 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	_ "modernc.org/sqlite"
+
+	"merkle-file-uploader/internal/merkle"
+)
+
+// sqliteMigrations migrate the schema of a database from its version, see PRAGMA user_version, to the last one.
+var sqliteMigrations = []string{
+	// Files are indexed within their batch, and the trees of a batch are stored along with them: the uploads outside
+	// of batches go to the last batch that's not standalone, see storageBatch.
+	// Merkle trees are also kept by root hash, as in the other storages, see RetrieveTreeByRoot.
+	`
+CREATE TABLE IF NOT EXISTS batches (
+	id         INTEGER PRIMARY KEY AUTOINCREMENT,
+	created_at DATETIME NOT NULL,
+	last_index INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS files (
+	batch_id   INTEGER NOT NULL REFERENCES batches (id),
+	file_index INTEGER NOT NULL,
+	name       TEXT NOT NULL,
+	size       INTEGER NOT NULL,
+	content    BLOB,
+	PRIMARY KEY (batch_id, file_index)
+);
+
+CREATE INDEX IF NOT EXISTS files_name ON files (name);
+CREATE INDEX IF NOT EXISTS files_size ON files (size);
+
+CREATE TABLE IF NOT EXISTS trees (
+	batch_id INTEGER NOT NULL REFERENCES batches (id),
+	kind     TEXT NOT NULL,
+	content  BLOB NOT NULL,
+	PRIMARY KEY (batch_id, kind)
+);
+
+CREATE TABLE IF NOT EXISTS merkle_trees (
+	root_hash TEXT PRIMARY KEY,
+	batch_id  INTEGER NOT NULL REFERENCES batches (id),
+	content   BLOB NOT NULL
+);
+`,
+	// Standalone batches are the ones created by CreateBatch, apart from the uploads outside of batches.
+	`ALTER TABLE batches ADD COLUMN standalone INTEGER NOT NULL DEFAULT 0;`,
+	// The upload time and leaf hash of the files stored before they were recorded are NULL.
+	`
+ALTER TABLE files ADD COLUMN content_type TEXT NOT NULL DEFAULT '';
+ALTER TABLE files ADD COLUMN uploaded_at DATETIME;
+ALTER TABLE files ADD COLUMN leaf_hash BLOB;
+`,
+	// Contents are stored in chunks, so that they're streamed in and out rather than read at once:
+	// the files stored before keep theirs in files.content.
+	`
+CREATE TABLE IF NOT EXISTS file_chunks (
+	batch_id   INTEGER NOT NULL,
+	file_index INTEGER NOT NULL,
+	seq        INTEGER NOT NULL,
+	content    BLOB NOT NULL,
+	PRIMARY KEY (batch_id, file_index, seq),
+	FOREIGN KEY (batch_id, file_index) REFERENCES files (batch_id, file_index) ON DELETE CASCADE
+);
+`,
+	// The chunk hashes of a file, a JSON array of hex digests, are NULL if it's been stored without.
+	`ALTER TABLE files ADD COLUMN chunk_hashes TEXT;`,
+	// Standalone batches are looked up by a random public ID, see newBatchID, rather than by their row ID,
+	// so that they can't be guessed: it's NULL for the batches of the uploads outside of batches.
+	`
+ALTER TABLE batches ADD COLUMN public_id TEXT;
+UPDATE batches SET public_id = lower(hex(randomblob(8))) WHERE standalone;
+CREATE UNIQUE INDEX IF NOT EXISTS batches_public_id ON batches (public_id);
+`,
+}
+
+// sqliteChunkSize is the size of the chunks the contents of files are stored in, see file_chunks.
+// Every chunk but the last is that long, so the one a range starts in is found by its seq.
+const sqliteChunkSize = 1 << 20
+
+// storageBatch selects the batch of the storage, given as its argument: the one the storage is scoped to,
+// see Batch, or else the current batch of the uploads outside of batches.
+const storageBatch = "COALESCE(NULLIF(?, 0), (SELECT MAX(id) FROM batches WHERE NOT standalone))"
+
+// kinds of the trees of a batch
+const (
+	treeKindMerkle        = "merkle"
+	treeKindSparse        = "sparse"
+	treeKindMountainRange = "mountainrange"
+)
+
+// SQLiteStorage keeps files and trees in an embedded SQLite database, writing them in transactions:
+// an upload either fully lands, or not at all, see Transaction.
+type SQLiteStorage struct {
+	db    *sql.DB
+	q     querier // the database, or the transaction the storage is bound to
+	batch int     // the batch the storage is scoped to, if any, see storageBatch
+}
+
+// querier runs the queries of SQLiteStorage, either a *sql.DB or a *sql.Tx.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+var _ Repository = (*SQLiteStorage)(nil)
+
+// Batch is a batch of files of SQLiteStorage, as uploaded at once, or appended later on.
+// Standalone batches are the ones created by CreateBatch.
+type Batch struct {
+	ID         int
+	PublicID   string // the ID of a standalone batch, as returned by CreateBatch
+	CreatedAt  time.Time
+	Standalone bool
+	FileCount  int
+	Size       int
+}
+
+// FileInfo describes a file of SQLiteStorage, without its content.
+type FileInfo struct {
+	Batch int
+	Index int
+	Name  string
+	Size  int
+}
+
+// FileQuery selects files of SQLiteStorage: NamePattern is a LIKE pattern, e.g. "%.pdf", sizes are in bytes,
+// and zero values select every file, e.g. a Batch of 0 selects the files of every batch.
+type FileQuery struct {
+	Batch       int
+	NamePattern string
+	MinSize     int
+	MaxSize     int
+}
+
+// sqliteMaxConns caps the connections to a database file: one writes at a time, the others read meanwhile.
+const sqliteMaxConns = 8
+
+// NewSQLiteStorage opens the database at path, creating it if missing, e.g. "mfu.db", or ":memory:".
+// Databases in files are in WAL mode, so that they're read while an upload writes to them.
+func NewSQLiteStorage(path string) (sqliteStorage *SQLiteStorage, err error) {
+	db, err := sql.Open("sqlite", path+"?_pragma=foreign_keys(1)&_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_txlock=immediate")
+	if err != nil {
+		return
+	}
+
+	// SQLite writes one transaction at a time, which immediate ones wait for, while each connection
+	// to an in-memory database has a database of its own: there's a single one
+	db.SetMaxOpenConns(sqliteMaxConns)
+	if path == ":memory:" {
+		db.SetMaxOpenConns(1)
+	}
+
+	sqliteStorage = &SQLiteStorage{db: db, q: db}
+	if err = sqliteStorage.migrate(context.Background()); err != nil {
+		_ = db.Close()
+
+		return nil, err
+	}
+
+	return
+}
+
+// migrate runs the migrations the database hasn't run yet, creating the first batch of a new database.
+func (s *SQLiteStorage) migrate(ctx context.Context) (err error) {
+	return s.inTransaction(ctx, func(tx *SQLiteStorage) (err error) {
+		var version int
+		if err = tx.q.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version); err != nil {
+			return
+		}
+
+		for _, migration := range sqliteMigrations[min(version, len(sqliteMigrations)):] {
+			if _, err = tx.q.ExecContext(ctx, migration); err != nil {
+				return
+			}
+		}
+		if _, err = tx.q.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d", len(sqliteMigrations))); err != nil {
+			return
+		}
+
+		var batches int
+		if err = tx.q.QueryRowContext(ctx, "SELECT COUNT(*) FROM batches WHERE NOT standalone").Scan(&batches); err != nil || batches > 0 {
+			return
+		}
+
+		return tx.newBatch(ctx)
+	})
+}
+
+// Close closes the database.
+func (s *SQLiteStorage) Close() error {
+	return s.db.Close()
+}
+
+// Transaction runs fn against the storage bound to a transaction, committed if fn succeeds, or rolled back.
+// Transactions don't nest: fn runs in the transaction of a storage that's already bound to one.
+func (s *SQLiteStorage) Transaction(ctx context.Context, fn func(Repository) error) error {
+	return s.inTransaction(ctx, func(tx *SQLiteStorage) error {
+		return fn(tx)
+	})
+}
+
+func (s *SQLiteStorage) Atomic() bool {
+	return true
+}
+
+func (s *SQLiteStorage) inTransaction(ctx context.Context, fn func(*SQLiteStorage) error) (err error) {
+	if _, ok := s.q.(*sql.Tx); ok {
+		return fn(s)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	if err = fn(&SQLiteStorage{db: s.db, q: tx, batch: s.batch}); err != nil {
+		return
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLiteStorage) newBatch(ctx context.Context) (err error) {
+	_, err = s.q.ExecContext(ctx, "INSERT INTO batches (created_at) VALUES (?)", time.Now().UTC())
+
+	return
+}
+
+func (s *SQLiteStorage) CreateBatch(ctx context.Context) (id string, err error) {
+	if id, err = newBatchID(); err != nil {
+		return
+	}
+
+	_, err = s.q.ExecContext(
+		ctx,
+		"INSERT INTO batches (created_at, standalone, public_id) VALUES (?, 1, ?)",
+		time.Now().UTC(), id,
+	)
+
+	return
+}
+
+// Batch returns the storage of a standalone batch, bound to the transaction of s, if any.
+func (s *SQLiteStorage) Batch(ctx context.Context, id string) (batch Repository, err error) {
+	if !validBatchID(id) {
+		return nil, ErrBatchNotFound
+	}
+
+	var i int
+	err = s.q.QueryRowContext(ctx, "SELECT id FROM batches WHERE public_id = ? AND standalone", id).Scan(&i)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrBatchNotFound
+	}
+	if err != nil {
+		return
+	}
+
+	return &SQLiteStorage{db: s.db, q: s.q, batch: i}, nil
+}
+
+func (s *SQLiteStorage) StoreFile(ctx context.Context, file StoredFile) (i int, err error) {
+	chunkHashes, err := nullChunkHashes(file.ChunkHashes)
+	if err != nil {
+		return
+	}
+
+	err = s.inTransaction(ctx, func(tx *SQLiteStorage) (err error) {
+		var batch int
+		if err = tx.q.QueryRowContext(
+			ctx,
+			"UPDATE batches SET last_index = last_index + 1 WHERE id = "+storageBatch+" RETURNING id, last_index",
+			tx.batch,
+		).Scan(&batch, &i); err != nil {
+			return
+		}
+
+		if _, err = tx.q.ExecContext(
+			ctx,
+			`INSERT INTO files (batch_id, file_index, name, size, content_type, uploaded_at, leaf_hash, chunk_hashes)
+			VALUES (?, ?, ?, 0, ?, ?, ?, ?)`,
+			batch, i, file.Name, file.ContentType, nullTime(file.UploadedAt), []byte(file.LeafHash), chunkHashes,
+		); err != nil {
+			return
+		}
+
+		return tx.storeContent(ctx, batch, i, file.Content)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return
+}
+
+// RetrieveFileByIndex returns the file at index i, whose content is read one chunk at a time by a single query,
+// which holds a connection until the content is closed. When the storage is bound to a transaction,
+// the content must be read before it ends.
+func (s *SQLiteStorage) RetrieveFileByIndex(ctx context.Context, i int) (metadata FileMetadata, content io.ReadCloser, err error) {
+	return s.retrieveFile(ctx, i, true, 0)
+}
+
+// RetrieveFileRange reads the chunks of the range only, from the one offset is in on.
+func (s *SQLiteStorage) RetrieveFileRange(ctx context.Context, i, offset, length int) (metadata FileMetadata, content io.ReadCloser, err error) {
+	if metadata, content, err = s.retrieveFile(ctx, i, true, offset); err != nil {
+		return
+	}
+	if offset >= metadata.Size {
+		_ = content.Close()
+
+		return metadata, nil, ErrRangeNotSatisfiable
+	}
+
+	return metadata, limitReadCloser(content, length), nil
+}
+
+func (s *SQLiteStorage) RetrieveFileMetadata(ctx context.Context, i int) (metadata FileMetadata, err error) {
+	metadata, _, err = s.retrieveFile(ctx, i, false, 0)
+
+	return
+}
+
+func (s *SQLiteStorage) RetrieveChunkHashes(ctx context.Context, i int) (chunkHashes []merkle.Digest, err error) {
+	var chunkHashesJSON sql.NullString
+	err = s.q.QueryRowContext(
+		ctx,
+		"SELECT chunk_hashes FROM files WHERE batch_id = "+storageBatch+" AND file_index = ?",
+		s.batch, i,
+	).Scan(&chunkHashesJSON)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = ErrStoredFileNotFound
+	}
+	if err != nil || !chunkHashesJSON.Valid {
+		return
+	}
+
+	err = json.Unmarshal([]byte(chunkHashesJSON.String), &chunkHashes)
+
+	return
+}
+
+// retrieveFile returns the file at index i, along with its content from offset on if withContent,
+// or ErrStoredFileNotFound.
+func (s *SQLiteStorage) retrieveFile(ctx context.Context, i int, withContent bool, offset int) (
+	metadata FileMetadata,
+	content io.ReadCloser,
+	err error,
+) {
+	var batch int
+	var uploadedAt sql.NullTime
+	var leafHash, legacyContent []byte
+	columns := "batch_id, name, size, content_type, uploaded_at, leaf_hash"
+	dest := []any{&batch, &metadata.Name, &metadata.Size, &metadata.ContentType, &uploadedAt, &leafHash}
+	if withContent {
+		columns += ", content"
+		dest = append(dest, &legacyContent)
+	}
+
+	err = s.q.QueryRowContext(
+		ctx,
+		"SELECT "+columns+" FROM files WHERE batch_id = "+storageBatch+" AND file_index = ?",
+		s.batch, i,
+	).Scan(dest...)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = ErrStoredFileNotFound
+	}
+	if err != nil {
+		return
+	}
+
+	metadata.Index = i
+	metadata.UploadedAt = uploadedAt.Time
+	metadata.LeafHash = leafHash
+
+	switch {
+	case !withContent:
+	case legacyContent != nil:
+		content = io.NopCloser(bytes.NewReader(legacyContent[min(offset, len(legacyContent)):]))
+	default:
+		content = &sqliteContent{
+			ctx:   ctx,
+			q:     s.q,
+			batch: batch,
+			index: i,
+			seq:   offset / sqliteChunkSize,
+			skip:  offset % sqliteChunkSize,
+		}
+	}
+
+	return
+}
+
+func (s *SQLiteStorage) ReplaceFile(ctx context.Context, file StoredFile) (err error) {
+	chunkHashes, err := nullChunkHashes(file.ChunkHashes)
+	if err != nil {
+		return
+	}
+
+	return s.inTransaction(ctx, func(tx *SQLiteStorage) (err error) {
+		var batch int
+		err = tx.q.QueryRowContext(
+			ctx,
+			`UPDATE files SET name = ?, size = 0, content = NULL, content_type = ?, uploaded_at = ?, leaf_hash = ?, chunk_hashes = ?
+			WHERE batch_id = `+storageBatch+" AND file_index = ? RETURNING batch_id",
+			file.Name, file.ContentType, nullTime(file.UploadedAt), []byte(file.LeafHash), chunkHashes, tx.batch, file.Index,
+		).Scan(&batch)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrStoredFileNotFound
+		}
+		if err != nil {
+			return
+		}
+
+		if _, err = tx.q.ExecContext(ctx, "DELETE FROM file_chunks WHERE batch_id = ? AND file_index = ?", batch, file.Index); err != nil {
+			return
+		}
+
+		return tx.storeContent(ctx, batch, file.Index, file.Content)
+	})
+}
+
+// storeContent stores the content of the file at index in batch, reading it one chunk at a time, and records its size.
+func (s *SQLiteStorage) storeContent(ctx context.Context, batch, index int, content io.Reader) (err error) {
+	chunk := make([]byte, sqliteChunkSize)
+	size := 0
+	for seq := 0; ; seq++ {
+		n, readErr := io.ReadFull(content, chunk)
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			return readErr
+		}
+
+		if n > 0 {
+			if _, err = s.q.ExecContext(
+				ctx,
+				"INSERT INTO file_chunks (batch_id, file_index, seq, content) VALUES (?, ?, ?, ?)",
+				batch, index, seq, chunk[:n],
+			); err != nil {
+				return
+			}
+			size += n
+		}
+
+		if readErr != nil {
+			break
+		}
+	}
+
+	_, err = s.q.ExecContext(ctx, "UPDATE files SET size = ? WHERE batch_id = ? AND file_index = ?", size, batch, index)
+
+	return
+}
+
+// sqliteContent reads the content of a file one chunk at a time, from chunk seq on, skipping skip bytes into it.
+// The chunks are selected by a single query, run on the first read, whose rows are scanned as the content is read:
+// they're read from the same snapshot of the database, even if the file is replaced meanwhile.
+type sqliteContent struct {
+	ctx   context.Context
+	q     querier
+	batch int
+	index int
+	seq   int
+	skip  int
+	rows  *sql.Rows
+	chunk []byte
+}
+
+func (c *sqliteContent) Read(p []byte) (n int, err error) {
+	if c.rows == nil {
+		if c.rows, err = c.q.QueryContext(
+			c.ctx,
+			"SELECT content FROM file_chunks WHERE batch_id = ? AND file_index = ? AND seq >= ? ORDER BY seq",
+			c.batch, c.index, c.seq,
+		); err != nil {
+			return
+		}
+	}
+
+	for len(c.chunk) == 0 {
+		if !c.rows.Next() {
+			if err = c.rows.Err(); err == nil {
+				err = io.EOF
+			}
+
+			return
+		}
+		if err = c.rows.Scan(&c.chunk); err != nil {
+			return
+		}
+		c.chunk = c.chunk[min(c.skip, len(c.chunk)):]
+		c.skip = 0
+	}
+
+	n = copy(p, c.chunk)
+	c.chunk = c.chunk[n:]
+
+	return
+}
+
+// Close closes the rows of the chunks, releasing their connection.
+func (c *sqliteContent) Close() error {
+	if c.rows == nil {
+		return nil
+	}
+
+	return c.rows.Close()
+}
+
+func (s *SQLiteStorage) DeleteFile(ctx context.Context, i int) (err error) {
+	result, err := s.q.ExecContext(ctx, "DELETE FROM files WHERE batch_id = "+storageBatch+" AND file_index = ?", s.batch, i)
+	if err != nil {
+		return
+	}
+
+	return fileAffected(result)
+}
+
+// fileAffected returns ErrStoredFileNotFound unless the result of a statement affected a file.
+func fileAffected(result sql.Result) (err error) {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return
+	}
+	if affected == 0 {
+		err = ErrStoredFileNotFound
+	}
+
+	return
+}
+
+// nullChunkHashes encodes chunk hashes as a JSON array, or NULL if there are none.
+func nullChunkHashes(chunkHashes []merkle.Digest) (value sql.NullString, err error) {
+	if len(chunkHashes) == 0 {
+		return
+	}
+
+	chunkHashesJSON, err := json.Marshal(chunkHashes)
+	if err != nil {
+		return
+	}
+
+	return sql.NullString{String: string(chunkHashesJSON), Valid: true}, nil
+}
+
+// nullTime is t, or NULL if zero.
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t.UTC(), Valid: !t.IsZero()}
+}
+
+// DeleteAllFiles deletes the files and trees of the batch of the storage, along with the chunks of the files,
+// and indexes files from 1 again. Trees by root hash are kept, see RetrieveTreeByRoot.
+func (s *SQLiteStorage) DeleteAllFiles(ctx context.Context) (err error) {
+	return s.inTransaction(ctx, func(tx *SQLiteStorage) (err error) {
+		for _, query := range []string{
+			"DELETE FROM files WHERE batch_id = " + storageBatch,
+			"DELETE FROM trees WHERE batch_id = " + storageBatch,
+			"UPDATE batches SET last_index = 0 WHERE id = " + storageBatch,
+		} {
+			if _, err = tx.q.ExecContext(ctx, query, tx.batch); err != nil {
+				return
+			}
+		}
+
+		return
+	})
+}
+
+func (s *SQLiteStorage) StoreTree(ctx context.Context, tree *merkle.Tree) (err error) {
+	treeBytes, err := tree.Serialize()
+	if err != nil {
+		return
+	}
+
+	return s.inTransaction(ctx, func(tx *SQLiteStorage) (err error) {
+		if _, err = tx.q.ExecContext(
+			ctx,
+			"INSERT OR REPLACE INTO merkle_trees (root_hash, batch_id, content) VALUES (?, "+storageBatch+", ?)",
+			tree.RootHash().String(), tx.batch, treeBytes,
+		); err != nil {
+			return
+		}
+
+		return tx.storeTree(ctx, treeKindMerkle, treeBytes)
+	})
+}
+
+func (s *SQLiteStorage) RetrieveTree(ctx context.Context) (tree *merkle.Tree, err error) {
+	treeBytes, err := s.retrieveTree(ctx, treeKindMerkle)
+	if err != nil {
+		return
+	}
+
+	return merkle.Deserialize(bytes.NewReader(treeBytes))
+}
+
+func (s *SQLiteStorage) RetrieveTreeByRoot(ctx context.Context, rootHash merkle.Digest) (tree *merkle.Tree, err error) {
+	var treeBytes []byte
+	err = s.q.QueryRowContext(ctx, "SELECT content FROM merkle_trees WHERE root_hash = ?", rootHash.String()).Scan(&treeBytes)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = ErrTreeNotFound
+	}
+	if err != nil {
+		return
+	}
+
+	return merkle.Deserialize(bytes.NewReader(treeBytes))
+}
+
+func (s *SQLiteStorage) StoreSparseTree(ctx context.Context, tree *merkle.SparseTree) (err error) {
+	treeBytes, err := tree.Serialize()
+	if err != nil {
+		return
+	}
+
+	return s.storeTree(ctx, treeKindSparse, treeBytes)
+}
+
+func (s *SQLiteStorage) RetrieveSparseTree(ctx context.Context) (tree *merkle.SparseTree, err error) {
+	treeBytes, err := s.retrieveTree(ctx, treeKindSparse)
+	if err != nil {
+		return
+	}
+
+	return merkle.DeserializeSparseTree(bytes.NewReader(treeBytes))
+}
+
+func (s *SQLiteStorage) StoreMountainRange(ctx context.Context, mountainRange *merkle.MountainRange) (err error) {
+	rangeBytes, err := mountainRange.Serialize()
+	if err != nil {
+		return
+	}
+
+	return s.storeTree(ctx, treeKindMountainRange, rangeBytes)
+}
+
+func (s *SQLiteStorage) RetrieveMountainRange(ctx context.Context) (mountainRange *merkle.MountainRange, err error) {
+	rangeBytes, err := s.retrieveTree(ctx, treeKindMountainRange)
+	if err != nil {
+		return
+	}
+
+	return merkle.DeserializeMountainRange(bytes.NewReader(rangeBytes))
+}
+
+// storeTree stores a tree of the current batch, replacing the one of the same kind.
+func (s *SQLiteStorage) storeTree(ctx context.Context, kind string, content []byte) (err error) {
+	_, err = s.q.ExecContext(
+		ctx,
+		"INSERT OR REPLACE INTO trees (batch_id, kind, content) VALUES ("+storageBatch+", ?, ?)",
+		s.batch, kind, content,
+	)
+
+	return
+}
+
+// retrieveTree returns a tree of the current batch, or ErrTreeNotFound if missing.
+func (s *SQLiteStorage) retrieveTree(ctx context.Context, kind string) (content []byte, err error) {
+	err = s.q.QueryRowContext(
+		ctx,
+		"SELECT content FROM trees WHERE batch_id = "+storageBatch+" AND kind = ?",
+		s.batch, kind,
+	).Scan(&content)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = ErrTreeNotFound
+	}
+
+	return
+}
+
+// ListBatches lists every batch, oldest first.
+func (s *SQLiteStorage) ListBatches(ctx context.Context) (batches []Batch, err error) {
+	rows, err := s.q.QueryContext(ctx, `
+		SELECT b.id, COALESCE(b.public_id, ''), b.created_at, b.standalone, COUNT(f.file_index), COALESCE(SUM(f.size), 0)
+		FROM batches b LEFT JOIN files f ON f.batch_id = b.id
+		GROUP BY b.id
+		ORDER BY b.id`,
+	)
+	if err != nil {
+		return
+	}
+	defer func() { _ = rows.Close() }()
+
+	for rows.Next() {
+		var batch Batch
+		if err = rows.Scan(&batch.ID, &batch.PublicID, &batch.CreatedAt, &batch.Standalone, &batch.FileCount, &batch.Size); err != nil {
+			return nil, err
+		}
+		batches = append(batches, batch)
+	}
+
+	return batches, rows.Err()
+}
+
+// ListFiles lists the files selected by the query, by batch then index.
+func (s *SQLiteStorage) ListFiles(ctx context.Context, query FileQuery) (files []FileInfo, err error) {
+	namePattern := query.NamePattern
+	if namePattern == "" {
+		namePattern = "%"
+	}
+
+	sqlQuery := "SELECT batch_id, file_index, name, size FROM files WHERE name LIKE ? AND size >= ?"
+	args := []any{namePattern, query.MinSize}
+	if query.MaxSize > 0 {
+		sqlQuery += " AND size <= ?"
+		args = append(args, query.MaxSize)
+	}
+	if query.Batch > 0 {
+		sqlQuery += " AND batch_id = ?"
+		args = append(args, query.Batch)
+	}
+
+	rows, err := s.q.QueryContext(ctx, sqlQuery+" ORDER BY batch_id, file_index", args...)
+	if err != nil {
+		return
+	}
+	defer func() { _ = rows.Close() }()
+
+	for rows.Next() {
+		var file FileInfo
+		if err = rows.Scan(&file.Batch, &file.Index, &file.Name, &file.Size); err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+
+	return files, rows.Err()
+}
@@ -0,0 +1,321 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"merkle-file-uploader/internal/merkle"
+)
+
+func newTestSQLiteStorage(t *testing.T) *SQLiteStorage {
+	sqliteStorage, err := NewSQLiteStorage(filepath.Join(t.TempDir(), "mfu.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = sqliteStorage.Close() })
+
+	return sqliteStorage
+}
+
+func newTestTree(t *testing.T, blocks ...string) *merkle.Tree {
+	var leaves [][]byte
+	for _, block := range blocks {
+		leaves = append(leaves, []byte(block))
+	}
+
+	tree, err := merkle.NewTree(leaves, merkle.HashFactory(sha256.New))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tree
+}
+
+func TestSQLiteTransactionRollback(t *testing.T) {
+	errFailed := errors.New("failed")
+
+	// each case fails an upload replacing the files a and b, and their tree, after some of its writes
+	cases := map[string]struct {
+		fn func(t *testing.T, tx Repository) error
+	}{
+		"after deleting the files": {
+			fn: func(t *testing.T, tx Repository) error {
+				assert.NoError(t, tx.DeleteAllFiles(context.Background()))
+
+				return errFailed
+			},
+		},
+		"after storing new files": {
+			fn: func(t *testing.T, tx Repository) error {
+				assert.NoError(t, tx.DeleteAllFiles(context.Background()))
+				storeTestFile(t, tx, "c")
+
+				return errFailed
+			},
+		},
+		"after storing the new tree": {
+			fn: func(t *testing.T, tx Repository) error {
+				assert.NoError(t, tx.DeleteAllFiles(context.Background()))
+				storeTestFile(t, tx, "c")
+				assert.NoError(t, tx.StoreTree(context.Background(), newTestTree(t, "c")))
+
+				return errFailed
+			},
+		},
+		"after changing files": {
+			fn: func(t *testing.T, tx Repository) error {
+				assert.NoError(t, tx.DeleteFile(context.Background(), 1))
+				assert.NoError(t, tx.ReplaceFile(context.Background(), StoredFile{
+					FileMetadata: FileMetadata{Index: 2, Name: "c.txt"},
+					Content:      bytes.NewReader([]byte("c")),
+				}))
+
+				return errFailed
+			},
+		},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			sqliteStorage := newTestSQLiteStorage(t)
+			storeTestFile(t, sqliteStorage, "a")
+			storeTestFile(t, sqliteStorage, "b")
+			tree := newTestTree(t, "a", "b")
+			assert.NoError(t, sqliteStorage.StoreTree(context.Background(), tree))
+
+			err := sqliteStorage.Transaction(context.Background(), func(tx Repository) error {
+				return tc.fn(t, tx)
+			})
+			assert.ErrorIs(t, err, errFailed)
+
+			// the files and tree are the ones before the transaction
+			for i, expected := range map[int]string{1: "a", 2: "b"} {
+				name, content, err := retrieveTestFile(sqliteStorage, i)
+				assert.NoError(t, err)
+				assert.Equal(t, expected, content)
+				assert.Equal(t, expected+".txt", name)
+			}
+
+			stored, err := sqliteStorage.RetrieveTree(context.Background())
+			assert.NoError(t, err)
+			assert.Equal(t, tree.RootHash(), stored.RootHash())
+
+			_, err = sqliteStorage.RetrieveTreeByRoot(context.Background(), newTestTree(t, "c").RootHash())
+			assert.ErrorIs(t, err, ErrTreeNotFound)
+
+			// the index of the files stored by the transaction is handed out again
+			assert.Equal(t, 3, storeTestFile(t, sqliteStorage, "d"))
+		})
+	}
+}
+
+func TestSQLiteDeleteAllFiles(t *testing.T) {
+	sqliteStorage := newTestSQLiteStorage(t)
+	storeTestFile(t, sqliteStorage, "a")
+	storeTestFile(t, sqliteStorage, "b")
+	tree := newTestTree(t, "a", "b")
+	assert.NoError(t, sqliteStorage.StoreTree(context.Background(), tree))
+
+	assert.NoError(t, sqliteStorage.DeleteAllFiles(context.Background()))
+
+	// the rows of the files, and of their chunks, are deleted
+	files, err := sqliteStorage.ListFiles(context.Background(), FileQuery{})
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+
+	var chunks int
+	assert.NoError(t, sqliteStorage.db.QueryRow("SELECT COUNT(*) FROM file_chunks").Scan(&chunks))
+	assert.Zero(t, chunks)
+
+	_, err = sqliteStorage.RetrieveTree(context.Background())
+	assert.ErrorIs(t, err, ErrTreeNotFound)
+
+	// trees by root hash are kept
+	_, err = sqliteStorage.RetrieveTreeByRoot(context.Background(), tree.RootHash())
+	assert.NoError(t, err)
+
+	assert.Equal(t, 1, storeTestFile(t, sqliteStorage, "c"))
+}
+
+func TestSQLiteReadsDuringTransaction(t *testing.T) {
+	sqliteStorage := newTestSQLiteStorage(t)
+	storeTestFile(t, sqliteStorage, "a")
+
+	// a transaction holds the database, as an upload does while its files are streamed in
+	started, done := make(chan struct{}), make(chan struct{})
+	txErr := make(chan error)
+	go func() {
+		txErr <- sqliteStorage.Transaction(context.Background(), func(tx Repository) error {
+			storeTestFile(t, tx, "b")
+			close(started)
+			<-done
+
+			return nil
+		})
+	}()
+	<-started
+
+	// the file stored before is read meanwhile, the one being stored is not seen yet
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	metadata, content, err := sqliteStorage.RetrieveFileByIndex(ctx, 1)
+	if assert.NoError(t, err) {
+		data, err := io.ReadAll(content)
+		assert.NoError(t, err)
+		assert.NoError(t, content.Close())
+		assert.Equal(t, "a", string(data))
+		assert.Equal(t, "a.txt", metadata.Name)
+	}
+
+	_, err = sqliteStorage.RetrieveFileMetadata(ctx, 2)
+	assert.ErrorIs(t, err, ErrStoredFileNotFound)
+
+	close(done)
+	assert.NoError(t, <-txErr)
+
+	_, content2, err := retrieveTestFile(sqliteStorage, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, "b", content2)
+}
+
+func TestSQLiteRetrieveFileRange(t *testing.T) {
+	sqliteStorage := newTestSQLiteStorage(t)
+
+	// the content spans 3 chunks, the last one being shorter
+	content := make([]byte, 2*sqliteChunkSize+10)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	i, err := sqliteStorage.StoreFile(context.Background(), StoredFile{Content: bytes.NewReader(content)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]struct {
+		offset, length int
+		err            error
+	}{
+		"whole content":        {0, len(content), nil},
+		"within a chunk":       {10, 20, nil},
+		"across chunks":        {sqliteChunkSize - 5, sqliteChunkSize + 10, nil},
+		"last chunk":           {2 * sqliteChunkSize, 10, nil},
+		"past the end":         {len(content) - 3, 100, nil},
+		"outside of the range": {len(content), 1, ErrRangeNotSatisfiable},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			metadata, stored, err := sqliteStorage.RetrieveFileRange(context.Background(), i, tc.offset, tc.length)
+			assert.ErrorIs(t, err, tc.err)
+			if err != nil {
+				return
+			}
+
+			data, err := io.ReadAll(stored)
+			assert.NoError(t, err)
+			assert.NoError(t, stored.Close())
+			assert.Equal(t, content[tc.offset:min(tc.offset+tc.length, len(content))], data)
+			assert.Equal(t, len(content), metadata.Size)
+		})
+	}
+}
+
+func TestSQLiteBatch(t *testing.T) {
+	sqliteStorage := newTestSQLiteStorage(t)
+	storeTestFile(t, sqliteStorage, "a")
+
+	id, err := sqliteStorage.CreateBatch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, validBatchID(id), "batch ID %q", id)
+
+	batch, err := sqliteStorage.Batch(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, storeTestFile(t, batch, "b"))
+
+	// the files of the batch are apart from the ones uploaded outside of batches
+	_, content, err := retrieveTestFile(sqliteStorage, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "a", content)
+
+	cases := map[string]struct {
+		id string
+	}{
+		"row ID of the uploads": {"1"},
+		"row ID of the batch":   {"2"},
+		"unknown ID":            {"0123456789abcdef"},
+		"upper case ID":         {strings.ToUpper(id)},
+		"empty ID":              {""},
+	}
+
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := sqliteStorage.Batch(context.Background(), tc.id)
+			assert.ErrorIs(t, err, ErrBatchNotFound)
+		})
+	}
+
+	batches, err := sqliteStorage.ListBatches(context.Background())
+	assert.NoError(t, err)
+	if assert.Len(t, batches, 2) {
+		assert.Empty(t, batches[0].PublicID)
+		assert.Equal(t, id, batches[1].PublicID)
+	}
+}
+
+func TestSQLiteMigrateBatchIDs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mfu.db")
+
+	// a database of the version before public IDs, with a standalone batch
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version := len(sqliteMigrations) - 1
+	for _, migration := range sqliteMigrations[:version] {
+		if _, err = db.Exec(migration); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, query := range []string{
+		fmt.Sprintf("PRAGMA user_version = %d", version),
+		"INSERT INTO batches (created_at) VALUES (CURRENT_TIMESTAMP)",
+		"INSERT INTO batches (created_at, standalone) VALUES (CURRENT_TIMESTAMP, 1)",
+	} {
+		if _, err = db.Exec(query); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assert.NoError(t, db.Close())
+
+	sqliteStorage, err := NewSQLiteStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = sqliteStorage.Close() })
+
+	// the standalone batch gets a public ID it's found by, the one of the uploads keeps none
+	batches, err := sqliteStorage.ListBatches(context.Background())
+	assert.NoError(t, err)
+	if assert.Len(t, batches, 2) {
+		assert.Empty(t, batches[0].PublicID)
+		assert.True(t, validBatchID(batches[1].PublicID), "batch ID %q", batches[1].PublicID)
+
+		_, err = sqliteStorage.Batch(context.Background(), batches[1].PublicID)
+		assert.NoError(t, err)
+	}
+}
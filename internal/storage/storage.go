@@ -2,25 +2,102 @@ package storage
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
+	"io"
+	"time"
 
 	"merkle-file-uploader/internal/merkle"
 )
 
 var (
-	ErrStoredFileNotFound = errors.New("the file is not found in the storage")
+	ErrStoredFileNotFound  = errors.New("the file is not found in the storage")
+	ErrTreeNotFound        = errors.New("the merkle tree is not found in the storage")
+	ErrBatchNotFound       = errors.New("the batch is not found in the storage")
+	ErrRangeNotSatisfiable = errors.New("the range is not within the content of the file")
 )
 
+// batchesPrefix prefixes the keys, or paths, the batches of a storage are kept under, see Repository.Batch.
+const batchesPrefix = "batches/"
+
+// FileMetadata describes a stored file: Size is the one of its content, set by the storage,
+// while UploadedAt and LeafHash are zero for the files stored before they were recorded.
+type FileMetadata struct {
+	Index       int
+	Name        string
+	Size        int
+	ContentType string
+	UploadedAt  time.Time
+	LeafHash    merkle.Digest
+}
+
+// StoredFile is a file to store, whose content is read as it's stored, so that it never has to fit in memory.
+// Its Size is counted by the storage. ChunkHashes are the hashes of the chunks of its content, when its tree splits
+// files into chunks, see merkle.ChunkHashes, so that its proofs are served without reading it again.
 type StoredFile struct {
-	Index   int
-	Name    string
-	Content []byte
+	FileMetadata
+	Content     io.Reader
+	ChunkHashes []merkle.Digest
 }
 
 type Repository interface {
 	StoreFile(context.Context, StoredFile) (int, error)
-	RetrieveFileByIndex(context.Context, int) (StoredFile, error)
+	// RetrieveFileByIndex returns the metadata of a stored file, along with its content, Size bytes long,
+	// which is read as it's streamed, and must be closed.
+	RetrieveFileByIndex(context.Context, int) (FileMetadata, io.ReadCloser, error)
+	// RetrieveFileRange is RetrieveFileByIndex, but for length bytes of the content from offset on at most,
+	// or ErrRangeNotSatisfiable if offset isn't within it. The metadata are still the ones of the whole file.
+	RetrieveFileRange(ctx context.Context, i, offset, length int) (FileMetadata, io.ReadCloser, error)
+	// RetrieveFileMetadata returns the metadata of a stored file, without reading its content.
+	RetrieveFileMetadata(context.Context, int) (FileMetadata, error)
+	// RetrieveChunkHashes returns the chunk hashes a file has been stored with, which are nil for the files
+	// stored without, or before they were recorded.
+	RetrieveChunkHashes(context.Context, int) ([]merkle.Digest, error)
+	ReplaceFile(context.Context, StoredFile) error
+	DeleteFile(context.Context, int) error
 	DeleteAllFiles(context.Context) error
 	StoreTree(context.Context, *merkle.Tree) error
 	RetrieveTree(context.Context) (*merkle.Tree, error)
+	RetrieveTreeByRoot(context.Context, merkle.Digest) (*merkle.Tree, error)
+	StoreSparseTree(context.Context, *merkle.SparseTree) error
+	RetrieveSparseTree(context.Context) (*merkle.SparseTree, error)
+	StoreMountainRange(context.Context, *merkle.MountainRange) error
+	RetrieveMountainRange(context.Context) (*merkle.MountainRange, error)
+	// Transaction runs fn against a repository whose writes land all at once if fn succeeds, or not at all.
+	// Storages without transactions run fn against themselves: the writes land as they go, see S3Storage.
+	Transaction(context.Context, func(Repository) error) error
+	// Atomic tells whether Transaction discards the writes of fn when it fails, rather than letting them land as they go.
+	Atomic() bool
+	// CreateBatch creates an empty batch of files, and returns its ID.
+	CreateBatch(context.Context) (string, error)
+	// Batch returns the repository of the files and trees of a batch, or ErrBatchNotFound.
+	// The repository itself holds the files uploaded outside of batches, while trees by root hash,
+	// see RetrieveTreeByRoot, and batches are shared by all of them.
+	Batch(context.Context, string) (Repository, error)
+}
+
+// limitReadCloser reads length bytes of content at most, and closes it.
+func limitReadCloser(content io.ReadCloser, length int) io.ReadCloser {
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(content, int64(length)), content}
+}
+
+// newBatchID generates the random ID of a new batch, 16 hex digits.
+func newBatchID() (id string, err error) {
+	b := make([]byte, 8)
+	if _, err = rand.Read(b); err != nil {
+		return
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// validBatchID tells whether id is one newBatchID may have generated, and can safely be part of a key or path.
+func validBatchID(id string) bool {
+	b, err := hex.DecodeString(id)
+
+	return err == nil && len(b) == 8 && hex.EncodeToString(b) == id
 }
@@ -1,18 +1,6 @@
 package utils
 
-import (
-	"os"
-	"strconv"
-)
-
-func EnvInt(name string, defaultValue int) (value int) {
-	value, _ = strconv.Atoi(os.Getenv(name))
-	if value == 0 {
-		value = defaultValue
-	}
-
-	return
-}
+import "os"
 
 func EnvStr(name, defaultValue string) (value string) {
 	value = os.Getenv(name)
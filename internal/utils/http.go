@@ -1,14 +1,18 @@
 package utils
 
 import (
-	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+
+	"github.com/gorilla/mux"
 )
 
 func HttpOkJson(w http.ResponseWriter, payload any) (err error) {
@@ -22,38 +26,68 @@ func HttpError(w http.ResponseWriter, statusCode int, err error) {
 	http.Error(w, http.StatusText(statusCode), statusCode)
 }
 
-func MultipartFormFromFiles(filePaths []string) (multipartForm bytes.Buffer, formDataContentType string, err error) {
-	multipartWriter := multipart.NewWriter(&multipartForm)
+// MultipartFormFromFiles streams a multipart form, with one filesField part per file, plus the given plain fields.
+// The files are read as the form is, failing to read them fails reading it, which also stops once the form is closed.
+func MultipartFormFromFiles(filesField string, filePaths []string, fields map[string]string) (multipartForm io.ReadCloser, formDataContentType string) {
+	pipeReader, pipeWriter := io.Pipe()
+	multipartWriter := multipart.NewWriter(pipeWriter)
 
-	for _, fp := range filePaths {
-		var file *os.File
-		file, err = os.Open(fp)
-		if err != nil {
-			return
-		}
+	go func() {
+		_ = pipeWriter.CloseWithError(writeMultipartForm(multipartWriter, filesField, filePaths, fields))
+	}()
 
-		var filePart io.Writer
-		filePart, err = multipartWriter.CreateFormFile("files", filepath.Base(fp))
-		if err != nil {
-			return
-		}
+	return pipeReader, multipartWriter.FormDataContentType()
+}
 
-		// copy the file content to the form file part
-		if _, err = io.Copy(filePart, file); err != nil {
+func writeMultipartForm(multipartWriter *multipart.Writer, filesField string, filePaths []string, fields map[string]string) (err error) {
+	for name, value := range fields {
+		if err = multipartWriter.WriteField(name, value); err != nil {
 			return
 		}
+	}
 
-		if err = file.Close(); err != nil {
+	for _, fp := range filePaths {
+		if err = writeFormFile(multipartWriter, filesField, fp); err != nil {
 			return
 		}
 	}
 
 	// Close the multipart writer to finish building the request body
-	if err = multipartWriter.Close(); err != nil {
+	return multipartWriter.Close()
+}
+
+func writeFormFile(multipartWriter *multipart.Writer, filesField string, filePath string) (err error) {
+	file, err := os.Open(filePath)
+	if err != nil {
 		return
 	}
+	defer func() { _ = file.Close() }()
 
-	formDataContentType = multipartWriter.FormDataContentType()
+	filePart, err := multipartWriter.CreateFormFile(filesField, filepath.Base(filePath))
+	if err != nil {
+		return
+	}
+
+	// copy the file content to the form file part
+	_, err = io.Copy(filePart, file)
+
+	return
+}
+
+// IndexFromRequest parses the numeric {index} path param.
+func IndexFromRequest(r *http.Request) (index int, err error) {
+	vars := mux.Vars(r)
+	indexParam, isIndexSet := vars["index"]
+	if !isIndexSet {
+		err = errors.New("{index} path param is not passed in")
+
+		return
+	}
+
+	index, err = strconv.Atoi(indexParam)
+	if err != nil {
+		err = fmt.Errorf("{index} path param must be numeric: %s", err)
+	}
 
 	return
 }